@@ -0,0 +1,375 @@
+// Package bindgen generates Go bindings of Lua APIs: packages declaring
+// the functions, values and types of an API for Go code compiled with
+// lunar. The packages are meant to be marked transient, so that only
+// their declarations are used, but they also work as regular packages
+// since all of their functions and values are declared with the
+// //lunar:extern directive.
+//
+// APIs are described in JSON:
+//
+//	{
+//		"package": "ui",
+//		"types": [
+//			{"name": "Frame", "inherits": ["Region"], "methods": [
+//				{"name": "SetScript", "params": [
+//					{"name": "event", "type": "string"},
+//					{"name": "handler", "type": "ScriptHandler"}
+//				]}
+//			]},
+//			{"name": "ScriptHandler", "callback": {
+//				"params": [{"name": "frame", "type": "Frame"}, {"name": "args", "type": "any"}],
+//				"variadic": true
+//			}}
+//		],
+//		"functions": [
+//			{"name": "C_Timer.After", "params": [...]},
+//			{"name": "GetCursorPosition", "results": [
+//				{"name": "x", "type": "number"},
+//				{"name": "y", "type": "number"}
+//			]}
+//		],
+//		"values": [{"name": "UIParent", "type": "Frame"}]
+//	}
+//
+// Types of objects with methods become interfaces embedding the types
+// they inherit from, and callback types become function types. The types
+// of parameters, results and values are the types of the API or:
+//
+//	number    float64
+//	integer   int
+//	string    string
+//	boolean   bool
+//	any       interface{}
+//	table     lua.Table
+//	function  func(...interface{}) lua.Multi
+//	T[]       []T, a sequence
+//
+// The Go names of functions and values default to their Lua names with
+// dots replaced by underscores and the first letter in upper case; the
+// Lua names are kept with the //lunar:name directive.
+package bindgen
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/format"
+	"go/token"
+	"strings"
+)
+
+// API describes a Lua API.
+type API struct {
+	Package   string     `json:"package"` // name of the Go package
+	Doc       string     `json:"doc,omitempty"`
+	Types     []Type     `json:"types,omitempty"`
+	Functions []Function `json:"functions,omitempty"`
+	Values    []Value    `json:"values,omitempty"`
+}
+
+// Type is a type of the API: the type of objects with methods, or the type
+// of callbacks if Callback is set.
+type Type struct {
+	Name     string     `json:"name"`
+	Doc      string     `json:"doc,omitempty"`
+	Inherits []string   `json:"inherits,omitempty"` // types whose methods objects have too
+	Methods  []Function `json:"methods,omitempty"`
+	Callback *Function  `json:"callback,omitempty"` // signature of callbacks, without a name
+}
+
+// Function is a function or method of the API.
+type Function struct {
+	Name     string  `json:"name"`             // Lua name, which can be a dotted path
+	GoName   string  `json:"goName,omitempty"` // Go name, if not derived from Name
+	Doc      string  `json:"doc,omitempty"`
+	Params   []Param `json:"params,omitempty"`
+	Results  []Param `json:"results,omitempty"`
+	Variadic bool    `json:"variadic,omitempty"` // whether the last parameter is variadic
+}
+
+// Param is a parameter or result of a function.
+type Param struct {
+	Name string `json:"name,omitempty"`
+	Type string `json:"type"`
+}
+
+// Value is a global variable of the API.
+type Value struct {
+	Name   string `json:"name"`
+	GoName string `json:"goName,omitempty"`
+	Doc    string `json:"doc,omitempty"`
+	Type   string `json:"type"`
+}
+
+// ParseAPI parses the JSON description of an API.
+func ParseAPI(data []byte) (*API, error) {
+	api := &API{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(api); err != nil {
+		return nil, fmt.Errorf("bindgen: parsing API: %v", err)
+	}
+	return api, nil
+}
+
+// luaPkgPath is the import path of the lua package.
+const luaPkgPath = "github.com/eandre/lunar/lua"
+
+// builtinTypes are the Go types of the basic Lua types.
+var builtinTypes = map[string]string{
+	"number":   "float64",
+	"integer":  "int",
+	"string":   "string",
+	"boolean":  "bool",
+	"any":      "interface{}",
+	"table":    "lua.Table",
+	"function": "func(...interface{}) lua.Multi",
+}
+
+// generator writes the Go code of an API.
+type generator struct {
+	api     *API
+	buf     bytes.Buffer
+	types   map[string]*Type
+	names   map[string]string // Lua names of the declared Go names
+	usesLua bool              // whether the lua package is imported
+}
+
+// Generate returns the formatted Go source of the package binding api.
+// The source is named source in the comment marking it as generated.
+func Generate(api *API, source string) ([]byte, error) {
+	g := &generator{api: api, types: make(map[string]*Type), names: make(map[string]string)}
+	if !token.IsIdentifier(api.Package) {
+		return nil, fmt.Errorf("bindgen: invalid package name %q", api.Package)
+	}
+	for i := range api.Types {
+		t := &api.Types[i]
+		if err := g.declare(t.Name, t.Name); err != nil {
+			return nil, err
+		}
+		g.types[t.Name] = t
+	}
+
+	var body bytes.Buffer
+	for _, t := range api.Types {
+		if err := g.writeType(&body, &t); err != nil {
+			return nil, err
+		}
+	}
+	for _, fn := range api.Functions {
+		if err := g.writeFunc(&body, &fn); err != nil {
+			return nil, err
+		}
+	}
+	for _, v := range api.Values {
+		if err := g.writeValue(&body, &v); err != nil {
+			return nil, err
+		}
+	}
+
+	fmt.Fprintf(&g.buf, "// Code generated by lunar bind from %s; DO NOT EDIT.\n\n", source)
+	writeDoc(&g.buf, api.Doc)
+	fmt.Fprintf(&g.buf, "package %s\n\n", api.Package)
+	if g.usesLua {
+		fmt.Fprintf(&g.buf, "import %q\n\n", luaPkgPath)
+	}
+	g.buf.Write(body.Bytes())
+
+	out, err := format.Source(g.buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("bindgen: formatting bindings: %v", err)
+	}
+	return out, nil
+}
+
+// declare declares the Go name of the Lua name.
+func (g *generator) declare(goName, luaName string) error {
+	if !token.IsIdentifier(goName) || !token.IsExported(goName) {
+		return fmt.Errorf("bindgen: %s: %q is not an exported Go name", luaName, goName)
+	}
+	if prev, ok := g.names[goName]; ok {
+		return fmt.Errorf("bindgen: %s and %s are both declared as %s", prev, luaName, goName)
+	}
+	g.names[goName] = luaName
+	return nil
+}
+
+// goName returns the Go name of a function or value with the given Lua
+// name, unless name is set.
+func goName(luaName, name string) string {
+	if name != "" {
+		return name
+	}
+	name = strings.ReplaceAll(luaName, ".", "_")
+	if name == "" {
+		return ""
+	}
+	return strings.ToUpper(name[:1]) + name[1:]
+}
+
+// writeDoc writes the doc comment doc.
+func writeDoc(buf *bytes.Buffer, doc string) {
+	if doc == "" {
+		return
+	}
+	for _, line := range strings.Split(strings.TrimSpace(doc), "\n") {
+		buf.WriteString(strings.TrimRight("// "+line, " ") + "\n")
+	}
+}
+
+func (g *generator) writeType(buf *bytes.Buffer, t *Type) error {
+	writeDoc(buf, t.Doc)
+	if t.Callback != nil {
+		if len(t.Inherits) > 0 || len(t.Methods) > 0 {
+			return fmt.Errorf("bindgen: callback type %s cannot have methods", t.Name)
+		}
+		sig, err := g.signature(t.Callback)
+		if err != nil {
+			return fmt.Errorf("bindgen: %s: %v", t.Name, err)
+		}
+		fmt.Fprintf(buf, "type %s func%s\n\n", t.Name, sig)
+		return nil
+	}
+
+	fmt.Fprintf(buf, "type %s interface {\n", t.Name)
+	for _, base := range t.Inherits {
+		if b, ok := g.types[base]; !ok || b.Callback != nil {
+			return fmt.Errorf("bindgen: %s inherits from %s, which is not an object type", t.Name, base)
+		}
+		fmt.Fprintf(buf, "%s\n", base)
+	}
+	for _, m := range t.Methods {
+		// Methods are called by their Go names
+		name := goName(m.Name, m.GoName)
+		if name != m.Name || !token.IsIdentifier(name) || !token.IsExported(name) {
+			return fmt.Errorf("bindgen: method %s of %s must have an exported Go name", m.Name, t.Name)
+		}
+		sig, err := g.signature(&m)
+		if err != nil {
+			return fmt.Errorf("bindgen: %s.%s: %v", t.Name, m.Name, err)
+		}
+		writeDoc(buf, m.Doc)
+		fmt.Fprintf(buf, "%s%s\n", name, sig)
+	}
+	buf.WriteString("}\n\n")
+	return nil
+}
+
+func (g *generator) writeFunc(buf *bytes.Buffer, fn *Function) error {
+	name := goName(fn.Name, fn.GoName)
+	if err := g.declare(name, fn.Name); err != nil {
+		return err
+	}
+	sig, err := g.signature(fn)
+	if err != nil {
+		return fmt.Errorf("bindgen: %s: %v", fn.Name, err)
+	}
+	writeDoc(buf, fn.Doc)
+	g.writeDirectives(buf, name, fn.Name, fn.Doc != "")
+	fmt.Fprintf(buf, "func %s%s {\n\tpanic(%q)\n}\n\n", name, sig, fn.Name+" is implemented in Lua")
+	return nil
+}
+
+func (g *generator) writeValue(buf *bytes.Buffer, v *Value) error {
+	name := goName(v.Name, v.GoName)
+	if err := g.declare(name, v.Name); err != nil {
+		return err
+	}
+	typ, err := g.goType(v.Type)
+	if err != nil {
+		return fmt.Errorf("bindgen: %s: %v", v.Name, err)
+	}
+	writeDoc(buf, v.Doc)
+	g.writeDirectives(buf, name, v.Name, v.Doc != "")
+	fmt.Fprintf(buf, "var %s %s\n\n", name, typ)
+	return nil
+}
+
+// writeDirectives writes the directives declaring the Lua function or value
+// luaName as name, separated from the doc comment if there is one.
+func (g *generator) writeDirectives(buf *bytes.Buffer, name, luaName string, doc bool) {
+	if doc {
+		buf.WriteString("//\n")
+	}
+	buf.WriteString("//lunar:extern\n")
+	if name != luaName {
+		fmt.Fprintf(buf, "//lunar:name %s\n", luaName)
+	}
+}
+
+// signature returns the Go parameters and results of fn.
+func (g *generator) signature(fn *Function) (string, error) {
+	if fn.Variadic && len(fn.Params) == 0 {
+		return "", fmt.Errorf("variadic function without parameters")
+	}
+	for _, p := range append(fn.Params[:len(fn.Params):len(fn.Params)], fn.Results...) {
+		if p.Name != "" && !token.IsIdentifier(p.Name) && !token.IsKeyword(p.Name) {
+			return "", fmt.Errorf("invalid parameter name %q", p.Name)
+		}
+	}
+	var params []string
+	for i, p := range fn.Params {
+		typ, err := g.goType(p.Type)
+		if err != nil {
+			return "", err
+		}
+		if fn.Variadic && i == len(fn.Params)-1 {
+			typ = "..." + typ
+		}
+		params = append(params, paramName(p.Name, i)+" "+typ)
+	}
+
+	named := len(fn.Results) > 0
+	for _, r := range fn.Results {
+		named = named && r.Name != ""
+	}
+	var results []string
+	for _, r := range fn.Results {
+		typ, err := g.goType(r.Type)
+		if err != nil {
+			return "", err
+		}
+		if named {
+			typ = paramName(r.Name, 0) + " " + typ
+		}
+		results = append(results, typ)
+	}
+
+	sig := "(" + strings.Join(params, ", ") + ")"
+	switch {
+	case len(results) == 1 && !named:
+		sig += " " + results[0]
+	case len(results) > 0:
+		sig += " (" + strings.Join(results, ", ") + ")"
+	}
+	return sig, nil
+}
+
+// paramName returns the Go name of the i'th parameter named name.
+func paramName(name string, i int) string {
+	switch {
+	case name == "":
+		return fmt.Sprintf("arg%d", i+1)
+	case token.IsKeyword(name):
+		return name + "_"
+	}
+	return name
+}
+
+// goType returns the Go type of the API type typ.
+func (g *generator) goType(typ string) (string, error) {
+	if elem := strings.TrimSuffix(typ, "[]"); elem != typ {
+		t, err := g.goType(elem)
+		return "[]" + t, err
+	}
+	if t, ok := builtinTypes[typ]; ok {
+		if strings.Contains(t, "lua.") {
+			g.usesLua = true
+		}
+		return t, nil
+	}
+	if _, ok := g.types[typ]; ok {
+		return typ, nil
+	}
+	return "", fmt.Errorf("unknown type %q", typ)
+}
@@ -0,0 +1,120 @@
+package bindgen
+
+import (
+	"strings"
+	"testing"
+)
+
+const testAPI = `{
+	"package": "ui",
+	"doc": "Package ui binds the UI API.",
+	"types": [
+		{"name": "Region", "methods": [
+			{"name": "GetWidth", "results": [{"type": "number"}]}
+		]},
+		{"name": "Frame", "doc": "Frame is a frame.", "inherits": ["Region"], "methods": [
+			{"name": "SetScript", "params": [
+				{"name": "event", "type": "string"},
+				{"name": "handler", "type": "ScriptHandler"}
+			]}
+		]},
+		{"name": "ScriptHandler", "callback": {
+			"params": [{"name": "frame", "type": "Frame"}, {"name": "args", "type": "any"}],
+			"variadic": true
+		}}
+	],
+	"functions": [
+		{"name": "C_Timer.After", "params": [
+			{"name": "seconds", "type": "number"},
+			{"name": "func", "type": "function"}
+		]},
+		{"name": "GetCursorPosition", "doc": "GetCursorPosition returns the position of the cursor.", "results": [
+			{"name": "x", "type": "number"},
+			{"name": "y", "type": "number"}
+		]},
+		{"name": "strsplit", "params": [{"type": "string"}, {"type": "string"}], "results": [{"type": "string[]"}]}
+	],
+	"values": [{"name": "UIParent", "type": "Frame"}]
+}`
+
+const testBindings = `// Code generated by lunar bind from ui.json; DO NOT EDIT.
+
+// Package ui binds the UI API.
+package ui
+
+import "github.com/eandre/lunar/lua"
+
+type Region interface {
+	GetWidth() float64
+}
+
+// Frame is a frame.
+type Frame interface {
+	Region
+	SetScript(event string, handler ScriptHandler)
+}
+
+type ScriptHandler func(frame Frame, args ...interface{})
+
+//lunar:extern
+//lunar:name C_Timer.After
+func C_Timer_After(seconds float64, func_ func(...interface{}) lua.Multi) {
+	panic("C_Timer.After is implemented in Lua")
+}
+
+// GetCursorPosition returns the position of the cursor.
+//
+//lunar:extern
+func GetCursorPosition() (x float64, y float64) {
+	panic("GetCursorPosition is implemented in Lua")
+}
+
+//lunar:extern
+//lunar:name strsplit
+func Strsplit(arg1 string, arg2 string) []string {
+	panic("strsplit is implemented in Lua")
+}
+
+//lunar:extern
+var UIParent Frame
+`
+
+func TestGenerate(t *testing.T) {
+	api, err := ParseAPI([]byte(testAPI))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := Generate(api, "ui.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(src) != testBindings {
+		t.Errorf("Got bindings:\n%s\nwant:\n%s", src, testBindings)
+	}
+}
+
+func TestGenerateErrors(t *testing.T) {
+	tests := []struct {
+		api, err string
+	}{
+		{`{"package": "ui", "functions": [{"name": "f", "params": [{"type": "float"}]}]}`, `f: unknown type "float"`},
+		{`{"package": "ui", "functions": [{"name": "f"}, {"name": "F"}]}`, "f and F are both declared as F"},
+		{`{"package": "ui", "types": [{"name": "T", "methods": [{"name": "m"}]}]}`, "method m of T must have an exported Go name"},
+		{`{"package": "ui", "types": [{"name": "T", "inherits": ["U"]}]}`, "T inherits from U, which is not an object type"},
+		{`{"package": "ui", "functions": [{"name": "f", "variadic": true}]}`, "variadic function without parameters"},
+		{`{"package": "ui", "functions": [{"name": "f", "params": [{"name": "a-b", "type": "any"}]}]}`, `invalid parameter name "a-b"`},
+		{`{"package": "ui-x"}`, `invalid package name "ui-x"`},
+	}
+	for _, test := range tests {
+		api, err := ParseAPI([]byte(test.api))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Generate(api, "api.json"); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("Generate(%s): Got error %v, want %q", test.api, err, test.err)
+		}
+	}
+	if _, err := ParseAPI([]byte(`{"package": "ui", "func": []}`)); err == nil {
+		t.Errorf("ParseAPI accepted an unknown field")
+	}
+}
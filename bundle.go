@@ -0,0 +1,135 @@
+package lunar
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/types"
+	"io"
+	"sort"
+)
+
+// InitOrder returns pkgs in Go's package initialization order: a package
+// is initialized after the packages it imports, and otherwise packages
+// are initialized in order of their import paths. Imports of packages
+// that are not in pkgs are ignored.
+func InitOrder(pkgs []*Package) []*Package {
+	pending := append([]*Package(nil), pkgs...)
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].Pkg.Path() < pending[j].Pkg.Path()
+	})
+	waiting := make(map[string]bool)
+	for _, pkg := range pending {
+		waiting[pkg.Pkg.Path()] = true
+	}
+
+	// Repeatedly initialize the first package whose imports are done
+	order := make([]*Package, 0, len(pending))
+	for len(pending) > 0 {
+		next := 0
+		for i, pkg := range pending {
+			ready := true
+			for _, imp := range pkg.Pkg.Imports() {
+				if waiting[imp.Path()] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				next = i
+				break
+			}
+		}
+		pkg := pending[next]
+		order = append(order, pkg)
+		delete(waiting, pkg.Pkg.Path())
+		pending = append(pending[:next], pending[next+1:]...)
+	}
+	return order
+}
+
+// WriteBundle writes a self-contained Lua program consisting of the
+// builtins for the target and the given packages, which must be part of
+// the parser's program.
+//
+// Each package is wrapped in a function, so that its locals are scoped to
+// it and the order the packages are written in does not matter. The
+// packages are initialized by the builtins.run_inits call at the end of
+// the bundle, in Go's package initialization order, followed by the main
+// function of the main package, if any. Like ParseNode, WriteBundle
+// records diagnostics and a source map for the whole bundle. If the parser
+// eliminates dead code, the bundle only contains the builtins it uses.
+//
+// If chunk is not empty, the bundle registers its line table under that
+// chunk name before initializing the packages, so that errors refer to Go
+// positions; see SourceMap.WriteLineTable.
+func (p *Parser) WriteBundle(w io.Writer, pkgs []*Package, chunk string) error {
+	if p.modules != nil {
+		return fmt.Errorf("lunar: bundles cannot be written in module mode")
+	}
+	var main *Package
+	for _, pkg := range pkgs {
+		if pkg.Pkg.Name() != "main" {
+			continue
+		}
+		if main != nil {
+			return fmt.Errorf("lunar: bundle contains multiple main packages: %s and %s", main.Pkg.Path(), pkg.Pkg.Path())
+		}
+		main = pkg
+	}
+
+	return p.parse(w, func(w *Writer) {
+		// The packages are written before the builtins they use
+		var stmts []luaStmt
+		for _, pkg := range InitOrder(pkgs) {
+			stmts = append(stmts, p.parseBundledPackage(pkg)...)
+		}
+		var buf bytes.Buffer
+		pw := w.sub(&buf)
+		p.printChunk(pw, stmts)
+		if p.live != nil {
+			WriteUsedBuiltins(w, p.target, buf.String())
+		} else {
+			WriteBuiltinsFor(w, p.target)
+		}
+		printLua(w, []luaStmt{
+			&luaBlankStmt{lines: 1},
+			&luaLocalStmt{names: []string{"builtins"}, values: []luaExpr{luaPath("_G", "lunar_go_builtins")}},
+			&luaBlankStmt{lines: 1},
+		})
+		w.writeFrom(pw, buf.Bytes())
+		if chunk != "" {
+			sm := &SourceMap{Fset: p.prog.Fset, Mappings: w.Mappings()}
+			sm.WriteLineTable(w, chunk)
+			w.WriteNewline()
+		}
+		run := []luaStmt{&luaExprStmt{x: luaBuiltin("run_inits")}}
+		if main != nil {
+			if _, ok := main.Pkg.Scope().Lookup("main").(*types.Func); ok {
+				pkg := &luaIndexExpr{x: luaIdentOf("_G"), key: luaStringOf(main.Pkg.Path())}
+				run = append(run, &luaExprStmt{x: luaCallOf(&luaSelectorExpr{x: pkg, name: "main"})})
+			}
+		}
+		printLua(w, run)
+	})
+}
+
+// parseBundledPackage returns the files of pkg, in file name order, as a
+// package of a bundle. Each file is written in its own block to keep its
+// locals private, as they would be in a file of their own.
+func (p *Parser) parseBundledPackage(pkg *Package) []luaStmt {
+	files := append([]*ast.File(nil), pkg.Files...)
+	sort.Slice(files, func(i, j int) bool {
+		return p.prog.Fset.File(files[i].Pos()).Name() < p.prog.Fset.File(files[j].Pos()).Name()
+	})
+
+	init := &luaFuncLit{}
+	for _, f := range files {
+		init.body = append(init.body, &luaDoStmt{body: p.parseNode(f, true)})
+	}
+	return []luaStmt{
+		&luaCommentStmt{text: " Package " + pkg.Pkg.Path()},
+		&luaExprStmt{x: luaBuiltin("add_package", init)},
+		&luaBlankStmt{lines: 1},
+	}
+}
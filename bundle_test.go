@@ -0,0 +1,101 @@
+package lunar
+
+import (
+	"bytes"
+	"fmt"
+	"go/types"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/tools/go/packages"
+)
+
+func TestInitOrder(t *testing.T) {
+	c := types.NewPackage("c", "c")
+	a := types.NewPackage("a", "a")
+	a.SetImports([]*types.Package{c, types.NewPackage("fmt", "fmt")})
+	b := types.NewPackage("b", "b")
+	pkgs := []*Package{{Pkg: c}, {Pkg: b}, {Pkg: a}}
+
+	var got []string
+	for _, pkg := range InitOrder(pkgs) {
+		got = append(got, pkg.Pkg.Path())
+	}
+	if want := "b c a"; strings.Join(got, " ") != want {
+		t.Errorf("Got init order %v; want %s", got, want)
+	}
+}
+
+func TestWriteBundle(t *testing.T) {
+	dir := t.TempDir()
+	for name, src := range map[string]string{
+		"go.mod":  "module example.com/m\n\ngo 1.18\n",
+		"main.go": "package main\n\nimport \"example.com/m/b\"\n\nfunc main() {\n\tprintln(b.B)\n}\n",
+		"b/b.go":  "package b\n\nvar B = 1\n",
+		"b/c.go":  "package b\n\nfunc init() {\n\tB = 2\n}\n",
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	prog, err := Load(&packages.Config{Dir: dir}, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkgs := []*Package{prog.Package("example.com/m"), prog.Package("example.com/m/b")}
+
+	p := NewProgramParser(prog)
+	buf := &bytes.Buffer{}
+	if err := p.WriteBundle(buf, pkgs, ""); err != nil {
+		t.Fatalf("Got error: %v", err)
+	}
+	lua := buf.String()
+
+	// The builtins come first, then the packages in initialization order
+	want := []string{
+		"_G.lunar_go_builtins = builtins",
+		"-- Package example.com/m/b\nbuiltins.add_package(function()\n\tdo\n",
+		"\t\t_b.B = 1\n",
+		"\tend\n\tdo\n",
+		"\t\tbuiltins.add_init(function()\n",
+		"-- Package example.com/m\n",
+		"builtins.run_inits()\n_G[\"example.com/m\"].main()\n",
+	}
+	prev := 0
+	for _, s := range want {
+		i := strings.Index(lua[prev:], s)
+		if i < 0 {
+			t.Fatalf("Could not find %q after offset %d in bundle:\n%s", s, prev, lua[strings.Index(lua, "-- Package"):])
+		}
+		prev += i + len(s)
+	}
+
+	// The source map covers the whole bundle
+	line := strings.Count(lua[:strings.Index(lua, "_b.B = 1")], "\n") + 1
+	if pos := p.SourceMap().Position(line); filepath.Base(pos.Filename) != "b.go" || pos.Line != 3 {
+		t.Errorf("Line %d maps to %s; want b.go:3", line, pos)
+	}
+
+	// Line tables are registered before initialization
+	buf.Reset()
+	if err := p.WriteBundle(buf, pkgs, "bundle.lua"); err != nil {
+		t.Fatalf("Got error: %v", err)
+	}
+	lua = buf.String()
+	entry := fmt.Sprintf(`	[%d] = "%s:3",`, line, filepath.Join(dir, "b", "b.go"))
+	table := strings.Index(lua, `builtins.source_maps["bundle.lua"] = {`)
+	if i := strings.Index(lua, entry); table < 0 || i < table || i > strings.LastIndex(lua, "builtins.run_inits()") {
+		t.Errorf("Could not find line table entry %q before builtins.run_inits", entry)
+	}
+
+	main := prog.Package("example.com/m")
+	if err := p.WriteBundle(buf, []*Package{main, main}, ""); err == nil {
+		t.Errorf("Bundle with multiple main packages succeeded")
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/eandre/lunar/bindgen"
+)
+
+func runBind(args []string, stdout, stderr io.Writer) int {
+	fs := newFlagSet("bind", "api.json", stderr)
+	out := fs.String("o", "", "write the bindings to `file` instead of standard output")
+	pkg := fs.String("pkg", "", "name of the generated package, instead of the one of the API")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	path := fs.Arg(0)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(stderr, "lunar: %v\n", err)
+		return 1
+	}
+	api, err := bindgen.ParseAPI(data)
+	if err != nil {
+		fmt.Fprintf(stderr, "lunar: %s: %v\n", path, err)
+		return 1
+	}
+	if *pkg != "" {
+		api.Package = *pkg
+	}
+	src, err := bindgen.Generate(api, filepath.Base(path))
+	if err != nil {
+		fmt.Fprintf(stderr, "lunar: %s: %v\n", path, err)
+		return 1
+	}
+
+	if *out == "" {
+		_, err = stdout.Write(src)
+	} else if err = os.MkdirAll(filepath.Dir(*out), 0755); err == nil {
+		err = os.WriteFile(*out, src, 0644)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "lunar: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eandre/lunar"
+)
+
+// Output layouts
+const (
+	layoutPackage = "package" // a Lua file per package
+	layoutFile    = "file"    // a Lua file per Go file
+	layoutSingle  = "single"  // a self-contained bundle; see lunar.WriteBundle
+)
+
+// Source map formats
+const (
+	sourceMapNone  = "none"
+	sourceMapJSON  = "json"  // source map v3 files next to the Lua files
+	sourceMapTable = "table" // line tables used by the builtins
+)
+
+// runtimeFile is the name of the file the builtins are written to.
+const runtimeFile = "lunar_builtins.lua"
+
+type buildOptions struct {
+	options
+	out         string
+	layout      string
+	sourceMap   string
+	chunkPrefix string
+	runtime     bool
+	verbose     bool
+	watch       bool
+	interval    time.Duration
+	modules     bool
+	moduleMap   stringList
+	dce         bool
+	minify      bool
+	optimize    bool
+	indent      string
+	style       lunar.Style
+}
+
+func runBuild(args []string, stdout, stderr io.Writer) int {
+	var o buildOptions
+	fs := newFlagSet("build", "[packages]", stderr)
+	o.register(fs)
+	fs.StringVar(&o.out, "o", "", "output `path`: a directory, or a file for the single layout (default \"out\" or \"out.lua\")")
+	fs.StringVar(&o.layout, "layout", layoutPackage, "output layout: package (a file per package), file (a file per Go file) or single (a self-contained bundle)")
+	fs.StringVar(&o.sourceMap, "sourcemap", sourceMapNone, "source maps to write: none, json (.map files) or table (line tables for runtime errors)")
+	fs.StringVar(&o.chunkPrefix, "chunkprefix", "", "`prefix` of the output paths in Lua error messages, for line table source maps")
+	fs.BoolVar(&o.runtime, "runtime", true, "write the builtins to "+runtimeFile+"; the single layout always includes them")
+	fs.BoolVar(&o.verbose, "v", false, "print the written files in load order")
+	fs.BoolVar(&o.modules, "modules", false, "write packages as Lua modules loaded with require instead of global tables; requires the package layout")
+	fs.Var(&o.moduleMap, "modmap", "comma-separated `path=name` pairs mapping import path prefixes to module name prefixes, for -modules; the builtins are "+lunar.BuiltinsPath)
+	fs.BoolVar(&o.dce, "dce", false, "leave out the code unreachable from main, init functions and //lunar:export declarations, and the unused builtins")
+	fs.BoolVar(&o.minify, "minify", false, "write minified Lua, keeping line numbers: no comments or indentation, short local names")
+	fs.BoolVar(&o.optimize, "O", false, "optimize the Lua code: drop nil fallbacks of index expressions, fold constants, inline small single-expression functions and builtins, cache hot standard globals in locals and drop redundant blocks")
+	o.style = lunar.DefaultStyle
+	fs.StringVar(&o.indent, "indent", "tab", "indentation of the Lua code: tab, or a number of spaces")
+	fs.IntVar(&o.style.MaxWidth, "width", 0, "wrap argument lists and table constructors longer than `columns`, counting tabs as 4; 0 does not wrap")
+	fs.BoolVar(&o.style.TrailingComma, "trailingcomma", false, "end wrapped table constructors with a comma")
+	fs.BoolVar(&o.style.PadTables, "padtables", true, "put spaces inside the braces of table constructors")
+	fs.IntVar(&o.style.BlankLines, "blanklines", 1, "`number` of blank lines after declarations")
+	fs.BoolVar(&o.watch, "watch", false, "keep running, recompiling packages when their Go files change")
+	fs.DurationVar(&o.interval, "interval", 500*time.Millisecond, "how often to check for changes in watch mode")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	switch o.layout {
+	case layoutPackage, layoutFile, layoutSingle:
+	default:
+		fmt.Fprintf(stderr, "lunar: unknown layout %q\n", o.layout)
+		return 2
+	}
+	switch o.sourceMap {
+	case sourceMapNone, sourceMapJSON, sourceMapTable:
+	default:
+		fmt.Fprintf(stderr, "lunar: unknown source map format %q\n", o.sourceMap)
+		return 2
+	}
+	if o.modules && o.layout != layoutPackage {
+		fmt.Fprintf(stderr, "lunar: -modules requires the %s layout\n", layoutPackage)
+		return 2
+	}
+	for _, m := range o.moduleMap {
+		if !strings.Contains(m, "=") {
+			fmt.Fprintf(stderr, "lunar: invalid -modmap entry %q\n", m)
+			return 2
+		}
+	}
+	if o.indent != "tab" {
+		n, err := strconv.Atoi(o.indent)
+		if err != nil || n < 0 {
+			fmt.Fprintf(stderr, "lunar: invalid -indent %q\n", o.indent)
+			return 2
+		}
+		o.style.Indent = strings.Repeat(" ", n)
+	}
+	if _, err := lunar.ParseTarget(o.target); err != nil {
+		fmt.Fprintf(stderr, "lunar: %v\n", err)
+		return 2
+	}
+	if o.out == "" {
+		o.out = "out"
+		if o.layout == layoutSingle {
+			o.out = "out.lua"
+		}
+	}
+
+	prog, err := o.load(fs.Args())
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	b := &builder{o: &o, stdout: stdout, stderr: stderr, outputs: make(map[string][]string)}
+	ok := b.build(prog, nil)
+	if o.watch {
+		w := newWatcher(b, fs.Args(), prog)
+		for {
+			time.Sleep(o.interval)
+			w.poll()
+		}
+	}
+	if !ok {
+		return 1
+	}
+	return 0
+}
+
+// A builder compiles programs and writes the output.
+type builder struct {
+	o              *buildOptions
+	stdout, stderr io.Writer
+	outputs        map[string][]string // chunk names by package path
+}
+
+// build compiles prog and writes the output, reporting whether it
+// succeeded. If only is not nil, only the Lua files of the packages in
+// only are written again, unless the layout is single.
+func (b *builder) build(prog *lunar.Program, only map[*lunar.Package]bool) bool {
+	p, err := b.o.newParser(prog)
+	if err != nil {
+		fmt.Fprintf(b.stderr, "lunar: %v\n", err)
+		return false
+	}
+	if b.o.modules {
+		p.SetModules(b.o.moduleName)
+	}
+	p.SetMinify(b.o.minify)
+	p.SetOptimize(b.o.optimize)
+	p.SetStyle(b.o.style)
+	if b.o.dce {
+		// Changes to any package can make code of others reachable
+		p.EliminateDeadCode(compiledPackages(prog, p))
+		only = nil
+	}
+
+	if b.o.layout == layoutSingle {
+		return b.buildBundle(prog, p)
+	}
+
+	var chunks []*chunk
+	var diags lunar.Diagnostics
+	for _, pkg := range compiledPackages(prog, p) {
+		if only != nil && !only[pkg] {
+			continue
+		}
+		pkgChunks, err := b.compilePackage(prog, p, pkg, &diags)
+		if err != nil {
+			fmt.Fprintf(b.stderr, "lunar: %v\n", err)
+			return false
+		}
+		chunks = append(chunks, pkgChunks...)
+	}
+	printDiagnostics(b.stderr, diags)
+	if len(diags.Errors()) > 0 {
+		return false
+	}
+	if b.o.runtime && only == nil {
+		chunks = append([]*chunk{b.compileRuntime(p, chunks)}, chunks...)
+	}
+	if !b.writeChunks(chunks) {
+		return false
+	}
+	return b.removeStale(chunks)
+}
+
+// buildBundle writes prog as a single self-contained Lua file, reporting
+// whether it succeeded.
+func (b *builder) buildBundle(prog *lunar.Program, p *lunar.Parser) bool {
+	c := &chunk{name: path.Base(filepath.ToSlash(b.o.out))}
+	lineTable := ""
+	if b.o.sourceMap == sourceMapTable {
+		// The line table has to be registered before the packages are
+		// initialized
+		lineTable = b.o.chunkPrefix + c.name
+		c.hasLineTable = true
+	}
+	var buf bytes.Buffer
+	err := p.WriteBundle(&buf, compiledPackages(prog, p), lineTable)
+	diags := p.Diagnostics()
+	printDiagnostics(b.stderr, diags)
+	if _, ok := err.(lunar.Diagnostics); err != nil && !ok {
+		fmt.Fprintf(b.stderr, "%v\n", err)
+		return false
+	}
+	if len(diags.Errors()) > 0 {
+		return false
+	}
+	c.write(buf.Bytes())
+	c.sourceMap = *p.SourceMap()
+	return b.writeChunks([]*chunk{c})
+}
+
+// writeChunks writes the chunks, reporting whether it succeeded.
+func (b *builder) writeChunks(chunks []*chunk) bool {
+	for _, c := range chunks {
+		written, err := b.write(c)
+		if err != nil {
+			fmt.Fprintf(b.stderr, "lunar: %v\n", err)
+			return false
+		}
+		if written && b.o.verbose {
+			fmt.Fprintln(b.stdout, b.path(c.name))
+		}
+	}
+	return true
+}
+
+// compileRuntime returns the chunk of the builtins. With -dce, only the
+// builtins used by the package chunks are written.
+func (b *builder) compileRuntime(p *lunar.Parser, pkgChunks []*chunk) *chunk {
+	var code []string
+	for _, c := range pkgChunks {
+		code = append(code, c.lua.String())
+	}
+	var buf bytes.Buffer
+	switch {
+	case b.o.modules && b.o.dce:
+		lunar.WriteUsedBuiltinsModule(&buf, p.Target(), code...)
+	case b.o.modules:
+		lunar.WriteBuiltinsModule(&buf, p.Target())
+	case b.o.dce:
+		lunar.WriteUsedBuiltins(&buf, p.Target(), code...)
+	default:
+		lunar.WriteBuiltinsFor(&buf, p.Target())
+	}
+	c := &chunk{name: runtimeFile}
+	if b.o.modules {
+		c.name = moduleFile(b.o.moduleName(lunar.BuiltinsPath))
+	}
+	lua := buf.Bytes()
+	if b.o.minify {
+		// The builtins are valid Lua
+		lua, _ = lunar.Minify(lua)
+	}
+	c.write(lua)
+	return c
+}
+
+// compilePackage compiles pkg into chunks according to the layout.
+// Diagnostics are appended to diags.
+func (b *builder) compilePackage(prog *lunar.Program, p *lunar.Parser, pkg *lunar.Package, diags *lunar.Diagnostics) ([]*chunk, error) {
+	if b.o.modules {
+		c := &chunk{name: moduleFile(b.o.moduleName(pkg.Pkg.Path())), pkg: pkg.Pkg.Path()}
+		err := c.add(p, func(w io.Writer) error {
+			return p.WriteModule(w, pkg)
+		}, diags)
+		if err != nil {
+			return nil, err
+		}
+		return []*chunk{c}, nil
+	}
+
+	var chunks []*chunk
+	var c *chunk
+	for _, f := range sortedFiles(prog, pkg) {
+		if c == nil || b.o.layout == layoutFile {
+			name := pkg.Pkg.Path() + ".lua"
+			if b.o.layout == layoutFile {
+				base := filepath.Base(prog.Fset.File(f.Pos()).Name())
+				name = pkg.Pkg.Path() + "/" + strings.TrimSuffix(base, ".go") + ".lua"
+			}
+			c = &chunk{name: name, pkg: pkg.Pkg.Path()}
+			chunks = append(chunks, c)
+		}
+		err := c.add(p, func(w io.Writer) error {
+			return p.ParseNode(w, f)
+		}, diags)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return chunks, nil
+}
+
+// moduleName returns the name of the Lua module of the package with the
+// given import path, applying the longest matching prefix of -modmap.
+func (o *buildOptions) moduleName(path string) string {
+	best, name := "", ""
+	for _, m := range o.moduleMap {
+		i := strings.Index(m, "=")
+		prefix := m[:i]
+		if len(prefix) > len(best) && (path == prefix || strings.HasPrefix(path, prefix+"/")) {
+			best, name = prefix, m[i+1:]
+		}
+	}
+	if best == "" {
+		return lunar.DefaultModuleName(path)
+	}
+	if rest := strings.TrimPrefix(path, best); rest != "" {
+		return name + "." + lunar.DefaultModuleName(rest[1:])
+	}
+	return name
+}
+
+// moduleFile returns the slash-separated path of the file of the Lua
+// module with the given name, relative to a directory of package.path.
+func moduleFile(name string) string {
+	return strings.Replace(name, ".", "/", -1) + ".lua"
+}
+
+// path returns the file path chunk name is written to.
+func (b *builder) path(name string) string {
+	if b.o.layout == layoutSingle {
+		return b.o.out
+	}
+	return filepath.Join(b.o.out, filepath.FromSlash(name))
+}
+
+// write writes the chunk and its source map, reporting whether the chunk
+// was written. Files whose contents have not changed are left alone, so
+// that their modification times only change with their contents.
+func (b *builder) write(c *chunk) (bool, error) {
+	file := b.path(c.name)
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return false, err
+	}
+
+	lua := c.lua.Bytes()
+	hasMappings := len(c.sourceMap.Mappings) > 0
+	switch {
+	case b.o.sourceMap == sourceMapTable && hasMappings && !c.hasLineTable:
+		var buf bytes.Buffer
+		buf.Write(lua)
+		if err := c.sourceMap.WriteLineTable(&buf, b.o.chunkPrefix+c.name); err != nil {
+			return false, err
+		}
+		lua = buf.Bytes()
+	case b.o.sourceMap == sourceMapJSON && hasMappings:
+		var buf bytes.Buffer
+		if err := c.sourceMap.WriteJSON(&buf, path.Base(c.name)); err != nil {
+			return false, err
+		}
+		if _, err := writeFile(file+".map", buf.Bytes()); err != nil {
+			return false, err
+		}
+	}
+	return writeFile(file, lua)
+}
+
+// removeStale removes the files previously written for the packages of
+// chunks that are not among chunks anymore, which happens when Go files
+// are removed with the file layout.
+func (b *builder) removeStale(chunks []*chunk) bool {
+	names := make(map[string][]string)
+	for _, c := range chunks {
+		if c.pkg != "" {
+			names[c.pkg] = append(names[c.pkg], c.name)
+		}
+	}
+	ok := true
+	for pkg, pkgNames := range names {
+		current := make(map[string]bool)
+		for _, name := range pkgNames {
+			current[name] = true
+		}
+		for _, name := range b.outputs[pkg] {
+			if current[name] {
+				continue
+			}
+			for _, file := range []string{b.path(name), b.path(name) + ".map"} {
+				if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+					fmt.Fprintf(b.stderr, "lunar: %v\n", err)
+					ok = false
+				}
+			}
+		}
+		b.outputs[pkg] = pkgNames
+	}
+	return ok
+}
+
+// writeFile writes data to the named file unless it already has that
+// content, reporting whether it was written.
+func writeFile(name string, data []byte) (bool, error) {
+	if old, err := os.ReadFile(name); err == nil && bytes.Equal(old, data) {
+		return false, nil
+	}
+	if err := os.WriteFile(name, data, 0644); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/eandre/lunar"
+)
+
+func runCheck(args []string, stdout, stderr io.Writer) int {
+	var o options
+	fs := newFlagSet("check", "[packages]", stderr)
+	o.register(fs)
+	asJSON := fs.Bool("json", false, "write the diagnostics to standard output as JSON")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	prog, err := o.load(fs.Args())
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	p, err := o.newParser(prog)
+	if err != nil {
+		fmt.Fprintf(stderr, "lunar: %v\n", err)
+		return 2
+	}
+
+	var diags lunar.Diagnostics
+	for _, pkg := range compiledPackages(prog, p) {
+		for _, f := range sortedFiles(prog, pkg) {
+			if err := p.ParseNode(io.Discard, f); err != nil {
+				if _, ok := err.(lunar.Diagnostics); !ok {
+					fmt.Fprintf(stderr, "lunar: %v\n", err)
+					return 1
+				}
+			}
+			diags = append(diags, p.Diagnostics()...)
+		}
+	}
+
+	if *asJSON {
+		if err := diags.WriteJSON(stdout); err != nil {
+			fmt.Fprintf(stderr, "lunar: %v\n", err)
+			return 1
+		}
+	} else {
+		printDiagnostics(stderr, diags)
+	}
+	if len(diags.Errors()) > 0 {
+		return 1
+	}
+	return 0
+}
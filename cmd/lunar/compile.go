@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"go/ast"
+	"io"
+	"sort"
+
+	"github.com/eandre/lunar"
+)
+
+// compiledPackages returns the packages of prog that are compiled: the
+// requested packages and the packages they import from modules, which
+// excludes the standard library. Transient packages, and the packages
+// only they import, are never compiled. The packages are returned in
+// initialization order.
+func compiledPackages(prog *lunar.Program, p *lunar.Parser) []*lunar.Package {
+	initial := make(map[*lunar.Package]bool)
+	for _, pkg := range prog.Initial {
+		initial[pkg] = true
+	}
+
+	var pkgs []*lunar.Package
+	visited := make(map[*lunar.Package]bool)
+	var visit func(pkg *lunar.Package)
+	visit = func(pkg *lunar.Package) {
+		if pkg == nil || visited[pkg] {
+			return
+		}
+		visited[pkg] = true
+		if p.IsTransientPkg(pkg.Pkg) || (!initial[pkg] && pkg.Module == nil) {
+			return
+		}
+		for _, imp := range pkg.Pkg.Imports() {
+			visit(prog.Package(imp.Path()))
+		}
+		pkgs = append(pkgs, pkg)
+	}
+	for _, pkg := range prog.Initial {
+		visit(pkg)
+	}
+	return lunar.InitOrder(pkgs)
+}
+
+// sortedFiles returns the files of pkg ordered by file name.
+func sortedFiles(prog *lunar.Program, pkg *lunar.Package) []*ast.File {
+	files := append([]*ast.File(nil), pkg.Files...)
+	sort.Slice(files, func(i, j int) bool {
+		return prog.Fset.File(files[i].Pos()).Name() < prog.Fset.File(files[j].Pos()).Name()
+	})
+	return files
+}
+
+// A chunk is the Lua code of an output file, compiled from one or more Go
+// files.
+type chunk struct {
+	name      string // slash-separated path relative to the output
+	pkg       string // import path of the package, if compiled from one
+	lua       bytes.Buffer
+	sourceMap lunar.SourceMap
+	lines     int // number of lines in lua
+
+	hasLineTable bool // whether lua registers its own line table
+}
+
+// add appends the Lua code written by parse, which is a method of p such
+// as ParseNode, to the chunk. Diagnostics are appended to diags; the
+// returned error is only non-nil if the code could not be written.
+func (c *chunk) add(p *lunar.Parser, parse func(w io.Writer) error, diags *lunar.Diagnostics) error {
+	var buf bytes.Buffer
+	err := parse(&buf)
+	*diags = append(*diags, p.Diagnostics()...)
+	if _, ok := err.(lunar.Diagnostics); err != nil && !ok {
+		return err
+	}
+
+	// The source map is relative to its own output
+	sm := p.SourceMap()
+	c.sourceMap.Fset = sm.Fset
+	for _, m := range sm.Mappings {
+		m.Line += c.lines
+		c.sourceMap.Mappings = append(c.sourceMap.Mappings, m)
+	}
+	c.write(buf.Bytes())
+	return nil
+}
+
+// write appends Lua code without source mappings to the chunk.
+func (c *chunk) write(lua []byte) {
+	if len(lua) == 0 {
+		return
+	}
+	if lua[len(lua)-1] != '\n' {
+		lua = append(lua, '\n')
+	}
+	c.lua.Write(lua)
+	c.lines += bytes.Count(lua, []byte{'\n'})
+}
@@ -0,0 +1,149 @@
+// Command lunar compiles Go packages to Lua.
+//
+// Usage:
+//
+//	lunar build [flags] [packages]
+//	lunar check [flags] [packages]
+//	lunar bind [flags] api.json
+//
+// The build command compiles the packages matching the patterns, and the
+// packages they import, to Lua. The check command translates the same
+// packages without writing anything, reporting the constructs that cannot
+// be translated. The bind command generates a Go package declaring the Lua
+// API described by a JSON file, to be marked transient with -transient;
+// see package github.com/eandre/lunar/bindgen for the format. Run "lunar <command> -h" for the flags of a command.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/eandre/lunar"
+	"golang.org/x/tools/go/packages"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+const usage = `usage: lunar <command> [flags] [packages]
+
+Commands:
+	build	compile packages to Lua
+	check	report Go code that cannot be compiled to Lua
+	bind	generate Go bindings of a Lua API
+`
+
+// run runs the command line args and returns the exit status: 0 on
+// success, 1 if the Go code could not be compiled and 2 for usage errors.
+func run(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+	switch args[0] {
+	case "build":
+		return runBuild(args[1:], stdout, stderr)
+	case "check":
+		return runCheck(args[1:], stdout, stderr)
+	case "bind":
+		return runBind(args[1:], stdout, stderr)
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(stdout, usage)
+		return 0
+	}
+	fmt.Fprintf(stderr, "lunar: unknown command %q\n", args[0])
+	fmt.Fprint(stderr, usage)
+	return 2
+}
+
+// options are the flags shared by all commands.
+type options struct {
+	target    string
+	transient stringList
+	promote   stringList
+	tags      string
+	dir       string
+	checkRaw  bool
+}
+
+func (o *options) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.target, "target", lunar.Lua51.String(), "Lua dialect to generate code for: lua5.1, lua5.2, lua5.3, lua5.4, luajit or wow")
+	fs.Var(&o.transient, "transient", "comma-separated import `paths` of packages that are only used for type checking, such as API bindings")
+	fs.Var(&o.promote, "promote", "comma-separated warning `categories` to report as errors")
+	fs.StringVar(&o.tags, "tags", "", "comma-separated build `tags`")
+	fs.StringVar(&o.dir, "C", "", "load packages relative to `dir`")
+	fs.BoolVar(&o.checkRaw, "checkraw", false, "check the syntax of the Lua code of lua.Raw, lua.Expr and lua.Stmt calls")
+}
+
+// load loads the packages matching patterns.
+func (o *options) load(patterns []string) (*lunar.Program, error) {
+	if len(patterns) == 0 {
+		patterns = []string{"."}
+	}
+	cfg := &packages.Config{Dir: o.dir}
+	if o.tags != "" {
+		cfg.BuildFlags = []string{"-tags=" + o.tags}
+	}
+	return lunar.Load(cfg, patterns...)
+}
+
+// newParser returns a parser for prog configured by the options.
+func (o *options) newParser(prog *lunar.Program) (*lunar.Parser, error) {
+	target, err := lunar.ParseTarget(o.target)
+	if err != nil {
+		return nil, err
+	}
+	p := lunar.NewProgramParser(prog)
+	p.SetTarget(target)
+	p.MarkTransientPackage(lunar.LuaPkgPath)
+	for _, path := range o.transient {
+		p.MarkTransientPackage(path)
+	}
+	p.PromoteWarnings(o.promote...)
+	p.SetCheckRaw(o.checkRaw)
+	return p, nil
+}
+
+// stringList is a flag holding a comma-separated list of strings. It can
+// be given multiple times.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// newFlagSet returns a flag set for the named command that reports errors
+// to stderr.
+func newFlagSet(name, args string, stderr io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "usage: lunar %s [flags] %s\n\nFlags:\n", name, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// printDiagnostics writes the diagnostics to w, one per line.
+func printDiagnostics(w io.Writer, diags lunar.Diagnostics) {
+	for _, d := range diags {
+		if d.Pos.IsValid() {
+			fmt.Fprintf(w, "%s: %s: %s [%s]\n", d.Pos, d.Severity, d.Message, d.Code)
+		} else {
+			fmt.Fprintf(w, "%s: %s [%s]\n", d.Severity, d.Message, d.Code)
+		}
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeModule writes a module with the given files to a temporary
+// directory and returns the directory.
+func writeModule(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	write := func(name, src string) {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("go.mod", "module example.com/m\n\ngo 1.18\n")
+	for name, src := range files {
+		write(name, src)
+	}
+	return dir
+}
+
+func runLunar(args ...string) (code int, stdout, stderr string) {
+	var out, errOut bytes.Buffer
+	code = run(args, &out, &errOut)
+	return code, out.String(), errOut.String()
+}
+
+var testModule = map[string]string{
+	"main.go": `package main
+
+import "example.com/m/b"
+
+func init() {
+	println(b.Double(2))
+}
+`,
+	"b/b.go": `package b
+
+func Double(n int) int {
+	return n * 2
+}
+`,
+	"b/c.go": `package b
+
+var C = 3
+`,
+}
+
+func TestBuild(t *testing.T) {
+	tests := []struct {
+		layout string
+		files  []string
+	}{
+		{"package", []string{"lunar_builtins.lua", "example.com/m/b.lua", "example.com/m.lua"}},
+		{"file", []string{"lunar_builtins.lua", "example.com/m/b/b.lua", "example.com/m/b/c.lua", "example.com/m/main.lua"}},
+	}
+	for _, test := range tests {
+		dir := writeModule(t, testModule)
+		out := filepath.Join(dir, "out")
+		code, stdout, stderr := runLunar("build", "-C", dir, "-o", out, "-layout", test.layout, "-v", ".")
+		if code != 0 {
+			t.Fatalf("%s: Got exit status %d: %s", test.layout, code, stderr)
+		}
+
+		var want []string
+		for _, name := range test.files {
+			want = append(want, filepath.Join(out, filepath.FromSlash(name)))
+		}
+		if got := strings.Fields(stdout); strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("%s: Got files %v; want %v", test.layout, got, want)
+		}
+		for _, file := range want {
+			if _, err := os.Stat(file); err != nil {
+				t.Errorf("%s: %v", test.layout, err)
+			}
+		}
+	}
+}
+
+func TestBuildSingle(t *testing.T) {
+	dir := writeModule(t, testModule)
+	out := filepath.Join(dir, "main.lua")
+	code, _, stderr := runLunar("build", "-C", dir, "-o", out, "-layout", "single", "-sourcemap", "json", "-target", "lua5.3", ".")
+	if code != 0 {
+		t.Fatalf("Got exit status %d: %s", code, stderr)
+	}
+	lua, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The builtins come first, followed by packages after their imports
+	s := string(lua)
+	builtins := strings.Index(s, "_G.lunar_go_builtins = builtins")
+	b := strings.Index(s, `_G["example.com/m/b"] = _b`)
+	main := strings.Index(s, `_G["example.com/m"] = _main`)
+	if builtins < 0 || b < builtins || main < b {
+		t.Errorf("Got wrong order of builtins (%d), b (%d) and main (%d)", builtins, b, main)
+	}
+	if !strings.Contains(s, "builtins.idiv(a, b)\n\tif b == 0 then") || !strings.Contains(s, "a // b") {
+		t.Errorf("Builtins are not for lua5.3")
+	}
+
+	var sm struct {
+		Sources []string `json:"sources"`
+	}
+	data, err := os.ReadFile(out + ".map")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &sm); err != nil {
+		t.Fatal(err)
+	}
+	if len(sm.Sources) != 3 {
+		t.Errorf("Got sources %v; want b/b.go, b/c.go and main.go", sm.Sources)
+	}
+}
+
+func TestBuildDCE(t *testing.T) {
+	dir := writeModule(t, testModule)
+	out := filepath.Join(dir, "out")
+	code, _, stderr := runLunar("build", "-C", dir, "-o", out, "-dce", ".")
+	if code != 0 {
+		t.Fatalf("Got exit status %d: %s", code, stderr)
+	}
+	b, err := os.ReadFile(filepath.Join(out, "example.com", "m", "b.lua"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "_b.Double = ") || strings.Contains(string(b), "_b.C = ") {
+		t.Errorf("Got b.lua without Double or with C:\n%s", b)
+	}
+	builtins, err := os.ReadFile(filepath.Join(out, "lunar_builtins.lua"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(builtins), `builtins.pkgs["fmt"]`) {
+		t.Errorf("Unused fmt shim was written")
+	}
+}
+
+func TestBuildMinify(t *testing.T) {
+	dir := writeModule(t, testModule)
+	out := filepath.Join(dir, "out")
+	code, _, stderr := runLunar("build", "-C", dir, "-o", out, "-minify", ".")
+	if code != 0 {
+		t.Fatalf("Got exit status %d: %s", code, stderr)
+	}
+	for _, name := range []string{"lunar_builtins.lua", "example.com/m/b.lua"} {
+		lua, err := os.ReadFile(filepath.Join(out, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(lua), "\t") || strings.Contains(string(lua), "--") {
+			t.Errorf("Got unminified %s:\n%s", name, lua)
+		}
+	}
+}
+
+func TestBuildStyle(t *testing.T) {
+	dir := writeModule(t, testModule)
+	out := filepath.Join(dir, "out")
+	code, _, stderr := runLunar("build", "-C", dir, "-o", out, "-indent", "2", "-blanklines", "2", ".")
+	if code != 0 {
+		t.Fatalf("Got exit status %d: %s", code, stderr)
+	}
+	lua, err := os.ReadFile(filepath.Join(out, filepath.FromSlash("example.com/m/b.lua")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(lua), "\t") || !strings.Contains(string(lua), "\n  ") || !strings.Contains(string(lua), "end\n\n\n") {
+		t.Errorf("Got output without style:\n%s", lua)
+	}
+
+	if code, _, _ := runLunar("build", "-C", dir, "-o", out, "-indent", "x", "."); code != 2 {
+		t.Errorf("Got exit status %d for an invalid -indent; want 2", code)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	dir := writeModule(t, map[string]string{
+		"main.go": `package main
+
+func main() {
+	ch := make(chan int)
+	go func() {}()
+	_ = ch
+}
+`,
+	})
+	code, stdout, stderr := runLunar("check", "-C", dir, "-json", ".")
+	if code != 1 {
+		t.Fatalf("Got exit status %d; want 1: %s", code, stderr)
+	}
+	var diags []struct {
+		Line     int    `json:"line"`
+		Severity string `json:"severity"`
+	}
+	if err := json.Unmarshal([]byte(stdout), &diags); err != nil {
+		t.Fatalf("Could not decode %q: %v", stdout, err)
+	}
+	if len(diags) == 0 || diags[0].Severity != "error" {
+		t.Errorf("Got diagnostics %+v; want errors", diags)
+	}
+
+	if code, _, _ := runLunar("check", "-C", writeModule(t, testModule), "."); code != 0 {
+		t.Errorf("Got exit status %d for valid module; want 0", code)
+	}
+}
+
+func TestBind(t *testing.T) {
+	dir := writeModule(t, map[string]string{
+		"api.json": `{
+	"package": "ui",
+	"functions": [
+		{"name": "C_Timer.After", "params": [{"name": "seconds", "type": "number"}, {"name": "callback", "type": "Callback"}]},
+		{"name": "GetCursorPosition", "results": [{"type": "number"}, {"type": "number"}]}
+	],
+	"types": [{"name": "Callback", "callback": {}}]
+}`,
+		"main.go": `package main
+
+import "example.com/m/ui"
+
+func init() {
+	x, y := ui.GetCursorPosition()
+	ui.C_Timer_After(1, func() { println(x, y) })
+}
+`,
+	})
+	code, _, stderr := runLunar("bind", "-o", filepath.Join(dir, "ui", "ui.go"), filepath.Join(dir, "api.json"))
+	if code != 0 {
+		t.Fatalf("Got exit status %d: %s", code, stderr)
+	}
+
+	out := filepath.Join(dir, "main.lua")
+	code, _, stderr = runLunar("build", "-C", dir, "-o", out, "-layout", "single", "-transient", "example.com/m/ui", ".")
+	if code != 0 {
+		t.Fatalf("Got exit status %d: %s", code, stderr)
+	}
+	lua, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := string(lua)
+	for _, want := range []string{"local x, y = GetCursorPosition()", "C_Timer.After(1, function()"} {
+		if !strings.Contains(s, want) {
+			t.Errorf("Output does not contain %q:\n%s", want, s)
+		}
+	}
+	if strings.Contains(s, "example.com/m/ui") {
+		t.Errorf("Output contains the transient bindings:\n%s", s)
+	}
+
+	if code, _, _ := runLunar("bind", filepath.Join(dir, "main.go")); code != 1 {
+		t.Errorf("Got exit status %d for invalid API; want 1", code)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	for _, args := range [][]string{
+		nil,
+		{"frob"},
+		{"build", "-layout", "tree"},
+		{"build", "-target", "lua6"},
+	} {
+		if code, _, _ := runLunar(args...); code != 2 {
+			t.Errorf("%q: Got exit status %d; want 2", args, code)
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir := writeModule(t, testModule)
+	var stdout, stderr bytes.Buffer
+	o := &buildOptions{out: filepath.Join(dir, "out"), layout: layoutFile, runtime: true, verbose: true}
+	o.target = "lua5.1"
+	o.dir = dir
+	prog, err := o.load([]string{"."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &builder{o: o, stdout: &stdout, stderr: &stderr, outputs: make(map[string][]string)}
+	if !b.build(prog, nil) {
+		t.Fatalf("Build failed: %s", stderr.String())
+	}
+	w := newWatcher(b, []string{"."}, prog)
+
+	// Changes must be visible in the modification times
+	mtime := time.Now()
+	change := func(name, src string) {
+		mtime = mtime.Add(time.Second)
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if src == "" {
+			if err := os.Remove(file); err != nil {
+				t.Fatal(err)
+			}
+			return
+		}
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		changes []string // pairs of file name and source; empty to remove
+		written []string
+		removed []string
+	}{
+		// Nothing changed
+		{nil, nil, nil},
+		// Importers are rechecked, but their output does not change
+		{[]string{"b/b.go", "package b\n\nfunc Double(n int) int {\n\treturn n + n\n}\n"}, []string{"example.com/m/b/b.lua"}, nil},
+		// New files are compiled and the output of removed files is removed
+		{[]string{"b/d.go", "package b\n\nvar D = 4\n", "b/c.go", ""}, []string{"example.com/m/b/d.lua"}, []string{"example.com/m/b/c.lua"}},
+		// New imports load the program again
+		{[]string{"b/d.go", "package b\n\nimport \"example.com/m/e\"\n\nvar D = e.E\n", "e/e.go", "package e\n\nvar E = 5\n"}, []string{"example.com/m/e/e.lua", "example.com/m/b/d.lua"}, nil},
+		// A file set grown too large loads the program again
+		{[]string{"e/e.go", "package e\n\nvar E = 6\n"}, []string{"example.com/m/e/e.lua"}, nil},
+	}
+	defer func(max int) { maxFileSetBase = max }(maxFileSetBase)
+	for i, test := range tests {
+		for j := 0; j < len(test.changes); j += 2 {
+			change(test.changes[j], test.changes[j+1])
+		}
+		stdout.Reset()
+		stderr.Reset()
+		fset := w.prog.Fset
+		if i == len(tests)-1 {
+			maxFileSetBase = fset.Base()
+		}
+		w.poll()
+		if i == len(tests)-1 && w.prog.Fset == fset {
+			t.Errorf("%d. The file set was kept", i)
+		}
+
+		var want []string
+		for _, name := range test.written {
+			want = append(want, b.path(name))
+		}
+		if got := strings.Fields(stdout.String()); strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("%d. Got written files %v; want %v (%s)", i, got, want, stderr.String())
+		}
+		for _, name := range test.removed {
+			if _, err := os.Stat(b.path(name)); !os.IsNotExist(err) {
+				t.Errorf("%d. File %s was not removed", i, name)
+			}
+		}
+	}
+}
+
+func TestBuildModules(t *testing.T) {
+	dir := writeModule(t, testModule)
+	out := filepath.Join(dir, "out")
+	code, stdout, stderr := runLunar("build", "-C", dir, "-o", out, "-modules", "-modmap", "example.com/m=game,github.com/eandre/lunar/builtins=lunar", "-v", ".")
+	if code != 0 {
+		t.Fatalf("Got exit status %d: %s", code, stderr)
+	}
+	var want []string
+	for _, name := range []string{"lunar.lua", "game/b.lua", "game.lua"} {
+		want = append(want, filepath.Join(out, filepath.FromSlash(name)))
+	}
+	if got := strings.Fields(stdout); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("Got files %v; want %v", got, want)
+	}
+
+	lua, err := os.ReadFile(filepath.Join(out, "game.lua"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{`local builtins = require("lunar")`, `local _b = require("game.b")`, "return _main"} {
+		if !strings.Contains(string(lua), s) {
+			t.Errorf("Could not find %q in module:\n%s", s, lua)
+		}
+	}
+
+	if code, _, _ := runLunar("build", "-modules", "-layout", "single"); code != 2 {
+		t.Errorf("Got exit status %d for -modules with single layout; want 2", code)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"go/build"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/eandre/lunar"
+)
+
+// A watcher recompiles the packages whose Go files changed, and the
+// packages importing them. Files are polled, since file system
+// notifications are not portable.
+type watcher struct {
+	b        *builder
+	patterns []string
+	ctx      build.Context
+	prog     *lunar.Program
+	dirs     map[string]string    // import paths of the watched packages by directory
+	stamps   map[string]fileStamp // by Go file
+}
+
+// maxFileSetBase bounds the size of the file set of the watched program.
+// Updating the program adds the changed files to its file set, which is
+// only replaced by loading the program again; a file set with a base
+// beyond this is replaced on the next change.
+var maxFileSetBase = 64 << 20
+
+// A fileStamp identifies a version of a file.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func newWatcher(b *builder, patterns []string, prog *lunar.Program) *watcher {
+	w := &watcher{b: b, patterns: patterns, ctx: build.Default}
+	if b.o.tags != "" {
+		w.ctx.BuildTags = strings.Split(b.o.tags, ",")
+	}
+	w.watch(prog)
+	return w
+}
+
+// watch watches the Go files of the packages of prog that are compiled.
+func (w *watcher) watch(prog *lunar.Program) {
+	w.prog = prog
+	w.dirs = make(map[string]string)
+	w.stamps = make(map[string]fileStamp)
+	p, err := w.b.o.newParser(prog)
+	if err != nil {
+		return
+	}
+	for _, pkg := range compiledPackages(prog, p) {
+		if len(pkg.Files) == 0 {
+			continue
+		}
+		dir := filepath.Dir(prog.Fset.File(pkg.Files[0].Pos()).Name())
+		w.dirs[dir] = pkg.Pkg.Path()
+		files, _ := w.goFiles(dir)
+		for _, file := range files {
+			w.stamps[file] = stamp(file)
+		}
+	}
+}
+
+// goFiles returns the Go files in dir that are part of the package built
+// from it, excluding tests.
+func (w *watcher) goFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		if ok, err := w.ctx.MatchFile(dir, name); err != nil || !ok {
+			continue
+		}
+		files = append(files, filepath.Join(dir, name))
+	}
+	return files, nil
+}
+
+func stamp(file string) fileStamp {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{fi.ModTime(), fi.Size()}
+}
+
+// changes returns the Go files of the watched packages that were added,
+// removed or modified since they were last watched, by import path.
+func (w *watcher) changes() map[string][]string {
+	changed := make(map[string][]string)
+	seen := make(map[string]bool)
+	for dir, path := range w.dirs {
+		files, err := w.goFiles(dir)
+		if err != nil {
+			// The package was removed; loading the program again reports it
+			changed[path] = nil
+			continue
+		}
+		for _, file := range files {
+			seen[file] = true
+			if old, ok := w.stamps[file]; !ok || old != stamp(file) {
+				changed[path] = files
+			}
+		}
+	}
+	for file := range w.stamps {
+		if path := w.dirs[filepath.Dir(file)]; !seen[file] {
+			files, _ := w.goFiles(filepath.Dir(file))
+			changed[path] = files
+		}
+	}
+	return changed
+}
+
+// poll recompiles the packages affected by changes since the last poll,
+// and writes their output.
+func (w *watcher) poll() {
+	changed := w.changes()
+	if len(changed) == 0 {
+		return
+	}
+	var paths []string
+	for path := range changed {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	fmt.Fprintf(w.b.stderr, "lunar: changed %s\n", strings.Join(paths, ", "))
+
+	prog, checked, err := w.prog.Update(changed)
+	if err != nil || prog.Fset.Base() > maxFileSetBase {
+		// Changes to imports require resolving packages again, and the
+		// program may load without the errors of the update. Loading also
+		// starts a new file set, which updates make grow.
+		prog, err = w.b.o.load(w.patterns)
+		checked = nil
+		if err != nil {
+			fmt.Fprintln(w.b.stderr, err)
+			// Wait for further changes before trying again
+			w.watch(w.prog)
+			return
+		}
+	}
+
+	var only map[*lunar.Package]bool
+	if checked != nil {
+		only = make(map[*lunar.Package]bool)
+		for _, pkg := range checked {
+			only[pkg] = true
+		}
+	}
+	w.b.build(prog, only)
+	w.watch(prog)
+}
@@ -0,0 +1,366 @@
+package lunar
+
+import (
+	"go/ast"
+	"go/types"
+)
+
+// EliminateDeadCode makes the parser leave out the package-level
+// functions, methods, types, variables and constants of pkgs that cannot
+// be reached from the roots of the program:
+//
+//   - the main function of the main package and all init functions,
+//   - the initializers of package-level variables that call functions,
+//   - declarations marked with a //lunar:export directive, which keeps
+//     all methods of an exported type.
+//   - functions assigned to globals with a //lunar:global directive.
+//
+// A method is reachable when it is used directly, or when its type is
+// reachable and a method with the same name is called through an
+// interface or by the builtins, like Error and String. Code that is only
+// referred to from Lua, such as lua.Raw snippets, must be exported with
+// the directive.
+//
+// Declarations of packages not in pkgs are always written. Bundles
+// written by a parser eliminating dead code also leave out unused
+// builtins; see WriteUsedBuiltins.
+func (p *Parser) EliminateDeadCode(pkgs []*Package) {
+	d := &deadCode{
+		pkgs:     make(map[*types.Package]*Package),
+		decls:    make(map[types.Object]liveDecl),
+		live:     make(map[ast.Node]bool),
+		objs:     make(map[types.Object]bool),
+		dynamic:  make(map[string]bool),
+		imported: make(map[*types.Package]bool),
+	}
+	for _, pkg := range pkgs {
+		d.pkgs[pkg.Pkg] = pkg
+	}
+	for name := range runtimeMethods {
+		d.dynamic[name] = true
+	}
+	d.index()
+	d.markRoots()
+	for len(d.queue) > 0 {
+		decl := d.queue[0]
+		d.queue = d.queue[1:]
+		d.walk(decl)
+	}
+	p.live = d
+}
+
+// runtimeMethods are the names of the methods the builtins call on
+// values, like interface method calls.
+var runtimeMethods = map[string]bool{
+	"Error":  true,
+	"String": true,
+	"Is":     true,
+	"Unwrap": true,
+	"Len":    true,
+	"Less":   true,
+	"Swap":   true,
+}
+
+// isLive reports whether the top-level declaration or spec n is written.
+// Everything is live unless dead code is eliminated.
+func (p *Parser) isLive(n ast.Node) bool {
+	if p.live == nil {
+		return true
+	}
+	switch n := n.(type) {
+	case *ast.GenDecl:
+		for _, spec := range n.Specs {
+			if p.isLive(spec) {
+				return true
+			}
+		}
+		return false
+	case *ast.ImportSpec:
+		// Imports are live if a live declaration uses the package, so that
+		// the shims of unused standard packages can be left out
+		if _, ok := p.live.pkgs[p.nodePkg(n).Pkg]; !ok {
+			return true
+		}
+		name, ok := p.importObject(n).(*types.PkgName)
+		return !ok || p.live.imported[name.Imported()]
+	case *ast.FuncDecl:
+		if n.Recv == nil && n.Name.Name == "init" {
+			return true
+		}
+	}
+	if _, ok := p.live.pkgs[p.nodePkg(n).Pkg]; !ok {
+		return true
+	}
+	return p.live.live[n]
+}
+
+// A liveDecl is a package-level declaration found by the dead code
+// analysis: a FuncDecl, TypeSpec or ValueSpec.
+type liveDecl struct {
+	pkg  *Package
+	node ast.Node
+}
+
+// deadCode finds the reachable declarations of a set of packages.
+type deadCode struct {
+	pkgs     map[*types.Package]*Package
+	decls    map[types.Object]liveDecl // by the objects they declare
+	live     map[ast.Node]bool         // reachable declarations
+	objs     map[types.Object]bool     // reachable objects
+	named    []*types.Named            // reachable named types
+	imported map[*types.Package]bool   // packages used by reachable declarations
+	dynamic  map[string]bool           // names of methods called dynamically
+	queue    []liveDecl                // reachable declarations not walked yet
+}
+
+// index records the package-level declarations by the objects they
+// declare.
+func (d *deadCode) index() {
+	for _, pkg := range d.pkgs {
+		for _, f := range pkg.Files {
+			for _, decl := range f.Decls {
+				switch decl := decl.(type) {
+				case *ast.FuncDecl:
+					if obj := pkg.Info.Defs[decl.Name]; obj != nil {
+						d.decls[obj] = liveDecl{pkg, decl}
+					}
+				case *ast.GenDecl:
+					for _, spec := range decl.Specs {
+						switch spec := spec.(type) {
+						case *ast.TypeSpec:
+							if obj := pkg.Info.Defs[spec.Name]; obj != nil {
+								d.decls[obj] = liveDecl{pkg, spec}
+							}
+						case *ast.ValueSpec:
+							for _, name := range spec.Names {
+								if obj := pkg.Info.Defs[name]; obj != nil {
+									d.decls[obj] = liveDecl{pkg, spec}
+								}
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+// markRoots marks the declarations that are reachable regardless of
+// their uses.
+func (d *deadCode) markRoots() {
+	for _, pkg := range d.pkgs {
+		for _, f := range pkg.Files {
+			for _, decl := range f.Decls {
+				switch decl := decl.(type) {
+				case *ast.FuncDecl:
+					isInit := decl.Recv == nil && decl.Name.Name == "init"
+					isMain := decl.Recv == nil && decl.Name.Name == "main" && pkg.Pkg.Name() == "main"
+					dirs := collectDirectives(readDirectives(decl.Doc))
+					if isInit || isMain || dirs != nil && (dirs.export || dirs.global != "") {
+						d.markDecl(liveDecl{pkg, decl})
+					}
+				case *ast.GenDecl:
+					for _, spec := range decl.Specs {
+						switch spec := spec.(type) {
+						case *ast.TypeSpec:
+							if dirs := collectDirectives(readDirectives(decl.Doc, spec.Doc)); dirs != nil && dirs.export {
+								d.markExportedType(pkg.Info.Defs[spec.Name])
+							}
+						case *ast.ValueSpec:
+							dirs := collectDirectives(readDirectives(decl.Doc, spec.Doc))
+							if dirs != nil && dirs.export || d.hasSideEffects(pkg, spec) {
+								d.markDecl(liveDecl{pkg, spec})
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+// markExportedType marks the named type obj and all its methods.
+func (d *deadCode) markExportedType(obj types.Object) {
+	if obj == nil {
+		return
+	}
+	d.markObject(obj)
+	if named, ok := obj.Type().(*types.Named); ok {
+		mset := types.NewMethodSet(types.NewPointer(named))
+		for i := 0; i < mset.Len(); i++ {
+			d.markObject(mset.At(i).Obj())
+		}
+	}
+}
+
+// hasSideEffects reports whether initializing the package-level
+// variables of spec may have side effects, which is the case when it
+// calls a function. Function literals are not called by initializing
+// them, and conversions and the builtins computing values have no side
+// effects.
+func (d *deadCode) hasSideEffects(pkg *Package, spec *ast.ValueSpec) bool {
+	found := false
+	for _, val := range spec.Values {
+		ast.Inspect(val, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.FuncLit:
+				return false
+			case *ast.CallExpr:
+				if tv, ok := pkg.Info.Types[n.Fun]; ok && tv.IsType() {
+					return true
+				}
+				if id, ok := n.Fun.(*ast.Ident); ok {
+					if b, ok := pkg.Info.Uses[id].(*types.Builtin); ok && pureBuiltins[b.Name()] {
+						return true
+					}
+				}
+				found = true
+			}
+			return !found
+		})
+	}
+	return found
+}
+
+// pureBuiltins are the Go builtin functions without side effects.
+var pureBuiltins = map[string]bool{
+	"cap":     true,
+	"complex": true,
+	"imag":    true,
+	"len":     true,
+	"make":    true,
+	"max":     true,
+	"min":     true,
+	"new":     true,
+	"real":    true,
+}
+
+// markDecl marks decl as reachable, queueing it to be walked.
+func (d *deadCode) markDecl(decl liveDecl) {
+	if d.live[decl.node] {
+		return
+	}
+	d.live[decl.node] = true
+	d.queue = append(d.queue, decl)
+}
+
+// markObject marks obj as reachable. Calls to interface methods make the
+// methods with the same name reachable for all reachable types.
+func (d *deadCode) markObject(obj types.Object) {
+	if fn, ok := obj.(*types.Func); ok {
+		obj = fn.Origin()
+		if recv := fn.Type().(*types.Signature).Recv(); recv != nil && types.IsInterface(recv.Type()) {
+			d.markDynamic(fn.Name())
+			return
+		}
+	}
+	if d.objs[obj] {
+		return
+	}
+	if _, ok := d.pkgs[obj.Pkg()]; !ok {
+		return
+	}
+	d.objs[obj] = true
+	if tn, ok := obj.(*types.TypeName); ok && !tn.IsAlias() {
+		if named, ok := tn.Type().(*types.Named); ok {
+			d.named = append(d.named, named)
+			d.markMethods(named)
+		}
+	}
+	if decl, ok := d.decls[obj]; ok {
+		d.markDecl(decl)
+	}
+}
+
+// markDynamic records that methods named name are called dynamically.
+func (d *deadCode) markDynamic(name string) {
+	if d.dynamic[name] {
+		return
+	}
+	d.dynamic[name] = true
+	for _, named := range d.named {
+		d.markMethods(named)
+	}
+}
+
+// markMethods marks the methods of the reachable type named that are
+// called dynamically, including those promoted from embedded fields.
+func (d *deadCode) markMethods(named *types.Named) {
+	mset := types.NewMethodSet(types.NewPointer(named))
+	for i := 0; i < mset.Len(); i++ {
+		if obj := mset.At(i).Obj(); d.dynamic[obj.Name()] {
+			d.markObject(obj)
+		}
+	}
+}
+
+// markType marks the named type of values of type t, if any. Values of
+// named types can be created without referring to the type by name, as
+// in the elements of composite literals.
+func (d *deadCode) markType(t types.Type) {
+	if ptr, ok := t.(*types.Pointer); ok {
+		t = ptr.Elem()
+	}
+	if named, ok := types.Unalias(t).(*types.Named); ok {
+		d.markObject(named.Origin().Obj())
+	}
+}
+
+// walk marks the objects used by decl, and the packages they belong to.
+func (d *deadCode) walk(decl liveDecl) {
+	info := decl.pkg.Info
+	ast.Inspect(decl.node, func(n ast.Node) bool {
+		if id, ok := n.(*ast.Ident); ok {
+			switch obj := info.Uses[id].(type) {
+			case nil:
+			case *types.PkgName:
+				d.imported[obj.Imported()] = true
+			default:
+				// Objects of dot imports are used without their package name
+				if obj.Pkg() != nil {
+					d.imported[obj.Pkg()] = true
+				}
+				d.markObject(obj)
+			}
+		}
+		if x, ok := n.(ast.Expr); ok {
+			if tv, ok := info.Types[x]; ok && tv.Type != nil {
+				d.markType(tv.Type)
+				d.markTypePkgs(tv.Type, nil)
+			}
+		}
+		return true
+	})
+}
+
+// markTypePkgs records the packages of the named types of values of type
+// t as used, as the translation may refer to their type tables.
+func (d *deadCode) markTypePkgs(t types.Type, seen map[*types.Named]bool) {
+	switch t := types.Unalias(t).(type) {
+	case *types.Named:
+		if seen[t] {
+			return
+		}
+		if seen == nil {
+			seen = make(map[*types.Named]bool)
+		}
+		seen[t] = true
+		if pkg := t.Obj().Pkg(); pkg != nil {
+			d.imported[pkg] = true
+		}
+		d.markTypePkgs(t.Underlying(), seen)
+	case *types.Pointer:
+		d.markTypePkgs(t.Elem(), seen)
+	case *types.Slice:
+		d.markTypePkgs(t.Elem(), seen)
+	case *types.Array:
+		d.markTypePkgs(t.Elem(), seen)
+	case *types.Map:
+		d.markTypePkgs(t.Key(), seen)
+		d.markTypePkgs(t.Elem(), seen)
+	case *types.Struct:
+		for i := 0; i < t.NumFields(); i++ {
+			d.markTypePkgs(t.Field(i).Type(), seen)
+		}
+	}
+}
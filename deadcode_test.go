@@ -0,0 +1,146 @@
+package lunar
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/tools/go/packages"
+)
+
+func TestEliminateDeadCode(t *testing.T) {
+	dir := t.TempDir()
+	for name, src := range map[string]string{
+		"go.mod": "module example.com/m\n\ngo 1.18\n",
+		"main.go": `package main
+
+import (
+	"strings"
+
+	"example.com/m/b"
+)
+
+type Shape interface{ Area() int }
+
+type Square struct{ Side int }
+
+func (s Square) Area() int      { return s.Side * s.Side }
+func (s Square) Perimeter() int { return 4 * s.Side }
+func (s Square) String() string { return "square" }
+
+type Circle struct{ R int }
+
+func (c Circle) Area() int { return 3 * c.R * c.R }
+
+var registered = register()
+
+func register() int { return 1 }
+
+func shout(s string) string { return strings.ToUpper(s) }
+
+var unusedVar = 2
+
+func main() {
+	shapes := []Shape{Square{2}}
+	println(shapes[0].Area(), b.Used())
+}
+`,
+		"b/b.go": `package b
+
+func Used() int { return helper() }
+
+func helper() int { return 1 }
+
+func Unused() int { return 2 }
+
+//lunar:export
+func Exported() {}
+`,
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	prog, err := Load(&packages.Config{Dir: dir}, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkgs := []*Package{prog.Package("example.com/m"), prog.Package("example.com/m/b")}
+
+	p := NewProgramParser(prog)
+	p.EliminateDeadCode(pkgs)
+	buf := &bytes.Buffer{}
+	if err := p.WriteBundle(buf, pkgs, ""); err != nil {
+		t.Fatalf("Got error: %v", err)
+	}
+	lua := buf.String()
+
+	for _, s := range []string{
+		"_main.Square = ",
+		"_main.Square.Area = ",
+		"_main.Square.String = ",
+		"_main.registered = ",
+		"_main.register = ",
+		"_main.main = ",
+		"_b.Used = ",
+		"_b.helper = ",
+		"_b.Exported = ",
+		"local _b = ",
+		"function builtins.run_inits()",
+	} {
+		if !strings.Contains(lua, s) {
+			t.Errorf("Reachable %q was left out", s)
+		}
+	}
+	for _, s := range []string{
+		"_main.Square.Perimeter = ",
+		"_main.Circle",
+		"_main.unusedVar",
+		"_b.Unused = ",
+		"function builtins.mapLength(",
+		`builtins.pkgs["fmt"] = `,
+		"_main.shout = ",
+		"local _strings = ",
+		`builtins.pkgs["strings"] = `,
+	} {
+		if strings.Contains(lua, s) {
+			t.Errorf("Unreachable %q was written", s)
+		}
+	}
+}
+
+func TestWriteUsedBuiltins(t *testing.T) {
+	buf := &bytes.Buffer{}
+	code := "local _strings = builtins.pkgs[\"strings\"]\nx = builtins.append(x, 1)\n"
+	if _, err := WriteUsedBuiltins(buf, Lua51, code); err != nil {
+		t.Fatalf("Got error: %v", err)
+	}
+	lua := buf.String()
+
+	for _, s := range []string{
+		"function builtins.append(",
+		`builtins.pkgs["strings"] = `,
+		"function builtins.traceback(",
+		"local function run_added_inits()",
+	} {
+		if !strings.Contains(lua, s) {
+			t.Errorf("Used builtin %q was left out", s)
+		}
+	}
+	for _, s := range []string{
+		"function builtins.mapLength(",
+		"function builtins.band(",
+		"local function bitop(",
+		`builtins.pkgs["sort"] = `,
+	} {
+		if strings.Contains(lua, s) {
+			t.Errorf("Unused builtin %q was written", s)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package lunar
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/printer"
+	"go/token"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Diagnostic codes identify the kind of problem a diagnostic reports.
+// They are stable, so tools can rely on them.
+const (
+	CodeUnsupported = "unsupported" // Go construct without a Lua translation
+	CodeInvalid     = "invalid"     // malformed or invalid Go code
+	CodeTarget      = "target"      // construct not supported by the target
+	CodeInternal    = "internal"    // missing type information
+)
+
+// Severity is the severity of a diagnostic.
+type Severity int
+
+const (
+	SeverityError Severity = iota
+	SeverityWarning
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityError:
+		return "error"
+	case SeverityWarning:
+		return "warning"
+	}
+	return fmt.Sprintf("Severity(%d)", int(s))
+}
+
+// A Diagnostic describes a problem found in the Go code being translated.
+type Diagnostic struct {
+	Pos      token.Position // invalid if unknown
+	Severity Severity
+	Code     string
+	Message  string
+	Snippet  string // first line of the offending source code
+}
+
+func (d Diagnostic) Error() string {
+	if d.Pos.IsValid() {
+		return fmt.Sprintf("%s: %s", d.Pos, d.Message)
+	}
+	return d.Message
+}
+
+// MarshalJSON encodes the diagnostic as a flat JSON object.
+func (d Diagnostic) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		File     string `json:"file"`
+		Line     int    `json:"line"`
+		Column   int    `json:"column"`
+		Severity string `json:"severity"`
+		Code     string `json:"code"`
+		Message  string `json:"message"`
+		Snippet  string `json:"snippet"`
+	}{d.Pos.Filename, d.Pos.Line, d.Pos.Column, d.Severity.String(), d.Code, d.Message, d.Snippet})
+}
+
+// Diagnostics is a list of diagnostics, ordered by position.
+type Diagnostics []Diagnostic
+
+func (d Diagnostics) Error() string {
+	lines := make([]string, len(d))
+	for i, diag := range d {
+		lines[i] = diag.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Errors returns the diagnostics with error severity.
+func (d Diagnostics) Errors() Diagnostics {
+	var errs Diagnostics
+	for _, diag := range d {
+		if diag.Severity == SeverityError {
+			errs = append(errs, diag)
+		}
+	}
+	return errs
+}
+
+// WriteJSON writes the diagnostics as a JSON array.
+func (d Diagnostics) WriteJSON(w io.Writer) error {
+	if d == nil {
+		d = Diagnostics{}
+	}
+	return json.NewEncoder(w).Encode([]Diagnostic(d))
+}
+
+// Diagnostics returns the diagnostics found by the last call to ParseNode,
+// ordered by position.
+func (p *Parser) Diagnostics() Diagnostics {
+	return p.diags
+}
+
+// addDiagnostic records a diagnostic for node, keeping the diagnostics
+// ordered by position.
+func (p *Parser) addDiagnostic(node ast.Node, severity Severity, code, msg string) Diagnostic {
+	d := Diagnostic{Severity: severity, Code: code, Message: msg}
+	if p.prog != nil && node != nil {
+		d.Pos = p.prog.Fset.Position(node.Pos())
+		d.Snippet = p.snippet(node)
+	}
+	i := sort.Search(len(p.diags), func(i int) bool {
+		return positionLess(d.Pos, p.diags[i].Pos)
+	})
+	p.diags = append(p.diags, Diagnostic{})
+	copy(p.diags[i+1:], p.diags[i:])
+	p.diags[i] = d
+	return d
+}
+
+func (p *Parser) addError(e ParseError) {
+	p.addDiagnostic(e.node, SeverityError, e.code, e.err)
+}
+
+// recoverError records a ParseError as a diagnostic so parsing can
+// continue with the next declaration or statement. The declaration or
+// statement that failed is left out of the output.
+func (p *Parser) recoverError() {
+	e := recover()
+	if e == nil {
+		return
+	}
+	perr, ok := e.(ParseError)
+	if !ok {
+		panic(e)
+	}
+	p.addError(perr)
+}
+
+// snippet returns the first line of the source code of node.
+func (p *Parser) snippet(node ast.Node) string {
+	var buf bytes.Buffer
+	if err := printer.Fprint(&buf, p.prog.Fset, node); err != nil {
+		return ""
+	}
+	line := buf.String()
+	if i := strings.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	return line
+}
+
+func positionLess(a, b token.Position) bool {
+	if a.Filename != b.Filename {
+		return a.Filename < b.Filename
+	}
+	if a.Line != b.Line {
+		return a.Line < b.Line
+	}
+	return a.Column < b.Column
+}
@@ -0,0 +1,84 @@
+package lunar
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const diagnosticsSrc = `
+func f() {}
+
+func g() {
+	go f()
+	x := 1
+	_ = x
+}
+
+func h() {
+	for {
+		go f()
+	}
+}
+`
+
+func TestDiagnostics(t *testing.T) {
+	_, _, err := ParsePackage(diagnosticsSrc)
+	diags, ok := err.(Diagnostics)
+	if !ok {
+		t.Fatalf("Got error %#v, want Diagnostics", err)
+	}
+	want := []struct {
+		Line    int
+		Snippet string
+	}{
+		{6, "go f()"},
+		{13, "go f()"},
+	}
+	if len(diags) != len(want) {
+		t.Fatalf("Got %d diagnostics, want %d: %v", len(diags), len(want), diags)
+	}
+	for i, d := range diags {
+		if d.Pos.Filename != "dummy.go" || d.Pos.Line != want[i].Line || d.Pos.Column != 2+i {
+			t.Errorf("%d. Got position %s, want dummy.go:%d:%d", i, d.Pos, want[i].Line, 2+i)
+		}
+		if d.Severity != SeverityError || d.Code != CodeUnsupported {
+			t.Errorf("%d. Got severity %s and code %q", i, d.Severity, d.Code)
+		}
+		if d.Snippet != want[i].Snippet {
+			t.Errorf("%d. Got snippet %q, want %q", i, d.Snippet, want[i].Snippet)
+		}
+	}
+
+	if want := "dummy.go:6:2: Unhandled statement type *ast.GoStmt"; !strings.HasPrefix(err.Error(), want) {
+		t.Errorf("Got error string %q, want prefix %q", err.Error(), want)
+	}
+}
+
+func TestDiagnosticsJSON(t *testing.T) {
+	diags := Diagnostics{{
+		Severity: SeverityError,
+		Code:     CodeUnsupported,
+		Message:  "Unhandled statement type *ast.GoStmt",
+		Snippet:  "go f()",
+	}}
+	diags[0].Pos.Filename = "dummy.go"
+	diags[0].Pos.Line = 6
+	diags[0].Pos.Column = 2
+
+	buf := &bytes.Buffer{}
+	if err := diags.WriteJSON(buf); err != nil {
+		t.Fatalf("Got error: %v", err)
+	}
+	want := `[{"file":"dummy.go","line":6,"column":2,"severity":"error","code":"unsupported",` +
+		`"message":"Unhandled statement type *ast.GoStmt","snippet":"go f()"}]` + "\n"
+	if buf.String() != want {
+		t.Errorf("Got JSON %s, want %s", buf.String(), want)
+	}
+
+	buf.Reset()
+	Diagnostics(nil).WriteJSON(buf)
+	if buf.String() != "[]\n" {
+		t.Errorf("Got JSON %s for no diagnostics, want []", buf.String())
+	}
+}
@@ -0,0 +1,326 @@
+package lunar
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"regexp"
+	"strings"
+)
+
+// Declarations can be annotated with directives, comments of the form
+// //lunar:name [argument] in their doc comment:
+//
+//   - //lunar:export keeps a declaration when eliminating dead code.
+//   - //lunar:inline inlines the calls of a function whose body is a
+//     single return statement with one result; see inlineCall. Other
+//     functions are still called, with a not-inlined warning.
+//   - //lunar:name NAME sets the name a function, variable or constant is
+//     written as in its package table.
+//   - //lunar:extern declares a function, method or variable implemented in
+//     Lua. Nothing is written for it, and functions and variables are
+//     referred to as the global of their name, which can be a dotted path
+//     like string.format.
+//   - //lunar:global [NAME] also assigns a function to the global NAME,
+//     which defaults to the name of the function.
+//   - //lunar:noinit leaves a variable uninitialized, or an init function
+//     unregistered.
+//   - //lunar:ignore leaves out a declaration.
+//
+// Directives of grouped declarations apply to all of their specs. Unknown
+// or misplaced directives are errors.
+
+// directivePrefix starts the comments holding directives.
+const directivePrefix = "//lunar:"
+
+// declKind is a kind of declaration directives can be placed on.
+type declKind int
+
+const (
+	declFunc declKind = 1 << iota
+	declMethod
+	declInit
+	declVar
+	declConst
+	declType
+	declImport
+	declLocal // declarations in function bodies
+)
+
+var declKindNames = map[declKind]string{
+	declFunc:   "functions",
+	declMethod: "methods",
+	declInit:   "init functions",
+	declVar:    "variables",
+	declConst:  "constants",
+	declType:   "types",
+	declImport: "imports",
+	declLocal:  "local declarations",
+}
+
+// directiveKinds are the kinds of declarations each directive is allowed
+// on.
+var directiveKinds = map[string]declKind{
+	"export": declFunc | declMethod | declVar | declConst | declType,
+	"inline": declFunc | declMethod,
+	"name":   declFunc | declVar | declConst,
+	"extern": declFunc | declMethod | declVar,
+	"global": declFunc,
+	"noinit": declVar | declInit,
+	"ignore": declFunc | declMethod | declInit | declVar | declConst | declType | declImport,
+}
+
+// directive is a directive read from a comment.
+type directive struct {
+	c    *ast.Comment
+	name string
+	arg  string
+}
+
+// declDirectives are the directives of a declaration that change how it
+// is written.
+type declDirectives struct {
+	name   string // set by //lunar:name
+	export bool
+	inline bool
+	extern bool
+	global string // set by //lunar:global; see globalName
+	noinit bool
+	ignore bool
+}
+
+// globalName returns the name of the global the function is assigned to
+// by //lunar:global, if it is named name, or "" if it is not.
+func (dirs *declDirectives) globalName(name string) string {
+	if dirs.global == "." {
+		return name
+	}
+	return dirs.global
+}
+
+// readDirectives returns the directives in the comment groups.
+func readDirectives(docs ...*ast.CommentGroup) []directive {
+	var ds []directive
+	for _, doc := range docs {
+		if doc == nil {
+			continue
+		}
+		for _, c := range doc.List {
+			if !strings.HasPrefix(c.Text, directivePrefix) {
+				continue
+			}
+			text := c.Text[len(directivePrefix):]
+			name, arg := text, ""
+			if i := strings.IndexAny(text, " \t"); i >= 0 {
+				name, arg = text[:i], strings.TrimSpace(text[i:])
+			}
+			ds = append(ds, directive{c: c, name: name, arg: arg})
+		}
+	}
+	return ds
+}
+
+// collectDirectives returns the declDirectives set by ds, or nil if there
+// are none.
+func collectDirectives(ds []directive) *declDirectives {
+	var dirs *declDirectives
+	for _, d := range ds {
+		if dirs == nil {
+			dirs = &declDirectives{}
+		}
+		switch d.name {
+		case "name":
+			dirs.name = d.arg
+		case "export":
+			dirs.export = true
+		case "inline":
+			dirs.inline = true
+		case "extern":
+			dirs.extern = true
+		case "global":
+			dirs.global = d.arg
+			if d.arg == "" {
+				dirs.global = "."
+			}
+		case "noinit":
+			dirs.noinit = true
+		case "ignore":
+			dirs.ignore = true
+		}
+	}
+	return dirs
+}
+
+// luaNamePattern matches Lua names and keywords.
+var luaNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// isLuaName reports whether s can be used as a Lua name.
+func isLuaName(s string) bool {
+	return luaNamePattern.MatchString(s) && !luaKeywordSet[s]
+}
+
+// isLuaPath reports whether s is a dotted path of Lua names.
+func isLuaPath(s string) bool {
+	for _, name := range strings.Split(s, ".") {
+		if !isLuaName(name) {
+			return false
+		}
+	}
+	return true
+}
+
+// declDirectivesOf checks the directives in the comment groups of a
+// declaration of the given kind declaring n names, and returns what they
+// set. Their result is never nil.
+func (p *Parser) declDirectivesOf(kind declKind, n int, docs ...*ast.CommentGroup) *declDirectives {
+	ds := readDirectives(docs...)
+	seen := make(map[string]bool)
+	for _, d := range ds {
+		kinds, ok := directiveKinds[d.name]
+		if !ok {
+			p.errorf(d.c, CodeInvalid, "Unknown directive %s%s", directivePrefix, d.name)
+		}
+		if kinds&kind == 0 {
+			p.errorf(d.c, CodeInvalid, "Directive %s%s is not allowed on %s", directivePrefix, d.name, declKindNames[kind])
+		}
+		if seen[d.name] {
+			p.errorf(d.c, CodeInvalid, "Duplicate directive %s%s", directivePrefix, d.name)
+		}
+		seen[d.name] = true
+		switch d.name {
+		case "name":
+			if d.arg == "" {
+				p.errorf(d.c, CodeInvalid, "Directive %sname needs a name", directivePrefix)
+			}
+			if n != 1 {
+				p.errorf(d.c, CodeInvalid, "Directive %sname cannot name %d declarations", directivePrefix, n)
+			}
+		case "global":
+			// The name is optional
+		default:
+			if d.arg != "" {
+				p.errorf(d.c, CodeInvalid, "Directive %s%s takes no argument", directivePrefix, d.name)
+			}
+		}
+	}
+
+	dirs := collectDirectives(ds)
+	if dirs == nil {
+		return &declDirectives{}
+	}
+	// External names can refer to fields of globals
+	if dirs.name != "" && !isLuaName(dirs.name) && !(dirs.extern && isLuaPath(dirs.name)) {
+		p.errorf(ds[0].c, CodeInvalid, "Invalid Lua name %q", dirs.name)
+	}
+	if dirs.global != "" && dirs.global != "." && !isLuaName(dirs.global) {
+		p.errorf(ds[0].c, CodeInvalid, "Invalid Lua name %q", dirs.global)
+	}
+	if dirs.extern && (dirs.global != "" || seen["inline"]) {
+		p.errorf(ds[0].c, CodeInvalid, "Directive %sextern cannot be combined with %sglobal or %sinline", directivePrefix, directivePrefix, directivePrefix)
+	}
+	return dirs
+}
+
+// funcDirectives returns the directives of the function declaration d.
+func (p *Parser) funcDirectives(d *ast.FuncDecl) *declDirectives {
+	kind := declFunc
+	switch {
+	case d.Recv != nil:
+		kind = declMethod
+	case d.Name.Name == "init":
+		kind = declInit
+	}
+	return p.declDirectivesOf(kind, 1, d.Doc)
+}
+
+// specDirectives returns the directives of spec, declared by d.
+func (p *Parser) specDirectives(d *ast.GenDecl, spec ast.Spec, topLevel bool) *declDirectives {
+	kind, n := declLocal, 1
+	switch d.Tok {
+	case token.TYPE:
+		kind = declType
+	case token.IMPORT:
+		kind = declImport
+	case token.CONST:
+		kind = declConst
+	case token.VAR:
+		kind = declVar
+	}
+	if s, ok := spec.(*ast.ValueSpec); ok {
+		n = len(s.Names)
+	}
+	if !topLevel && d.Tok != token.IMPORT {
+		kind = declLocal
+	}
+	var doc *ast.CommentGroup
+	switch s := spec.(type) {
+	case *ast.TypeSpec:
+		doc = s.Doc
+	case *ast.ValueSpec:
+		doc = s.Doc
+	case *ast.ImportSpec:
+		doc = s.Doc
+	}
+	return p.declDirectivesOf(kind, n, d.Doc, doc)
+}
+
+// objDirectives returns the directives of the declaration of the
+// package-level function, variable or constant obj, or nil if it has none.
+func (p *Parser) objDirectives(obj types.Object) *declDirectives {
+	if p.prog == nil || obj.Pkg() == nil || obj.Parent() != obj.Pkg().Scope() {
+		return nil
+	}
+	if p.directives == nil {
+		p.directives = make(map[*types.Package]map[types.Object]*declDirectives)
+	}
+	index, ok := p.directives[obj.Pkg()]
+	if !ok {
+		index = make(map[types.Object]*declDirectives)
+		if pkg := p.prog.PackageOf(obj.Pos()); pkg != nil {
+			for _, f := range pkg.Files {
+				for _, decl := range f.Decls {
+					switch decl := decl.(type) {
+					case *ast.FuncDecl:
+						if dirs := collectDirectives(readDirectives(decl.Doc)); dirs != nil && decl.Recv == nil {
+							index[pkg.Defs[decl.Name]] = dirs
+						}
+					case *ast.GenDecl:
+						for _, spec := range decl.Specs {
+							spec, ok := spec.(*ast.ValueSpec)
+							if !ok {
+								continue
+							}
+							if dirs := collectDirectives(readDirectives(decl.Doc, spec.Doc)); dirs != nil {
+								for _, name := range spec.Names {
+									index[pkg.Defs[name]] = dirs
+								}
+							}
+						}
+					}
+				}
+			}
+		}
+		p.directives[obj.Pkg()] = index
+	}
+	return index[obj]
+}
+
+// declName returns the name the package-level object obj is written as.
+func (p *Parser) declName(obj types.Object) string {
+	if dirs := p.objDirectives(obj); dirs != nil && dirs.name != "" {
+		return dirs.name
+	}
+	return obj.Name()
+}
+
+// declRef returns the expression referring to the package-level object
+// obj: the field of its name in pkgTable, or the global of its name if it
+// is external or pkgTable is nil.
+func (p *Parser) declRef(obj types.Object, pkgTable luaExpr) luaExpr {
+	name := p.declName(obj)
+	if dirs := p.objDirectives(obj); pkgTable == nil || dirs != nil && dirs.extern {
+		names := strings.Split(name, ".")
+		return luaPath(names[0], names[1:]...)
+	}
+	return &luaSelectorExpr{x: pkgTable, name: name}
+}
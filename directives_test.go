@@ -0,0 +1,85 @@
+package lunar
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDirectives(t *testing.T) {
+	const src = `
+//lunar:name print_line
+func PrintLine(s string) { Log(s) }
+
+//lunar:extern
+//lunar:name string.format
+func Format(format string, args ...interface{}) string { return "" }
+
+//lunar:extern
+func Log(s string) {}
+
+//lunar:global
+func Start() { PrintLine(Format("%d", Count)) }
+
+//lunar:global on_load
+func Load() {}
+
+//lunar:name count
+var Count = 1
+
+//lunar:noinit
+var Config map[string]string
+
+//lunar:extern
+var Env map[string]string
+
+//lunar:ignore
+const Debug = true
+
+//lunar:noinit
+func init() { Config = Env }
+`
+	lua, _, err := ParsePackage(src)
+	if err != nil {
+		t.Fatalf("Got error: %v", err)
+	}
+	for _, s := range []string{
+		"_dummy.print_line = function(s)\n\tLog(s)\nend",
+		"_dummy.Start = function()\n\t_dummy.print_line(string.format(\"%d\", _dummy.count))\nend\n_G.Start = _dummy.Start",
+		"_G.on_load = _dummy.Load",
+		"_dummy.count = 1",
+	} {
+		if !strings.Contains(lua, s) {
+			t.Errorf("Lua %q does not contain %q", lua, s)
+		}
+	}
+	for _, s := range []string{"lunar:", "dummy.Format", "dummy.Log", "Config", "Env", "Debug", "add_init"} {
+		if strings.Contains(lua, s) {
+			t.Errorf("Lua %q contains %q", lua, s)
+		}
+	}
+}
+
+func TestInvalidDirectives(t *testing.T) {
+	tests := []struct {
+		Go, Err string
+	}{
+		{"//lunar:unknown\nfunc f() {}", "Unknown directive //lunar:unknown"},
+		{"//lunar:global\nvar x int", "Directive //lunar:global is not allowed on variables"},
+		{"type T int\n\n//lunar:name g\nfunc (T) f() {}", "Directive //lunar:name is not allowed on methods"},
+		{"//lunar:name\nfunc f() {}", "Directive //lunar:name needs a name"},
+		{"//lunar:name end\nfunc f() {}", `Invalid Lua name "end"`},
+		{"//lunar:name a.b\nfunc f() {}", `Invalid Lua name "a.b"`},
+		{"//lunar:name x\nvar a, b int", "Directive //lunar:name cannot name 2 declarations"},
+		{"//lunar:extern x\nfunc f() {}", "Directive //lunar:extern takes no argument"},
+		{"//lunar:extern\n//lunar:global\nfunc f() {}", "Directive //lunar:extern cannot be combined with //lunar:global or //lunar:inline"},
+		{"func f() {\n\t//lunar:ignore\n\tvar x int\n\t_ = x\n}", "Directive //lunar:ignore is not allowed on local declarations"},
+	}
+	for i, test := range tests {
+		_, _, err := ParsePackage(test.Go)
+		if err == nil {
+			t.Errorf("%d. Go %q resulted in no error; want %q", i, test.Go, test.Err)
+		} else if !strings.Contains(err.Error(), test.Err) {
+			t.Errorf("%d. Go %q resulted in error %v; want %q", i, test.Go, err, test.Err)
+		}
+	}
+}
@@ -0,0 +1,453 @@
+package lunar
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+)
+
+// Calls of functions and methods declared with the //lunar:inline
+// directive, and of small functions and methods if the parser optimizes
+// its output, are replaced with the bodies of the functions. Only bodies
+// consisting of a single return statement with one result can be written
+// in place of a call, and only the bodies of functions declared in the
+// package of the call, whose locals they may refer to.
+//
+// Go evaluates the arguments of a call before the body of the function,
+// while Lua evaluates the arguments written in place of the parameters
+// where they are used. A call is only inlined if that makes no difference:
+// arguments other than literals and locals must be used exactly once, and
+// if evaluating the arguments or the body may have side effects, in the
+// order of the arguments and before anything else the body reads.
+
+// maxAutoInline is the size, in syntax tree nodes, of the largest function
+// bodies inlined without the //lunar:inline directive.
+const maxAutoInline = 12
+
+// An inlineParam is a parameter of a function whose body is inlined.
+type inlineParam struct {
+	uses []*luaIdent // placeholders for the uses of the parameter
+}
+
+// use returns a placeholder for a use of the parameter.
+func (ip *inlineParam) use(name string) luaExpr {
+	id := luaIdentOf(name)
+	ip.uses = append(ip.uses, id)
+	return id
+}
+
+// inlineCall returns the body of the function called by e with the
+// arguments of call, its Lua translation, in place of the parameters, or
+// nil if the call is not inlined.
+func (p *Parser) inlineCall(e *ast.CallExpr, call *luaCallExpr) luaExpr {
+	if p.prog == nil || e.Ellipsis.IsValid() {
+		return nil
+	}
+	fn, decl := p.calleeDecl(e)
+	if decl == nil || p.inlining[fn] {
+		return nil
+	}
+	dirs := collectDirectives(readDirectives(decl.Doc))
+	directive := dirs != nil && dirs.inline
+	if !directive && !p.optimize {
+		return nil
+	}
+	res := inlinedResult(decl)
+	if res == nil {
+		return nil
+	}
+
+	pkg := p.nodePkg(decl)
+	var params []types.Object
+	if decl.Recv != nil {
+		field := decl.Recv.List[0]
+		if len(field.Names) == 0 {
+			params = append(params, nil)
+		}
+		for _, name := range field.Names {
+			params = append(params, pkg.Defs[name])
+		}
+	}
+	for _, field := range decl.Type.Params.List {
+		if len(field.Names) == 0 {
+			params = append(params, nil)
+		}
+		for _, name := range field.Names {
+			params = append(params, pkg.Defs[name])
+		}
+	}
+	args := call.args
+	if call.method != "" {
+		args = append([]luaExpr{call.fn}, args...)
+	}
+	if len(args) != len(params) || !p.canInline(pkg, res, params) {
+		return nil
+	}
+
+	inlined := make([]*inlineParam, len(params))
+	for i := range inlined {
+		inlined[i] = &inlineParam{}
+	}
+	body := p.parseInlined(fn, res, params, inlined)
+	if body == nil {
+		return nil
+	}
+
+	uses := make(map[*luaIdent]int)
+	for i, param := range inlined {
+		for _, id := range param.uses {
+			uses[id] = i
+		}
+	}
+	var events []inlineEvent
+	size := 0
+	valid := true
+	walkLua(body, func(n luaNode) bool {
+		size++
+		if id, ok := n.(*luaIdent); ok {
+			if _, ok := uses[id]; !ok && isParamName(id.name, params) {
+				// A parameter referred to other than by a placeholder
+				valid = false
+			}
+		}
+		return true
+	})
+	if !valid || !evalEvents(body, uses, false, &events) {
+		return nil
+	}
+	calls := false
+	for _, ev := range events {
+		calls = calls || ev.call
+	}
+	if !directive && (calls || size > maxAutoInline) {
+		return nil
+	}
+	for _, arg := range args {
+		calls = calls || hasCalls(arg)
+	}
+	if !inlineOrderKept(events, args, inlined, calls) {
+		return nil
+	}
+
+	// The body is mapped to the position of the call, and the arguments to
+	// their own
+	walkLua(body, func(n luaNode) bool {
+		n.setPos(token.NoPos)
+		return true
+	})
+	subst := func(x luaExpr) luaExpr {
+		id, ok := x.(*luaIdent)
+		if !ok {
+			return x
+		}
+		i, ok := uses[id]
+		if !ok {
+			return x
+		}
+		switch arg := args[i].(type) {
+		case *luaLit:
+			return &luaLit{luaPos: arg.luaPos, text: arg.text}
+		case *luaIdent:
+			return &luaIdent{luaPos: arg.luaPos, name: arg.name}
+		}
+		return args[i]
+	}
+	rewriteExprsIn(body, subst)
+	return subst(body)
+}
+
+// calleeDecl returns the function or concrete method called by e, and its
+// declaration if it is declared in the package of e.
+func (p *Parser) calleeDecl(e *ast.CallExpr) (*types.Func, *ast.FuncDecl) {
+	pkg := p.nodePkg(e)
+	fn := p.calledFunc(e)
+	if sel, ok := e.Fun.(*ast.SelectorExpr); ok && fn == nil {
+		s := pkg.Selections[sel]
+		if s == nil || s.Kind() != types.MethodVal || types.IsInterface(s.Recv()) || len(s.Index()) != 1 {
+			return nil, nil
+		}
+		fn = s.Obj().(*types.Func)
+	}
+	if fn == nil || fn.Pkg() != pkg.Pkg {
+		return nil, nil
+	}
+
+	if p.funcDecls == nil {
+		p.funcDecls = make(map[*types.Package]map[*types.Func]*ast.FuncDecl)
+	}
+	decls := p.funcDecls[pkg.Pkg]
+	if decls == nil {
+		decls = make(map[*types.Func]*ast.FuncDecl)
+		for _, f := range pkg.Files {
+			for _, d := range f.Decls {
+				// Functions implemented in Lua have stub bodies
+				d, ok := d.(*ast.FuncDecl)
+				if !ok || d.Body == nil {
+					continue
+				}
+				if dirs := collectDirectives(readDirectives(d.Doc)); dirs == nil || !dirs.extern {
+					if obj, ok := pkg.Defs[d.Name].(*types.Func); ok {
+						decls[obj] = d
+					}
+				}
+			}
+		}
+		p.funcDecls[pkg.Pkg] = decls
+	}
+	return fn, decls[fn]
+}
+
+// inlinedResult returns the result of the function declared by d if its
+// body can be inlined: if it consists of a single return statement with a
+// single result, and the function is not variadic.
+func inlinedResult(d *ast.FuncDecl) ast.Expr {
+	if d.Body == nil || len(d.Body.List) != 1 {
+		return nil
+	}
+	ret, ok := d.Body.List[0].(*ast.ReturnStmt)
+	if !ok || len(ret.Results) != 1 {
+		return nil
+	}
+	if params := d.Type.Params.List; len(params) > 0 {
+		if _, ok := params[len(params)-1].Type.(*ast.Ellipsis); ok {
+			return nil
+		}
+	}
+	return ret.Results[0]
+}
+
+// canInline reports whether the result expression res of a function of
+// pkg with the given parameters can be written in another function of pkg.
+// It may only refer to the parameters, to predeclared objects and to the
+// declarations of pkg, which are visible from all of its files. Functions
+// and composite literals are not inlined.
+func (p *Parser) canInline(pkg *Package, res ast.Expr, params []types.Object) bool {
+	ok := true
+	ast.Inspect(res, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.FuncLit, *ast.CompositeLit:
+			ok = false
+		case *ast.Ident:
+			obj := pkg.Uses[n]
+			switch {
+			case obj == nil || obj.Pkg() == nil:
+			case isField(obj):
+			case obj.Pkg() != pkg.Pkg:
+				ok = false
+			default:
+				if _, isPkg := obj.(*types.PkgName); isPkg {
+					ok = false
+				}
+			}
+		}
+		if x, isExpr := n.(ast.Expr); isExpr {
+			if typ := pkg.TypeOf(x); typ != nil && refersToOtherPkg(typ, pkg.Pkg, nil) {
+				// Zero values and boxed values refer to their type
+				ok = false
+			}
+		}
+		return ok
+	})
+	return ok
+}
+
+// isField reports whether obj is a struct field or a method.
+func isField(obj types.Object) bool {
+	switch obj := obj.(type) {
+	case *types.Var:
+		return obj.IsField()
+	case *types.Func:
+		return obj.Type().(*types.Signature).Recv() != nil
+	}
+	return false
+}
+
+// refersToOtherPkg reports whether typ, or the type of a value nested in
+// values of typ, is a named type declared in another package than pkg.
+func refersToOtherPkg(typ types.Type, pkg *types.Package, seen map[*types.Named]bool) bool {
+	switch t := typ.(type) {
+	case *types.Named:
+		if t.Obj().Pkg() != nil && t.Obj().Pkg() != pkg {
+			return true
+		}
+		if seen[t] {
+			return false
+		}
+		if seen == nil {
+			seen = make(map[*types.Named]bool)
+		}
+		seen[t] = true
+		return refersToOtherPkg(t.Underlying(), pkg, seen)
+	case *types.Pointer:
+		return refersToOtherPkg(t.Elem(), pkg, seen)
+	case *types.Array:
+		return refersToOtherPkg(t.Elem(), pkg, seen)
+	case *types.Struct:
+		for i := 0; i < t.NumFields(); i++ {
+			if refersToOtherPkg(t.Field(i).Type(), pkg, seen) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseInlined returns the translation of the result expression res of
+// fn, with placeholders for the parameters recorded in inlined, or nil if
+// it cannot be translated. Diagnostics are left to the translation of the
+// declaration of fn.
+func (p *Parser) parseInlined(fn *types.Func, res ast.Expr, params []types.Object, inlined []*inlineParam) (x luaExpr) {
+	diags := append(Diagnostics(nil), p.diags...)
+	warnings, outer := p.warnings, p.inlineParams
+	p.warnings = nil
+	p.inlineParams = make(map[types.Object]*inlineParam)
+	for i, param := range params {
+		if param != nil {
+			p.inlineParams[param] = inlined[i]
+		}
+	}
+	if p.inlining == nil {
+		p.inlining = make(map[*types.Func]bool)
+	}
+	p.inlining[fn] = true
+	defer func() {
+		p.diags, p.warnings, p.inlineParams = diags, warnings, outer
+		delete(p.inlining, fn)
+		if e := recover(); e != nil {
+			if _, ok := e.(ParseError); !ok {
+				panic(e)
+			}
+			x = nil
+		}
+	}()
+	sig := fn.Type().(*types.Signature)
+	return p.parseExprTo(res, sig.Results().At(0).Type())
+}
+
+// isParamName reports whether name is the name of one of params.
+func isParamName(name string, params []types.Object) bool {
+	for _, param := range params {
+		if param != nil && param.Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// An inlineEvent is a step of the evaluation of an inlined body that
+// matters to the order of evaluation: the use of a parameter, or reading
+// state that the evaluation of the arguments may change.
+type inlineEvent struct {
+	param int  // index of the parameter used, or -1 for reads
+	cond  bool // whether the use is conditional
+	call  bool // whether the read is a call
+}
+
+// evalEvents appends the events of the evaluation of x to events, in the
+// order Lua evaluates them, with uses mapping the placeholders of the
+// parameters to their indexes. It reports false if x contains code whose
+// evaluation is not known.
+func evalEvents(x luaExpr, uses map[*luaIdent]int, cond bool, events *[]inlineEvent) bool {
+	read := func(call bool) {
+		*events = append(*events, inlineEvent{param: -1, cond: cond, call: call})
+	}
+	switch x := x.(type) {
+	case *luaIdent:
+		if i, ok := uses[x]; ok {
+			*events = append(*events, inlineEvent{param: i, cond: cond})
+		}
+	case *luaLit, *luaVararg:
+	case *luaParenExpr:
+		return evalEvents(x.x, uses, cond, events)
+	case *luaUnaryExpr:
+		if !evalEvents(x.x, uses, cond, events) {
+			return false
+		}
+		if x.op == "#" {
+			read(false)
+		}
+	case *luaBinaryExpr:
+		short := x.op == "and" || x.op == "or"
+		return evalEvents(x.x, uses, cond, events) && evalEvents(x.y, uses, cond || short, events)
+	case *luaSelectorExpr:
+		if !evalEvents(x.x, uses, cond, events) {
+			return false
+		}
+		read(false)
+	case *luaIndexExpr:
+		if !evalEvents(x.x, uses, cond, events) || !evalEvents(x.key, uses, cond, events) {
+			return false
+		}
+		read(false)
+	case *luaCallExpr:
+		if !evalEvents(x.fn, uses, cond, events) {
+			return false
+		}
+		for _, arg := range x.args {
+			if !evalEvents(arg, uses, cond, events) {
+				return false
+			}
+		}
+		read(true)
+	case *luaTableLit:
+		for _, item := range x.items {
+			if item.key != nil && !evalEvents(item.key, uses, cond, events) {
+				return false
+			}
+			if !evalEvents(item.value, uses, cond, events) {
+				return false
+			}
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// hasCalls reports whether evaluating x may call functions.
+func hasCalls(x luaExpr) bool {
+	calls := false
+	walkLua(x, func(n luaNode) bool {
+		switch n.(type) {
+		case *luaCallExpr, *luaCode, *luaRawExpr:
+			calls = true
+		}
+		return !calls
+	})
+	return calls
+}
+
+// inlineOrderKept reports whether evaluating an inlined body, with the
+// given events, evaluates the arguments as the call would. Literals, and
+// locals if nothing is called, can be evaluated any number of times at
+// any point. Other arguments must be used exactly once, unconditionally,
+// and if anything is called, in order before the body reads any state.
+func inlineOrderKept(events []inlineEvent, args []luaExpr, inlined []*inlineParam, calls bool) bool {
+	trivial := make([]bool, len(args))
+	for i, arg := range args {
+		switch arg.(type) {
+		case *luaLit:
+			trivial[i] = true
+		case *luaIdent:
+			trivial[i] = !calls
+		}
+		if !trivial[i] && len(inlined[i].uses) != 1 {
+			return false
+		}
+	}
+	next, reads := 0, false
+	for _, ev := range events {
+		switch {
+		case ev.param < 0:
+			reads = true
+		case trivial[ev.param]:
+		case ev.cond:
+			return false
+		case calls && (reads || ev.param < next):
+			return false
+		default:
+			next = ev.param + 1
+		}
+	}
+	return true
+}
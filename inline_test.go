@@ -0,0 +1,97 @@
+package lunar
+
+import (
+	"go/ast"
+	"testing"
+)
+
+func TestInline(t *testing.T) {
+	const decls = `
+type Point struct{ X, Y int }
+
+func (p *Point) GetX() int { return p.X }
+
+func (p *Point) Plus(n int) int { return p.X + n }
+
+//lunar:inline
+func add(a, b int) int { return a + b }
+
+//lunar:inline
+func twice(a int) int { return a + a }
+
+//lunar:inline
+func loop(n int) int { return loop(n) }
+
+func next() int { return len(Points) }
+
+var Points []Point
+`
+	tests := []struct {
+		Go, Lua, Optimized string
+	}{
+		// Small functions are only inlined when optimizing
+		{
+			"p := &Point{1, 2}; _ = p.GetX()",
+			"local p = setmetatable({ [\"X\"] = 1, [\"Y\"] = 2 }, {__index=_dummy.Point})\n_ = p:GetX()",
+			"local p = setmetatable({ [\"X\"] = 1, [\"Y\"] = 2 }, {__index=_dummy.Point})\n_ = p.X",
+		},
+		{
+			"x := 1; _ = add(x, 2)",
+			"local x = 1\n_ = x + 2",
+			"local x = 1\n_ = x + 2",
+		},
+		// Arguments are evaluated in order
+		{
+			"_ = add(next(), Points[0].X)",
+			"_ = _dummy.next() + (_dummy.Points[0 + 1] or setmetatable({ [\"X\"] = 0, [\"Y\"] = 0 }, {__index=_dummy.Point})).X",
+			"_ = _dummy.next() + (_dummy.Points[1] or setmetatable({ [\"X\"] = 0, [\"Y\"] = 0 }, {__index=_dummy.Point})).X",
+		},
+		// Plus would read p.X before calling next
+		{
+			"p := &Point{}; _ = p.Plus(next())",
+			"local p = setmetatable({ [\"X\"] = 0, [\"Y\"] = 0 }, {__index=_dummy.Point})\n_ = p:Plus(_dummy.next())",
+			"local p = setmetatable({ [\"X\"] = 0, [\"Y\"] = 0 }, {__index=_dummy.Point})\n_ = p:Plus(_dummy.next())",
+		},
+		// and only once
+		{
+			"_ = twice(next())",
+			"_ = _dummy.twice(_dummy.next())",
+			"_ = _dummy.twice(_dummy.next())",
+		},
+		{
+			"x := 3; _ = twice(x)",
+			"local x = 3\n_ = x + x",
+			"local x = 3\n_ = x + x",
+		},
+		// Inlined calls used as statements are assigned
+		{
+			"add(1, 2)",
+			"local _ = 1 + 2",
+			"local _ = 3",
+		},
+		// Recursive functions are inlined once
+		{
+			"_ = loop(1)",
+			"_ = _dummy.loop(1)",
+			"_ = _dummy.loop(1)",
+		},
+	}
+	get := func(f *ast.File) ast.Node {
+		return f.Decls[len(f.Decls)-1].(*ast.FuncDecl).Body
+	}
+	for i, test := range tests {
+		src := decls + "\nfunc testFunc() {" + test.Go + "}"
+		for _, opt := range []bool{false, true} {
+			want := test.Lua
+			if opt {
+				want = test.Optimized
+			}
+			lua, _, err := parseStrWith(func(p *Parser) { p.SetOptimize(opt) }, src, get)
+			if err != nil {
+				t.Errorf("%d. Go %q resulted in error: %v", i, test.Go, err)
+			} else if lua != want {
+				t.Errorf("%d. Go %q resulted in Lua %q with optimizations %v; want %q", i, test.Go, lua, opt, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// Package lua gives Go code compiled with lunar direct access to Lua
+// values. Its functions are compiled to the Lua operations they stand for,
+// and the package itself is never written; the Go implementations only
+// work on Tables.
+package lua
+
+// Table is a Lua table. Go code can index tables, range over them and
+// create them with composite literals like any map, which lunar writes as
+// tables too.
+type Table map[interface{}]interface{}
+
+// Multi is a list of values passed to or returned from a Lua function.
+// Calls of functions returning a Multi, such as Call, return their values
+// as multiple Lua values, which are only packed in a table when the Multi
+// is used as a value. Indexing, spreading or returning such a call uses
+// the values directly:
+//
+//	n := lua.Call(tonumber, s)[0]   // local n = (tonumber(s))
+//	lua.Call(print, lua.Vararg()...) // print(...)
+type Multi []interface{}
+
+// Global returns the value of the global variable name.
+func Global(name string) interface{} {
+	panic("lua: Global is only available in Lua")
+}
+
+// SetGlobal sets the global variable name to v.
+func SetGlobal(name string, v interface{}) {
+	panic("lua: SetGlobal is only available in Lua")
+}
+
+// Env returns the environment of the function fn, the table its globals
+// are looked up in: getfenv(fn) on Lua 5.1, LuaJIT and WoW, and its _ENV
+// upvalue from Lua 5.2, where functions without one use the global table.
+func Env(fn interface{}) Table {
+	panic("lua: Env is only available in Lua")
+}
+
+// SetEnv sets the environment of the function fn to env, with setfenv on
+// Lua 5.1, LuaJIT and WoW. From Lua 5.2, it replaces the _ENV upvalue of
+// fn using the debug library, and has no effect on functions without one,
+// which use no globals.
+func SetEnv(fn interface{}, env Table) {
+	panic("lua: SetEnv is only available in Lua")
+}
+
+// Call calls the Lua function fn with args and returns its results.
+func Call(fn interface{}, args ...interface{}) Multi {
+	panic("lua: Call is only available in Lua")
+}
+
+// Get returns x[key], which is subject to the metatable of x.
+func Get(x, key interface{}) interface{} {
+	return x.(Table)[key]
+}
+
+// Set sets x[key] to v, which is subject to the metatable of x.
+func Set(x, key, v interface{}) {
+	x.(Table)[key] = v
+}
+
+// Len returns #x, the length of a string or sequence, which is subject to
+// the metatable of x.
+func Len(x interface{}) int {
+	if s, ok := x.(string); ok {
+		return len(s)
+	}
+	n := 0
+	for x.(Table)[n+1] != nil {
+		n++
+	}
+	return n
+}
+
+// Pairs returns an iterator over the keys and values of t, ranged over
+// with pairs(t).
+func Pairs(t interface{}) func(yield func(key, v interface{}) bool) {
+	return func(yield func(key, v interface{}) bool) {
+		for k, v := range t.(Table) {
+			if !yield(k, v) {
+				return
+			}
+		}
+	}
+}
+
+// IPairs returns an iterator over the sequence t, ranged over with
+// ipairs(t). Indexes start at 1.
+func IPairs(t interface{}) func(yield func(i int, v interface{}) bool) {
+	return func(yield func(i int, v interface{}) bool) {
+		for i := 1; t.(Table)[i] != nil; i++ {
+			if !yield(i, t.(Table)[i]) {
+				return
+			}
+		}
+	}
+}
+
+// Vararg returns the values passed for the variadic parameter of the
+// enclosing function, ..., including those Go code cannot see because
+// they were passed from Lua. It can only be used in variadic functions.
+func Vararg() Multi {
+	panic("lua: Vararg is only available in Lua")
+}
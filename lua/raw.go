@@ -2,6 +2,29 @@ package lua
 
 type RawSource interface{}
 
+// Raw is replaced with the Lua code src, which should be a constant
+// string. The code is an expression, or statements if the call is a
+// statement. If src is not constant, the translation of its expression is
+// written instead, with a raw-expr warning.
 func Raw(src string) RawSource {
 	return src
 }
+
+// Expr returns the value of the Lua expression src, which must be a
+// constant string. In src, $1, $2 and so on stand for the Lua values of
+// args and $$ for a dollar sign:
+//
+//	n := lua.Expr("#$1 + $2", s, 1)
+//
+// Arguments are evaluated where they are used, and all of them must be.
+// Arguments that call functions must be used once, in the order they are
+// passed.
+func Expr(src string, args ...interface{}) interface{} {
+	panic("lua: Expr is only available in Lua")
+}
+
+// Stmt runs the Lua statements src, which must be a constant string
+// using the placeholders of Expr for args.
+func Stmt(src string, args ...interface{}) {
+	panic("lua: Stmt is only available in Lua")
+}
@@ -0,0 +1,420 @@
+package lunar
+
+import "go/token"
+
+// The parser translates Go to a syntax tree of Lua code rather than to
+// text. The tree is transformed by the passes in luaPasses, which lower
+// constructs Lua lacks, and then printed by printLua.
+
+// A luaNode is a node of a Lua syntax tree. A node with a valid position
+// maps the output it is printed to to that Go position, except for the
+// output of nested nodes with a position of their own.
+type luaNode interface {
+	Pos() token.Pos
+	setPos(pos token.Pos)
+}
+
+// A luaStmt is a Lua statement.
+type luaStmt interface {
+	luaNode
+	stmtNode()
+}
+
+// A luaExpr is a Lua expression.
+type luaExpr interface {
+	luaNode
+	exprNode()
+}
+
+// luaPos is embedded in nodes to record the Go position they were
+// translated from.
+type luaPos struct {
+	pos token.Pos
+}
+
+func (n *luaPos) Pos() token.Pos       { return n.pos }
+func (n *luaPos) setPos(pos token.Pos) { n.pos = pos }
+
+// setLuaPos sets the position of the statements that do not have one.
+func setLuaPos(stmts []luaStmt, pos token.Pos) {
+	for _, n := range stmts {
+		if !n.Pos().IsValid() {
+			n.setPos(pos)
+		}
+	}
+}
+
+// Expressions
+type (
+	// luaIdent is a local or global variable.
+	luaIdent struct {
+		luaPos
+		name string
+	}
+
+	// luaLit is a literal: nil, true, false, a number or a string.
+	luaLit struct {
+		luaPos
+		text string
+	}
+
+	// luaVararg is the vararg expression "...".
+	luaVararg struct {
+		luaPos
+	}
+
+	// luaParenExpr is a parenthesized expression. The printer adds the
+	// parentheses that precedence requires by itself.
+	luaParenExpr struct {
+		luaPos
+		x luaExpr
+	}
+
+	// luaUnaryExpr is a unary operation: not, -, # or ~.
+	luaUnaryExpr struct {
+		luaPos
+		op string
+		x  luaExpr
+	}
+
+	// luaBinaryExpr is a binary operation.
+	luaBinaryExpr struct {
+		luaPos
+		op   string
+		x, y luaExpr
+	}
+
+	// luaSelectorExpr is the field lookup x.name.
+	luaSelectorExpr struct {
+		luaPos
+		x    luaExpr
+		name string
+	}
+
+	// luaIndexExpr is the index lookup x[key].
+	luaIndexExpr struct {
+		luaPos
+		x, key luaExpr
+	}
+
+	// luaCallExpr is the call fn(args), or the method call fn:method(args) if
+	// method is set. The arguments of wrapping calls are never written one
+	// per line, so that a table argument wraps around them instead.
+	luaCallExpr struct {
+		luaPos
+		fn       luaExpr
+		method   string
+		args     []luaExpr
+		wrapping bool
+	}
+
+	// luaFuncLit is a function. The last parameter may be "...". One-line
+	// functions are written on a single line, and may only contain
+	// simple statements; see printSimpleStmt.
+	luaFuncLit struct {
+		luaPos
+		params  []string
+		body    []luaStmt
+		oneLine bool
+	}
+
+	// luaTableLit is a table constructor.
+	luaTableLit struct {
+		luaPos
+		items []luaItem
+	}
+
+	// luaRawExpr is the code of a lua.Raw call: its parts written one after
+	// another.
+	luaRawExpr struct {
+		luaPos
+		parts []luaExpr
+	}
+)
+
+// A luaItem is an item of a table constructor: [key] = value if key is
+// set, name = value if name is set, and a positional value otherwise.
+type luaItem struct {
+	key   luaExpr
+	name  string
+	value luaExpr
+}
+
+// Statements
+type (
+	// luaLocalStmt declares local variables.
+	luaLocalStmt struct {
+		luaPos
+		names  []string
+		values []luaExpr
+	}
+
+	// luaAssignStmt is an assignment.
+	luaAssignStmt struct {
+		luaPos
+		targets, values []luaExpr
+	}
+
+	// luaExprStmt is an expression used as a statement, which must be a
+	// call or raw code.
+	luaExprStmt struct {
+		luaPos
+		x luaExpr
+	}
+
+	// luaReturnStmt is a return statement.
+	luaReturnStmt struct {
+		luaPos
+		values []luaExpr
+	}
+
+	// luaIfStmt is an if statement with a clause for each of its if and elseif
+	// branches. One-line ifs may only contain simple statements.
+	luaIfStmt struct {
+		luaPos
+		clauses   []luaClause
+		elseBlock []luaStmt
+		oneLine   bool
+	}
+
+	// luaWhileStmt is a while loop. The post statements are run after the
+	// body on each iteration, including after continue statements.
+	luaWhileStmt struct {
+		luaPos
+		cond       luaExpr
+		body, post []luaStmt
+	}
+
+	// luaForInStmt is a generic for loop.
+	luaForInStmt struct {
+		luaPos
+		names []string
+		x     luaExpr
+		body  []luaStmt
+	}
+
+	// luaRepeatStmt is a repeat-until loop.
+	luaRepeatStmt struct {
+		luaPos
+		body []luaStmt
+		cond luaExpr
+	}
+
+	// luaDoStmt is a do block.
+	luaDoStmt struct {
+		luaPos
+		body []luaStmt
+	}
+
+	// luaBreakStmt breaks out of the innermost loop.
+	luaBreakStmt struct {
+		luaPos
+	}
+
+	// luaContinueStmt continues with the next iteration of the innermost loop.
+	// Lua has no such statement; it is lowered by lowerLoops.
+	luaContinueStmt struct {
+		luaPos
+	}
+
+	// luaGotoStmt jumps to a label.
+	luaGotoStmt struct {
+		luaPos
+		label string
+	}
+
+	// luaLabelStmt is a label.
+	luaLabelStmt struct {
+		luaPos
+		name string
+	}
+
+	// luaCommentStmt is a line comment, or a long comment if block is set.
+	luaCommentStmt struct {
+		luaPos
+		text  string
+		block bool
+	}
+
+	// luaBlankStmt is a number of blank lines.
+	luaBlankStmt struct {
+		luaPos
+		lines int
+	}
+)
+
+// A luaClause is the condition and body of a branch of an if statement.
+type luaClause struct {
+	cond luaExpr
+	body []luaStmt
+}
+
+// luaCode is Lua code written as is, as an expression or as statements,
+// such as the string arguments of lua.Raw and fixed runtime helpers. Code
+// spanning several lines is indented like other code unless raw is set.
+type luaCode struct {
+	luaPos
+	text string
+	raw  bool
+}
+
+func (*luaIdent) exprNode()        {}
+func (*luaLit) exprNode()          {}
+func (*luaVararg) exprNode()       {}
+func (*luaParenExpr) exprNode()    {}
+func (*luaUnaryExpr) exprNode()    {}
+func (*luaBinaryExpr) exprNode()   {}
+func (*luaSelectorExpr) exprNode() {}
+func (*luaIndexExpr) exprNode()    {}
+func (*luaCallExpr) exprNode()     {}
+func (*luaFuncLit) exprNode()      {}
+func (*luaTableLit) exprNode()     {}
+func (*luaRawExpr) exprNode()      {}
+func (*luaCode) exprNode()         {}
+
+func (*luaLocalStmt) stmtNode()    {}
+func (*luaAssignStmt) stmtNode()   {}
+func (*luaExprStmt) stmtNode()     {}
+func (*luaReturnStmt) stmtNode()   {}
+func (*luaIfStmt) stmtNode()       {}
+func (*luaWhileStmt) stmtNode()    {}
+func (*luaForInStmt) stmtNode()    {}
+func (*luaRepeatStmt) stmtNode()   {}
+func (*luaDoStmt) stmtNode()       {}
+func (*luaBreakStmt) stmtNode()    {}
+func (*luaContinueStmt) stmtNode() {}
+func (*luaGotoStmt) stmtNode()     {}
+func (*luaLabelStmt) stmtNode()    {}
+func (*luaCommentStmt) stmtNode()  {}
+func (*luaBlankStmt) stmtNode()    {}
+func (*luaCode) stmtNode()         {}
+
+// luaBlocks returns pointers to the statement lists directly contained in
+// n, such as the branches of an if statement or the body of a function,
+// so that passes can replace them.
+func luaBlocks(n luaNode) []*[]luaStmt {
+	switch n := n.(type) {
+	case *luaFuncLit:
+		return []*[]luaStmt{&n.body}
+	case *luaIfStmt:
+		blocks := make([]*[]luaStmt, 0, len(n.clauses)+1)
+		for i := range n.clauses {
+			blocks = append(blocks, &n.clauses[i].body)
+		}
+		return append(blocks, &n.elseBlock)
+	case *luaWhileStmt:
+		return []*[]luaStmt{&n.body, &n.post}
+	case *luaForInStmt:
+		return []*[]luaStmt{&n.body}
+	case *luaRepeatStmt:
+		return []*[]luaStmt{&n.body}
+	case *luaDoStmt:
+		return []*[]luaStmt{&n.body}
+	}
+	return nil
+}
+
+// luaExprs returns pointers to the expressions directly contained in n,
+// so that passes can replace them.
+func luaExprs(n luaNode) []*luaExpr {
+	var exprs []*luaExpr
+	list := func(xs []luaExpr) {
+		for i := range xs {
+			exprs = append(exprs, &xs[i])
+		}
+	}
+	switch n := n.(type) {
+	case *luaParenExpr:
+		exprs = append(exprs, &n.x)
+	case *luaUnaryExpr:
+		exprs = append(exprs, &n.x)
+	case *luaBinaryExpr:
+		exprs = append(exprs, &n.x, &n.y)
+	case *luaSelectorExpr:
+		exprs = append(exprs, &n.x)
+	case *luaIndexExpr:
+		exprs = append(exprs, &n.x, &n.key)
+	case *luaCallExpr:
+		exprs = append(exprs, &n.fn)
+		list(n.args)
+	case *luaTableLit:
+		for i := range n.items {
+			if n.items[i].key != nil {
+				exprs = append(exprs, &n.items[i].key)
+			}
+			exprs = append(exprs, &n.items[i].value)
+		}
+	case *luaRawExpr:
+		list(n.parts)
+	case *luaLocalStmt:
+		list(n.values)
+	case *luaAssignStmt:
+		list(n.targets)
+		list(n.values)
+	case *luaExprStmt:
+		exprs = append(exprs, &n.x)
+	case *luaReturnStmt:
+		list(n.values)
+	case *luaIfStmt:
+		for i := range n.clauses {
+			exprs = append(exprs, &n.clauses[i].cond)
+		}
+	case *luaWhileStmt:
+		exprs = append(exprs, &n.cond)
+	case *luaForInStmt:
+		exprs = append(exprs, &n.x)
+	case *luaRepeatStmt:
+		exprs = append(exprs, &n.cond)
+	}
+	return exprs
+}
+
+// walkLua calls f for n and, if f returns true, for each of the nodes n
+// contains, depth-first.
+func walkLua(n luaNode, f func(luaNode) bool) {
+	if !f(n) {
+		return
+	}
+	for _, x := range luaExprs(n) {
+		walkLua(*x, f)
+	}
+	for _, block := range luaBlocks(n) {
+		for _, s := range *block {
+			walkLua(s, f)
+		}
+	}
+}
+
+// isLuaNil reports whether x is the literal nil.
+func isLuaNil(x luaExpr) bool {
+	lit, ok := x.(*luaLit)
+	return ok && lit.text == "nil"
+}
+
+// Constructors for common nodes
+
+func luaIdentOf(name string) *luaIdent { return &luaIdent{name: name} }
+func luaLitOf(text string) *luaLit     { return &luaLit{text: text} }
+
+// luaStringOf returns the string literal with the value s.
+func luaStringOf(s string) *luaLit { return &luaLit{text: luaQuote(s)} }
+
+// luaPath returns the expression looking up the fields of a variable,
+// such as builtins.pkgs for luaPath("builtins", "pkgs").
+func luaPath(name string, fields ...string) luaExpr {
+	var x luaExpr = luaIdentOf(name)
+	for _, f := range fields {
+		x = &luaSelectorExpr{x: x, name: f}
+	}
+	return x
+}
+
+// luaCallOf returns the call of fn with args.
+func luaCallOf(fn luaExpr, args ...luaExpr) *luaCallExpr {
+	return &luaCallExpr{fn: fn, args: args}
+}
+
+// luaBuiltin returns the call of the builtin function name with args.
+func luaBuiltin(name string, args ...luaExpr) *luaCallExpr {
+	return luaCallOf(luaPath("builtins", name), args...)
+}
@@ -0,0 +1,219 @@
+package lunar
+
+import (
+	"go/token"
+	"strconv"
+)
+
+// luaPasses transform the Lua syntax tree of each chunk, in order, before
+// it is printed.
+var luaPasses = []func(p *Parser, chunk []luaStmt) []luaStmt{
+	(*Parser).lowerLoops,
+}
+
+// printChunk runs the passes on stmts, and the optimizations if enabled,
+// and writes the result to w.
+func (p *Parser) printChunk(w *Writer, stmts []luaStmt) {
+	for _, pass := range luaPasses {
+		stmts = pass(p, stmts)
+	}
+	if p.optimize {
+		for _, pass := range luaOptimizations {
+			stmts = pass(p, stmts)
+		}
+	}
+	printLua(w, stmts)
+}
+
+// rewriteExprs replaces each expression x nested in stmts with f(x),
+// bottom-up, so that f sees the replacements of the expressions x
+// contains.
+func rewriteExprs(stmts []luaStmt, f func(x luaExpr) luaExpr) {
+	for _, s := range stmts {
+		rewriteExprsIn(s, f)
+	}
+}
+
+func rewriteExprsIn(n luaNode, f func(x luaExpr) luaExpr) {
+	for _, x := range luaExprs(n) {
+		rewriteExprsIn(*x, f)
+		*x = f(*x)
+	}
+	for _, block := range luaBlocks(n) {
+		rewriteExprs(*block, f)
+	}
+}
+
+// rewriteStmts returns block with each statement s nested in it replaced
+// with the statements f returns for it, unless f returns nil. Nested
+// statements are replaced first.
+func rewriteStmts(block []luaStmt, f func(s luaStmt) []luaStmt) []luaStmt {
+	var out []luaStmt
+	for i, s := range block {
+		rewriteStmtsIn(s, f)
+		if repl := f(s); repl != nil {
+			if out == nil {
+				out = append([]luaStmt(nil), block[:i]...)
+			}
+			out = append(out, repl...)
+			continue
+		}
+		if out != nil {
+			out = append(out, s)
+		}
+	}
+	if out == nil {
+		return block
+	}
+	return out
+}
+
+func rewriteStmtsIn(n luaNode, f func(s luaStmt) []luaStmt) {
+	for _, x := range luaExprs(n) {
+		rewriteStmtsIn(*x, f)
+	}
+	for _, block := range luaBlocks(n) {
+		*block = rewriteStmts(*block, f)
+	}
+}
+
+// withLuaPos returns x, with its position set to pos unless it has one.
+func withLuaPos(x luaExpr, pos token.Pos) luaExpr {
+	if !x.Pos().IsValid() {
+		x.setPos(pos)
+	}
+	return x
+}
+
+// lowerLoops replaces continue statements, which Lua lacks. Where goto is
+// available, continue jumps to a label at the end of the loop body.
+// Elsewhere the body is wrapped in a loop that runs once, which continue
+// breaks out of. The break statements of the loop then set a flag that
+// breaks out of the actual loop as well.
+func (p *Parser) lowerLoops(chunk []luaStmt) []luaStmt {
+	for _, s := range chunk {
+		p.lowerLoopsIn(s, 0)
+	}
+	return chunk
+}
+
+// lowerLoopsIn lowers the loops of n, which is nested in depth loops of
+// the same function.
+func (p *Parser) lowerLoopsIn(n luaNode, depth int) {
+	if _, ok := n.(*luaFuncLit); ok {
+		depth = 0
+	}
+	body := loopBody(n)
+	if body != nil {
+		depth++
+	}
+	for _, x := range luaExprs(n) {
+		p.lowerLoopsIn(*x, depth)
+	}
+	for _, block := range luaBlocks(n) {
+		for _, s := range *block {
+			p.lowerLoopsIn(s, depth)
+		}
+	}
+	if body != nil {
+		*body = p.lowerLoopBody(*body, depth)
+	}
+}
+
+// lowerLoopBody returns the body of a loop nested in depth-1 other loops
+// with its continue statements replaced.
+func (p *Parser) lowerLoopBody(body []luaStmt, depth int) []luaStmt {
+	hasContinue, hasBreak := false, false
+	eachBranch(&body, func(s luaStmt) []luaStmt {
+		_, isContinue := s.(*luaContinueStmt)
+		hasContinue = hasContinue || isContinue
+		hasBreak = hasBreak || !isContinue
+		return nil
+	})
+	if !hasContinue {
+		return body
+	}
+
+	if p.target.hasGoto() {
+		// Lua 5.4 does not allow labels to shadow the labels of enclosing
+		// blocks, so nested loops use distinct labels.
+		label := "continue"
+		if depth > 1 {
+			label += strconv.Itoa(depth)
+		}
+		eachBranch(&body, func(s luaStmt) []luaStmt {
+			if _, ok := s.(*luaContinueStmt); ok {
+				return []luaStmt{&luaGotoStmt{luaPos: luaPos{s.Pos()}, label: label}}
+			}
+			return nil
+		})
+		return []luaStmt{&luaDoStmt{body: body}, &luaLabelStmt{name: label}}
+	}
+
+	eachBranch(&body, func(s luaStmt) []luaStmt {
+		brk := &luaBreakStmt{luaPos: luaPos{s.Pos()}}
+		if _, ok := s.(*luaContinueStmt); ok || !hasBreak {
+			return []luaStmt{brk}
+		}
+		set := &luaAssignStmt{
+			luaPos:  luaPos{s.Pos()},
+			targets: []luaExpr{luaIdentOf("__break")},
+			values:  []luaExpr{luaLitOf("true")},
+		}
+		return []luaStmt{set, brk}
+	})
+	lowered := []luaStmt{&luaRepeatStmt{body: body, cond: luaLitOf("true")}}
+	if hasBreak {
+		flag := &luaLocalStmt{names: []string{"__break"}, values: []luaExpr{luaLitOf("false")}}
+		check := &luaIfStmt{
+			clauses: []luaClause{{cond: luaIdentOf("__break"), body: []luaStmt{&luaBreakStmt{}}}},
+			oneLine: true,
+		}
+		lowered = append([]luaStmt{flag}, append(lowered, check)...)
+	}
+	return lowered
+}
+
+// loopBody returns a pointer to the body of n if n is a loop, or nil.
+func loopBody(n luaNode) *[]luaStmt {
+	switch n := n.(type) {
+	case *luaWhileStmt:
+		return &n.body
+	case *luaForInStmt:
+		return &n.body
+	case *luaRepeatStmt:
+		return &n.body
+	}
+	return nil
+}
+
+// eachBranch calls f for the break and continue statements in block that
+// belong to the loop block is the body of, replacing each with the
+// statements f returns, if any.
+func eachBranch(block *[]luaStmt, f func(s luaStmt) []luaStmt) {
+	var out []luaStmt
+	for i, s := range *block {
+		switch s.(type) {
+		case *luaBreakStmt, *luaContinueStmt:
+			if repl := f(s); repl != nil {
+				if out == nil {
+					out = append([]luaStmt(nil), (*block)[:i]...)
+				}
+				out = append(out, repl...)
+				continue
+			}
+		case *luaWhileStmt, *luaForInStmt, *luaRepeatStmt:
+			// Nested loops have branches of their own
+		default:
+			for _, b := range luaBlocks(s) {
+				eachBranch(b, f)
+			}
+		}
+		if out != nil {
+			out = append(out, s)
+		}
+	}
+	if out != nil {
+		*block = out
+	}
+}
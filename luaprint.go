@@ -0,0 +1,355 @@
+package lunar
+
+import (
+	"fmt"
+	"strings"
+)
+
+// luaPrec is the precedence of Lua's binary operators. Unary operators
+// bind tighter than all of them but ^.
+var luaPrec = map[string]int{
+	"or":  1,
+	"and": 2,
+	"<":   3, ">": 3, "<=": 3, ">=": 3, "~=": 3, "==": 3,
+	"|":  4,
+	"~":  5,
+	"&":  6,
+	"<<": 7, ">>": 7,
+	"..": 8,
+	"+":  9, "-": 9,
+	"*": 10, "/": 10, "//": 10, "%": 10,
+	"^": 12,
+}
+
+const (
+	luaUnaryPrec  = 11
+	luaSimplePrec = 13 // literals, tables and functions
+	luaPrefixPrec = 14 // expressions that can be called and indexed
+)
+
+// printLua writes the statements to w. Statements without a position of
+// their own are mapped to the position of the enclosing node.
+func printLua(w *Writer, stmts []luaStmt) {
+	parent := w.pos
+	for _, s := range stmts {
+		// Consecutive statements at the same position share a mapping
+		if pos := s.Pos(); pos.IsValid() {
+			w.SetPos(pos)
+		} else {
+			w.SetPos(parent)
+		}
+		printStmt(w, s)
+	}
+	w.SetPos(parent)
+}
+
+// printBlock writes the statements of a block, one level deeper than w.
+func printBlock(w *Writer, stmts []luaStmt) {
+	w.Indent()
+	printLua(w, stmts)
+	w.Dedent()
+}
+
+// printStmt writes s, with the position of the writer set for it.
+func printStmt(w *Writer, s luaStmt) {
+	switch s := s.(type) {
+	case *luaLocalStmt, *luaAssignStmt, *luaExprStmt, *luaReturnStmt, *luaBreakStmt, *luaGotoStmt:
+		printSimpleStmt(w, s)
+		w.WriteNewline()
+	case *luaIfStmt:
+		if s.oneLine {
+			printSimpleStmt(w, s)
+			w.WriteNewline()
+			return
+		}
+		for i, c := range s.clauses {
+			if i == 0 {
+				w.WriteString("if ")
+			} else {
+				w.WriteString("elseif ")
+			}
+			printExpr(w, c.cond, 0)
+			w.WriteLine(" then")
+			printBlock(w, c.body)
+		}
+		if len(s.elseBlock) > 0 {
+			w.WriteLine("else")
+			printBlock(w, s.elseBlock)
+		}
+		w.WriteLine("end")
+	case *luaWhileStmt:
+		w.WriteString("while ")
+		printExpr(w, s.cond, 0)
+		w.WriteLine(" do")
+		printBlock(w, append(s.body[:len(s.body):len(s.body)], s.post...))
+		w.WriteLine("end")
+	case *luaForInStmt:
+		w.WriteStringf("for %s in ", strings.Join(s.names, ", "))
+		printExpr(w, s.x, 0)
+		w.WriteLine(" do")
+		printBlock(w, s.body)
+		w.WriteLine("end")
+	case *luaRepeatStmt:
+		w.WriteLine("repeat")
+		printBlock(w, s.body)
+		w.WriteString("until ")
+		printExpr(w, s.cond, 0)
+		w.WriteNewline()
+	case *luaDoStmt:
+		w.WriteLine("do")
+		printBlock(w, s.body)
+		w.WriteLine("end")
+	case *luaLabelStmt:
+		w.WriteLinef("::%s::", s.name)
+	case *luaCommentStmt:
+		if s.block {
+			w.WriteRawString("--[=[" + s.text + "]=]")
+			w.WriteNewline()
+		} else {
+			w.WriteLine("--" + s.text)
+		}
+	case *luaBlankStmt:
+		for i := 0; i < s.lines; i++ {
+			w.WriteNewline()
+		}
+	case *luaCode:
+		printCode(w, s)
+		if !strings.HasSuffix(s.text, strNewline) {
+			w.WriteNewline()
+		}
+	default:
+		panic(fmt.Sprintf("lunar: cannot print Lua statement %T", s))
+	}
+}
+
+// printSimpleStmt writes a statement that can be written on a single
+// line, without a line break.
+func printSimpleStmt(w *Writer, s luaStmt) {
+	if pos := s.Pos(); pos.IsValid() {
+		defer w.SetPos(w.SetPos(pos))
+	}
+	switch s := s.(type) {
+	case *luaLocalStmt:
+		w.WriteString("local " + strings.Join(s.names, ", "))
+		if len(s.values) > 0 {
+			w.WriteString(" = ")
+			printExprList(w, s.values)
+		}
+	case *luaAssignStmt:
+		printExprList(w, s.targets)
+		w.WriteString(" = ")
+		printExprList(w, s.values)
+	case *luaExprStmt:
+		// A statement starting with a parenthesis would otherwise continue
+		// the call of the previous statement.
+		if startsWithParen(s.x) {
+			w.WriteByte(';')
+		}
+		printExpr(w, s.x, 0)
+	case *luaReturnStmt:
+		w.WriteString("return")
+		if len(s.values) > 0 {
+			w.WriteByte(' ')
+			printExprList(w, s.values)
+		}
+	case *luaBreakStmt:
+		w.WriteString("break")
+	case *luaGotoStmt:
+		w.WriteString("goto " + s.label)
+	case *luaIfStmt:
+		for i, c := range s.clauses {
+			if i == 0 {
+				w.WriteString("if ")
+			} else {
+				w.WriteString("elseif ")
+			}
+			printExpr(w, c.cond, 0)
+			w.WriteString(" then ")
+			printSimpleStmts(w, c.body)
+		}
+		if len(s.elseBlock) > 0 {
+			w.WriteString("else ")
+			printSimpleStmts(w, s.elseBlock)
+		}
+		w.WriteString("end")
+	default:
+		panic(fmt.Sprintf("lunar: cannot print Lua statement %T on one line", s))
+	}
+}
+
+// printSimpleStmts writes statements on a single line, each followed by
+// a space.
+func printSimpleStmts(w *Writer, stmts []luaStmt) {
+	for _, s := range stmts {
+		printSimpleStmt(w, s)
+		w.WriteByte(' ')
+	}
+}
+
+// printExprList writes expressions separated by commas.
+func printExprList(w *Writer, xs []luaExpr) {
+	for i, x := range xs {
+		if i > 0 {
+			w.WriteString(", ")
+		}
+		printExpr(w, x, 0)
+	}
+}
+
+// printExpr writes the expression x, which is an operand of an operator of
+// precedence prec, parenthesizing it if it binds less tightly.
+func printExpr(w *Writer, x luaExpr, prec int) {
+	if pos := x.Pos(); pos.IsValid() {
+		defer w.SetPos(w.SetPos(pos))
+	}
+	if luaExprPrec(x) < prec {
+		w.WriteByte('(')
+		defer w.WriteByte(')')
+	}
+	switch x := x.(type) {
+	case *luaIdent:
+		w.WriteString(x.name)
+	case *luaLit:
+		w.WriteString(x.text)
+	case *luaVararg:
+		w.WriteString("...")
+	case *luaParenExpr:
+		w.WriteByte('(')
+		printExpr(w, x.x, 0)
+		w.WriteByte(')')
+	case *luaUnaryExpr:
+		w.WriteString(x.op)
+		if x.op == "not" {
+			w.WriteByte(' ')
+		}
+		printExpr(w, x.x, luaUnaryPrec)
+	case *luaBinaryExpr:
+		// Operators are left associative, except for .. and ^. The
+		// operands of .. are not parenthesized either way since it is
+		// associative.
+		left, right := luaPrec[x.op], luaPrec[x.op]+1
+		switch x.op {
+		case "..":
+			right--
+		case "^":
+			left, right = left+1, right-1
+		}
+		printExpr(w, x.x, left)
+		w.WriteStringf(" %s ", x.op)
+		printExpr(w, x.y, right)
+	case *luaSelectorExpr:
+		printExpr(w, x.x, luaPrefixPrec)
+		w.WriteString("." + x.name)
+	case *luaIndexExpr:
+		printExpr(w, x.x, luaPrefixPrec)
+		w.WriteByte('[')
+		printExpr(w, x.key, 0)
+		w.WriteByte(']')
+	case *luaCallExpr:
+		printExpr(w, x.fn, luaPrefixPrec)
+		if x.method != "" {
+			w.WriteString(":" + x.method)
+		}
+		if x.wrapping {
+			w.WriteByte('(')
+			printExprList(w, x.args)
+			w.WriteByte(')')
+			break
+		}
+		w.writeList("(", ")", false, len(x.args), func(w *Writer, i int) {
+			printExpr(w, x.args[i], 0)
+		})
+	case *luaFuncLit:
+		w.WriteStringf("function(%s)", strings.Join(x.params, ", "))
+		if x.oneLine {
+			w.WriteByte(' ')
+			printSimpleStmts(w, x.body)
+		} else {
+			w.WriteNewline()
+			printBlock(w, x.body)
+		}
+		w.WriteString("end")
+	case *luaTableLit:
+		w.writeList("{", "}", true, len(x.items), func(w *Writer, i int) {
+			item := x.items[i]
+			switch {
+			case item.key != nil:
+				w.WriteByte('[')
+				printExpr(w, item.key, 0)
+				w.WriteString("] = ")
+			case item.name != "":
+				w.WriteString(item.name + " = ")
+			}
+			printExpr(w, item.value, 0)
+		})
+	case *luaRawExpr:
+		for _, part := range x.parts {
+			printExpr(w, part, 0)
+		}
+	case *luaCode:
+		printCode(w, x)
+	default:
+		panic(fmt.Sprintf("lunar: cannot print Lua expression %T", x))
+	}
+}
+
+// luaExprPrec returns the precedence of the operator of x, or of the kind
+// of operand it is. Literals, tables and functions can only be called or
+// indexed when parenthesized.
+func luaExprPrec(x luaExpr) int {
+	switch x := x.(type) {
+	case *luaBinaryExpr:
+		return luaPrec[x.op]
+	case *luaUnaryExpr:
+		return luaUnaryPrec
+	case *luaLit, *luaVararg, *luaFuncLit, *luaTableLit:
+		return luaSimplePrec
+	}
+	return luaPrefixPrec
+}
+
+// startsWithParen reports whether x is written starting with a
+// parenthesis.
+func startsWithParen(x luaExpr) bool {
+	for {
+		if luaExprPrec(x) < luaPrefixPrec {
+			return true
+		}
+		switch t := x.(type) {
+		case *luaParenExpr:
+			return true
+		case *luaCallExpr:
+			x = t.fn
+		case *luaSelectorExpr:
+			x = t.x
+		case *luaIndexExpr:
+			x = t.x
+		case *luaRawExpr:
+			x = firstRawPart(t)
+		case *luaCode:
+			return strings.HasPrefix(strings.TrimSpace(t.text), "(")
+		default:
+			return false
+		}
+	}
+}
+
+// firstRawPart returns the first part of x that is written as code, or
+// nil if there is none.
+func firstRawPart(x *luaRawExpr) luaExpr {
+	for _, part := range x.parts {
+		if c, ok := part.(*luaCode); ok && (strings.TrimSpace(c.text) == "" || c.text == rawMarker) {
+			continue
+		}
+		return part
+	}
+	return nil
+}
+
+func printCode(w *Writer, c *luaCode) {
+	if c.raw {
+		w.WriteRawString(c.text)
+	} else {
+		w.WriteString(c.text)
+	}
+}
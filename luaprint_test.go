@@ -0,0 +1,90 @@
+package lunar
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPrintLua(t *testing.T) {
+	x, y := luaIdentOf("x"), luaIdentOf("y")
+	tests := []struct {
+		stmts []luaStmt
+		want  string
+	}{
+		// Parentheses are added where precedence requires them
+		{
+			[]luaStmt{&luaReturnStmt{values: []luaExpr{
+				&luaBinaryExpr{op: "*", x: &luaBinaryExpr{op: "+", x: x, y: y}, y: x},
+				&luaBinaryExpr{op: "-", x: x, y: &luaBinaryExpr{op: "-", x: y, y: x}},
+				&luaBinaryExpr{op: "..", x: x, y: &luaBinaryExpr{op: "..", x: y, y: x}},
+				&luaUnaryExpr{op: "not", x: &luaBinaryExpr{op: "==", x: x, y: y}},
+			}}},
+			"return (x + y) * x, x - (y - x), x .. y .. x, not (x == y)\n",
+		},
+		// Literals and functions are parenthesized when called or indexed,
+		// and statements starting with a parenthesis are separated from
+		// the previous statement
+		{
+			[]luaStmt{
+				&luaExprStmt{x: luaCallOf(luaIdentOf("f"), &luaIndexExpr{x: &luaTableLit{items: []luaItem{{value: x}}}, key: luaLitOf("1")})},
+				&luaExprStmt{x: luaCallOf(&luaFuncLit{body: []luaStmt{&luaReturnStmt{}}, oneLine: true})},
+			},
+			"f(({ x })[1])\n;(function() return end)()\n",
+		},
+		{
+			[]luaStmt{&luaIfStmt{
+				clauses:   []luaClause{{cond: x, body: []luaStmt{&luaBreakStmt{}}}, {cond: y}},
+				elseBlock: []luaStmt{&luaGotoStmt{label: "done"}},
+			}, &luaLabelStmt{name: "done"}},
+			"if x then\n\tbreak\nelseif y then\nelse\n\tgoto done\nend\n::done::\n",
+		},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		printLua(NewWriter(&buf), test.stmts)
+		if got := buf.String(); got != test.want {
+			t.Errorf("printLua:\nGot:\n%s\nwant:\n%s", got, test.want)
+		}
+	}
+}
+
+func TestLowerLoops(t *testing.T) {
+	loop := func() []luaStmt {
+		inner := &luaWhileStmt{cond: luaIdentOf("y"), body: []luaStmt{&luaContinueStmt{}}}
+		return []luaStmt{&luaForInStmt{
+			names: []string{"_"},
+			x:     luaIdentOf("x"),
+			body: []luaStmt{
+				&luaIfStmt{clauses: []luaClause{{cond: luaIdentOf("a"), body: []luaStmt{&luaBreakStmt{}}}}},
+				&luaIfStmt{clauses: []luaClause{{cond: luaIdentOf("b"), body: []luaStmt{&luaContinueStmt{}}}}},
+				inner,
+			},
+		}}
+	}
+	tests := []struct {
+		target Target
+		want   string
+	}{
+		{
+			Lua52,
+			"for _ in x do\n\tdo\n\t\tif a then\n\t\t\tbreak\n\t\tend\n\t\tif b then\n\t\t\tgoto continue\n\t\tend\n" +
+				"\t\twhile y do\n\t\t\tdo\n\t\t\t\tgoto continue2\n\t\t\tend\n\t\t\t::continue2::\n\t\tend\n" +
+				"\tend\n\t::continue::\nend\n",
+		},
+		{
+			Lua51,
+			"for _ in x do\n\tlocal __break = false\n\trepeat\n\t\tif a then\n\t\t\t__break = true\n\t\t\tbreak\n\t\tend\n" +
+				"\t\tif b then\n\t\t\tbreak\n\t\tend\n" +
+				"\t\twhile y do\n\t\t\trepeat\n\t\t\t\tbreak\n\t\t\tuntil true\n\t\tend\n" +
+				"\tuntil true\n\tif __break then break end\nend\n",
+		},
+	}
+	for _, test := range tests {
+		p := &Parser{target: test.target}
+		var buf bytes.Buffer
+		printLua(NewWriter(&buf), p.lowerLoops(loop()))
+		if got := buf.String(); got != test.want {
+			t.Errorf("lowerLoops for %s:\nGot:\n%s\nwant:\n%s", test.target, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,875 @@
+package lunar
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// rawMarker marks the Lua code of lua.Raw calls in the output of parsers
+// that minify, so that the locals it may refer to keep their names.
+const rawMarker = "--[[lunar:raw]]"
+
+// SetMinify makes the parser write minified Lua for production use:
+// comments and indentation are stripped, locals are renamed to short
+// names and frequently used builtins and standard globals are cached in
+// locals. The locals visible to code of lua.Raw calls keep their names.
+//
+// Minified code keeps the line numbers of the code it was minified from,
+// so that line tables and the lines of Lua errors remain valid. Source map
+// columns are adjusted to the minified code.
+func (p *Parser) SetMinify(on bool) {
+	p.minify = on
+}
+
+// Minify minifies the Lua code src like a parser minifying its output,
+// such as the builtins. See Parser.SetMinify.
+func Minify(src []byte) ([]byte, error) {
+	out, _, err := minifyLua(src)
+	return out, err
+}
+
+// minifyLua minifies src, returning the minified code and a function
+// mapping positions of tokens in src to the column they are moved to on
+// the same line.
+func minifyLua(src []byte) ([]byte, func(line, col int) int, error) {
+	m, err := newLuaMinifier(string(src))
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := m.analyze(); err != nil {
+		return nil, nil, err
+	}
+	m.hoist()
+	m.rename()
+	out, cols := m.print()
+	remap := func(line, col int) int {
+		for _, c := range cols[line] {
+			if c[0] >= col {
+				return c[1]
+			}
+		}
+		return 0
+	}
+	return out, remap, nil
+}
+
+// newLuaMinifier returns a minifier for the Lua code src.
+func newLuaMinifier(src string) (*luaMinifier, error) {
+	toks, err := lexLua(src)
+	if err != nil {
+		return nil, err
+	}
+	m := &luaMinifier{}
+	for _, tok := range toks {
+		if tok.kind == luaComment {
+			if tok.text == rawMarker {
+				m.raw = append(m.raw, len(m.toks))
+			}
+			continue
+		}
+		m.toks = append(m.toks, tok)
+	}
+	m.refs = make([]*luaVar, len(m.toks))
+	m.globals = make([]bool, len(m.toks))
+	m.free = make(map[string]bool)
+	m.assigned = make(map[string]bool)
+	m.hoistAt = -1
+	return m, nil
+}
+
+// checkLua checks the syntax of the Lua code src, which is a chunk, or an
+// expression if expr is set, for the target t.
+func checkLua(src string, expr bool, t Target) error {
+	m, err := newLuaMinifier(src)
+	if err != nil {
+		return err
+	}
+	parse := m.statements
+	if expr {
+		parse = m.expr
+	}
+	if err := m.parse(parse); err != nil {
+		return err
+	}
+	for _, tok := range m.toks {
+		if tok.kind != luaOp && tok.kind != luaKeyword {
+			continue
+		}
+		var supported bool
+		switch tok.text {
+		case "goto", "::":
+			supported = t.hasGoto()
+		case "//", "&", "|", "~", "<<", ">>":
+			supported = t.hasIntegers()
+		default:
+			continue
+		}
+		if !supported {
+			return fmt.Errorf("%d:%d: %q is not supported by %s", tok.line+1, tok.col+1, tok.text, t)
+		}
+	}
+	return nil
+}
+
+// minifyOutput minifies the output of the parser written to buf,
+// adjusting the mappings of w.
+func (p *Parser) minifyOutput(w *Writer, buf []byte) ([]byte, error) {
+	out, remap, err := minifyLua(buf)
+	if err != nil {
+		return nil, fmt.Errorf("lunar: minifying output: %v", err)
+	}
+	for i, m := range w.mappings {
+		w.mappings[i].Column = remap(m.Line, m.Column)
+	}
+	return out, nil
+}
+
+// A luaVar is a local variable of minified code.
+type luaVar struct {
+	name    string
+	newName string
+	prev    *luaVar // innermost local visible where this one is declared
+	pinned  bool    // keeps its name, as lua.Raw code may refer to it
+}
+
+// A luaFieldAssign is an assignment to a field of a variable, such as a
+// function definition in the builtins table.
+type luaFieldAssign struct {
+	v      *luaVar
+	field  string
+	tok    int
+	nested bool // in a function or block, which may run at any time
+}
+
+// A luaMinifier minifies a chunk of Lua code.
+type luaMinifier struct {
+	toks    []luaToken // without comments
+	raw     []int      // indexes of the tokens following raw markers
+	pos     int
+	top     *luaVar   // innermost visible local
+	nesting int       // of blocks and functions
+	refs    []*luaVar // variables declared or referred to by name tokens
+	globals []bool    // whether name tokens refer to globals
+	vars    []*luaVar // in order of declaration
+	free    map[string]bool
+
+	assigned     map[string]bool // globals that are assigned
+	fieldAssigns []luaFieldAssign
+	topLocals    int     // number of locals of the main chunk
+	builtins     *luaVar // the builtins table
+	hoistAt      int     // index of the token after which locals are hoisted
+
+	hoisted []luaHoist
+	replace map[int]int  // hoisted expressions by index of their first token
+	skip    map[int]bool // tokens of hoisted expressions after the first
+}
+
+// A luaHoist is an expression that is cached in a local: a builtin or a
+// standard global.
+type luaHoist struct {
+	field string // of the builtins table, or empty for a global
+	name  string // global
+	uses  []int  // indexes of the first tokens of the uses
+	local string
+}
+
+// hoistableGlobals are the standard globals worth caching in locals.
+// Code must not replace them after it is loaded.
+var hoistableGlobals = map[string]bool{
+	"error":        true,
+	"getmetatable": true,
+	"ipairs":       true,
+	"math":         true,
+	"next":         true,
+	"pairs":        true,
+	"rawget":       true,
+	"rawset":       true,
+	"select":       true,
+	"setmetatable": true,
+	"string":       true,
+	"table":        true,
+	"tonumber":     true,
+	"tostring":     true,
+	"type":         true,
+}
+
+// maxHoisted limits the number of hoisted locals, as each of them may be
+// an upvalue of the functions using them, of which Lua 5.1 allows 60.
+const maxHoisted = 16
+
+func (m *luaMinifier) tok() luaToken { return m.toks[m.pos] }
+
+func (m *luaMinifier) at(text string) bool {
+	t := m.tok()
+	return (t.kind == luaOp || t.kind == luaKeyword) && t.text == text
+}
+
+func (m *luaMinifier) next() {
+	if m.pos < len(m.toks)-1 {
+		m.pos++
+	}
+	for len(m.raw) > 0 && m.raw[0] <= m.pos {
+		// lua.Raw code may refer to any visible local
+		for v := m.top; v != nil; v = v.prev {
+			v.pinned = true
+		}
+		m.raw = m.raw[1:]
+	}
+}
+
+func (m *luaMinifier) accept(text string) bool {
+	if m.at(text) {
+		m.next()
+		return true
+	}
+	return false
+}
+
+func (m *luaMinifier) expect(text string) {
+	if !m.accept(text) {
+		m.fail("expected %q", text)
+	}
+}
+
+func (m *luaMinifier) expectName() int {
+	if m.tok().kind != luaName {
+		m.fail("expected name")
+	}
+	i := m.pos
+	m.next()
+	return i
+}
+
+type luaSyntaxError string
+
+func (m *luaMinifier) fail(format string, args ...interface{}) {
+	t := m.tok()
+	text := t.text
+	if t.kind == luaEOF {
+		text = "<eof>"
+	}
+	panic(luaSyntaxError(fmt.Sprintf("%d:%d: %s near %q", t.line+1, t.col+1, fmt.Sprintf(format, args...), text)))
+}
+
+// declare declares the local named by token i.
+func (m *luaMinifier) declare(i int) {
+	v := &luaVar{name: m.toks[i].text, prev: m.top}
+	m.top = v
+	m.refs[i] = v
+	m.vars = append(m.vars, v)
+	if m.nesting == 0 {
+		m.topLocals++
+	}
+}
+
+// reference resolves the variable named by token i.
+func (m *luaMinifier) reference(i int) {
+	name := m.toks[i].text
+	for v := m.top; v != nil; v = v.prev {
+		if v.name == name {
+			m.refs[i] = v
+			return
+		}
+	}
+	m.free[name] = true
+	m.globals[i] = true
+}
+
+// analyze resolves the variables of the chunk.
+func (m *luaMinifier) analyze() error {
+	return m.parse(m.statements)
+}
+
+// parse parses all tokens with fn, returning the syntax errors found.
+func (m *luaMinifier) parse(fn func()) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			msg, ok := e.(luaSyntaxError)
+			if !ok {
+				panic(e)
+			}
+			err = fmt.Errorf("%s", string(msg))
+		}
+	}()
+	m.pos = -1
+	m.next()
+	fn()
+	if m.tok().kind != luaEOF {
+		m.fail("unexpected token")
+	}
+	return nil
+}
+
+func (m *luaMinifier) blockEnd() bool {
+	t := m.tok()
+	switch {
+	case t.kind == luaEOF:
+		return true
+	case t.kind == luaKeyword:
+		return t.text == "end" || t.text == "else" || t.text == "elseif" || t.text == "until"
+	}
+	return false
+}
+
+// statements parses statements up to the end of the enclosing block.
+func (m *luaMinifier) statements() {
+	for !m.blockEnd() {
+		if m.accept("return") {
+			if !m.blockEnd() && !m.at(";") {
+				m.exprList()
+			}
+			m.accept(";")
+			return
+		}
+		m.statement()
+	}
+}
+
+// block parses a block with its own scope.
+func (m *luaMinifier) block() {
+	top := m.top
+	m.nesting++
+	m.statements()
+	m.nesting--
+	m.top = top
+}
+
+func (m *luaMinifier) statement() {
+	t := m.tok()
+	if t.kind != luaKeyword && t.kind != luaOp {
+		m.exprStatement()
+		return
+	}
+	switch t.text {
+	case ";", "break":
+		m.next()
+	case "::":
+		m.next()
+		m.expectName()
+		m.expect("::")
+	case "goto":
+		m.next()
+		m.expectName()
+	case "do":
+		m.next()
+		m.block()
+		m.expect("end")
+	case "while":
+		m.next()
+		m.expr()
+		m.expect("do")
+		m.block()
+		m.expect("end")
+	case "repeat":
+		// The condition is in the scope of the body
+		m.next()
+		top := m.top
+		m.nesting++
+		m.statements()
+		m.expect("until")
+		m.expr()
+		m.nesting--
+		m.top = top
+	case "if":
+		m.next()
+		m.expr()
+		m.expect("then")
+		m.block()
+		for m.accept("elseif") {
+			m.expr()
+			m.expect("then")
+			m.block()
+		}
+		if m.accept("else") {
+			m.block()
+		}
+		m.expect("end")
+	case "for":
+		m.next()
+		names := []int{m.expectName()}
+		if m.accept("=") {
+			m.exprList()
+		} else {
+			for m.accept(",") {
+				names = append(names, m.expectName())
+			}
+			m.expect("in")
+			m.exprList()
+		}
+		m.expect("do")
+		top := m.top
+		m.nesting++
+		for _, i := range names {
+			m.declare(i)
+		}
+		m.block()
+		m.nesting--
+		m.top = top
+		m.expect("end")
+	case "function":
+		m.next()
+		name := m.expectName()
+		m.reference(name)
+		fields := 0
+		field := ""
+		method := false
+		for m.at(".") || m.at(":") {
+			method = m.at(":")
+			m.next()
+			field = m.toks[m.expectName()].text
+			fields++
+			if method {
+				break
+			}
+		}
+		m.assign(name, fields, field)
+		m.funcBody(method)
+	case "local":
+		m.next()
+		if m.accept("function") {
+			m.declare(m.expectName())
+			m.funcBody(false)
+			return
+		}
+		var names []int
+		for {
+			names = append(names, m.expectName())
+			if m.accept("<") {
+				m.expectName()
+				m.expect(">")
+			}
+			if !m.accept(",") {
+				break
+			}
+		}
+		if m.accept("=") {
+			m.exprList()
+		}
+		topLevel := m.nesting == 0
+		for _, i := range names {
+			m.declare(i)
+			if topLevel && m.toks[i].text == "builtins" {
+				m.builtins = m.refs[i]
+				m.hoistAt = m.pos - 1
+			}
+		}
+	default:
+		m.exprStatement()
+	}
+}
+
+// exprStatement parses an assignment or a function call.
+func (m *luaMinifier) exprStatement() {
+	type target struct {
+		name, fields int
+		field        string
+	}
+	var targets []target
+	name, fields, field := m.suffixedExpr()
+	targets = append(targets, target{name, fields, field})
+	if !m.at("=") && !m.at(",") {
+		return
+	}
+	for m.accept(",") {
+		name, fields, field := m.suffixedExpr()
+		targets = append(targets, target{name, fields, field})
+	}
+	m.expect("=")
+	m.exprList()
+	for _, t := range targets {
+		m.assign(t.name, t.fields, t.field)
+	}
+}
+
+// assign records an assignment to the variable named by token name, or
+// to one of its fields if fields is 1. The token is -1 for assignments to
+// other expressions.
+func (m *luaMinifier) assign(name, fields int, field string) {
+	if name < 0 {
+		return
+	}
+	v := m.refs[name]
+	switch {
+	case fields == 0 && v == nil:
+		m.assigned[m.toks[name].text] = true
+	case fields == 1 && field != "" && v != nil:
+		m.fieldAssigns = append(m.fieldAssigns, luaFieldAssign{v, field, name, m.nesting > 0})
+	}
+}
+
+// funcBody parses the parameters and body of a function.
+func (m *luaMinifier) funcBody(method bool) {
+	top := m.top
+	m.nesting++
+	if method {
+		self := &luaVar{name: "self", newName: "self", prev: m.top, pinned: true}
+		m.top = self
+		m.vars = append(m.vars, self)
+	}
+	m.expect("(")
+	for !m.at(")") {
+		if m.accept("...") {
+			break
+		}
+		m.declare(m.expectName())
+		if !m.accept(",") {
+			break
+		}
+	}
+	m.expect(")")
+	m.block()
+	m.expect("end")
+	m.nesting--
+	m.top = top
+}
+
+func (m *luaMinifier) exprList() {
+	m.expr()
+	for m.accept(",") {
+		m.expr()
+	}
+}
+
+var luaBinaryOps = map[string]bool{
+	"+": true, "-": true, "*": true, "/": true, "//": true, "%": true,
+	"^": true, "..": true, "==": true, "~=": true, "<": true, "<=": true,
+	">": true, ">=": true, "and": true, "or": true, "&": true, "|": true,
+	"~": true, "<<": true, ">>": true,
+}
+
+func (m *luaMinifier) unaryOps() {
+	for m.at("not") || m.at("-") || m.at("#") || m.at("~") {
+		m.next()
+	}
+}
+
+func (m *luaMinifier) expr() {
+	m.unaryOps()
+	m.simpleExpr()
+	for t := m.tok(); (t.kind == luaOp || t.kind == luaKeyword) && luaBinaryOps[t.text]; t = m.tok() {
+		m.next()
+		m.unaryOps()
+		m.simpleExpr()
+	}
+}
+
+func (m *luaMinifier) simpleExpr() {
+	t := m.tok()
+	switch {
+	case t.kind == luaNumber || t.kind == luaString:
+		m.next()
+	case t.kind == luaKeyword && (t.text == "nil" || t.text == "true" || t.text == "false"):
+		m.next()
+	case m.accept("..."):
+	case m.accept("function"):
+		m.funcBody(false)
+	case m.at("{"):
+		m.table()
+	default:
+		m.suffixedExpr()
+	}
+}
+
+func (m *luaMinifier) table() {
+	m.expect("{")
+	for !m.at("}") {
+		switch {
+		case m.accept("["):
+			m.expr()
+			m.expect("]")
+			m.expect("=")
+			m.expr()
+		case m.tok().kind == luaName && m.toks[m.pos+1].kind == luaOp && m.toks[m.pos+1].text == "=":
+			m.next()
+			m.next()
+			m.expr()
+		default:
+			m.expr()
+		}
+		if !m.accept(",") && !m.accept(";") {
+			break
+		}
+	}
+	m.expect("}")
+}
+
+// suffixedExpr parses a primary expression followed by field accesses,
+// indexing and calls. It returns the token of the primary expression if it
+// is a name, or -1, along with the number of suffixes and the name of the
+// field accessed by the first suffix, if any.
+func (m *luaMinifier) suffixedExpr() (name, fields int, field string) {
+	name = -1
+	switch {
+	case m.tok().kind == luaName:
+		name = m.pos
+		m.reference(name)
+		m.next()
+	case m.accept("("):
+		m.expr()
+		m.expect(")")
+	default:
+		m.fail("unexpected token")
+	}
+	for {
+		switch {
+		case m.accept("."):
+			f := m.toks[m.expectName()].text
+			if fields == 0 {
+				field = f
+			}
+		case m.accept("["):
+			m.expr()
+			m.expect("]")
+		case m.accept(":"):
+			m.expectName()
+			m.args()
+		case m.at("(") || m.at("{") || m.tok().kind == luaString:
+			m.args()
+		default:
+			return name, fields, field
+		}
+		fields++
+	}
+}
+
+func (m *luaMinifier) args() {
+	switch {
+	case m.at("{"):
+		m.table()
+	case m.tok().kind == luaString:
+		m.next()
+	default:
+		m.expect("(")
+		if !m.at(")") {
+			m.exprList()
+		}
+		m.expect(")")
+	}
+}
+
+// hoist decides which builtins and globals used after the declaration of
+// the builtins, or anywhere if there is none, are cached in locals
+// declared there. Builtins assigned after the declaration are not cached,
+// nor are assigned globals.
+func (m *luaMinifier) hoist() {
+	byName := make(map[string]*luaHoist)
+	reassigned := make(map[string]bool)
+	for _, a := range m.fieldAssigns {
+		if a.v == m.builtins && (a.tok > m.hoistAt || a.nested) {
+			reassigned[a.field] = true
+		}
+	}
+	for i := m.hoistAt + 1; i < len(m.toks); i++ {
+		t := m.toks[i]
+		if t.kind != luaName {
+			continue
+		}
+		var key string
+		h := luaHoist{}
+		switch v := m.refs[i]; {
+		case v != nil && v == m.builtins && i+2 < len(m.toks) && m.toks[i+1].text == "." && m.toks[i+2].kind == luaName:
+			h.field = m.toks[i+2].text
+			key = "builtins." + h.field
+			if reassigned[h.field] {
+				continue
+			}
+		case m.globals[i] && hoistableGlobals[t.text] && !m.assigned[t.text]:
+			h.name = t.text
+			key = h.name
+		default:
+			continue
+		}
+		if byName[key] == nil {
+			byName[key] = &h
+		}
+		byName[key].uses = append(byName[key].uses, i)
+	}
+
+	// Hoist the expressions saving the most bytes, assuming two byte names
+	benefit := func(h *luaHoist) int {
+		if h.field != "" {
+			return len(h.uses)*len(h.field) - (len(h.field) + 6)
+		}
+		return len(h.uses)*(len(h.name)-2) - (len(h.name) + 4)
+	}
+	var hoists []*luaHoist
+	for _, h := range byName {
+		if benefit(h) > 0 {
+			hoists = append(hoists, h)
+		}
+	}
+	sort.Slice(hoists, func(i, j int) bool {
+		if bi, bj := benefit(hoists[i]), benefit(hoists[j]); bi != bj {
+			return bi > bj
+		}
+		return hoists[i].field+hoists[i].name < hoists[j].field+hoists[j].name
+	})
+	max := maxHoisted
+	if n := 180 - m.topLocals; n < max {
+		// Functions are limited to 200 locals
+		max = n
+	}
+	if len(hoists) > max {
+		hoists = hoists[:max]
+	}
+
+	m.replace = make(map[int]int)
+	m.skip = make(map[int]bool)
+	for i, h := range hoists {
+		m.hoisted = append(m.hoisted, *h)
+		for _, use := range h.uses {
+			m.replace[use] = i
+			if h.field != "" {
+				m.skip[use+1] = true
+				m.skip[use+2] = true
+			}
+		}
+	}
+}
+
+// shortName returns the i-th short Lua name.
+func shortName(i int) string {
+	const first = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ_"
+	const rest = first + "0123456789"
+	name := []byte{first[i%len(first)]}
+	for i /= len(first); i > 0; i /= len(rest) {
+		i--
+		name = append(name, rest[i%len(rest)])
+	}
+	return string(name)
+}
+
+// rename gives the hoisted locals and the locals that are not pinned
+// short names. Names are not reused while visible, and never take the
+// name of a global or pinned local, so no reference changes meaning.
+func (m *luaMinifier) rename() {
+	reserved := make(map[string]bool)
+	for name := range luaKeywordSet {
+		reserved[name] = true
+	}
+	for name := range m.free {
+		reserved[name] = true
+	}
+	for _, v := range m.vars {
+		if v.pinned {
+			reserved[v.name] = true
+		}
+	}
+
+	n := 0
+	for i := range m.hoisted {
+		for reserved[shortName(n)] {
+			n++
+		}
+		m.hoisted[i].local = shortName(n)
+		reserved[shortName(n)] = true
+	}
+
+	for _, v := range m.vars {
+		if v.pinned {
+			v.newName = v.name
+			continue
+		}
+		used := make(map[string]bool)
+		for u := v.prev; u != nil; u = u.prev {
+			used[u.newName] = true
+		}
+		for n := 0; ; n++ {
+			if name := shortName(n); !reserved[name] && !used[name] {
+				v.newName = name
+				break
+			}
+		}
+	}
+}
+
+// print writes the minified tokens, keeping them on their lines. It also
+// returns the original and new columns of the tokens on each line.
+func (m *luaMinifier) print() ([]byte, map[int][][2]int) {
+	var buf bytes.Buffer
+	cols := make(map[int][][2]int)
+	line := 0
+	last := luaToken{}
+	write := func(t luaToken, text string, mapped bool) {
+		if t.line > line {
+			buf.WriteString(strings.Repeat("\n", t.line-line))
+			line = t.line
+			last = luaToken{}
+		} else if last.text != "" && needSpace(last, text) {
+			buf.WriteByte(' ')
+		}
+		col := buf.Len() - bytes.LastIndexByte(buf.Bytes(), '\n') - 1
+		if mapped {
+			cols[t.line] = append(cols[t.line], [2]int{t.col, col})
+		}
+		buf.WriteString(text)
+		line += strings.Count(text, "\n")
+		last = luaToken{kind: t.kind, text: text}
+	}
+
+	decl := func(at luaToken) {
+		var names, values []string
+		for _, h := range m.hoisted {
+			names = append(names, h.local)
+			if h.field != "" {
+				values = append(values, m.builtins.newName+"."+h.field)
+			} else {
+				values = append(values, h.name)
+			}
+		}
+		write(at, "local "+strings.Join(names, ",")+"="+strings.Join(values, ","), false)
+	}
+	if len(m.hoisted) > 0 && m.hoistAt < 0 {
+		decl(luaToken{kind: luaName})
+	}
+
+	for i, t := range m.toks {
+		if t.kind == luaEOF {
+			buf.WriteString(strings.Repeat("\n", t.line-line))
+			break
+		}
+		text := t.text
+		switch {
+		case m.skip[i]:
+			cols[t.line] = append(cols[t.line], [2]int{t.col, cols[t.line][len(cols[t.line])-1][1]})
+			continue
+		case t.kind == luaName && m.replaceOK(i):
+			text = m.hoisted[m.replace[i]].local
+		case t.kind == luaName && m.refs[i] != nil:
+			text = m.refs[i].newName
+		}
+		write(t, text, true)
+		if i == m.hoistAt && len(m.hoisted) > 0 {
+			decl(luaToken{kind: luaName, line: t.line, col: t.col + len(t.text)})
+		}
+	}
+	return buf.Bytes(), cols
+}
+
+func (m *luaMinifier) replaceOK(i int) bool {
+	_, ok := m.replace[i]
+	return ok
+}
+
+// needSpace reports whether a space is needed between the token prev and
+// text to keep them separate tokens.
+func needSpace(prev luaToken, text string) bool {
+	a, b := prev.text[len(prev.text)-1], text[0]
+	switch {
+	case isNameChar(a) && isNameChar(b):
+		return true
+	case prev.kind == luaNumber && b == '.':
+		return true
+	case a == '.' && b == '.':
+		return true
+	case a == '[' && (b == '[' || b == '='):
+		return true
+	}
+	switch string(a) + string(b) {
+	case "--", "<<", "<=", ">>", ">=", "//", "==", "::", "~=":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,177 @@
+package lunar
+
+import (
+	"fmt"
+	"strings"
+)
+
+type luaTokenKind int
+
+const (
+	luaEOF luaTokenKind = iota
+	luaName
+	luaKeyword
+	luaNumber
+	luaString
+	luaOp
+	luaComment
+)
+
+// A luaToken is a token of Lua source code.
+type luaToken struct {
+	kind      luaTokenKind
+	text      string
+	line, col int // zero-based position in the source
+}
+
+var luaKeywordSet = map[string]bool{
+	"and": true, "break": true, "do": true, "else": true, "elseif": true,
+	"end": true, "false": true, "for": true, "function": true, "goto": true,
+	"if": true, "in": true, "local": true, "nil": true, "not": true,
+	"or": true, "repeat": true, "return": true, "then": true, "true": true,
+	"until": true, "while": true,
+}
+
+// luaOps are the operators and punctuation of Lua, longest first.
+var luaOps = []string{
+	"...", "..", "==", "~=", "<=", ">=", "<<", ">>", "//", "::",
+	"+", "-", "*", "/", "%", "^", "#", "&", "~", "|", "<", ">", "=",
+	"(", ")", "{", "}", "[", "]", ";", ":", ",", ".",
+}
+
+// lexLua splits src into tokens, including comments, ending with an
+// EOF token. Any version of Lua from 5.1 up is accepted.
+func lexLua(src string) ([]luaToken, error) {
+	var toks []luaToken
+	line, col := 0, 0
+	i := 0
+	// advance moves i to j, keeping track of the position
+	advance := func(j int) {
+		for ; i < j; i++ {
+			if src[i] == '\n' {
+				line, col = line+1, 0
+			} else {
+				col++
+			}
+		}
+	}
+	errorf := func(format string, args ...interface{}) error {
+		return fmt.Errorf("%d:%d: %s", line+1, col+1, fmt.Sprintf(format, args...))
+	}
+
+	for {
+		for i < len(src) && strings.IndexByte(" \t\r\n\f\v", src[i]) >= 0 {
+			advance(i + 1)
+		}
+		if i >= len(src) {
+			return append(toks, luaToken{kind: luaEOF, line: line, col: col}), nil
+		}
+
+		tok := luaToken{line: line, col: col}
+		c := src[i]
+		end := i + 1
+		switch {
+		case strings.HasPrefix(src[i:], "--"):
+			tok.kind = luaComment
+			if n := longBracket(src[i+2:]); n >= 0 {
+				close := "]" + strings.Repeat("=", n) + "]"
+				j := strings.Index(src[i+2:], close)
+				if j < 0 {
+					return nil, errorf("unfinished long comment")
+				}
+				end = i + 2 + j + len(close)
+			} else if j := strings.IndexByte(src[i:], '\n'); j >= 0 {
+				end = i + j
+			} else {
+				end = len(src)
+			}
+		case isNameStart(c):
+			for end < len(src) && isNameChar(src[end]) {
+				end++
+			}
+			tok.kind = luaName
+			if luaKeywordSet[src[i:end]] {
+				tok.kind = luaKeyword
+			}
+		case isDigit(c) || c == '.' && i+1 < len(src) && isDigit(src[i+1]):
+			tok.kind = luaNumber
+			hex := strings.HasPrefix(src[i:], "0x") || strings.HasPrefix(src[i:], "0X")
+			for end < len(src) {
+				d := src[end]
+				prev := src[end-1]
+				exp := (prev == 'e' || prev == 'E') && !hex || prev == 'p' || prev == 'P'
+				if !isNameChar(d) && d != '.' && !((d == '+' || d == '-') && exp) {
+					break
+				}
+				end++
+			}
+		case c == '"' || c == '\'':
+			tok.kind = luaString
+			for end < len(src) && src[end] != c {
+				if src[end] == '\n' {
+					return nil, errorf("unfinished string")
+				}
+				if src[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(src) {
+				return nil, errorf("unfinished string")
+			}
+			end++
+		case c == '[' && longBracket(src[i:]) >= 0:
+			tok.kind = luaString
+			n := longBracket(src[i:])
+			close := "]" + strings.Repeat("=", n) + "]"
+			j := strings.Index(src[i:], close)
+			if j < 0 {
+				return nil, errorf("unfinished long string")
+			}
+			end = i + j + len(close)
+		default:
+			tok.kind = luaOp
+			end = -1
+			for _, op := range luaOps {
+				if strings.HasPrefix(src[i:], op) {
+					end = i + len(op)
+					break
+				}
+			}
+			if end < 0 {
+				return nil, errorf("unexpected character %q", c)
+			}
+		}
+		tok.text = src[i:end]
+		toks = append(toks, tok)
+		advance(end)
+	}
+}
+
+// longBracket returns the level of the opening long bracket s starts
+// with, or -1 if it does not start with one.
+func longBracket(s string) int {
+	if !strings.HasPrefix(s, "[") {
+		return -1
+	}
+	n := 1
+	for n < len(s) && s[n] == '=' {
+		n++
+	}
+	if n < len(s) && s[n] == '[' {
+		return n - 1
+	}
+	return -1
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func isNameChar(c byte) bool {
+	return isNameStart(c) || isDigit(c)
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
@@ -0,0 +1,107 @@
+package lunar
+
+import (
+	"bytes"
+	"go/ast"
+	"strings"
+	"testing"
+)
+
+func TestMinify(t *testing.T) {
+	tests := []struct{ src, want string }{
+		{
+			"local function add(first, second)\n\treturn first + second -- sum\nend\nprint(add(1, 2))",
+			"local function a(b,c)\nreturn b+c\nend\nprint(a(1,2))",
+		},
+		// Locals are declared after their initializers
+		{
+			"local x = 1\ndo\n\tlocal x = x + 1\n\tprint(x)\nend",
+			"local a=1\ndo\nlocal b=a+1\nprint(b)\nend",
+		},
+		// Globals keep their names and are not shadowed
+		{
+			"local function f(a) return a + b end",
+			"local function a(c)return c+b end",
+		},
+		// Locals visible to lua.Raw code keep their names
+		{
+			"local keep = 1\nlocal function g(arg)\n\t" + rawMarker + "print(keep)\nend\nlocal other = 2",
+			"local keep=1\nlocal function g(arg)\nprint(keep)\nend\nlocal a=2",
+		},
+		// Builtins used often enough are hoisted
+		{
+			"local builtins = _G.lunar_go_builtins\nx = builtins.append(x, 1)\ny = builtins.append(y, 2)\nz = builtins.append(z, 3)",
+			"local b=_G.lunar_go_builtins local a=b.append\nx=a(x,1)\ny=a(y,2)\nz=a(z,3)",
+		},
+		{
+			"local builtins = {}\nfunction builtins.f(t)\n\treturn type(t), type(t), type(t), type(t), type(t)\nend",
+			"local b={}local a=type\nfunction b.f(c)\nreturn a(c),a(c),a(c),a(c),a(c)\nend",
+		},
+		{
+			"local s = \"a -- b\" .. [[x]] --[==[\ncomment\n]==]\nprint(s, 1 .. 2, 0x1p-2, - -1)",
+			"local a=\"a -- b\"..[[x]]\n\n\nprint(a,1 ..2,0x1p-2,- -1)",
+		},
+		{
+			"for i, v in ipairs(t) do\n\tlocal t = {v = v, [i] = i}\nend\nrepeat local x = f() until x",
+			"for a,b in ipairs(t)do\nlocal c={v=b,[a]=a}\nend\nrepeat local a=f()until a",
+		},
+		{
+			"local t = {}\nfunction t:m(x) return self, x end",
+			"local a={}\nfunction a:m(b)return self,b end",
+		},
+	}
+	for _, test := range tests {
+		got, err := Minify([]byte(test.src))
+		if err != nil {
+			t.Errorf("Minify(%q): Got error: %v", test.src, err)
+			continue
+		}
+		if string(got) != test.want {
+			t.Errorf("Minify(%q):\nGot:\n%s\nwant:\n%s", test.src, got, test.want)
+		}
+	}
+
+	// The builtins of every target can be minified
+	for _, target := range []Target{Lua51, Lua52, Lua53, Lua54, LuaJIT, WoW} {
+		buf := &bytes.Buffer{}
+		WriteBuiltinsFor(buf, target)
+		if _, err := Minify(buf.Bytes()); err != nil {
+			t.Errorf("Minifying the builtins for %s: Got error: %v", target, err)
+		}
+	}
+
+	for _, src := range []string{"local = 1", "x = 'unfinished", "f(", "if x then"} {
+		if _, err := Minify([]byte(src)); err == nil {
+			t.Errorf("Minify(%q) succeeded", src)
+		}
+	}
+}
+
+func TestSetMinify(t *testing.T) {
+	src := `// F adds one
+func F(value int) int {
+	sum := value + 1
+	return sum
+}`
+	get := func(f *ast.File) ast.Node {
+		return f
+	}
+	lua, _, err := parseStrWith(nil, src, get)
+	if err != nil {
+		t.Fatalf("Got error: %v", err)
+	}
+	min, _, err := parseStrWith(func(p *Parser) { p.SetMinify(true) }, src, get)
+	if err != nil {
+		t.Fatalf("Got error: %v", err)
+	}
+	// The first line, a comment, is empty and trimmed when minified
+	if got, want := strings.Count(min, "\n")+1, strings.Count(lua, "\n"); got != want {
+		t.Errorf("Minified code has %d lines; want %d", got, want)
+	}
+	if strings.Contains(min, "--") || strings.Contains(min, "\t") || strings.Contains(min, "value") {
+		t.Errorf("Got unminified code:\n%s", min)
+	}
+	if !strings.Contains(min, `_G["dummy"]`) {
+		t.Errorf("Got minified code without package table:\n%s", min)
+	}
+}
@@ -0,0 +1,85 @@
+package lunar
+
+import (
+	"go/ast"
+	"io"
+	"sort"
+	"strings"
+)
+
+// BuiltinsPath is the import path the module of the builtins is named by
+// in module mode. See SetModules.
+const BuiltinsPath = "github.com/eandre/lunar/builtins"
+
+// DefaultModuleName returns the name of the Lua module for the package
+// with the given import path: slashes become dots, which require maps to
+// directory separators, and dots become underscores. For example, the
+// module of "example.com/game/ui" is "example_com.game.ui".
+func DefaultModuleName(path string) string {
+	return strings.NewReplacer(".", "_", "/", ".").Replace(path)
+}
+
+// SetModules makes the parser write packages as Lua modules instead of
+// global package tables: a package is a module returning its package
+// table, and imports are require calls. The builtins are required as a
+// module too; see WriteBuiltinsModule.
+//
+// The names function maps import paths, and BuiltinsPath, to module
+// names. If it is nil, DefaultModuleName is used.
+func (p *Parser) SetModules(names func(path string) string) {
+	if names == nil {
+		names = DefaultModuleName
+	}
+	p.modules = names
+}
+
+// WriteModule writes the files of pkg, which must be part of the parser's
+// program, as a single Lua module. The parser must be in module mode. Like
+// ParseNode, WriteModule records diagnostics and a source map.
+func (p *Parser) WriteModule(w io.Writer, pkg *Package) error {
+	files := append([]*ast.File(nil), pkg.Files...)
+	sort.Slice(files, func(i, j int) bool {
+		return p.prog.Fset.File(files[i].Pos()).Name() < p.prog.Fset.File(files[j].Pos()).Name()
+	})
+	return p.parse(w, func(w *Writer) {
+		p.printChunk(w, p.parseModule(pkg, files))
+	})
+}
+
+// parseModule returns the files of pkg as a module returning the package
+// table. If there are multiple files, each is written in its own block to
+// keep its locals private, as they would be in a file of their own.
+func (p *Parser) parseModule(pkg *Package, files []*ast.File) []luaStmt {
+	name := "_" + pkg.Pkg.Name()
+	stmts := []luaStmt{
+		&luaCommentStmt{text: " Package declaration"},
+		&luaLocalStmt{names: []string{name}, values: []luaExpr{&luaTableLit{}}},
+		&luaBlankStmt{lines: 1},
+		&luaLocalStmt{names: []string{"builtins"}, values: []luaExpr{&luaCode{text: p.builtinsRef()}}},
+		&luaBlankStmt{lines: 1},
+	}
+
+	for _, f := range files {
+		var decls []luaStmt
+		for _, decl := range f.Decls {
+			decls = append(decls, p.parseNode(decl, true)...)
+		}
+		if len(files) > 1 {
+			stmts = append(stmts, &luaDoStmt{body: decls})
+		} else {
+			stmts = append(stmts, decls...)
+		}
+	}
+	if len(files) > 1 {
+		stmts = append(stmts, &luaBlankStmt{lines: 1})
+	}
+	return append(stmts, &luaReturnStmt{values: []luaExpr{luaIdentOf(name)}})
+}
+
+// builtinsRef returns the Lua expression evaluating to the builtins.
+func (p *Parser) builtinsRef() string {
+	if p.modules != nil {
+		return "require(" + luaQuote(p.modules(BuiltinsPath)) + ")"
+	}
+	return "_G.lunar_go_builtins"
+}
@@ -0,0 +1,114 @@
+package lunar
+
+import (
+	"bytes"
+	"go/ast"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/tools/go/packages"
+)
+
+func TestDefaultModuleName(t *testing.T) {
+	tests := []StringTest{
+		{"foo", "foo"},
+		{"example.com/game/ui", "example_com.game.ui"},
+		{BuiltinsPath, "github_com.eandre.lunar.builtins"},
+	}
+	for i, test := range tests {
+		if got := DefaultModuleName(test.Go); got != test.Lua {
+			t.Errorf("%d. Got module name %q for %q; want %q", i, got, test.Go, test.Lua)
+		}
+	}
+}
+
+func TestModuleFile(t *testing.T) {
+	src := `import (
+	"strings"
+	"unicode"
+	_ "os"
+)
+
+var X = strings.ToUpper("a")
+
+var Y = unicode.MaxRune`
+	names := func(path string) string {
+		return "mods." + strings.Replace(path, "/", ".", -1)
+	}
+	get := func(f *ast.File) ast.Node {
+		return f
+	}
+	lua, _, err := parseStrWith(func(p *Parser) { p.SetModules(names) }, src, get)
+	if err != nil {
+		t.Fatalf("Got error: %v", err)
+	}
+	want := `-- Package declaration
+local _dummy = {}
+
+local builtins = require("mods.github.com.eandre.lunar.builtins")
+
+local _strings = builtins.pkgs["strings"]
+local _unicode = require("mods.unicode")
+require("mods.os")
+
+_dummy.X = _strings.ToUpper("a")
+
+_dummy.Y = _unicode.MaxRune
+
+return _dummy`
+	if lua != want {
+		t.Errorf("Got Lua:\n%s\nwant:\n%s", lua, want)
+	}
+}
+
+func TestWriteModule(t *testing.T) {
+	dir := t.TempDir()
+	for name, src := range map[string]string{
+		"go.mod": "module example.com/m\n\ngo 1.18\n",
+		"a.go":   "package m\n\nvar A = 1\n",
+		"b.go":   "package m\n\nvar B = 2\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	prog, err := Load(&packages.Config{Dir: dir}, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewProgramParser(prog)
+	p.SetModules(nil)
+	buf := &bytes.Buffer{}
+	if err := p.WriteModule(buf, prog.Initial[0]); err != nil {
+		t.Fatalf("Got error: %v", err)
+	}
+	want := `-- Package declaration
+local _m = {}
+
+local builtins = require("github_com.eandre.lunar.builtins")
+
+do
+	_m.A = 1
+
+end
+do
+	_m.B = 2
+
+end
+
+return _m`
+	if lua := strings.TrimSpace(buf.String()); lua != want {
+		t.Errorf("Got Lua:\n%s\nwant:\n%s", lua, want)
+	}
+
+	buf.Reset()
+	if _, err := WriteBuiltinsModule(buf, Lua51); err != nil {
+		t.Fatalf("Got error: %v", err)
+	}
+	if lua := buf.String(); strings.Contains(lua, "_G.lunar_go_builtins") || !strings.HasSuffix(lua, "\nreturn builtins\n") {
+		t.Errorf("Builtins module does not return the builtins")
+	}
+}
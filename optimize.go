@@ -0,0 +1,321 @@
+package lunar
+
+import (
+	"sort"
+	"strconv"
+)
+
+// SetOptimize makes the parser simplify the Lua code it writes: index
+// expressions no longer fall back to zero values that are nil, integer
+// constant arithmetic is folded, small functions and builtins are
+// inlined, standard globals used often are cached in locals and blocks that
+// scope no locals are merged into their enclosing block. Small functions
+// are inlined like those declared with the //lunar:inline directive, whose
+// calls are inlined whether or not the output is optimized: only if their
+// body is a single return statement with one result.
+//
+// Like minified code, optimized code assumes that the standard globals it
+// uses are not replaced after it is loaded.
+func (p *Parser) SetOptimize(on bool) {
+	p.optimize = on
+}
+
+// luaOptimizations are the passes run after luaPasses if the parser
+// optimizes its output.
+var luaOptimizations = []func(p *Parser, chunk []luaStmt) []luaStmt{
+	(*Parser).removeNilFallbacks,
+	(*Parser).foldConstants,
+	(*Parser).inlineBuiltins,
+	(*Parser).removeScopes,
+	(*Parser).localizeGlobals,
+}
+
+// removeNilFallbacks removes the fallbacks of index expressions to the
+// zero value of their element type where it is nil anyway, turning
+// (t[k] or nil) into t[k].
+func (p *Parser) removeNilFallbacks(chunk []luaStmt) []luaStmt {
+	rewriteExprs(chunk, func(x luaExpr) luaExpr {
+		paren, ok := x.(*luaParenExpr)
+		if !ok {
+			return x
+		}
+		or, ok := paren.x.(*luaBinaryExpr)
+		if !ok || or.op != "or" || !isLuaNil(or.y) {
+			return x
+		}
+		if _, ok := or.x.(*luaIndexExpr); !ok {
+			return x
+		}
+		return withLuaPos(or.x, paren.Pos())
+	})
+	return chunk
+}
+
+// maxFolded is the largest integer that is folded. Larger results could
+// lose precision on targets without integers.
+const maxFolded = 1<<53 - 1
+
+// foldConstants folds the addition, subtraction and multiplication of
+// integer literals, such as the i + 1 of constant slice indexes, and
+// drops the parentheses around the resulting literals.
+func (p *Parser) foldConstants(chunk []luaStmt) []luaStmt {
+	rewriteExprs(chunk, func(x luaExpr) luaExpr {
+		switch x := x.(type) {
+		case *luaParenExpr:
+			if lit, ok := x.x.(*luaLit); ok {
+				return withLuaPos(lit, x.Pos())
+			}
+		case *luaBinaryExpr:
+			a, ok1 := luaIntLit(x.x)
+			b, ok2 := luaIntLit(x.y)
+			if !ok1 || !ok2 {
+				break
+			}
+			var v int64
+			switch x.op {
+			case "+":
+				v = a + b
+			case "-":
+				v = a - b
+			case "*":
+				if b != 0 && a > maxFolded/b {
+					return x
+				}
+				v = a * b
+			default:
+				return x
+			}
+			if v < 0 || v > maxFolded {
+				break
+			}
+			return &luaLit{luaPos: x.luaPos, text: strconv.FormatInt(v, 10)}
+		}
+		return x
+	})
+	return chunk
+}
+
+// luaIntLit returns the value of x if it is a decimal integer literal
+// small enough to be folded.
+func luaIntLit(x luaExpr) (int64, bool) {
+	lit, ok := x.(*luaLit)
+	if !ok || lit.text == "" || len(lit.text) > 15 {
+		return 0, false
+	}
+	for _, c := range lit.text {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+	}
+	v, err := strconv.ParseInt(lit.text, 10, 64)
+	return v, err == nil
+}
+
+// inlineBuiltins replaces the calls of builtins that are simple enough to
+// be written in place: builtins.length(x) becomes #(x or ""), which is 0
+// for nil like the builtin, and the statement builtins.delete(m, k)
+// becomes m[k] = nil.
+func (p *Parser) inlineBuiltins(chunk []luaStmt) []luaStmt {
+	rewriteExprs(chunk, func(x luaExpr) luaExpr {
+		if args, ok := builtinCall(x, "length"); ok && len(args) == 1 {
+			or := &luaBinaryExpr{op: "or", x: args[0], y: luaStringOf("")}
+			return &luaUnaryExpr{luaPos: luaPos{x.Pos()}, op: "#", x: or}
+		}
+		return x
+	})
+	return rewriteStmts(chunk, func(s luaStmt) []luaStmt {
+		if s, ok := s.(*luaExprStmt); ok {
+			if args, ok := builtinCall(s.x, "delete"); ok && len(args) == 2 {
+				return []luaStmt{&luaAssignStmt{
+					luaPos:  s.luaPos,
+					targets: []luaExpr{&luaIndexExpr{x: args[0], key: args[1]}},
+					values:  []luaExpr{luaLitOf("nil")},
+				}}
+			}
+		}
+		return nil
+	})
+}
+
+// builtinCall returns the arguments of x if it calls the builtin name.
+func builtinCall(x luaExpr, name string) ([]luaExpr, bool) {
+	call, ok := x.(*luaCallExpr)
+	if !ok || call.method != "" {
+		return nil, false
+	}
+	sel, ok := call.fn.(*luaSelectorExpr)
+	if !ok || sel.name != name {
+		return nil, false
+	}
+	if id, ok := sel.x.(*luaIdent); !ok || id.name != "builtins" {
+		return nil, false
+	}
+	return call.args, true
+}
+
+// removeScopes merges do blocks into their enclosing block where that
+// does not change what their locals and labels are visible to: blocks
+// that declare neither, and blocks ending their enclosing block.
+func (p *Parser) removeScopes(chunk []luaStmt) []luaStmt {
+	return removeScopesIn(chunk, false)
+}
+
+// removeScopesIn returns block with its do blocks merged into it. If open
+// is set, the locals of block are visible after its end, like those of the
+// body of a repeat loop to its condition.
+func removeScopesIn(block []luaStmt, open bool) []luaStmt {
+	var out []luaStmt
+	for i, s := range block {
+		removeNestedScopes(s)
+		do, ok := s.(*luaDoStmt)
+		if ok {
+			locals, labels := blockNames(do.body)
+			last := i == len(block)-1 && !open
+			if !labels && (last || !locals && !endsWithJump(do.body)) {
+				setLuaPos(do.body, do.Pos())
+				out = append(out, do.body...)
+				continue
+			}
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+// removeNestedScopes merges the do blocks of the blocks nested in n.
+func removeNestedScopes(n luaNode) {
+	for _, x := range luaExprs(n) {
+		removeNestedScopes(*x)
+	}
+	switch n := n.(type) {
+	case *luaRepeatStmt:
+		n.body = removeScopesIn(n.body, true)
+	case *luaWhileStmt:
+		// The post statements are written in the same block
+		n.body = removeScopesIn(n.body, len(n.post) > 0)
+		n.post = removeScopesIn(n.post, false)
+	default:
+		for _, b := range luaBlocks(n) {
+			*b = removeScopesIn(*b, false)
+		}
+	}
+}
+
+// blockNames reports whether block may declare locals and labels. Code
+// written as is may declare either.
+func blockNames(block []luaStmt) (locals, labels bool) {
+	for _, s := range block {
+		switch s := s.(type) {
+		case *luaLocalStmt:
+			locals = true
+		case *luaLabelStmt:
+			labels = true
+		case *luaCode:
+			return true, true
+		case *luaExprStmt:
+			if _, ok := s.x.(*luaCallExpr); !ok {
+				return true, true
+			}
+		}
+	}
+	return locals, labels
+}
+
+// endsWithJump reports whether block ends with a statement that must be
+// the last of its block in some Lua versions.
+func endsWithJump(block []luaStmt) bool {
+	if len(block) == 0 {
+		return false
+	}
+	switch block[len(block)-1].(type) {
+	case *luaReturnStmt, *luaBreakStmt:
+		return true
+	}
+	return false
+}
+
+// hotGlobalUses is the number of uses that makes a standard global worth
+// caching in a local.
+const hotGlobalUses = 3
+
+// localizeGlobals caches the standard globals used often in the chunk in
+// locals of the same name declared at its start. Globals the chunk
+// assigns, or declares locals or parameters of the same name as, are
+// left alone.
+func (p *Parser) localizeGlobals(chunk []luaStmt) []luaStmt {
+	uses := make(map[string]int)
+	taken := make(map[string]bool)
+	for _, s := range chunk {
+		walkLua(s, func(n luaNode) bool {
+			switch n := n.(type) {
+			case *luaIdent:
+				if hoistableGlobals[n.name] {
+					uses[n.name]++
+				}
+			case *luaLocalStmt:
+				for _, name := range n.names {
+					taken[name] = true
+				}
+			case *luaForInStmt:
+				for _, name := range n.names {
+					taken[name] = true
+				}
+			case *luaFuncLit:
+				for _, name := range n.params {
+					taken[name] = true
+				}
+			case *luaAssignStmt:
+				for _, x := range n.targets {
+					if id, ok := x.(*luaIdent); ok {
+						taken[id.name] = true
+					}
+				}
+			}
+			return true
+		})
+	}
+
+	var hot []string
+	for name, n := range uses {
+		if n >= hotGlobalUses && !taken[name] {
+			hot = append(hot, name)
+		}
+	}
+	if len(hot) == 0 {
+		return chunk
+	}
+	sort.Slice(hot, func(i, j int) bool {
+		if ui, uj := uses[hot[i]], uses[hot[j]]; ui != uj {
+			return ui > uj
+		}
+		return hot[i] < hot[j]
+	})
+	max := maxHoisted
+	if n := 180 - topLevelLocals(chunk); n < max {
+		// Functions are limited to 200 locals
+		max = n
+	}
+	if len(hot) > max {
+		hot = hot[:max]
+	}
+	sort.Strings(hot)
+
+	decls := make([]luaStmt, 0, len(hot)+1)
+	for _, name := range hot {
+		decls = append(decls, &luaLocalStmt{names: []string{name}, values: []luaExpr{luaIdentOf(name)}})
+	}
+	decls = append(decls, &luaBlankStmt{lines: 1})
+	return append(decls, chunk...)
+}
+
+// topLevelLocals returns the number of locals declared at the top level
+// of chunk.
+func topLevelLocals(chunk []luaStmt) int {
+	n := 0
+	for _, s := range chunk {
+		if s, ok := s.(*luaLocalStmt); ok {
+			n += len(s.names)
+		}
+	}
+	return n
+}
@@ -0,0 +1,120 @@
+package lunar
+
+import (
+	"bytes"
+	"go/ast"
+	"testing"
+)
+
+func TestOptimize(t *testing.T) {
+	tests := []struct {
+		name, src     string
+		before, after string
+	}{
+		{
+			"nil fallbacks",
+			`func testFunc(m map[string]*int, s []error) { _ = m["a"]; _ = s[0] }`,
+			"_ = (m[\"a\"] or nil)\n_ = (s[0 + 1] or nil)",
+			"_ = m[\"a\"]\n_ = s[1]",
+		},
+		{
+			"constant folding",
+			`func testFunc(s []int) int { return s[1] + s[2] }`,
+			"return (s[1 + 1] or 0) + (s[2 + 1] or 0)",
+			"return (s[2] or 0) + (s[3] or 0)",
+		},
+		{
+			"inlined builtins",
+			`func testFunc(s []int, m map[int]bool) int { delete(m, 1); return len(s) }`,
+			"builtins.delete(m, 1)\nreturn builtins.length(s)",
+			"m[1] = nil\nreturn #(s or \"\")",
+		},
+		{
+			"localized globals",
+			`func testFunc(m map[int]bool) (n int) {
+	for range m { n++ }
+	for range m { n++ }
+	for range m { n++ }
+	return n
+}`,
+			"for _ in pairs(m or {}) do\n\tn = n + 1\nend\nfor _ in pairs(m or {}) do\n\tn = n + 1\nend\nfor _ in pairs(m or {}) do\n\tn = n + 1\nend\nreturn n",
+			"local pairs = pairs\n\nfor _ in pairs(m or {}) do\n\tn = n + 1\nend\nfor _ in pairs(m or {}) do\n\tn = n + 1\nend\nfor _ in pairs(m or {}) do\n\tn = n + 1\nend\nreturn n",
+		},
+		// Blocks declaring locals are only removed at the end of their
+		// enclosing block
+		{
+			"scopes",
+			`func testFunc(s []int) {
+	for _, v := range s {
+		if w := v * 2; w > 2 {
+			println(w)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		s[i] = i
+	}
+}`,
+			"for _, v in builtins.slice_iter(s or {}) do\n\tdo\n\t\tlocal w = v * 2\n\t\tif w > 2 then\n\t\t\tprint(w)\n\t\tend\n\tend\nend\n" +
+				"do\n\tlocal i = 0\n\twhile i < 3 do\n\t\ts[i + 1] = i\n\t\ti = i + 1\n\tend\nend",
+			"for _, v in builtins.slice_iter(s or {}) do\n\tlocal w = v * 2\n\tif w > 2 then\n\t\tprint(w)\n\tend\nend\n" +
+				"local i = 0\nwhile i < 3 do\n\ts[i + 1] = i\n\ti = i + 1\nend",
+		},
+	}
+	get := func(f *ast.File) ast.Node {
+		return f.Decls[len(f.Decls)-1].(*ast.FuncDecl).Body
+	}
+	for _, test := range tests {
+		before, _, err := parseStrWith(nil, test.src, get)
+		if err != nil {
+			t.Errorf("%s: Got error: %v", test.name, err)
+			continue
+		}
+		after, _, err := parseStrWith(func(p *Parser) { p.SetOptimize(true) }, test.src, get)
+		if err != nil {
+			t.Errorf("%s: Got error with optimizations: %v", test.name, err)
+			continue
+		}
+		if before != test.before {
+			t.Errorf("%s: Got:\n%s\nwant:\n%s", test.name, before, test.before)
+		}
+		if after != test.after {
+			t.Errorf("%s: Got optimized:\n%s\nwant:\n%s", test.name, after, test.after)
+		}
+	}
+}
+
+func TestRemoveScopes(t *testing.T) {
+	call := func() luaStmt { return &luaExprStmt{x: luaCallOf(luaIdentOf("f"))} }
+	local := func() luaStmt { return &luaLocalStmt{names: []string{"x"}} }
+	tests := []struct {
+		stmts []luaStmt
+		want  string
+	}{
+		{
+			[]luaStmt{&luaDoStmt{body: []luaStmt{call()}}, &luaDoStmt{body: []luaStmt{local()}}},
+			"f()\nlocal x\n",
+		},
+		// Locals stay scoped if code follows, and returns must end a block
+		{
+			[]luaStmt{&luaDoStmt{body: []luaStmt{local()}}, &luaDoStmt{body: []luaStmt{&luaReturnStmt{}}}, call()},
+			"do\n\tlocal x\nend\ndo\n\treturn\nend\nf()\n",
+		},
+		// Labels are visible in nested blocks, which may have their own
+		{
+			[]luaStmt{&luaDoStmt{body: []luaStmt{&luaLabelStmt{name: "l"}}}},
+			"do\n\t::l::\nend\n",
+		},
+		// The locals of repeat loop bodies are visible to the condition
+		{
+			[]luaStmt{&luaRepeatStmt{body: []luaStmt{&luaDoStmt{body: []luaStmt{local()}}}, cond: luaIdentOf("x")}},
+			"repeat\n\tdo\n\t\tlocal x\n\tend\nuntil x\n",
+		},
+	}
+	for i, test := range tests {
+		var buf bytes.Buffer
+		printLua(NewWriter(&buf), (&Parser{}).removeScopes(test.stmts))
+		if got := buf.String(); got != test.want {
+			t.Errorf("%d. Got:\n%s\nwant:\n%s", i, got, test.want)
+		}
+	}
+}
@@ -5,85 +5,67 @@ import (
 	"go/types"
 )
 
-func (p *Parser) parseBuiltin(w *Writer, e *ast.CallExpr, tav types.TypeAndValue) {
+func (p *Parser) parseBuiltin(e *ast.CallExpr, tav types.TypeAndValue) luaExpr {
 	id := e.Fun.(*ast.Ident)
 	switch id.Name {
 	case "make":
 		typ := p.exprType(e.Args[0])
 		switch typ := typ.Underlying().(type) {
 		case *types.Map:
-			w.WriteString("{}")
+			return &luaTableLit{}
 		case *types.Slice:
-			w.WriteString("builtins.makeSlice(function() return ")
-			p.writeZeroValue(w, typ.Elem(), "")
-			w.WriteString(" end")
+			call := luaBuiltin("makeSlice", p.zeroValueFunc(typ.Elem()))
 			if len(e.Args) > 1 {
-				w.WriteString(", ")
-				p.parseExpr(w, e.Args[1])
+				call.args = append(call.args, p.parseExpr(e.Args[1]))
 			}
-			w.WriteByte(')')
+			return call
 		default:
-			p.errorf(e, "Unknown make() type %s", typ)
+			p.errorf(e, CodeUnsupported, "Unknown make() type %s", typ)
 		}
 
 	case "println":
-		w.WriteString("print(")
-		for i, arg := range e.Args {
-			p.parseExpr(w, arg)
-			if (i + 1) < len(e.Args) {
-				w.WriteString(", ")
-			}
-		}
-		w.WriteByte(')')
+		return luaCallOf(luaIdentOf("print"), p.parseArgs(e.Args)...)
 
 	case "print":
-		w.WriteString("write(")
-		for i, arg := range e.Args {
-			p.parseExpr(w, arg)
-			if (i + 1) < len(e.Args) {
-				w.WriteString(", ")
-			}
-		}
-		w.WriteByte(')')
+		return luaBuiltin("write", p.parseArgs(e.Args)...)
 
 	case "append":
-		w.WriteString("builtins.append(")
+		elem := p.exprType(e.Args[0]).(*types.Slice).Elem()
+		call := luaBuiltin("append")
 		for i, arg := range e.Args {
-			p.parseExpr(w, arg)
-			if (i + 1) < len(e.Args) {
-				w.WriteString(", ")
+			if i > 0 && !e.Ellipsis.IsValid() {
+				call.args = append(call.args, p.parseExprTo(arg, elem))
+			} else {
+				call.args = append(call.args, p.parseExpr(arg))
 			}
 		}
-		w.WriteByte(')')
+		return call
 
 	case "delete":
-		w.WriteString("builtins.delete(")
-		for i, arg := range e.Args {
-			p.parseExpr(w, arg)
-			if (i + 1) < len(e.Args) {
-				w.WriteString(", ")
-			}
-		}
-		w.WriteByte(')')
+		return luaBuiltin("delete", p.parseExpr(e.Args[0]), p.parseMapKey(e.Args[0], e.Args[1]))
 
 	case "panic":
-		w.WriteString("error(")
-		p.parseExpr(w, e.Args[0])
-		w.WriteByte(')')
+		return luaCallOf(luaIdentOf("error"), p.parseExpr(e.Args[0]))
 
 	case "len":
 		typ := p.exprType(e.Args[0])
 		switch typ.Underlying().(type) {
 		case *types.Map:
-			w.WriteString("builtins.mapLength(")
-			p.parseExpr(w, e.Args[0])
-			w.WriteByte(')')
+			return luaBuiltin("mapLength", p.parseExpr(e.Args[0]))
 		default:
-			w.WriteString("builtins.length(")
-			p.parseExpr(w, e.Args[0])
-			w.WriteByte(')')
+			return luaBuiltin("length", p.parseExpr(e.Args[0]))
 		}
 	default:
-		p.errorf(e, "Unhandled builtin %s", id.Name)
+		p.errorf(e, CodeUnsupported, "Unhandled builtin %s", id.Name)
+	}
+	return nil
+}
+
+// parseArgs returns the expressions args.
+func (p *Parser) parseArgs(args []ast.Expr) []luaExpr {
+	xs := make([]luaExpr, len(args))
+	for i, arg := range args {
+		xs[i] = p.parseExpr(arg)
 	}
+	return xs
 }
@@ -1,57 +1,106 @@
 package lunar
 
 import (
+	"fmt"
 	"go/ast"
 	"go/token"
 	"go/types"
+	"strconv"
+	"strings"
 )
 
-func (p *Parser) parseGenDecl(w *Writer, d *ast.GenDecl, topLevel bool) {
-	p.parseCommentGroup(w, d.Doc)
+func (p *Parser) parseGenDecl(d *ast.GenDecl, topLevel bool) []luaStmt {
+	if topLevel && !p.isLive(d) {
+		return nil
+	}
+	stmts := p.parseCommentGroup(d.Doc)
 	for _, spec := range d.Specs {
+		if topLevel && !p.isLive(spec) {
+			continue
+		}
+		dirs := p.specDirectives(d, spec, topLevel)
+		if dirs.ignore {
+			continue
+		}
+		var specStmts []luaStmt
 		switch d.Tok {
 		case token.TYPE:
-			p.parseTypeSpec(w, spec.(*ast.TypeSpec))
+			specStmts = p.parseTypeSpec(spec.(*ast.TypeSpec))
 		case token.IMPORT:
-			p.parseImportSpec(w, spec.(*ast.ImportSpec))
-		case token.CONST:
-			p.parseValueSpec(w, spec.(*ast.ValueSpec), topLevel)
-		case token.VAR:
-			p.parseValueSpec(w, spec.(*ast.ValueSpec), topLevel)
+			specStmts = p.parseImportSpec(spec.(*ast.ImportSpec))
+		case token.CONST, token.VAR:
+			specStmts = p.parseValueSpec(spec.(*ast.ValueSpec), topLevel, dirs)
 		default:
-			p.errorf(d, "Unhandled GenDecl token type %q", d.Tok.String())
+			p.errorf(d, CodeUnsupported, "Unhandled GenDecl token type %q", d.Tok.String())
 		}
+		setLuaPos(specStmts, spec.Pos())
+		stmts = append(stmts, specStmts...)
 	}
-	w.WriteNewline()
+	return append(stmts, p.blankLines())
 }
 
-func (p *Parser) parseTypeSpec(w *Writer, s *ast.TypeSpec) {
+// blankLines returns the blank lines separating declarations.
+func (p *Parser) blankLines() luaStmt {
+	return &luaBlankStmt{lines: p.style.BlankLines}
+}
+
+func (p *Parser) parseTypeSpec(s *ast.TypeSpec) []luaStmt {
+	if s.Assign.IsValid() {
+		// Type aliases refer to an existing type
+		return nil
+	}
+
 	switch t := s.Type.(type) {
 	case *ast.StructType:
-		p.parseStructType(w, t, s)
-	case *ast.InterfaceType, *ast.FuncType, *ast.Ident:
+		return p.parseStructType(t, s)
+	case *ast.InterfaceType:
 		// No need to write anything since they are only used for static typing
-	default:
-		p.errorf(s, "Unhandled TypeSpec type %T", t)
+		return nil
 	}
+	// Other named types still need a type table to hold their methods
+	// and to identify their values when boxed in interfaces.
+	return []luaStmt{&luaAssignStmt{
+		targets: []luaExpr{luaPath("_"+p.pkgName(s), s.Name.Name)},
+		values:  []luaExpr{p.typeTable(s, nil)},
+	}}
 }
 
-func (p *Parser) parseImportSpec(w *Writer, s *ast.ImportSpec) {
-	pkg := p.nodePkg(s)
-	if pkg.Implicits[s] == nil {
-		// Anonymous import
-		return
-	}
-
-	obj := p.importObject(s)
-	if pn, ok := obj.(*types.PkgName); ok && p.IsTransientPkg(pn.Imported()) {
-		return
+// typeTable returns the table constructor of the type table of s, listing
+// the given struct fields if fields is not nil. Type tables are always
+// written on one line, whatever the maximum width of the style.
+func (p *Parser) typeTable(s *ast.TypeSpec, fields []string) luaExpr {
+	text := fmt.Sprintf("{ __name = %q", p.pkgName(s)+"."+s.Name.Name)
+	if fields != nil {
+		pad := ""
+		if p.style.PadTables && len(fields) > 0 {
+			pad = " "
+		}
+		text += ", __fields = {" + pad + strings.Join(fields, ", ") + pad + "}"
 	}
+	return &luaCode{text: text + " }"}
+}
 
-	pkgName := pkg.Implicits[s].(*types.PkgName)
+func (p *Parser) parseImportSpec(s *ast.ImportSpec) []luaStmt {
 	importPath := s.Path.Value
 	importPath = importPath[1 : len(importPath)-1] // Skip surrounding quotes
 
+	require := func(path string) luaExpr {
+		return luaCallOf(luaIdentOf("require"), luaStringOf(p.modules(path)))
+	}
+
+	if s.Name != nil && s.Name.Name == "_" {
+		// Anonymous import; modules are only initialized once required
+		if p.modules != nil && !isStdlibShim(importPath) && !p.transient[importPath] {
+			return []luaStmt{&luaExprStmt{x: require(importPath)}}
+		}
+		return nil
+	}
+
+	pkgName := p.importObject(s).(*types.PkgName)
+	if p.IsTransientPkg(pkgName.Imported()) {
+		return nil
+	}
+
 	var localName string
 	// If we have a local name, use that. Dot imports are handled by the fact
 	// that all raw idents will get the package name prepended, so dot
@@ -62,181 +111,230 @@ func (p *Parser) parseImportSpec(w *Writer, s *ast.ImportSpec) {
 		// Otherwise use the package name of the actual package being imported
 		localName = pkgName.Imported().Name()
 	}
-	w.WriteLinef(`local _%s = _G["%s"]`, localName, importPath)
+	var pkg luaExpr
+	switch {
+	case isStdlibShim(importPath):
+		pkg = &luaIndexExpr{x: luaPath("builtins", "pkgs"), key: luaStringOf(importPath)}
+	case p.modules != nil:
+		pkg = require(importPath)
+	default:
+		pkg = &luaIndexExpr{x: luaIdentOf("_G"), key: luaStringOf(importPath)}
+	}
+	return []luaStmt{&luaLocalStmt{names: []string{"_" + localName}, values: []luaExpr{pkg}}}
 }
 
-func (p *Parser) parseValueSpec(w *Writer, s *ast.ValueSpec, topLevel bool) {
+func (p *Parser) parseValueSpec(s *ast.ValueSpec, topLevel bool, dirs *declDirectives) []luaStmt {
+	if dirs.extern || dirs.noinit {
+		// The variable is set from Lua
+		return nil
+	}
 	pkgName := p.pkgName(s)
-	for i, name := range s.Names {
-		var val ast.Expr
-		if len(s.Values) > i {
-			val = s.Values[i]
+	// declare returns the statement assigning values to the names
+	declare := func(names []*ast.Ident, values ...luaExpr) luaStmt {
+		if !topLevel {
+			local := &luaLocalStmt{values: values}
+			for _, name := range names {
+				local.names = append(local.names, name.Name)
+			}
+			return local
 		}
+		assign := &luaAssignStmt{values: values}
+		for _, name := range names {
+			name := name.Name
+			if dirs.name != "" {
+				name = dirs.name
+			}
+			assign.targets = append(assign.targets, luaPath("_"+pkgName, name))
+		}
+		return assign
+	}
 
-		if topLevel {
-			w.WriteStringf("_%s.%s = ", pkgName, name)
-		} else {
-			w.WriteStringf("local %s = ", name)
+	// Multiple names assigned from a single multi-valued expression
+	if len(s.Names) > 1 && len(s.Values) == 1 {
+		if ta, ok := s.Values[0].(*ast.TypeAssertExpr); ok {
+			return []luaStmt{declare(s.Names, p.parseTypeAssertExpr(ta, true))}
 		}
+		return []luaStmt{declare(s.Names, p.parseExpr(s.Values[0]))}
+	}
 
-		if val != nil {
-			p.parseExpr(w, val)
+	var stmts []luaStmt
+	for i, name := range s.Names {
+		typ := p.exprTypeRaw(name)
+		if len(s.Values) > i {
+			stmts = append(stmts, declare(s.Names[i:i+1], p.parseExprTo(s.Values[i], typ)))
 		} else {
-			typ := p.exprType(name)
-			p.writeZeroValue(w, typ.Underlying(), "")
+			stmts = append(stmts, declare(s.Names[i:i+1], p.getZeroValue(typ, "")))
 		}
-		w.WriteNewline()
 	}
+	return stmts
 }
 
-func (p *Parser) parseFuncDecl(w *Writer, d *ast.FuncDecl) {
+func (p *Parser) parseFuncDecl(d *ast.FuncDecl) []luaStmt {
+	if !p.isLive(d) {
+		return nil
+	}
+	dirs := p.funcDirectives(d)
+	if dirs.ignore || dirs.extern || dirs.noinit {
+		return nil
+	}
+	if dirs.inline && inlinedResult(d) == nil {
+		p.warnf(d, WarnNotInlined, "%s cannot be inlined: its body must be a single return statement with one result", d.Name.Name)
+	}
 	pkgName := p.pkgName(d)
 	recv := ""
-	isInit := false
 	if d.Recv != nil {
-		recv = d.Recv.List[0].Names[0].Name
+		field := d.Recv.List[0]
+		recv = "_"
+		if len(field.Names) > 0 {
+			recv = field.Names[0].Name
+		}
+	}
+
+	var stmt luaStmt
+	switch {
+	case d.Recv != nil:
 		var typeName string
 		switch typ := d.Recv.List[0].Type.(type) {
 		case *ast.StarExpr:
 			typeName = typ.X.(*ast.Ident).Name
+		case *ast.Ident:
+			typeName = typ.Name
 		default:
-			p.errorf(d, "Unhandled FuncDecl with Recv type %T", typ)
+			p.errorf(d, CodeUnsupported, "Unhandled FuncDecl with Recv type %T", typ)
 		}
-		w.WriteStringf("_%s.%s.%s = ", pkgName, typeName, d.Name.Name)
-	} else if d.Name.Name == "init" {
+		stmt = &luaAssignStmt{
+			targets: []luaExpr{luaPath("_"+pkgName, typeName, d.Name.Name)},
+			values:  []luaExpr{p.parseFunc(d.Type, d.Body, recv, d.Name)},
+		}
+	case d.Name.Name == "init":
 		// init function; handle specially
-		isInit = true
-		w.WriteString("builtins.add_init(")
-	} else {
-		w.WriteStringf("_%s.%s = ", pkgName, d.Name.Name)
+		stmt = &luaExprStmt{x: luaBuiltin("add_init", p.parseFunc(d.Type, d.Body, recv, d.Name))}
+	default:
+		name := d.Name.Name
+		if dirs.name != "" {
+			name = dirs.name
+		}
+		stmt = &luaAssignStmt{
+			targets: []luaExpr{luaPath("_"+pkgName, name)},
+			values:  []luaExpr{p.parseFunc(d.Type, d.Body, recv, d.Name)},
+		}
+		if global := dirs.globalName(name); global != "" {
+			return []luaStmt{stmt, &luaAssignStmt{
+				targets: []luaExpr{luaPath("_G", global)},
+				values:  []luaExpr{luaPath("_"+pkgName, name)},
+			}, p.blankLines()}
+		}
 	}
+	return []luaStmt{stmt, p.blankLines()}
+}
 
-	p.parseFunc(w, d.Type, d.Body, recv, d.Name)
-	if isInit {
-		w.WriteByte(')')
+func (p *Parser) parseStructType(t *ast.StructType, s *ast.TypeSpec) []luaStmt {
+	typeRef := luaPath("_"+p.pkgName(s), s.Name.Name)
+	path := func(field string) luaExpr {
+		return &luaSelectorExpr{x: luaPath("_"+p.pkgName(s), s.Name.Name), name: field}
 	}
 
-	w.WriteNewline()
-	w.WriteNewline()
-}
-
-func (p *Parser) parseStructType(w *Writer, t *ast.StructType, s *ast.TypeSpec) {
-	pkgName := p.pkgName(s)
-	w.WriteLinef("_%s.%s = {}", pkgName, s.Name.Name)
+	// The type table records the type name and field order, which are
+	// needed to format struct values at runtime.
+	strct := p.identObject(s.Name).Type().Underlying().(*types.Struct)
+	fields := make([]string, strct.NumFields())
+	for i := range fields {
+		fields[i] = strconv.Quote(computeFieldName(strct.Field(i).Name(), strct.Tag(i)))
+	}
+	stmts := []luaStmt{&luaAssignStmt{targets: []luaExpr{typeRef}, values: []luaExpr{p.typeTable(s, fields)}}}
 
 	// Introduce a per-type helper that can initialize structs from a table
-	{
-		w.WriteLinef(`
-_%s.%s._createFromTable = function(tbl)
-	if tbl == nil then
-		return nil, nil
-	end
-	if type(tbl) ~= "table" then
-		return nil, builtins.create_error("cannot initialize struct from non-table")
-	end
-	local self = setmetatable({}, {__index=_%s.%s})
-	local obj, err
-	`, pkgName, s.Name.Name, pkgName, s.Name.Name)
-
-		// For each field, add an initializer
-		obj := p.identObject(s.Name)
-		typ := obj.Type().Underlying().(*types.Struct)
-		for i := 0; i < typ.NumFields(); i++ {
-			// Get the raw field type
-			f := typ.Field(i)
-			fType := f.Type()
-			var named *types.Named
-			for {
-				if n, ok := fType.(*types.Named); named == nil && ok {
-					named = n
-				}
-
-				if ptr, ok := fType.Underlying().(*types.Pointer); ok {
-					fType = ptr.Elem()
-				} else {
-					break
-				}
+	create := &luaFuncLit{params: []string{"tbl"}}
+	create.body = append(create.body, &luaCode{text: `if tbl == nil then
+	return nil, nil
+end
+if type(tbl) ~= "table" then
+	return nil, builtins.create_error("cannot initialize struct from non-table")
+end`})
+	create.body = append(create.body,
+		&luaCode{text: fmt.Sprintf("local self = setmetatable({}, {__index=_%s.%s})", p.pkgName(s), s.Name.Name)},
+		&luaCode{text: "local obj, err"})
+	create.body = append(create.body, p.fieldInitializers(s, strct, true)...)
+	create.body = append(create.body, &luaCode{text: "return self, nil"})
+	stmts = append(stmts, p.blankLines(), &luaAssignStmt{
+		targets: []luaExpr{path("_createFromTable")},
+		values:  []luaExpr{create},
+	})
+
+	// And a helper to initialize an existing object
+	init := &luaFuncLit{params: []string{"self", "tbl"}}
+	init.body = append(init.body, &luaCode{text: `if tbl == nil then
+	return nil
+end
+if type(tbl) ~= "table" then
+	return builtins.create_error("cannot initialize struct from non-table")
+end
+local obj, err`})
+	init.body = append(init.body, p.fieldInitializers(s, strct, false)...)
+	init.body = append(init.body, &luaCode{text: "return nil"})
+	return append(stmts, p.blankLines(), &luaAssignStmt{
+		targets: []luaExpr{path("_initializeFromTable")},
+		values:  []luaExpr{init},
+	})
+}
+
+// fieldInitializers returns the statements of the table helpers of the
+// struct type s that initialize the fields of self from tbl. The helper
+// creating structs also initializes the fields missing from tbl, and
+// returns errors as its second result.
+func (p *Parser) fieldInitializers(s *ast.TypeSpec, strct *types.Struct, create bool) []luaStmt {
+	var stmts []luaStmt
+	code := func(format string, args ...interface{}) {
+		stmts = append(stmts, &luaCode{text: fmt.Sprintf(format, args...)})
+	}
+	errResult := "err"
+	if create {
+		errResult = "nil, err"
+	}
+	for i := 0; i < strct.NumFields(); i++ {
+		// Get the raw field type
+		f := strct.Field(i)
+		fType := f.Type()
+		var named *types.Named
+		for {
+			if n, ok := fType.(*types.Named); named == nil && ok {
+				named = n
 			}
 
-			name := f.Name()
-			switch fType := fType.Underlying().(type) {
-			case *types.Struct:
-				if named != nil {
-					w.WriteLinef(`
-		obj, err = _%s.%s._createFromTable(tbl.%s)
-		if err ~= nil then
-			return nil, err
-		end
-		self.%s = obj
-					`, named.Obj().Pkg().Name(), named.Obj().Name(), name, name)
-				} else {
-					w.WriteLinef("self.%s = tbl.%s", name, name)
-				}
-			case *types.Interface:
-				// do nothing, can't deserialize interface types since we don't know
-				// which concrete type to use.
-			default:
-				w.WriteLinef("\tself.%s = %s", name, p.getZeroValue(w, fType, ""))
-				w.WriteLinef("\tif type(self.%s) == type(tbl.%s) then self.%s = tbl.%s end", name, name, name, name)
+			if ptr, ok := fType.Underlying().(*types.Pointer); ok {
+				fType = ptr.Elem()
+			} else {
+				break
 			}
 		}
-		w.WriteLine("\treturn self, nil\nend")
-	}
 
-	// And a helper to initialize an existing object
-	{
-		w.WriteLinef(`
-_%s.%s._initializeFromTable = function(self, tbl)
-	if tbl == nil then
-		return nil
-	end
-	if type(tbl) ~= "table" then
-		return builtins.create_error("cannot initialize struct from non-table")
-	end
-	local obj, err
-		`, pkgName, s.Name.Name)
-
-		// For each field, add an initializer
-		obj := p.identObject(s.Name)
-		typ := obj.Type().Underlying().(*types.Struct)
-		for i := 0; i < typ.NumFields(); i++ {
-			// Get the raw field type
-			f := typ.Field(i)
-			fType := f.Type()
-			var named *types.Named
-			for {
-				if n, ok := fType.(*types.Named); named == nil && ok {
-					named = n
-				}
-
-				if ptr, ok := fType.Underlying().(*types.Pointer); ok {
-					fType = ptr.Elem()
-				} else {
-					break
-				}
+		name := computeFieldName(f.Name(), strct.Tag(i))
+		switch fType := fType.Underlying().(type) {
+		case *types.Struct:
+			if named != nil {
+				code(`obj, err = %s._createFromTable(tbl.%s)
+if err ~= nil then
+	return %s
+end
+self.%s = obj`, typeName(named), name, errResult, name)
+			} else {
+				code("self.%s = tbl.%s", name, name)
 			}
-
-			name := computeFieldName(f.Name(), typ.Tag(i))
-			switch fType.Underlying().(type) {
-			case *types.Struct:
-				if named != nil {
-					w.WriteLinef(`
-		obj, err = _%s.%s._createFromTable(tbl.%s)
-		if err ~= nil then
-			return err
-		end
-		self.%s = obj
-					`, named.Obj().Pkg().Name(), named.Obj().Name(), name, name)
-				} else {
-					w.WriteLinef("self.%s = tbl.%s", name, name)
-				}
-			case *types.Interface:
-				// do nothing, can't deserialize interface types since we don't know
-				// which concrete type to use.
-			default:
-				w.WriteLinef("\tif type(self.%s) == type(tbl.%s) then self.%s = tbl.%s end", name, name, name, name)
+		case *types.Interface:
+			// do nothing, can't deserialize interface types since we don't know
+			// which concrete type to use.
+			if create {
+				p.warnf(s, WarnInterfaceField, "Field %s of interface type %s is not initialized from tables", name, f.Type())
+			}
+		default:
+			if create {
+				stmts = append(stmts, &luaAssignStmt{
+					targets: []luaExpr{luaPath("self", name)},
+					values:  []luaExpr{p.getZeroValue(fType, "")},
+				})
 			}
+			code("if type(self.%s) == type(tbl.%s) then self.%s = tbl.%s end", name, name, name, name)
 		}
-		w.WriteLine("\treturn nil\nend")
 	}
+	return stmts
 }
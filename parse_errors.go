@@ -0,0 +1,63 @@
+package lunar
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+)
+
+// parseErrors handles calls to the errors package and to fmt.Errorf, which
+// are implemented by the runtime rather than compiled from Go sources. It
+// returns nil for other calls.
+func (p *Parser) parseErrors(e *ast.CallExpr) luaExpr {
+	fn := p.calledFunc(e)
+	if fn == nil {
+		return nil
+	}
+
+	switch fn.Pkg().Path() + "." + fn.Name() {
+	case "errors.New":
+		return p.runtimeCall("errors_new", e)
+	case "errors.Is":
+		return p.runtimeCall("errors_is", e)
+	case "errors.Unwrap":
+		return p.runtimeCall("errors_unwrap", e)
+	case "errors.Join":
+		return p.runtimeCall("errors_join", e)
+	case "errors.As":
+		return p.parseErrorsAs(e)
+	case "fmt.Errorf":
+		return p.runtimeCall("errorf", e)
+	}
+	return nil
+}
+
+// runtimeCall returns a call to the builtin fn with the arguments of e.
+func (p *Parser) runtimeCall(fn string, e *ast.CallExpr) luaExpr {
+	sig := p.exprType(e.Fun).(*types.Signature)
+	return luaBuiltin(fn, p.parseCallArgs(nil, e, sig, true)...)
+}
+
+// parseErrorsAs returns a call to errors.As. Since pointers to variables
+// are not supported, the target must be of the form &x, and x is assigned
+// through a closure.
+func (p *Parser) parseErrorsAs(e *ast.CallExpr) luaExpr {
+	addr, ok := e.Args[1].(*ast.UnaryExpr)
+	if !ok || addr.Op != token.AND {
+		p.error(e.Args[1], CodeInvalid, "errors.As target must be of the form &x")
+	}
+
+	set := &luaFuncLit{
+		params: []string{"v"},
+		body: []luaStmt{&luaAssignStmt{
+			targets: []luaExpr{p.parseExpr(addr.X)},
+			values:  []luaExpr{luaIdentOf("v")},
+		}},
+		oneLine: true,
+	}
+	typ := p.exprTypeRaw(addr.X)
+	if iface, ok := typ.Underlying().(*types.Interface); ok {
+		return luaBuiltin("errors_as_iface", p.parseExpr(e.Args[0]), p.methodList(iface), set)
+	}
+	return luaBuiltin("errors_as", p.parseExpr(e.Args[0]), p.typeDesc(typ), set)
+}
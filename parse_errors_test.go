@@ -0,0 +1,52 @@
+package lunar
+
+import (
+	"testing"
+)
+
+func TestErrors(t *testing.T) {
+	const decls = `
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrInvalid = errors.New("invalid")
+
+type FieldErr struct{ Field string }
+
+func (e *FieldErr) Error() string { return e.Field }
+
+var _ = fmt.Sprint
+`
+	RunDeclFuncTests(t, decls, []StringTest{
+		{
+			`_ = errors.New("x")`,
+			`_ = builtins.errors_new("x")`,
+		},
+		{
+			`_ = fmt.Errorf("x %d: %w", 5, ErrInvalid)`,
+			`_ = builtins.errorf("x %d: %w", 5, _dummy.ErrInvalid)`,
+		},
+		{
+			`var err error; _ = errors.Is(err, ErrInvalid)`,
+			"local err = nil\n\n_ = builtins.errors_is(err, _dummy.ErrInvalid)",
+		},
+		{
+			`var err error; _ = errors.Unwrap(err)`,
+			"local err = nil\n\n_ = builtins.errors_unwrap(err)",
+		},
+		{
+			`errs := []error{ErrInvalid}; _ = errors.Join(errs...)`,
+			"local errs = { _dummy.ErrInvalid }\n_ = builtins.errors_join(unpack(errs))",
+		},
+		{
+			`var err error; var fe *FieldErr; _ = errors.As(err, &fe)`,
+			"local err = nil\n\nlocal fe = nil\n\n_ = builtins.errors_as(err, builtins.ptr_type(\"*dummy.FieldErr\", _dummy.FieldErr), function(v) fe = v end)",
+		},
+		{
+			`var err error; var target interface{ Error() string }; _ = errors.As(err, &target)`,
+			"local err = nil\n\nlocal target = nil\n\n_ = builtins.errors_as_iface(err, { \"Error\" }, function(v) target = v end)",
+		},
+	})
+}
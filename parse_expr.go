@@ -1,16 +1,20 @@
 package lunar
 
 import (
+	"fmt"
 	"go/ast"
+	"go/constant"
 	"go/token"
 	"go/types"
 	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
 )
 
-func (p *Parser) parseExpr(w *Writer, s ast.Expr) {
+func (p *Parser) parseExpr(s ast.Expr) luaExpr {
 	if s == nil {
-		w.WriteString("nil")
-		return
+		return luaLitOf("nil")
 	}
 
 	switch t := s.(type) {
@@ -18,11 +22,13 @@ func (p *Parser) parseExpr(w *Writer, s ast.Expr) {
 	case *ast.Ident:
 		pkg := p.nodePkg(t)
 		obj := pkg.Info.ObjectOf(t)
+		if param := p.inlineParams[obj]; param != nil {
+			return param.use(t.Name)
+		}
 
 		// If this itself is a package name, write it outright
 		if _, ok := obj.(*types.PkgName); ok {
-			w.WriteString("_" + t.Name)
-			return
+			return luaIdentOf("_" + t.Name)
 		}
 
 		// Otherwise prepend the package name
@@ -40,257 +46,477 @@ func (p *Parser) parseExpr(w *Writer, s ast.Expr) {
 			}
 
 			if addPkg {
-				w.WriteString("_" + obj.Pkg().Name() + ".")
+				// Dot imports of the standard library
+				p.checkStdlibObject(t, obj)
+				return p.declRef(obj, luaIdentOf("_"+obj.Pkg().Name()))
 			}
 		}
-		w.WriteString(t.Name)
+		return luaIdentOf(t.Name)
 	case *ast.BasicLit:
-		p.parseBasicLit(w, t)
+		return p.parseBasicLit(t)
 	case *ast.ParenExpr:
-		w.WriteByte('(')
-		p.parseExpr(w, t.X)
-		w.WriteByte(')')
+		return &luaParenExpr{x: p.parseExpr(t.X)}
 	case *ast.TypeAssertExpr:
-		p.parseExpr(w, t.X) // noop for now
+		return p.parseTypeAssertExpr(t, false)
 
 	// More complex expression types, handled separately
 	case *ast.BinaryExpr:
-		p.parseBinaryExpr(w, t)
+		return p.parseBinaryExpr(t)
 	case *ast.CallExpr:
-		p.parseCallExpr(w, t)
+		return p.parseCallExpr(t)
 	case *ast.CompositeLit:
-		p.parseCompositeLit(w, t)
+		return p.parseCompositeLit(t)
 	case *ast.FuncLit:
-		p.parseFunc(w, t.Type, t.Body, "", nil)
+		return p.parseFunc(t.Type, t.Body, "", nil)
 	case *ast.SelectorExpr:
-		p.parseSelectorExpr(w, t, false)
+		return p.parseSelectorExpr(t)
 	case *ast.UnaryExpr:
-		p.parseUnaryExpr(w, t)
+		return p.parseUnaryExpr(t)
 	case *ast.IndexExpr:
-		p.parseIndexExpr(w, t, false)
+		return p.parseIndexExpr(t, false)
 	default:
-		p.errorf(s, "Unsupported expression type %T", s)
+		p.errorf(s, CodeUnsupported, "Unsupported expression type %T", s)
 	}
+	return nil
 }
 
-func (p *Parser) parseBasicLit(w *Writer, e *ast.BasicLit) {
+func (p *Parser) parseBasicLit(e *ast.BasicLit) luaExpr {
 	switch e.Kind {
-	case token.INT, token.FLOAT:
-		w.WriteString(e.Value)
-	case token.CHAR:
-		w.WriteStringf(`"%s"`, e.Value[1:len(e.Value)-1])
-	case token.STRING:
-		inner := e.Value[1 : len(e.Value)-1]
-		if e.Value[0] == '`' {
-			w.WriteStringf(`[=[%s]=]`, inner)
-		} else {
-			w.WriteStringf(`"%s"`, inner)
+	case token.INT:
+		// Lua understands decimal and hexadecimal literals only
+		if strings.HasPrefix(strings.ToLower(e.Value), "0x") && !strings.Contains(e.Value, "_") {
+			return luaLitOf(e.Value)
+		}
+		return luaLitOf(constant.MakeFromLiteral(e.Value, e.Kind, 0).ExactString())
+	case token.FLOAT:
+		if strings.ContainsAny(e.Value, "xX_") {
+			f, _ := constant.Float64Val(constant.MakeFromLiteral(e.Value, e.Kind, 0))
+			return luaLitOf(strconv.FormatFloat(f, 'g', -1, 64))
+		}
+		return luaLitOf(e.Value)
+	case token.CHAR, token.STRING:
+		if e.Kind == token.CHAR {
+			p.warnf(e, WarnRuneLiteral, "Rune literal %s is represented as a string", e.Value)
+		}
+		s, err := strconv.Unquote(e.Value)
+		if err != nil {
+			p.errorf(e, CodeInvalid, "Invalid literal %s: %v", e.Value, err)
 		}
+		return luaStringOf(s)
 	default:
-		p.errorf(e, "Unsupported basic literal type %s", e.Kind)
+		p.errorf(e, CodeUnsupported, "Unsupported basic literal type %s", e.Kind)
 	}
+	return nil
 }
 
-func (p *Parser) parseBinaryExpr(w *Writer, e *ast.BinaryExpr) {
-	isStr := func(x ast.Expr) bool {
-		typ := p.exprType(e.X).Underlying()
-		b, ok := typ.(*types.Basic)
-		return ok && (b.Info()&types.IsString) != 0
+// luaQuote returns a Lua string literal with the value s. Control
+// characters and invalid UTF-8 use decimal escapes, which unlike Go's
+// escapes are understood by all Lua versions.
+func luaQuote(s string) string {
+	var buf strings.Builder
+	buf.WriteByte('"')
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == '"' || r == '\\':
+			buf.WriteByte('\\')
+			buf.WriteRune(r)
+		case r == '\n':
+			buf.WriteString(`\n`)
+		case r == '\t':
+			buf.WriteString(`\t`)
+		case r == '\r':
+			buf.WriteString(`\r`)
+		case r < 0x20 || r == 0x7f || (r == utf8.RuneError && size == 1):
+			// Use three digits so a following digit is not part of the escape
+			fmt.Fprintf(&buf, "\\%03d", s[i])
+		default:
+			buf.WriteString(s[i : i+size])
+		}
+		i += size
 	}
+	buf.WriteByte('"')
+	return buf.String()
+}
 
-	p.parseExpr(w, e.X)
-	w.WriteByte(' ')
+func (p *Parser) parseBinaryExpr(e *ast.BinaryExpr) luaExpr {
+	if (e.Op == token.EQL || e.Op == token.NEQ) && p.isIfaceComparison(e) {
+		return p.parseIfaceComparison(e)
+	}
 	switch e.Op {
-	// Expressions that are cross-compatible
-	case token.SUB, token.MUL, token.QUO, token.REM, token.EQL, token.LSS, token.GTR, token.LEQ, token.GEQ:
-		w.WriteString(e.Op.String())
-	case token.ADD:
-		if isStr(e.X) || isStr(e.Y) {
-			w.WriteString("..")
-		} else {
-			w.WriteString("+")
-		}
-	case token.NOT:
-		w.WriteString("not")
-	case token.NEQ:
-		w.WriteString("~=")
-	case token.LOR:
-		w.WriteString("or")
-	case token.LAND:
-		w.WriteString("and")
-	case token.ADD_ASSIGN, token.SUB_ASSIGN, token.MUL_ASSIGN, token.QUO_ASSIGN, token.REM_ASSIGN:
-		// Make sure the left operator is of type Ident
-		if _, ok := e.X.(*ast.Ident); !ok {
-			p.errorf(e, "LHS of %s is type %T, not Ident", e.Op, e.X)
-		}
-		w.WriteString(" = ")
-		p.parseExpr(w, e.X)
-
-		// Handle add separately
-		if e.Op == token.ADD_ASSIGN {
-			if isStr(e.X) || isStr(e.Y) {
-				w.WriteString("..")
-			} else {
-				w.WriteString("+")
-			}
-		} else {
-			w.WriteByte(e.Op.String()[0])
+	case token.QUO, token.REM, token.AND, token.OR, token.XOR, token.SHL, token.SHR, token.AND_NOT:
+		if x := p.constIntExpr(e); x != nil {
+			return x
 		}
-	default:
-		p.errorf(e, "Got unhandled binary expression token type %q", e.Op.String())
 	}
-	w.WriteByte(' ')
-	p.parseExpr(w, e.Y)
+	return p.parseBinaryOp(e.X, e.Op, e.Y)
 }
 
-func (p *Parser) parseCallExpr(w *Writer, e *ast.CallExpr) {
-	if ok := p.parseRaw(w, e); ok {
-		return
+func (p *Parser) parseCallExpr(e *ast.CallExpr) (x luaExpr) {
+	defer func() {
+		if x != nil && !x.Pos().IsValid() {
+			x.setPos(e.Pos())
+		}
+	}()
+	if x := p.parseRaw(e); x != nil {
+		return x
+	}
+	if x := p.parseErrors(e); x != nil {
+		return x
+	}
+	if x := p.parseLuaCall(e); x != nil {
+		return x
 	}
 
 	// If we have a builtin, handle it separately
 	tav := p.exprTypeAndValue(e.Fun)
 	if tav.IsBuiltin() {
-		p.parseBuiltin(w, e, tav)
-		return
+		return p.parseBuiltin(e, tav)
 	}
-	// If we have a type conversion, just unwrap it
+	// Type conversions are no-ops, except for conversions to interfaces
+	// and conversions from floats to integers, which truncate.
 	if tav.IsType() {
-		w.WriteByte('(')
-		p.parseExpr(w, e.Args[0])
-		w.WriteByte(')')
-		return
+		if isInteger(tav.Type) && isFloat(p.exprType(e.Args[0])) {
+			if x := p.constIntExpr(e); x != nil {
+				return x
+			}
+			return luaBuiltin("toint", p.parseExpr(e.Args[0]))
+		}
+		return &luaParenExpr{x: p.parseExprTo(e.Args[0], tav.Type)}
+	}
+	if x := p.parseMultiCall(e); x != nil {
+		// The values returned are only packed when used as a Multi
+		return &luaTableLit{items: []luaItem{{value: x}}}
 	}
+	return p.parseFuncCall(e)
+}
 
+// parseFuncCall returns a call of a function or method.
+func (p *Parser) parseFuncCall(e *ast.CallExpr) luaExpr {
+	sig, _ := p.exprType(e.Fun).(*types.Signature)
+	convert := !p.isTransientCall(e)
+	call := &luaCallExpr{}
 	if sel, ok := e.Fun.(*ast.SelectorExpr); ok {
-		p.parseSelectorExpr(w, sel, true)
-	} else {
-		p.parseExpr(w, e.Fun)
+		if named := p.staticRecv(sel); named != nil {
+			// Methods on named non-struct types cannot be looked up on the
+			// value itself, so call them directly with the receiver.
+			call.fn = &luaSelectorExpr{x: p.typeRef(named), name: sel.Sel.Name}
+			call.args = p.parseCallArgs(sel.X, e, sig, convert)
+			if x := p.inlineCall(e, call); x != nil {
+				return x
+			}
+			return call
+		}
+		if s := p.nodePkg(sel).Selections[sel]; s != nil && s.Kind() == types.MethodVal {
+			call.fn, call.method = p.parseExpr(sel.X), sel.Sel.Name
+		}
+	}
+	if call.fn == nil {
+		call.fn = p.parseExpr(e.Fun)
 	}
+	call.args = p.parseCallArgs(nil, e, sig, convert)
+	if x := p.inlineCall(e, call); x != nil {
+		return x
+	}
+	return call
+}
 
-	w.WriteByte('(')
+// parseCallArgs returns the arguments of a call, preceded by recv if it is
+// not nil. If convert is set, the arguments are converted to the parameter
+// types of sig.
+func (p *Parser) parseCallArgs(recv ast.Expr, e *ast.CallExpr, sig *types.Signature, convert bool) []luaExpr {
+	var args []luaExpr
+	if recv != nil {
+		args = append(args, p.parseExpr(recv))
+	}
 	narg := len(e.Args)
+	fmtCall := convert && sig != nil && sig.Variadic() && p.isFmtCall(e)
 	for i, arg := range e.Args {
 		lastArg := (i + 1) == narg
 		if e.Ellipsis.IsValid() && lastArg {
-			w.WriteString("unpack(")
-			p.parseExpr(w, arg)
-			w.WriteByte(')')
+			args = append(args, p.parseSpread(arg))
+		} else if fmtCall && i >= sig.Params().Len()-1 {
+			args = append(args, p.parseFmtArg(arg, paramType(sig, i)))
+		} else if convert && sig != nil && (narg == sig.Params().Len() || sig.Variadic()) {
+			args = append(args, p.parseExprTo(arg, paramType(sig, i)))
 		} else {
-			p.parseExpr(w, arg)
-		}
-		if !lastArg {
-			w.WriteString(", ")
+			args = append(args, p.parseExpr(arg))
 		}
 	}
-	w.WriteByte(')')
+	return args
 }
 
-func (p *Parser) parseCompositeLit(w *Writer, l *ast.CompositeLit) {
-	typ := p.exprType(l)
-	switch typ := typ.Underlying().(type) {
-	case *types.Array, *types.Slice:
-		w.WriteString("{ ")
-		nel := len(l.Elts)
-		for i, el := range l.Elts {
-			p.parseExpr(w, el)
-			if (i + 1) != nel {
-				w.WriteString(", ")
-			}
-		}
-		w.WriteString(" }")
+// paramType returns the type of the i'th argument passed to a function
+// with the given signature, or nil if there is no such parameter.
+func paramType(sig *types.Signature, i int) types.Type {
+	params := sig.Params()
+	n := params.Len()
+	if sig.Variadic() && i >= n-1 {
+		return params.At(n - 1).Type().(*types.Slice).Elem()
+	}
+	if i < n {
+		return params.At(i).Type()
+	}
+	return nil
+}
+
+// calledFunc returns the package-level function called by e, or nil if e
+// calls a method or a function value.
+func (p *Parser) calledFunc(e *ast.CallExpr) *types.Func {
+	var id *ast.Ident
+	switch fun := e.Fun.(type) {
+	case *ast.Ident:
+		id = fun
+	case *ast.SelectorExpr:
+		id = fun.Sel
+	default:
+		return nil
+	}
+	fn, ok := p.nodePkg(id).Info.Uses[id].(*types.Func)
+	if !ok || fn.Pkg() == nil || fn.Type().(*types.Signature).Recv() != nil {
+		return nil
+	}
+	return fn
+}
+
+// isTransientCall reports whether e calls a function or method declared
+// in a transient package.
+func (p *Parser) isTransientCall(e *ast.CallExpr) bool {
+	var id *ast.Ident
+	switch fun := e.Fun.(type) {
+	case *ast.Ident:
+		id = fun
+	case *ast.SelectorExpr:
+		id = fun.Sel
+	default:
+		return false
+	}
+	obj := p.nodePkg(id).Info.ObjectOf(id)
+	return obj != nil && p.IsTransientPkg(obj.Pkg())
+}
+
+func (p *Parser) parseCompositeLit(l *ast.CompositeLit) luaExpr {
+	// Use the type of the literal itself rather than l.Type, since the type
+	// is elided for composite literals nested in other composite literals.
+	raw := p.exprTypeRaw(l)
+	if ptr, ok := raw.Underlying().(*types.Pointer); ok {
+		// Elided &T{} literals are typed as *T
+		raw = ptr.Elem()
+	}
+
+	switch typ := raw.Underlying().(type) {
+	case *types.Array:
+		return p.parseArrayLit(l, typ.Elem(), typ.Len())
+	case *types.Slice:
+		return p.parseArrayLit(l, typ.Elem(), -1)
 
 	case *types.Map:
-		w.WriteString("{ ")
-		nel := len(l.Elts)
-		for i, el := range l.Elts {
+		key, elem := typ.Key(), typ.Elem()
+		if p.isLuaType(raw) {
+			key, elem = nil, nil
+		}
+		tbl := &luaTableLit{}
+		for _, el := range l.Elts {
 			kv := el.(*ast.KeyValueExpr)
-			w.WriteByte('[')
-			p.parseExpr(w, kv.Key)
-			w.WriteString("] = ")
-			p.parseExpr(w, kv.Value)
-			if (i + 1) != nel {
-				w.WriteString(", ")
-			}
+			tbl.items = append(tbl.items, luaItem{
+				key:   p.parseExprTo(kv.Key, key),
+				value: p.parseExprTo(kv.Value, elem),
+			})
 		}
-		w.WriteString(" }")
+		return tbl
 
 	case *types.Struct:
-		// Constructor of a type
-		// Check if we have methods
-		typTyp := p.exprTypeRaw(l.Type)
-		mset := types.NewMethodSet(types.NewPointer(typTyp))
-		haveMethods := mset.Len() > 0
-
-		if haveMethods {
-			w.WriteString("setmetatable({ ")
-		} else {
-			w.WriteString("{ ")
-		}
-
-		initialized := map[string]bool{}
-		nel := len(l.Elts)
-		for i, el := range l.Elts {
-			var value ast.Expr
-			var fieldName string
-			w.WriteString(`["`)
-			if kv, ok := el.(*ast.KeyValueExpr); ok {
-				fieldName = kv.Key.(*ast.Ident).Name
-				value = kv.Value
-			} else {
-				fieldName = typ.Field(i).Name()
-				value = el
-			}
-			w.WriteString(getFieldName(typ, fieldName))
-			w.WriteString(`"] = `)
-			p.parseExpr(w, value)
-			if (i + 1) != nel {
-				w.WriteString(", ")
-			}
+		return p.parseStructLit(l, raw, typ)
+	default:
+		p.errorf(l, CodeUnsupported, "Unhandled CompositeLit type: %T", typ)
+	}
+	return nil
+}
 
-			initialized[fieldName] = true
+// parseArrayLit returns an array or slice literal. length is the length of
+// the array type, or -1 for slices.
+func (p *Parser) parseArrayLit(l *ast.CompositeLit, elem types.Type, length int64) luaExpr {
+	keyed := false
+	for _, el := range l.Elts {
+		if _, ok := el.(*ast.KeyValueExpr); ok {
+			keyed = true
+			break
 		}
+	}
+
+	to := elem
+	if p.isLuaType(p.exprTypeRaw(l)) {
+		to = nil
+	}
 
-		// Go through all fields that were not initialized and assign default values
-		for i := 0; i < typ.NumFields(); i++ {
-			field := typ.Field(i)
-			if !initialized[field.Name()] {
-				if val := p.getZeroValue(w, field.Type(), typ.Tag(i)); val != "nil" {
-					if i > 0 || len(initialized) > 0 {
-						// We have a previous field; add a preceding comma
-						w.WriteString(", ")
-					}
+	// Simple case: a list of values without any holes
+	tbl := &luaTableLit{}
+	if !keyed && (length < 0 || int64(len(l.Elts)) == length) {
+		for _, el := range l.Elts {
+			tbl.items = append(tbl.items, luaItem{value: p.parseExprTo(el, to)})
+		}
+		return tbl
+	}
 
-					w.WriteStringf(`["%s"] = %s`, computeFieldName(field.Name(), typ.Tag(i)), val)
-				}
-			}
+	// Resolve the index of each element. Elements without a key follow
+	// the previous element.
+	elts := make(map[int64]ast.Expr, len(l.Elts))
+	var idx, n int64
+	for _, el := range l.Elts {
+		if kv, ok := el.(*ast.KeyValueExpr); ok {
+			idx = p.constInt(kv.Key)
+			el = kv.Value
 		}
+		elts[idx] = el
+		idx++
+		if idx > n {
+			n = idx
+		}
+	}
+	if length > n {
+		n = length
+	}
 
-		if haveMethods {
-			w.WriteString(" }, {__index=")
-			p.parseExpr(w, l.Type)
-			w.WriteString("})")
+	// Lua tables cannot hold holes reliably, so fill them with zero values
+	for i := int64(0); i < n; i++ {
+		if el, ok := elts[i]; ok {
+			tbl.items = append(tbl.items, luaItem{value: p.parseExprTo(el, to)})
 		} else {
-			w.WriteString("}")
+			tbl.items = append(tbl.items, luaItem{value: p.getZeroValue(elem, "")})
 		}
-	default:
-		p.errorf(l, "Unhandled CompositeLit type: %T", typ)
 	}
+	return tbl
 }
 
-func (p *Parser) parseFunc(w *Writer, typ *ast.FuncType, body *ast.BlockStmt, recv string, declName *ast.Ident) {
-	w.WriteString("function(")
-	params := typ.Params.List
+// parseStructLit returns a struct literal. typ is the (possibly named) type
+// of the literal and strct its underlying struct type.
+func (p *Parser) parseStructLit(l *ast.CompositeLit, typ types.Type, strct *types.Struct) luaExpr {
+	// The fields given, followed by the zero values of the fields that are
+	// not initialized
+	tbl := &luaTableLit{}
+	initialized := map[string]bool{}
+	for i, el := range l.Elts {
+		value := el
+		fieldName := strct.Field(i).Name()
+		if kv, ok := el.(*ast.KeyValueExpr); ok {
+			fieldName = kv.Key.(*ast.Ident).Name
+			value = kv.Value
+		}
+		to := fieldType(strct, fieldName)
+		if p.isLuaType(typ) {
+			to = nil
+		}
+		tbl.items = append(tbl.items, luaItem{
+			key:   luaStringOf(getFieldName(strct, fieldName)),
+			value: p.parseExprTo(value, to),
+		})
+		initialized[fieldName] = true
+	}
+	for i := 0; i < strct.NumFields(); i++ {
+		field := strct.Field(i)
+		if !initialized[field.Name()] {
+			if val := p.getZeroValue(field.Type(), strct.Tag(i)); !isLuaNil(val) {
+				tbl.items = append(tbl.items, luaItem{
+					key:   luaStringOf(computeFieldName(field.Name(), strct.Tag(i))),
+					value: val,
+				})
+			}
+		}
+	}
+	return p.withMetatable(tbl, typ)
+}
 
-	if recv != "" {
-		w.WriteString(recv)
-		if len(params) > 0 {
-			w.WriteString(", ")
+// withMetatable returns tbl given a metatable pointing to the type table
+// of typ if it is a named struct type. The type table holds the methods of
+// the struct and identifies its dynamic type.
+func (p *Parser) withMetatable(tbl *luaTableLit, typ types.Type) luaExpr {
+	named, ok := typ.(*types.Named)
+	if !ok {
+		return tbl
+	}
+	meta := &luaCode{text: "{__index=" + typeName(named) + "}"}
+	call := luaCallOf(luaIdentOf("setmetatable"), tbl, meta)
+	call.wrapping = true
+	return call
+}
+
+// convertStruct returns the struct value e converted to the struct type
+// to, or nil if the value can be used as it is. Values of named struct
+// types carry their type in their metatable, so converting a value of an
+// unnamed or another named struct type copies it with the metatable of to.
+// Literals are written with the type to directly.
+func (p *Parser) convertStruct(e ast.Expr, to types.Type) luaExpr {
+	toStruct, ok := to.Underlying().(*types.Struct)
+	if !ok {
+		return nil
+	}
+	from := p.exprTypeRaw(e)
+	fromStruct, ok := from.Underlying().(*types.Struct)
+	if !ok || types.Identical(from, to) {
+		return nil
+	}
+	toNamed, _ := to.(*types.Named)
+	if _, ok := from.(*types.Named); !ok && toNamed == nil {
+		// Unnamed struct types only differ in their tags
+		return nil
+	}
+	if lit, ok := ast.Unparen(e).(*ast.CompositeLit); ok {
+		// The field names of both types are the same
+		return p.parseStructLit(lit, to, toStruct)
+	}
+
+	var typ luaExpr = luaLitOf("nil")
+	if toNamed != nil {
+		typ = p.typeRef(toNamed)
+	}
+	// Fields whose luaname tags differ are renamed
+	renames := &luaTableLit{}
+	for i := 0; i < toStruct.NumFields(); i++ {
+		name := toStruct.Field(i).Name()
+		fromName := computeFieldName(name, fromStruct.Tag(i))
+		if toName := computeFieldName(name, toStruct.Tag(i)); toName != fromName {
+			renames.items = append(renames.items, luaItem{key: luaStringOf(fromName), value: luaStringOf(toName)})
 		}
 	}
+	if len(renames.items) == 0 {
+		return luaBuiltin("convert_struct", p.parseExpr(e), typ)
+	}
+	return luaBuiltin("convert_struct", p.parseExpr(e), typ, renames)
+}
+
+// typeRef returns the Lua expression referring to the table of a named type.
+func (p *Parser) typeRef(named *types.Named) luaExpr {
+	obj := named.Obj()
+	return luaPath("_"+obj.Pkg().Name(), obj.Name())
+}
+
+// typeName returns the Lua code of typeRef.
+func typeName(named *types.Named) string {
+	obj := named.Obj()
+	return fmt.Sprintf("_%s.%s", obj.Pkg().Name(), obj.Name())
+}
+
+// constInt returns the value of an integer constant expression.
+func (p *Parser) constInt(x ast.Expr) int64 {
+	tav := p.exprTypeAndValue(x)
+	if tav.Value == nil {
+		p.error(x, CodeInvalid, "Expected constant expression")
+	}
+	val, ok := constant.Int64Val(constant.ToInt(tav.Value))
+	if !ok {
+		p.error(x, CodeUnsupported, "Constant expression overflows int64")
+	}
+	return val
+}
+
+func (p *Parser) parseFunc(typ *ast.FuncType, body *ast.BlockStmt, recv string, declName *ast.Ident) luaExpr {
+	fn := &luaFuncLit{}
+	if recv != "" {
+		fn.params = append(fn.params, recv)
+	}
 
 	var names []string
-	for _, p := range params {
+	for _, p := range typ.Params.List {
 		for _, name := range p.Names {
 			names = append(names, name.Name)
 		}
@@ -305,25 +531,25 @@ func (p *Parser) parseFunc(w *Writer, typ *ast.FuncType, body *ast.BlockStmt, re
 	}
 
 	nn := len(names)
-	for i, name := range names {
-		if (i + 1) < nn {
-			w.WriteString(name + ", ")
-		} else if sig.Variadic() {
-			w.WriteString("...")
-		} else {
-			w.WriteString(name)
-		}
+	if sig.Variadic() && nn > 0 {
+		fn.params = append(fn.params, names[:nn-1]...)
+		fn.params = append(fn.params, "...")
+		fn.body = append(fn.body, &luaLocalStmt{
+			names:  []string{names[nn-1]},
+			values: []luaExpr{&luaCode{text: "{...}"}},
+		})
+	} else {
+		fn.params = append(fn.params, names...)
 	}
 
-	w.WriteByte(')')
-	w.WriteNewline()
-	w.Indent()
-	if sig.Variadic() {
-		w.WriteLinef("local %s = {...}", names[nn-1])
-	}
-	p.parseBlockStmt(w, body)
-	w.Dedent()
-	w.WriteString("end")
+	// Keep track of the signature for converting return values
+	p.funcSigs = append(p.funcSigs, sig)
+	defer func() {
+		p.funcSigs = p.funcSigs[:len(p.funcSigs)-1]
+	}()
+
+	fn.body = append(fn.body, p.parseBlockStmt(body)...)
+	return fn
 }
 
 func getFieldName(strct *types.Struct, defaultName string) string {
@@ -335,6 +561,16 @@ func getFieldName(strct *types.Struct, defaultName string) string {
 	return defaultName
 }
 
+// fieldType returns the type of the named field, or nil if there is none.
+func fieldType(strct *types.Struct, name string) types.Type {
+	for i := 0; i < strct.NumFields(); i++ {
+		if f := strct.Field(i); f.Name() == name {
+			return f.Type()
+		}
+	}
+	return nil
+}
+
 func computeFieldName(defaultName, tag string) string {
 	st := reflect.StructTag(tag)
 	if name := st.Get("luaname"); name != "" {
@@ -343,164 +579,204 @@ func computeFieldName(defaultName, tag string) string {
 	return defaultName
 }
 
-func (p *Parser) parseSelectorExpr(w *Writer, e *ast.SelectorExpr, inCall bool) {
+func (p *Parser) parseSelectorExpr(e *ast.SelectorExpr) luaExpr {
 	if ident, ok := e.X.(*ast.Ident); ok {
 		obj := p.identObject(ident)
 		if pn, ok := obj.(*types.PkgName); ok {
 			if p.IsTransientPkg(pn.Imported()) {
-				w.WriteString(e.Sel.Name)
-				return
+				return p.declRef(p.identObject(e.Sel), nil)
 			}
 		}
 	}
 
-	// See if e.X is a method
-	isMethod := false
-	selTyp := p.exprType(e.X)
-	for {
-		if ptr, ok := selTyp.(*types.Pointer); ok {
-			selTyp = ptr.Elem()
-		} else {
-			break
-		}
-	}
-	type hasMethods interface {
-		NumMethods() int
-		Method(i int) *types.Func
+	sel := p.nodePkg(e).Selections[e]
+	if sel == nil {
+		// Qualified identifier
+		obj := p.identObject(e.Sel)
+		p.checkStdlibObject(e, obj)
+		return p.declRef(obj, p.parseExpr(e.X))
 	}
-	if obj, ok := selTyp.(hasMethods); ok {
-		for i := 0; i < obj.NumMethods(); i++ {
-			m := obj.Method(i)
-			if m.Name() == e.Sel.Name {
-				isMethod = true
-				break
-			}
+
+	switch sel.Kind() {
+	case types.MethodExpr:
+		// Method expressions are plain functions taking the receiver first
+		if named := recvNamed(sel.Obj().(*types.Func)); named != nil {
+			return &luaSelectorExpr{x: p.typeRef(named), name: e.Sel.Name}
+		}
+		// Interface method; dispatch dynamically on the receiver
+		call := &luaCallExpr{fn: luaIdentOf("recv"), method: e.Sel.Name, args: []luaExpr{&luaVararg{}}}
+		return &luaFuncLit{
+			params:  []string{"recv", "..."},
+			body:    []luaStmt{&luaReturnStmt{values: []luaExpr{call}}},
+			oneLine: true,
 		}
-	}
 
-	selName := e.Sel.Name
-	if !isMethod {
-		// Not a method, but is it a field with a tag?
-		if strct, ok := selTyp.Underlying().(*types.Struct); ok {
-			selName = getFieldName(strct, selName)
+	case types.MethodVal:
+		// Method value; create a stable closure to preserve equality.
+		recv := p.parseExpr(e.X)
+		if named := p.staticRecv(e); named != nil {
+			recv = luaBuiltin("box", recv, p.typeRef(named))
 		}
+		return luaBuiltin("create_closure", recv, luaStringOf(e.Sel.Name))
 	}
 
-	if inCall {
-		p.parseExpr(w, e.X)
-		if isMethod {
-			w.WriteStringf(`:%s`, selName)
-		} else {
-			w.WriteStringf(`.%s`, selName)
-		}
-		return
+	// Regular field lookup, taking struct tags into account
+	selName := e.Sel.Name
+	recv := sel.Recv()
+	if ptr, ok := recv.Underlying().(*types.Pointer); ok {
+		recv = ptr.Elem()
+	}
+	if strct, ok := recv.Underlying().(*types.Struct); ok {
+		selName = getFieldName(strct, selName)
 	}
+	return &luaSelectorExpr{x: p.parseExpr(e.X), name: selName}
+}
 
-	// If the type is a function and we are referring to a method,
-	// this is a method expression.
-	if _, ok := p.exprType(e).(*types.Signature); ok && isMethod {
-		// Method expression; create a stable closure to preserve equality.
-		w.WriteString("builtins.create_closure(")
-		p.parseExpr(w, e.X)
-		w.WriteStringf(`, "%s")`, selName)
-		return
+// staticRecv returns the named type declaring the method selected by e if
+// the method must be called statically, because the receiver is of a named
+// non-struct type. It returns nil otherwise.
+func (p *Parser) staticRecv(e *ast.SelectorExpr) *types.Named {
+	sel := p.nodePkg(e).Selections[e]
+	if sel == nil || sel.Kind() != types.MethodVal || types.IsInterface(sel.Recv()) {
+		return nil
+	}
+	named := recvNamed(sel.Obj().(*types.Func))
+	if named == nil {
+		return nil
+	}
+	if _, ok := named.Underlying().(*types.Struct); ok {
+		return nil
 	}
+	return named
+}
 
-	// Regular field lookup
-	p.parseExpr(w, e.X)
-	w.WriteStringf(`.%s`, selName)
+// recvNamed returns the named type declaring the method fn, or nil if fn
+// is an interface method.
+func recvNamed(fn *types.Func) *types.Named {
+	recv := fn.Type().(*types.Signature).Recv().Type()
+	if ptr, ok := recv.(*types.Pointer); ok {
+		recv = ptr.Elem()
+	}
+	named, _ := recv.(*types.Named)
+	if named == nil || types.IsInterface(named) {
+		return nil
+	}
+	return named
 }
 
-func (p *Parser) parseUnaryExpr(w *Writer, e *ast.UnaryExpr) {
+func (p *Parser) parseUnaryExpr(e *ast.UnaryExpr) luaExpr {
 	switch e.Op {
 	case token.AND:
 		// Taking the address of something is a no-op in lua since we don't have value types
-		p.parseExpr(w, e.X)
+		return p.parseExpr(e.X)
 	case token.NOT:
-		w.WriteString("(not ")
-		p.parseExpr(w, e.X)
-		w.WriteByte(')')
+		return &luaParenExpr{x: &luaUnaryExpr{op: "not", x: p.parseExpr(e.X)}}
+	case token.XOR:
+		if x := p.constIntExpr(e); x != nil {
+			return x
+		}
+		return p.parseBitwiseOp(p.exprType(e.X), token.XOR, nil, e.X)
 	case token.SUB, token.ADD:
-		w.WriteString("(" + e.Op.String())
-		p.parseExpr(w, e.X)
-		w.WriteByte(')')
+		return &luaParenExpr{x: &luaUnaryExpr{op: e.Op.String(), x: p.parseExpr(e.X)}}
 	default:
-		p.errorf(e, "Unhandled UnaryExpr operand: %v", e.Op)
+		p.errorf(e, CodeUnsupported, "Unhandled UnaryExpr operand: %v", e.Op)
 	}
+	return nil
 }
 
-func (p *Parser) parseIndexExpr(w *Writer, e *ast.IndexExpr, assign bool) {
-	if !assign {
-		w.WriteByte('(')
+func (p *Parser) parseIndexExpr(e *ast.IndexExpr, assign bool) luaExpr {
+	if call, ok := ast.Unparen(e.X).(*ast.CallExpr); ok && !assign {
+		if multi := p.parseMultiCall(call); multi != nil {
+			return p.parseMultiIndex(multi, e.Index)
+		}
 	}
+	index := &luaIndexExpr{x: p.parseExpr(e.X), key: p.parseExpr(e.Index)}
 	typ := p.exprType(e.X).Underlying()
 	switch typ.(type) {
 	case *types.Map:
-		p.parseExpr(w, e.X)
-		w.WriteByte('[')
-		p.parseExpr(w, e.Index)
-		w.WriteByte(']')
+		index.key = p.parseMapKey(e.X, e.Index)
 	case *types.Slice, *types.Array:
-		p.parseExpr(w, e.X)
-		w.WriteByte('[')
-		p.parseExpr(w, e.Index)
-		w.WriteString(" + 1]")
+		index.key = &luaBinaryExpr{op: "+", x: index.key, y: luaLitOf("1")}
 	default:
-		p.errorf(e, "unhandled index type %s", typ)
+		p.errorf(e, CodeUnsupported, "unhandled index type %s", typ)
 	}
 
-	if !assign {
-		w.WriteString(" or ")
-		p.writeZeroValue(w, p.exprType(e).Underlying(), "")
-		w.WriteByte(')')
+	if assign {
+		return index
 	}
+	return &luaParenExpr{x: &luaBinaryExpr{op: "or", x: index, y: p.getZeroValue(p.exprTypeRaw(e), "")}}
 }
 
-func (p *Parser) isFuncLocal(obj types.Object) bool {
-	_, path, _ := p.prog.PathEnclosingInterval(obj.Pos(), obj.Pos())
-	for _, n := range path {
-		switch n.(type) {
-		case *ast.FieldList, *ast.Field, *ast.DeclStmt, *ast.AssignStmt, *ast.RangeStmt:
-			return true
-		}
+// parseMapKey returns the key k of the map m, converted to the key type of
+// the map so that keys converted to interfaces are looked up boxed like
+// they were stored.
+func (p *Parser) parseMapKey(m, k ast.Expr) luaExpr {
+	typ := p.exprTypeRaw(m)
+	if p.isLuaType(typ) {
+		return p.parseExpr(k)
 	}
-	return false
+	return p.parseExprTo(k, typ.Underlying().(*types.Map).Key())
 }
 
-func (p *Parser) parseZeroValue(w *Writer, typ ast.Expr) {
-	switch typ.(type) {
-	case *ast.ArrayType, *ast.MapType:
-		w.WriteString("{}")
-	default:
-		w.WriteString("nil")
+// isFuncLocal reports whether obj is declared inside a function, or is a
+// struct field, and thus is not a member of its package table.
+func (p *Parser) isFuncLocal(obj types.Object) bool {
+	if v, ok := obj.(*types.Var); ok && v.IsField() {
+		return true
 	}
+	return obj.Parent() != nil && obj.Pkg() != nil && obj.Parent() != obj.Pkg().Scope()
 }
 
-func (p *Parser) writeZeroValue(w *Writer, typ types.Type, tag string) {
-	w.WriteString(p.getZeroValue(w, typ, tag))
-}
-
-func (p *Parser) getZeroValue(w *Writer, typ types.Type, tag string) string {
+func (p *Parser) getZeroValue(typ types.Type, tag string) luaExpr {
 	st := reflect.StructTag(tag)
 	if val := st.Get("luadefault"); val != "" {
-		return val
+		return &luaCode{text: val}
 	}
 
-	switch typ := typ.(type) {
+	switch u := typ.Underlying().(type) {
 	case *types.Map:
-		return "nil"
+		return luaLitOf("nil")
 	case *types.Basic:
-		switch i := typ.Info(); true {
+		switch i := u.Info(); true {
 		case (i & types.IsBoolean) != 0:
-			return "false"
+			return luaLitOf("false")
 		case (i & types.IsNumeric) != 0:
-			return "0"
+			return luaLitOf("0")
 		case (i & types.IsString) != 0:
-			return `""`
+			return luaLitOf(`""`)
 		default:
 			panic("Unhandled zero value type")
 		}
+	case *types.Struct:
+		return p.getStructZeroValue(typ, u)
+	case *types.Array:
+		return luaBuiltin("makeSlice", p.zeroValueFunc(u.Elem()), luaLitOf(strconv.FormatInt(u.Len(), 10)))
 	default:
-		return "nil"
+		return luaLitOf("nil")
+	}
+}
+
+// zeroValueFunc returns a function returning a new zero value of typ each
+// time it is called.
+func (p *Parser) zeroValueFunc(typ types.Type) luaExpr {
+	return &luaFuncLit{
+		body:    []luaStmt{&luaReturnStmt{values: []luaExpr{p.getZeroValue(typ, "")}}},
+		oneLine: true,
+	}
+}
+
+// getStructZeroValue returns a table constructor for the zero value of a
+// struct. typ is the (possibly named) type and strct its underlying type.
+func (p *Parser) getStructZeroValue(typ types.Type, strct *types.Struct) luaExpr {
+	tbl := &luaTableLit{}
+	for i := 0; i < strct.NumFields(); i++ {
+		f := strct.Field(i)
+		if val := p.getZeroValue(f.Type(), strct.Tag(i)); !isLuaNil(val) {
+			tbl.items = append(tbl.items, luaItem{
+				key:   luaStringOf(computeFieldName(f.Name(), strct.Tag(i))),
+				value: val,
+			})
+		}
 	}
+	return p.withMetatable(tbl, typ)
 }
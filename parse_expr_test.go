@@ -55,3 +55,101 @@ func TestExpr(t *testing.T) {
 		},
 	})
 }
+
+func TestCompositeLit(t *testing.T) {
+	const decls = `
+type Point struct{ X, Y int }
+func (p *Point) Sum() int { return p.X + p.Y }
+type Plain struct{ A string; B *Point }
+`
+	RunDeclFuncTests(t, decls, []StringTest{
+		{
+			`a := []Point{{1, 2}}; _ = a`,
+			"local a = { setmetatable({ [\"X\"] = 1, [\"Y\"] = 2 }, {__index=_dummy.Point}) }\n_ = a",
+		},
+		{
+			`a := []*Point{{Y: 2}, &Point{}}; _ = a`,
+			"local a = { setmetatable({ [\"Y\"] = 2, [\"X\"] = 0 }, {__index=_dummy.Point}), setmetatable({ [\"X\"] = 0, [\"Y\"] = 0 }, {__index=_dummy.Point}) }\n_ = a",
+		},
+		{
+			`a := map[string]Point{"a": {1, 2}}; _ = a`,
+			"local a = { [\"a\"] = setmetatable({ [\"X\"] = 1, [\"Y\"] = 2 }, {__index=_dummy.Point}) }\n_ = a",
+		},
+		{
+			`a := struct{ A int; B string }{A: 5}; _ = a`,
+			"local a = { [\"A\"] = 5, [\"B\"] = \"\" }\n_ = a",
+		},
+		{
+			`a := Plain{B: &Point{1, 2}}; _ = a`,
+			"local a = setmetatable({ [\"B\"] = setmetatable({ [\"X\"] = 1, [\"Y\"] = 2 }, {__index=_dummy.Point}), [\"A\"] = \"\" }, {__index=_dummy.Plain})\n_ = a",
+		},
+		{
+			`a := [...]int{3: 1, 5}; _ = a`,
+			"local a = { 0, 0, 0, 1, 5 }\n_ = a",
+		},
+		{
+			`a := [3]string{"x"}; _ = a`,
+			"local a = { \"x\", \"\", \"\" }\n_ = a",
+		},
+		{
+			`a := []int{2: 1}; _ = a`,
+			"local a = { 0, 0, 1 }\n_ = a",
+		},
+		{
+			`var a struct{ A int }; _ = a`,
+			"local a = { [\"A\"] = 0 }\n\n_ = a",
+		},
+	})
+}
+
+func TestStructConversion(t *testing.T) {
+	const decls = `
+type Point struct{ X, Y int }
+type Vec struct {
+	X int ` + "`luaname:\"x\"`" + `
+	Y int
+}
+`
+	RunDeclFuncTests(t, decls, []StringTest{
+		{
+			`p := Point(struct{ X, Y int }{1, 2}); _ = p`,
+			"local p = (setmetatable({ [\"X\"] = 1, [\"Y\"] = 2 }, {__index=_dummy.Point}))\n_ = p",
+		},
+		{
+			`a := struct{ X, Y int }{1, 2}; var p Point = a; _ = p`,
+			"local a = { [\"X\"] = 1, [\"Y\"] = 2 }\nlocal p = builtins.convert_struct(a, _dummy.Point)\n\n_ = p",
+		},
+		{
+			`var p Point; v := Vec(p); _ = v`,
+			"local p = setmetatable({ [\"X\"] = 0, [\"Y\"] = 0 }, {__index=_dummy.Point})\n\nlocal v = (builtins.convert_struct(p, _dummy.Vec, { [\"X\"] = \"x\" }))\n_ = v",
+		},
+		{
+			`var p Point; a := struct{ X, Y int }(p); _ = a`,
+			"local p = setmetatable({ [\"X\"] = 0, [\"Y\"] = 0 }, {__index=_dummy.Point})\n\nlocal a = (builtins.convert_struct(p, nil))\n_ = a",
+		},
+		{
+			`var p, q Point; p = q; _ = p`,
+			"local p = setmetatable({ [\"X\"] = 0, [\"Y\"] = 0 }, {__index=_dummy.Point})\nlocal q = setmetatable({ [\"X\"] = 0, [\"Y\"] = 0 }, {__index=_dummy.Point})\n\np = q\n_ = p",
+		},
+	})
+}
+
+func TestStructConversionRuntime(t *testing.T) {
+	out := RunLua(t, `
+type Point struct{ X, Y int }
+
+func (p Point) Sum() int { return p.X + p.Y }
+
+func init() {
+	p := Point(struct{ X, Y int }{1, 2})
+	println(p.Sum())
+	a := struct{ X, Y int }{3, 4}
+	var q Point = a
+	a.X = 10
+	println(q.Sum(), a.X)
+}
+`)
+	if want := "3\n7\t10"; out != want {
+		t.Errorf("Got output %q; want %q", out, want)
+	}
+}
@@ -0,0 +1,200 @@
+package lunar
+
+import (
+	"fmt"
+	"go/ast"
+	"go/types"
+	"strconv"
+	"strings"
+)
+
+// isFmtCall reports whether e calls a function of the fmt package, whose
+// variadic arguments are formatted by the runtime.
+func (p *Parser) isFmtCall(e *ast.CallExpr) bool {
+	fn := p.calledFunc(e)
+	return fn != nil && fn.Pkg() != nil && fn.Pkg().Path() == "fmt"
+}
+
+// parseFmtArg returns the argument e of a function of the fmt package,
+// converted to the parameter type to. The Lua values of pointers, maps,
+// slices, arrays, unnamed structs and runes do not tell their Go type, so
+// they are boxed with a descriptor of their static type for the runtime to
+// format them like Go does.
+func (p *Parser) parseFmtArg(e ast.Expr, to types.Type) luaExpr {
+	typ := p.exprTypeRaw(e)
+	if !p.needsFmtType(typ) {
+		return p.parseExprTo(e, to)
+	}
+	box := luaBuiltin("box", p.parseExpr(e), p.fmtType(typ))
+	if n := fmtSliceLen(ast.Unparen(e), typ); n >= 0 {
+		// Trailing nil elements do not count in the length of Lua tables
+		box.args = append(box.args, luaLitOf(strconv.Itoa(n)))
+	}
+	return box
+}
+
+// needsFmtType reports whether values of type typ are boxed with their
+// type descriptor when passed to the fmt package.
+func (p *Parser) needsFmtType(typ types.Type) bool {
+	switch t := types.Unalias(typ).(type) {
+	case *types.Named:
+		if pkg := t.Obj().Pkg(); pkg == nil || pkg.Path() == LuaPkgPath || p.IsTransientPkg(pkg) {
+			return false
+		}
+		switch t.Underlying().(type) {
+		case *types.Pointer, *types.Map, *types.Slice, *types.Array:
+			return true
+		case *types.Struct:
+			return len(pointerFmtMethods(t)) > 0
+		}
+	case *types.Basic:
+		// Rune literals are written as strings
+		return t.Kind() == types.Int32 || t.Kind() == types.UntypedRune
+	case *types.Pointer, *types.Map, *types.Slice, *types.Array, *types.Struct:
+		return true
+	}
+	return false
+}
+
+// fmtSliceLen returns the length of the slice literal x of type typ if its
+// last element can be nil, or -1.
+func fmtSliceLen(x ast.Expr, typ types.Type) int {
+	lit, ok := x.(*ast.CompositeLit)
+	if !ok || len(lit.Elts) == 0 {
+		return -1
+	}
+	slice, ok := typ.Underlying().(*types.Slice)
+	if !ok {
+		return -1
+	}
+	switch slice.Elem().Underlying().(type) {
+	case *types.Interface, *types.Pointer, *types.Map, *types.Slice, *types.Signature, *types.Chan:
+	default:
+		return -1
+	}
+	n := 0
+	for _, el := range lit.Elts {
+		if _, ok := el.(*ast.KeyValueExpr); ok {
+			// Keyed elements leave the zero value, nil, in between
+			return -1
+		}
+		n++
+	}
+	return n
+}
+
+// fmtType returns the runtime descriptor of typ used by the fmt package.
+// Named types are described by their type table, basic types by their
+// name, and other types by descriptors built by the builtins, which are
+// created once per type. Interfaces are described by false, leaving the
+// dynamic type of values to the runtime.
+func (p *Parser) fmtType(typ types.Type) luaExpr {
+	typ = types.Unalias(typ)
+	name := luaStringOf(goTypeString(typ))
+	switch t := typ.(type) {
+	case *types.Named:
+		pkg := t.Obj().Pkg()
+		if pkg == nil || pkg.Path() == LuaPkgPath || p.IsTransientPkg(pkg) || types.IsInterface(t) {
+			return luaLitOf("false")
+		}
+		switch t.Underlying().(type) {
+		case *types.Pointer, *types.Map, *types.Slice, *types.Array:
+			return luaBuiltin("named_type", p.typeRef(t), p.fmtType(t.Underlying()))
+		case *types.Struct:
+			if hidden := pointerFmtMethods(t); len(hidden) > 0 {
+				names := &luaTableLit{}
+				for _, name := range hidden {
+					names.items = append(names.items, luaItem{value: luaStringOf(name)})
+				}
+				return luaBuiltin("value_type", p.typeRef(t), names)
+			}
+		}
+		return p.typeRef(t)
+	case *types.Basic:
+		return luaStringOf(goTypeString(types.Default(t)))
+	case *types.Pointer:
+		elem := p.fmtType(t.Elem())
+		if named, ok := types.Unalias(t.Elem()).(*types.Named); ok && len(pointerFmtMethods(named)) > 0 {
+			// Pointers have all methods of their element type
+			elem = p.typeRef(named)
+		}
+		return luaBuiltin("ptr_type", name, elem)
+	case *types.Slice:
+		return luaBuiltin("slice_type", name, p.fmtType(t.Elem()))
+	case *types.Array:
+		return luaBuiltin("array_type", name, p.fmtType(t.Elem()), luaLitOf(strconv.FormatInt(t.Len(), 10)))
+	case *types.Map:
+		return luaBuiltin("map_type", name, p.fmtType(t.Key()), p.fmtType(t.Elem()))
+	case *types.Struct:
+		fields, fieldTypes := &luaTableLit{}, &luaTableLit{}
+		for i := 0; i < t.NumFields(); i++ {
+			field := t.Field(i)
+			fields.items = append(fields.items, luaItem{value: luaStringOf(computeFieldName(field.Name(), t.Tag(i)))})
+			fieldTypes.items = append(fieldTypes.items, luaItem{value: p.fmtType(field.Type())})
+		}
+		return luaBuiltin("struct_type", name, fields, fieldTypes)
+	case *types.Interface:
+		return luaLitOf("false")
+	}
+	return name
+}
+
+// pointerFmtMethods returns the names of the methods the fmt package
+// calls, Error and String, that the named struct type t only has through
+// pointers. Struct values and pointers to them are the same Lua table, so
+// the runtime is told to ignore these methods when formatting values.
+func pointerFmtMethods(t *types.Named) []string {
+	var names []string
+	values, pointers := types.NewMethodSet(t), types.NewMethodSet(types.NewPointer(t))
+	for _, name := range []string{"Error", "String"} {
+		if values.Lookup(nil, name) == nil && pointers.Lookup(nil, name) != nil {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// goTypeString returns the name of typ as printed by the %T verb of the fmt
+// package, which follows the reflect package rather than go/types.
+func goTypeString(typ types.Type) string {
+	switch t := types.Unalias(typ).(type) {
+	case *types.Named:
+		if pkg := t.Obj().Pkg(); pkg != nil {
+			return pkg.Name() + "." + t.Obj().Name()
+		}
+		return t.Obj().Name()
+	case *types.Basic:
+		// byte and rune are printed as uint8 and int32
+		return types.Typ[t.Kind()].Name()
+	case *types.Pointer:
+		return "*" + goTypeString(t.Elem())
+	case *types.Slice:
+		return "[]" + goTypeString(t.Elem())
+	case *types.Array:
+		return fmt.Sprintf("[%d]%s", t.Len(), goTypeString(t.Elem()))
+	case *types.Map:
+		return "map[" + goTypeString(t.Key()) + "]" + goTypeString(t.Elem())
+	case *types.Struct:
+		if t.NumFields() == 0 {
+			return "struct {}"
+		}
+		fields := make([]string, t.NumFields())
+		for i := range fields {
+			field := t.Field(i)
+			s := goTypeString(field.Type())
+			if !field.Embedded() {
+				s = field.Name() + " " + s
+			}
+			if tag := t.Tag(i); tag != "" {
+				s += " " + strconv.Quote(tag)
+			}
+			fields[i] = s
+		}
+		return "struct { " + strings.Join(fields, "; ") + " }"
+	case *types.Interface:
+		if t.Empty() {
+			return "interface {}"
+		}
+	}
+	return types.TypeString(typ, func(pkg *types.Package) string { return pkg.Name() })
+}
@@ -0,0 +1,79 @@
+package lunar
+
+import (
+	"testing"
+)
+
+func TestFmt(t *testing.T) {
+	const decls = `
+import "fmt"
+
+type Celsius float64
+
+func (c Celsius) String() string { return fmt.Sprintf("%.1f", float64(c)) }
+`
+	RunDeclFuncTests(t, decls, []StringTest{
+		{
+			`fmt.Println("a", 1)`,
+			`_fmt.Println("a", 1)`,
+		},
+		{
+			`_ = fmt.Sprintf("%d-%s", 1, "x")`,
+			`_ = _fmt.Sprintf("%d-%s", 1, "x")`,
+		},
+		{
+			`var c Celsius; fmt.Print(c)`,
+			"local c = 0\n\n_fmt.Print(builtins.box(c, _dummy.Celsius))",
+		},
+		{
+			`args := []interface{}{1, 2}; _ = fmt.Sprint(args...)`,
+			"local args = { 1, 2 }\n_ = _fmt.Sprint(unpack(args))",
+		},
+		{
+			`n, err := fmt.Printf("%v", 1); _, _ = n, err`,
+			"local n, err = _fmt.Printf(\"%v\", 1)\n_, _ = n, err",
+		},
+	})
+}
+
+func TestFmtRuntime(t *testing.T) {
+	out := RunLua(t, `
+import "fmt"
+
+type P struct{ X, Y int }
+
+type T struct{ Field string }
+
+func (t *T) String() string { return "ptr" }
+
+func init() {
+	p := &P{1, 2}
+	fmt.Println(p)
+	fmt.Printf("%T %+v\n", p, p)
+	fmt.Println(map[int][]string{2: {"b"}, 1: {"a", "c"}})
+	fmt.Println(struct{ A, B int }{1, 2}, struct{}{})
+	fmt.Printf("%T\n", struct{ A int }{})
+	fmt.Println([]interface{}{1, "a", nil})
+	var m map[string]int
+	var s []int
+	fmt.Println(m, s)
+	fmt.Printf("%c %U %d\n", 'A', 'A', 'A')
+	fmt.Println('A', [2]bool{})
+	t := T{"a"}
+	fmt.Printf("%v %+v %v %v\n", t, t, &t, []T{t})
+}
+`)
+	want := `&{1 2}
+*dummy.P &{X:1 Y:2}
+map[1:[a c] 2:[b]]
+{1 2} {}
+struct { A int }
+[1 a <nil>]
+map[] []
+A U+0041 65
+65 [false false]
+{a} {Field:a} ptr [{a}]`
+	if out != want {
+		t.Errorf("Got output:\n%s\nwant:\n%s", out, want)
+	}
+}
@@ -0,0 +1,290 @@
+package lunar
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"strconv"
+)
+
+// Interface values are represented by the concrete value itself whenever
+// the value carries its dynamic type: pointers to named structs have a
+// metatable pointing to their type table, and values of type int, string
+// and bool, unnamed slices and maps are identified by their Lua type.
+// Values of other basic types, of named types, including struct values,
+// and nil pointers are boxed when converted to an interface so that they
+// retain their dynamic type and methods. Values stored in Lua types like
+// lua.Table are used as they are, see isLuaType.
+
+type boxKind int
+
+const (
+	noBox  boxKind = iota
+	boxVal         // box the value unconditionally
+	boxNil         // box the value only if it is nil
+)
+
+// parseExprTo returns the expression e converted to the type to, boxing
+// the value if necessary. Struct values converted to another struct type
+// are copied, see convertStruct.
+func (p *Parser) parseExprTo(e ast.Expr, to types.Type) luaExpr {
+	if to == nil {
+		return p.parseExpr(e)
+	}
+	if !types.IsInterface(to) {
+		if x := p.convertStruct(e, to); x != nil {
+			return x
+		}
+		return p.parseExpr(e)
+	}
+
+	from := p.exprTypeRaw(e)
+	switch p.boxKindOf(e, from) {
+	case boxVal:
+		return luaBuiltin("box", p.parseExpr(e), p.typeDesc(from))
+	case boxNil:
+		return luaBuiltin("box_nil", p.parseExpr(e), p.typeDesc(from))
+	}
+	return p.parseExpr(e)
+}
+
+// boxKindOf determines how a value of type typ must be boxed when
+// converted to an interface.
+func (p *Parser) boxKindOf(e ast.Expr, typ types.Type) boxKind {
+	typ = types.Unalias(typ)
+	if types.IsInterface(typ) {
+		return noBox
+	}
+
+	switch t := typ.(type) {
+	case *types.Named:
+		if p.isLuaType(t) {
+			// Values of Lua types are used as they are
+			return noBox
+		}
+		if _, ok := t.Underlying().(*types.Pointer); ok {
+			return boxNil
+		}
+		return boxVal
+	case *types.Basic:
+		switch types.Default(t).(*types.Basic).Kind() {
+		case types.Int, types.String, types.Bool, types.UntypedNil, types.UnsafePointer:
+			return noBox
+		}
+		return boxVal
+	case *types.Pointer:
+		if _, ok := t.Elem().(*types.Named); !ok {
+			return noBox
+		}
+		// Taking the address of something never yields nil
+		if u, ok := ast.Unparen(e).(*ast.UnaryExpr); ok && u.Op == token.AND {
+			return noBox
+		}
+		if _, ok := ast.Unparen(e).(*ast.CompositeLit); ok {
+			return noBox
+		}
+		return boxNil
+	}
+	return noBox
+}
+
+// isLuaType reports whether typ, or the type it points to, is declared by
+// the lua package or a transient package. Values of these types are passed
+// to Lua code, so the values stored in them are never boxed.
+func (p *Parser) isLuaType(typ types.Type) bool {
+	typ = types.Unalias(typ)
+	if ptr, ok := typ.(*types.Pointer); ok {
+		typ = types.Unalias(ptr.Elem())
+	}
+	named, ok := typ.(*types.Named)
+	if !ok || named.Obj().Pkg() == nil {
+		return false
+	}
+	pkg := named.Obj().Pkg()
+	return pkg.Path() == LuaPkgPath || p.IsTransientPkg(pkg)
+}
+
+// typeDesc returns a Lua expression describing the type at runtime. Named
+// types are described by their type table, pointers to them by a pointer
+// descriptor, and other types by their name, as returned by
+// builtins.type_of.
+func (p *Parser) typeDesc(typ types.Type) luaExpr {
+	typ = types.Unalias(typ)
+	if ptr, ok := typ.(*types.Pointer); ok {
+		if named, ok := types.Unalias(ptr.Elem()).(*types.Named); ok && named.Obj().Pkg() != nil {
+			return luaBuiltin("ptr_type", luaStringOf(goTypeString(typ)), p.typeRef(named))
+		}
+	}
+	if ptr, ok := typ.Underlying().(*types.Pointer); ok {
+		typ = types.Unalias(ptr.Elem())
+	}
+	if named, ok := typ.(*types.Named); ok && named.Obj().Pkg() != nil {
+		if _, ok := named.Underlying().(*types.Struct); ok && !p.isLuaType(named) {
+			// Struct values may hide methods of pointers; see fmtType
+			return p.fmtType(named)
+		}
+		return p.typeRef(named)
+	}
+
+	switch t := typ.Underlying().(type) {
+	case *types.Basic:
+		return luaStringOf(goTypeString(types.Default(t)))
+	case *types.Signature:
+		return luaStringOf("function")
+	}
+	return luaStringOf("table")
+}
+
+// methodList returns a Lua table constructor listing the method names of
+// an interface.
+func (p *Parser) methodList(iface *types.Interface) luaExpr {
+	tbl := &luaTableLit{}
+	for i := 0; i < iface.NumMethods(); i++ {
+		tbl.items = append(tbl.items, luaItem{value: luaStringOf(iface.Method(i).Name())})
+	}
+	return tbl
+}
+
+// isIfaceComparison reports whether the binary expression compares two
+// values at least one of which is an interface, and neither is nil.
+func (p *Parser) isIfaceComparison(e *ast.BinaryExpr) bool {
+	if p.isNilExpr(e.X) || p.isNilExpr(e.Y) {
+		return false
+	}
+	return types.IsInterface(p.exprTypeRaw(e.X)) || types.IsInterface(p.exprTypeRaw(e.Y))
+}
+
+// parseIfaceComparison returns an equality comparison involving interface
+// values. Both sides are converted to the interface type so that boxed
+// values compare by their dynamic type and value.
+func (p *Parser) parseIfaceComparison(e *ast.BinaryExpr) luaExpr {
+	iface := p.exprTypeRaw(e.X)
+	if !types.IsInterface(iface) {
+		iface = p.exprTypeRaw(e.Y)
+	}
+
+	eq := luaBuiltin("iface_eq", p.parseExprTo(e.X, iface), p.parseExprTo(e.Y, iface))
+	if e.Op == token.NEQ {
+		return &luaUnaryExpr{op: "not", x: eq}
+	}
+	return eq
+}
+
+// parseTypeAssertExpr returns a type assertion. If commaOk is set, the
+// assertion yields an additional boolean instead of panicking on failure.
+func (p *Parser) parseTypeAssertExpr(e *ast.TypeAssertExpr, commaOk bool) luaExpr {
+	typ := p.exprTypeRaw(e.Type)
+	if iface, ok := typ.Underlying().(*types.Interface); ok {
+		if commaOk {
+			return luaBuiltin("iface_assert_ok", p.parseExpr(e.X), p.methodList(iface))
+		}
+		return luaBuiltin("iface_assert", p.parseExpr(e.X), p.methodList(iface))
+	}
+
+	if commaOk {
+		return luaBuiltin("type_assert_ok", p.parseExpr(e.X), p.typeDesc(typ), p.getZeroValue(typ, ""))
+	}
+	return luaBuiltin("type_assert", p.parseExpr(e.X), p.typeDesc(typ))
+}
+
+func (p *Parser) parseTypeSwitchStmt(s *ast.TypeSwitchStmt) luaStmt {
+	// Break statements jump to the end of the switch, which is only
+	// possible on targets with goto.
+	info := &loopInfo{isSwitch: true}
+	p.loops = append(p.loops, info)
+	defer func() { p.loops = p.loops[:len(p.loops)-1] }()
+	if _, hasBreak := bodyBranches(s.Body); hasBreak && p.target.hasGoto() {
+		info.breakLabel = "switch_end"
+		if n := len(p.loops); n > 1 {
+			info.breakLabel += strconv.Itoa(n)
+		}
+	}
+
+	var stmts []luaStmt
+	if s.Init != nil {
+		stmts = p.parseStmt(s.Init)
+	}
+
+	var bind string
+	var x ast.Expr
+	switch a := s.Assign.(type) {
+	case *ast.AssignStmt:
+		bind = a.Lhs[0].(*ast.Ident).Name
+		x = a.Rhs[0].(*ast.TypeAssertExpr).X
+	case *ast.ExprStmt:
+		x = a.X.(*ast.TypeAssertExpr).X
+	default:
+		p.errorf(s, CodeUnsupported, "Unhandled type switch assignment %T", a)
+	}
+
+	// Evaluate the switch expression only once
+	stmts = append(stmts, &luaLocalStmt{names: []string{"__x"}, values: []luaExpr{p.parseExpr(x)}})
+
+	parseBody := func(cc *ast.CaseClause) []luaStmt {
+		var body []luaStmt
+		if bind != "" {
+			// The bound variable has the case type if there is exactly one,
+			// and the type of the switch expression otherwise.
+			var val luaExpr = luaIdentOf("__x")
+			if len(cc.List) == 1 && !types.IsInterface(p.exprTypeRaw(cc.List[0])) && !p.isNilExpr(cc.List[0]) {
+				val = luaBuiltin("unbox", val)
+			}
+			body = append(body, &luaLocalStmt{names: []string{bind}, values: []luaExpr{val}})
+		}
+		for _, stmt := range cc.Body {
+			body = append(body, p.parseStmt(stmt)...)
+		}
+		return body
+	}
+
+	var def *ast.CaseClause
+	cases := &luaIfStmt{}
+	for _, stmt := range s.Body.List {
+		cc := stmt.(*ast.CaseClause)
+		if cc.List == nil {
+			def = cc
+			continue
+		}
+
+		var cond luaExpr
+		for _, typExpr := range cc.List {
+			var test luaExpr
+			typ := p.exprTypeRaw(typExpr)
+			switch {
+			case p.isNilExpr(typExpr):
+				test = &luaBinaryExpr{op: "==", x: luaIdentOf("__x"), y: luaLitOf("nil")}
+			case types.IsInterface(typ):
+				test = luaBuiltin("implements", luaIdentOf("__x"), p.methodList(typ.Underlying().(*types.Interface)))
+			default:
+				test = luaBuiltin("is_type", luaIdentOf("__x"), p.typeDesc(typ))
+			}
+			if cond == nil {
+				cond = test
+			} else {
+				cond = &luaBinaryExpr{op: "or", x: cond, y: test}
+			}
+		}
+		cases.clauses = append(cases.clauses, luaClause{cond: cond, body: parseBody(cc)})
+	}
+
+	switch {
+	case len(cases.clauses) > 0:
+		if def != nil {
+			cases.elseBlock = parseBody(def)
+		}
+		stmts = append(stmts, cases)
+	case def != nil:
+		// Only a default clause; no need for a conditional
+		stmts = append(stmts, parseBody(def)...)
+	}
+	if info.breakLabel != "" {
+		stmts = append(stmts, &luaLabelStmt{name: info.breakLabel})
+	}
+	return &luaDoStmt{body: stmts}
+}
+
+// isNilExpr reports whether x is the predeclared nil.
+func (p *Parser) isNilExpr(x ast.Expr) bool {
+	b, ok := p.exprTypeRaw(x).(*types.Basic)
+	return ok && b.Kind() == types.UntypedNil
+}
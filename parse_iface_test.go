@@ -0,0 +1,159 @@
+package lunar
+
+import (
+	"testing"
+)
+
+func TestIfaceConversion(t *testing.T) {
+	const decls = `
+type Celsius float64
+func (c Celsius) String() string { return "C" }
+type Stringer interface{ String() string }
+type Err struct{}
+func (e *Err) Error() string { return "err" }
+func takesStringer(s Stringer) {}
+func typedNil() error {
+	var e *Err
+	return e
+}
+`
+	RunDeclFuncTests(t, decls, []StringTest{
+		{
+			`var s Stringer = Celsius(5); _ = s`,
+			"local s = builtins.box((5), _dummy.Celsius)\n\n_ = s",
+		},
+		{
+			`takesStringer(Celsius(5))`,
+			"_dummy.takesStringer(builtins.box((5), _dummy.Celsius))",
+		},
+		{
+			`var e *Err; var err error; err = e; _ = err`,
+			"local e = nil\n\nlocal err = nil\n\nerr = builtins.box_nil(e, builtins.ptr_type(\"*dummy.Err\", _dummy.Err))\n_ = err",
+		},
+		{
+			`var err error = &Err{}; _ = err`,
+			"local err = setmetatable({}, {__index=_dummy.Err})\n\n_ = err",
+		},
+		{
+			`c := Celsius(3); _ = c.String()`,
+			"local c = (3)\n_ = _dummy.Celsius.String(c)",
+		},
+		{
+			`var s Stringer; _ = s.String()`,
+			"local s = nil\n\n_ = s:String()",
+		},
+		{
+			`var s Stringer; _ = s == Celsius(1)`,
+			"local s = nil\n\n_ = builtins.iface_eq(s, builtins.box((1), _dummy.Celsius))",
+		},
+		{
+			`var s Stringer; _ = s != nil`,
+			"local s = nil\n\n_ = s ~= nil",
+		},
+	})
+}
+
+func TestTypeAssert(t *testing.T) {
+	const decls = `
+type Celsius float64
+func (c Celsius) String() string { return "C" }
+type Stringer interface{ String() string }
+`
+	RunDeclFuncTests(t, decls, []StringTest{
+		{
+			`var x interface{}; _ = x.(Celsius)`,
+			"local x = nil\n\n_ = builtins.type_assert(x, _dummy.Celsius)",
+		},
+		{
+			`var x interface{}; v, ok := x.(int); _, _ = v, ok`,
+			"local x = nil\n\nlocal v, ok = builtins.type_assert_ok(x, \"int\", 0)\n_, _ = v, ok",
+		},
+		{
+			`var x interface{}; v, ok := x.(Stringer); _, _ = v, ok`,
+			"local x = nil\n\nlocal v, ok = builtins.iface_assert_ok(x, { \"String\" })\n_, _ = v, ok",
+		},
+		{
+			`var x interface{}
+			switch v := x.(type) {
+			case nil:
+			case string, int:
+				_ = v
+			case Stringer:
+				_ = v.String()
+			default:
+				_ = v
+			}`,
+			`local x = nil
+
+do
+	local __x = x
+	if __x == nil then
+		local v = __x
+	elseif builtins.is_type(__x, "string") or builtins.is_type(__x, "int") then
+		local v = __x
+		_ = v
+	elseif builtins.implements(__x, { "String" }) then
+		local v = __x
+		_ = v:String()
+	else
+		local v = __x
+		_ = v
+	end
+end`,
+		},
+	})
+}
+
+func TestIfaceRuntime(t *testing.T) {
+	out := RunLua(t, `
+import "fmt"
+
+type T struct{ N int }
+
+func (t T) String() string { return "T" }
+
+func kind(x interface{}) string {
+	switch x.(type) {
+	case int:
+		return "int"
+	case float64:
+		return "float64"
+	case T:
+		return "T"
+	case *T:
+		return "*T"
+	}
+	return "other"
+}
+
+func init() {
+	var i, f interface{} = 3, float64(3)
+	fmt.Println(kind(i), kind(f), kind(2.5), kind(int8(3)))
+	fmt.Println(i == f, i == 3, f == float64(3), f == 3.0)
+	_, isInt := f.(int)
+	_, isFloat := i.(float64)
+	fmt.Println(isInt, isFloat)
+
+	t := T{1}
+	var v, p interface{} = t, &t
+	fmt.Println(kind(v), kind(p), v == p)
+	_, isPtr := v.(*T)
+	_, isVal := p.(T)
+	fmt.Println(isPtr, isVal, v.(T).N, p.(*T).N)
+
+	m := map[interface{}]string{1: "int", 1.5: "float"}
+	fmt.Println(m[1], m[1.5], m[float64(1)] == "")
+	fmt.Printf("%T %T %v %v\n", i, f, f, v)
+}
+`)
+	want := `int float64 float64 other
+false true true true
+false false
+T *T false
+false false 1 1
+int float true
+int float64 3 T`
+	if out != want {
+		t.Errorf("got:\n%s\nwant:\n%s", out, want)
+	}
+}
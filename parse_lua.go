@@ -0,0 +1,232 @@
+package lunar
+
+import (
+	"go/ast"
+	"go/constant"
+	"go/types"
+	"strconv"
+	"strings"
+)
+
+// luaFunc returns the name of the function of the lua package called by
+// e, or "" if e calls another function.
+func (p *Parser) luaFunc(e *ast.CallExpr) string {
+	sel, ok := e.Fun.(*ast.SelectorExpr)
+	if !ok {
+		return ""
+	}
+	ident, ok := sel.X.(*ast.Ident)
+	if !ok {
+		return ""
+	}
+	pkg, ok := p.identObject(ident).(*types.PkgName)
+	if !ok || pkg.Imported().Path() != LuaPkgPath {
+		return ""
+	}
+	return sel.Sel.Name
+}
+
+// isMulti reports whether t is lua.Multi.
+func isMulti(t types.Type) bool {
+	named, ok := t.(*types.Named)
+	if !ok {
+		return false
+	}
+	obj := named.Obj()
+	return obj.Pkg() != nil && obj.Pkg().Path() == LuaPkgPath && obj.Name() == "Multi"
+}
+
+// parseLuaCall returns the Lua operation a function of the lua package
+// other than Raw stands for, or nil if e calls another function. Calls
+// returning a Multi are handled by parseMultiCall.
+func (p *Parser) parseLuaCall(e *ast.CallExpr) luaExpr {
+	switch name := p.luaFunc(e); name {
+	case "Global":
+		return p.luaGlobal(e.Args[0])
+	case "Get":
+		return p.luaIndex(e.Args[0], e.Args[1])
+	case "Len":
+		return &luaUnaryExpr{op: "#", x: p.parseExpr(e.Args[0])}
+	case "Env":
+		return luaCallOf(p.fenvFunc("getfenv"), p.parseExpr(e.Args[0]))
+	case "Pairs", "IPairs":
+		p.errorf(e, CodeUnsupported, "lua.%s can only be ranged over", name)
+	case "Set", "SetGlobal", "SetEnv":
+		p.errorf(e, CodeUnsupported, "lua.%s can only be called as a statement", name)
+	}
+	return nil
+}
+
+// parseLuaStmt returns the statement calling e if it calls a function of
+// the lua package assigning a value or writing Lua code, or a function
+// returning a Multi. It returns nil if e is another call.
+func (p *Parser) parseLuaStmt(e *ast.CallExpr) luaStmt {
+	switch p.luaFunc(e) {
+	case "Raw", "Expr", "Stmt":
+		return p.parseRawStmt(e)
+	case "Set":
+		return &luaAssignStmt{
+			targets: []luaExpr{p.luaIndex(e.Args[0], e.Args[1])},
+			values:  []luaExpr{p.parseExpr(e.Args[2])},
+		}
+	case "SetGlobal":
+		return &luaAssignStmt{
+			targets: []luaExpr{p.luaGlobal(e.Args[0])},
+			values:  []luaExpr{p.parseExpr(e.Args[1])},
+		}
+	case "SetEnv":
+		return &luaExprStmt{x: luaCallOf(p.fenvFunc("setfenv"), p.parseExpr(e.Args[0]), p.parseExpr(e.Args[1]))}
+	}
+	x := p.parseMultiCall(e)
+	switch x.(type) {
+	case nil:
+		return nil
+	case *luaCallExpr:
+		return &luaExprStmt{x: x}
+	}
+	// An inlined call or ..., which Lua does not allow as a statement
+	return &luaLocalStmt{names: []string{"_"}, values: []luaExpr{x}}
+}
+
+// luaGlobal returns the global variable named by the string name. Constant
+// names are written as identifiers unless a local shadows them.
+func (p *Parser) luaGlobal(name ast.Expr) luaExpr {
+	if tav := p.exprTypeAndValue(name); tav.Value != nil {
+		if s := constant.StringVal(tav.Value); isLuaName(s) {
+			if p.shadowsGlobal(name, s) {
+				return luaPath("_G", s)
+			}
+			return luaIdentOf(s)
+		}
+	}
+	return &luaIndexExpr{x: luaIdentOf("_G"), key: p.parseExpr(name)}
+}
+
+// shadowsGlobal reports whether a local of the Lua code at node may be
+// named like the global name. Go locals keep their names, and the locals
+// lunar declares itself are builtins and names starting with an
+// underscore.
+func (p *Parser) shadowsGlobal(node ast.Node, name string) bool {
+	if name == "builtins" || strings.HasPrefix(name, "_") {
+		return true
+	}
+	scope := p.nodePkg(node).Pkg.Scope().Innermost(node.Pos())
+	if scope == nil {
+		return false
+	}
+	_, obj := scope.LookupParent(name, node.Pos())
+	return obj != nil && p.isFuncLocal(obj)
+}
+
+// fenvFunc returns the function name, getfenv or setfenv, of the target,
+// or of the builtins on targets without it.
+func (p *Parser) fenvFunc(name string) luaExpr {
+	if p.target.hasSetfenv() {
+		return luaIdentOf(name)
+	}
+	return luaPath("builtins", name)
+}
+
+// luaIndex returns x[key], using the field syntax for constant keys that
+// are Lua names.
+func (p *Parser) luaIndex(x, key ast.Expr) luaExpr {
+	if tav := p.exprTypeAndValue(key); tav.Value != nil && tav.Value.Kind() == constant.String {
+		if s := constant.StringVal(tav.Value); isLuaName(s) {
+			return &luaSelectorExpr{x: p.parseExpr(x), name: s}
+		}
+	}
+	return &luaIndexExpr{x: p.parseExpr(x), key: p.parseExpr(key)}
+}
+
+// parseMultiCall returns the call e of a function returning a Multi,
+// returning its values as multiple Lua values, or nil if e calls another
+// function. Calls of lua.Call are written as calls of the Lua function and
+// lua.Vararg as ....
+func (p *Parser) parseMultiCall(e *ast.CallExpr) luaExpr {
+	if tav := p.exprTypeAndValue(e.Fun); tav.IsBuiltin() || tav.IsType() {
+		return nil
+	}
+	sig, ok := p.exprType(e.Fun).(*types.Signature)
+	if !ok || sig.Results().Len() != 1 || !isMulti(sig.Results().At(0).Type()) {
+		return nil
+	}
+
+	switch p.luaFunc(e) {
+	case "Call":
+		// The arguments are Lua values, which are never boxed
+		call := &luaCallExpr{fn: p.parseExpr(e.Args[0])}
+		for i, arg := range e.Args[1:] {
+			if e.Ellipsis.IsValid() && i == len(e.Args)-2 {
+				call.args = append(call.args, p.parseSpread(arg))
+			} else {
+				call.args = append(call.args, p.parseExpr(arg))
+			}
+		}
+		return call
+	case "Vararg":
+		if n := len(p.funcSigs); n == 0 || !p.funcSigs[n-1].Variadic() {
+			p.errorf(e, CodeInvalid, "lua.Vararg can only be used in variadic functions")
+		}
+		return &luaVararg{}
+	}
+	return p.parseFuncCall(e)
+}
+
+// parseSpread returns the elements of the slice x passed as the last
+// arguments of a call.
+func (p *Parser) parseSpread(x ast.Expr) luaExpr {
+	if call, ok := ast.Unparen(x).(*ast.CallExpr); ok {
+		if multi := p.parseMultiCall(call); multi != nil {
+			return multi
+		}
+	}
+	return luaCallOf(&luaCode{text: p.target.unpack()}, p.parseExpr(x))
+}
+
+// parseMultiIndex returns the element index of the values of multi,
+// without packing them in a table.
+func (p *Parser) parseMultiIndex(multi luaExpr, index ast.Expr) luaExpr {
+	if tav := p.exprTypeAndValue(index); tav.Value != nil {
+		if i, ok := constant.Int64Val(constant.ToInt(tav.Value)); ok && i >= 0 {
+			if i == 0 {
+				return &luaParenExpr{x: multi}
+			}
+			n := luaLitOf(strconv.FormatInt(i+1, 10))
+			return &luaParenExpr{x: luaCallOf(luaIdentOf("select"), n, multi)}
+		}
+	}
+	n := &luaBinaryExpr{op: "+", x: p.parseExpr(index), y: luaLitOf("1")}
+	return &luaParenExpr{x: luaCallOf(luaIdentOf("select"), n, multi)}
+}
+
+// parseMultiResult returns the values returned for the result x of a
+// function returning a Multi. The elements of Multi literals are returned
+// as they are.
+func (p *Parser) parseMultiResult(x ast.Expr) []luaExpr {
+	lit, ok := ast.Unparen(x).(*ast.CompositeLit)
+	if !ok {
+		return []luaExpr{p.parseSpread(x)}
+	}
+	var values []luaExpr
+	for _, elt := range lit.Elts {
+		if _, ok := elt.(*ast.KeyValueExpr); ok {
+			return []luaExpr{p.parseSpread(x)}
+		}
+		values = append(values, p.parseExpr(elt))
+	}
+	return values
+}
+
+// parseLuaRange returns the iterator of a range statement ranging over
+// lua.Pairs or lua.IPairs, or nil if it ranges over something else.
+func (p *Parser) parseLuaRange(x ast.Expr) luaExpr {
+	call, ok := ast.Unparen(x).(*ast.CallExpr)
+	if !ok {
+		return nil
+	}
+	switch name := p.luaFunc(call); name {
+	case "Pairs", "IPairs":
+		return luaCallOf(luaIdentOf(strings.ToLower(name)), p.parseExpr(call.Args[0]))
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package lunar
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLuaInterop(t *testing.T) {
+	const decls = `import "github.com/eandre/lunar/lua"
+
+func pair() lua.Multi { return lua.Multi{1, "a"} }
+
+func pass(args ...interface{}) lua.Multi { return lua.Call(lua.Global("print"), lua.Vararg()...) }
+
+func values(m lua.Multi) lua.Multi { return m }
+
+type Color int
+`
+	RunDeclFuncTests(t, decls, []StringTest{
+		{`_ = lua.Global("print")`, `_ = print`},
+		{`_ = lua.Global("my-global")`, `_ = _G["my-global"]`},
+		{`lua.SetGlobal("x", 1)`, `x = 1`},
+		{`print := 3; _ = lua.Global("print"); _ = print`, "local print = 3\n_ = _G.print\n_ = print"},
+		{`x := 1; lua.SetGlobal("x", x)`, "local x = 1\n_G.x = x"},
+		{`lua.SetGlobal("x", 1); x := 2; _ = x`, "x = 1\nlocal x = 2\n_ = x"},
+		{`_ = lua.Global("builtins")`, `_ = _G.builtins`},
+		{`s := lua.Global("string"); _ = lua.Get(s, "format")`, "local s = string\n_ = s.format"},
+		{`t := lua.Table{}; lua.Set(t, "end", 1); _ = lua.Get(t, 2)`, "local t = {}\nt[\"end\"] = 1\n_ = t[2]"},
+		{`_ = lua.Len("abc") + 1`, `_ = #"abc" + 1`},
+		// Values of Multi calls are only packed when stored
+		{`lua.Call(lua.Global("print"), 1, "a")`, `print(1, "a")`},
+		{`m := lua.Call(lua.Global("f")); _ = m`, "local m = { f() }\n_ = m"},
+		{`_ = lua.Call(lua.Global("f"))[0]`, `_ = (f())`},
+		{`i := 1; _ = pair()[i]`, "local i = 1\n_ = (select(i + 1, _dummy.pair()))"},
+		{`_ = lua.Call(lua.Global("f"), pair()...)[1]`, `_ = (select(2, f(_dummy.pair())))`},
+		{`m := pair(); lua.Call(lua.Global("print"), m...)`, "local m = { _dummy.pair() }\nprint(unpack(m))"},
+		// Lua values are not boxed
+		{`var v interface{} = lua.Table{}; _ = v`, "local v = {}\n\n_ = v"},
+		{`c := Color(1); lua.Call(lua.Global("print"), c)`, "local c = (1)\nprint(c)"},
+		{`t := lua.Table{"x": 1.5, "y": Color(1)}; t["z"] = 2.5; _ = t`, "local t = { [\"x\"] = 1.5, [\"y\"] = (1) }\nt[\"z\"] = 2.5\n_ = t"},
+		{`for k, v := range lua.Pairs(lua.Global("t")) { _, _ = k, v }`, "for k, v in pairs(t) do\n\t_, _ = k, v\nend"},
+		{`for i := range lua.IPairs(lua.Table{1: "a"}) { _ = i }`, "for i in ipairs({ [1] = \"a\" }) do\n\t_ = i\nend"},
+	})
+
+	lua, _, err := ParsePackage(decls)
+	if err != nil {
+		t.Fatalf("Got error: %v", err)
+	}
+	for _, test := range []struct{ name, want string }{
+		{"pair", "return 1, \"a\""},
+		{"pass", "return print(...)"},
+		{"values", "return unpack(m)"},
+	} {
+		if !strings.Contains(lua, test.want) {
+			t.Errorf("%s: Lua %q does not contain %q", test.name, lua, test.want)
+		}
+	}
+}
+
+func TestLuaInteropErrors(t *testing.T) {
+	tests := []struct {
+		Go, Err string
+	}{
+		{`_ = lua.Vararg()`, "lua.Vararg can only be used in variadic functions"},
+		{`f := lua.Pairs(lua.Table{}); _ = f`, "lua.Pairs can only be ranged over"},
+	}
+	for i, test := range tests {
+		_, _, err := ParseFuncWithDecls(`import "github.com/eandre/lunar/lua"`, test.Go)
+		if err == nil {
+			t.Errorf("%d. Go %q resulted in no error; want %q", i, test.Go, test.Err)
+		} else if !strings.Contains(err.Error(), test.Err) {
+			t.Errorf("%d. Go %q resulted in error %v; want %q", i, test.Go, err, test.Err)
+		}
+	}
+}
+
+func TestLuaEnvRuntime(t *testing.T) {
+	out := RunLua(t, `
+import (
+	"fmt"
+
+	"github.com/eandre/lunar/lua"
+)
+
+func init() {
+	f := lua.Call(lua.Global("loadstring"), "return x")[0]
+	lua.SetEnv(f, lua.Table{"x": "sandboxed"})
+	fmt.Println(lua.Call(f)[0], lua.Get(lua.Env(f), "x"))
+}
+`)
+	if want := "sandboxed sandboxed"; out != want {
+		t.Errorf("got %q; want %q", out, want)
+	}
+}
@@ -5,42 +5,58 @@ import (
 	"strings"
 )
 
-func (p *Parser) parseCommentGroup(w *Writer, cg *ast.CommentGroup) {
+func (p *Parser) parseCommentGroup(cg *ast.CommentGroup) []luaStmt {
 	if cg == nil {
-		return
+		return nil
 	}
 
+	var stmts []luaStmt
 	for _, c := range cg.List {
+		if strings.HasPrefix(c.Text, directivePrefix) {
+			continue
+		}
 		// Handle long-style comments using Lua long-style comments
 		if c.Text[0:2] == "/*" {
 			if strings.Contains(c.Text, "]=]") {
-				p.error(cg, "Cannot handle comment containing ']='")
+				p.error(cg, CodeUnsupported, "Cannot handle comment containing ']='")
 			}
-			w.WriteLinef("--[=[%s]=]", c.Text[2:len(c.Text)-2])
+			stmts = append(stmts, &luaCommentStmt{text: c.Text[2 : len(c.Text)-2], block: true})
 		} else {
-			w.WriteLinef("--%s", c.Text[2:])
+			stmts = append(stmts, &luaCommentStmt{text: c.Text[2:]})
 		}
 	}
+	return stmts
 }
 
-func (p *Parser) parseFile(w *Writer, f *ast.File) {
+func (p *Parser) parseFile(f *ast.File) []luaStmt {
 	pkg := p.nodePkg(f)
-	name := pkg.Pkg.Name()
+	if p.modules != nil {
+		return p.parseModule(pkg, []*ast.File{f})
+	}
+	name := "_" + pkg.Pkg.Name()
 	path := pkg.Pkg.Path()
-	w.WriteLine("-- Package declaration")
-	w.WriteLinef(`local _%s = _G["%s"] or {}`, name, path)
-	w.WriteLinef(`_G["%s"] = _%s`, path, name)
-	w.WriteNewline()
-	w.WriteLine("local builtins = _G.lunar_go_builtins")
-	w.WriteNewline()
+	table := func() luaExpr {
+		return &luaIndexExpr{x: luaIdentOf("_G"), key: luaStringOf(path)}
+	}
+	stmts := []luaStmt{
+		&luaCommentStmt{text: " Package declaration"},
+		&luaLocalStmt{names: []string{name}, values: []luaExpr{&luaBinaryExpr{op: "or", x: table(), y: &luaTableLit{}}}},
+		&luaAssignStmt{targets: []luaExpr{table()}, values: []luaExpr{luaIdentOf(name)}},
+		&luaBlankStmt{lines: 1},
+		&luaLocalStmt{names: []string{"builtins"}, values: []luaExpr{luaPath("_G", "lunar_go_builtins")}},
+		&luaBlankStmt{lines: 1},
+	}
 
 	for _, decl := range f.Decls {
-		p.parseNode(w, decl, true)
+		stmts = append(stmts, p.parseNode(decl, true)...)
 	}
+	return stmts
 }
 
-func (p *Parser) parsePackage(w *Writer, pkg *ast.Package) {
+func (p *Parser) parsePackage(pkg *ast.Package) []luaStmt {
+	var stmts []luaStmt
 	for _, f := range pkg.Files {
-		p.parseFile(w, f)
+		stmts = append(stmts, p.parseFile(f)...)
 	}
+	return stmts
 }
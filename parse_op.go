@@ -0,0 +1,234 @@
+package lunar
+
+import (
+	"fmt"
+	"go/ast"
+	"go/constant"
+	"go/token"
+	"go/types"
+)
+
+// assignOps maps assignment operators to the binary operator they apply.
+var assignOps = map[token.Token]token.Token{
+	token.ADD_ASSIGN:     token.ADD,
+	token.SUB_ASSIGN:     token.SUB,
+	token.MUL_ASSIGN:     token.MUL,
+	token.QUO_ASSIGN:     token.QUO,
+	token.REM_ASSIGN:     token.REM,
+	token.AND_ASSIGN:     token.AND,
+	token.OR_ASSIGN:      token.OR,
+	token.XOR_ASSIGN:     token.XOR,
+	token.SHL_ASSIGN:     token.SHL,
+	token.SHR_ASSIGN:     token.SHR,
+	token.AND_NOT_ASSIGN: token.AND_NOT,
+}
+
+// bitFuncs maps bitwise operators to the corresponding functions of the
+// bit and bit32 libraries.
+var bitFuncs = map[token.Token]string{
+	token.AND: "band",
+	token.OR:  "bor",
+	token.XOR: "bxor",
+	token.SHL: "lshift",
+	token.SHR: "rshift",
+}
+
+// bitOps maps bitwise operators to the native Lua 5.3 operators.
+var bitOps = map[token.Token]string{
+	token.AND: "&",
+	token.OR:  "|",
+	token.XOR: "~",
+	token.SHL: "<<",
+	token.SHR: ">>",
+}
+
+// parseBinaryOp returns the binary operation x op y. It is shared by
+// binary expressions and assignment operations, which have no node of
+// their own.
+func (p *Parser) parseBinaryOp(x ast.Expr, op token.Token, y ast.Expr) luaExpr {
+	typ := p.exprType(x)
+	if isInteger(typ) {
+		switch op {
+		case token.ADD, token.SUB, token.MUL:
+			if size, _ := intSize(typ); size < 64 {
+				p.warnf(x, WarnIntOverflow, "Arithmetic on %s does not wrap around on overflow", typ)
+			}
+		case token.QUO:
+			return p.parseIntDiv(typ, x, y)
+		case token.REM:
+			// Lua's modulo operator rounds towards negative infinity, while
+			// Go truncates towards zero like fmod.
+			if !isUnsigned(typ) {
+				return luaCallOf(luaPath("math", "fmod"), p.parseExpr(x), p.parseExpr(y))
+			}
+		case token.AND, token.OR, token.XOR, token.SHL, token.SHR, token.AND_NOT:
+			return p.parseBitwiseOp(typ, op, x, y)
+		}
+	}
+
+	var luaOp string
+	switch op {
+	// Expressions that are cross-compatible
+	case token.SUB, token.MUL, token.QUO, token.REM, token.EQL, token.LSS, token.GTR, token.LEQ, token.GEQ:
+		luaOp = op.String()
+	case token.ADD:
+		if isString(typ) {
+			luaOp = ".."
+		} else {
+			luaOp = "+"
+		}
+	case token.NEQ:
+		luaOp = "~="
+	case token.LOR:
+		luaOp = "or"
+	case token.LAND:
+		luaOp = "and"
+	default:
+		p.errorf(x, CodeUnsupported, "Got unhandled binary expression token type %q", op.String())
+	}
+	return &luaBinaryExpr{op: luaOp, x: p.parseExpr(x), y: p.parseExpr(y)}
+}
+
+// parseIntDiv returns the division of the integers x and y, which
+// truncates towards zero in Go.
+func (p *Parser) parseIntDiv(typ types.Type, x, y ast.Expr) luaExpr {
+	switch {
+	case isUnsigned(typ) && p.target.hasIntegers():
+		return &luaBinaryExpr{op: "//", x: p.parseExpr(x), y: p.parseExpr(y)}
+	case isUnsigned(typ):
+		div := &luaBinaryExpr{op: "/", x: p.parseExpr(x), y: p.parseExpr(y)}
+		return luaCallOf(luaPath("math", "floor"), div)
+	default:
+		return luaBuiltin("idiv", p.parseExpr(x), p.parseExpr(y))
+	}
+}
+
+// parseBitwiseOp returns a bitwise operation on integers of type typ. If x
+// is nil, op is token.XOR and the operation is the complement of y.
+//
+// Targets without native bitwise operators use a bit library operating on
+// 32-bit integers, so only the lower 32 bits of the operands are used.
+func (p *Parser) parseBitwiseOp(typ types.Type, op token.Token, x, y ast.Expr) luaExpr {
+	if size, _ := intSize(typ); size > 32 && !p.target.hasIntegers() {
+		p.warnf(y, WarnBitwise32, "Bitwise operation on %s only uses the lower 32 bits on %s", typ, p.target)
+	}
+	var res luaExpr
+	if p.target.hasIntegers() {
+		switch {
+		case x == nil:
+			res = &luaParenExpr{x: &luaUnaryExpr{op: "~", x: p.parseExpr(y)}}
+		case op == token.SHR && !isUnsigned(typ):
+			res = luaBuiltin("arshift", p.parseExpr(x), p.parseExpr(y))
+		case op == token.AND_NOT:
+			not := &luaUnaryExpr{op: "~", x: p.parseExpr(y)}
+			res = &luaParenExpr{x: &luaBinaryExpr{op: "&", x: p.parseExpr(x), y: not}}
+		default:
+			res = &luaParenExpr{x: &luaBinaryExpr{op: bitOps[op], x: p.parseExpr(x), y: p.parseExpr(y)}}
+		}
+	} else {
+		lib := p.target.bitLib()
+		switch {
+		case x == nil:
+			res = luaCallOf(luaPath(lib, "bnot"), p.parseExpr(y))
+		case op == token.AND_NOT:
+			not := luaCallOf(luaPath(lib, "bnot"), p.parseExpr(y))
+			res = luaCallOf(luaPath(lib, "band"), p.parseExpr(x), not)
+		default:
+			fn := bitFuncs[op]
+			if op == token.SHR && !isUnsigned(typ) {
+				fn = "arshift"
+			}
+			res = luaCallOf(luaPath(lib, fn), p.parseExpr(x), p.parseExpr(y))
+		}
+	}
+	return p.intWrap(typ, op, res)
+}
+
+// intWrap returns the result x of a bitwise operation brought into the
+// range of typ.
+func (p *Parser) intWrap(typ types.Type, op token.Token, x luaExpr) luaExpr {
+	size, unsigned := intSize(typ)
+	native := p.target.hasIntegers()
+	if !native && size > 32 {
+		size = 32
+	}
+	mod := func(x luaExpr, m uint64) luaExpr {
+		return &luaBinaryExpr{op: "%", x: x, y: luaLitOf(fmt.Sprintf("%#x", m))}
+	}
+	switch {
+	case unsigned && native:
+		// Only shifts and complements can exceed the size of the operands
+		if size < 64 && (op == token.SHL || op == token.XOR) {
+			return &luaParenExpr{x: mod(x, uint64(1)<<uint(size))}
+		}
+	case unsigned:
+		// The bit library of LuaJIT returns signed integers
+		return &luaParenExpr{x: mod(x, uint64(1)<<uint(size))}
+	case p.target.bitLib() == "bit32":
+		// The bit32 library returns unsigned integers
+		shifted := &luaParenExpr{x: &luaBinaryExpr{op: "+", x: x, y: luaLitOf("0x80000000")}}
+		return &luaParenExpr{x: &luaBinaryExpr{op: "-", x: mod(shifted, 0x100000000), y: luaLitOf("0x80000000")}}
+	}
+	return x
+}
+
+// constIntExpr returns the value of e if it is an integer constant, or
+// nil. Operations on integer constants are folded since they may
+// otherwise require runtime support.
+func (p *Parser) constIntExpr(e ast.Expr) luaExpr {
+	tav := p.exprTypeAndValue(e)
+	if tav.Value == nil || tav.Value.Kind() != constant.Int {
+		return nil
+	}
+	lit := luaLitOf(tav.Value.ExactString())
+	if constant.Sign(tav.Value) < 0 {
+		return &luaParenExpr{x: lit}
+	}
+	return lit
+}
+
+// intSize returns the size in bits of the integer type typ and whether it
+// is unsigned.
+func intSize(typ types.Type) (size int, unsigned bool) {
+	b, ok := typ.Underlying().(*types.Basic)
+	if !ok {
+		return 64, false
+	}
+	switch b.Kind() {
+	case types.Int8:
+		return 8, false
+	case types.Int16:
+		return 16, false
+	case types.Int32:
+		return 32, false
+	case types.Uint8:
+		return 8, true
+	case types.Uint16:
+		return 16, true
+	case types.Uint32:
+		return 32, true
+	case types.Uint, types.Uint64, types.Uintptr:
+		return 64, true
+	}
+	return 64, false
+}
+
+func isInteger(typ types.Type) bool {
+	b, ok := typ.Underlying().(*types.Basic)
+	return ok && b.Info()&types.IsInteger != 0
+}
+
+func isFloat(typ types.Type) bool {
+	b, ok := typ.Underlying().(*types.Basic)
+	return ok && b.Info()&types.IsFloat != 0
+}
+
+func isUnsigned(typ types.Type) bool {
+	b, ok := typ.Underlying().(*types.Basic)
+	return ok && b.Info()&types.IsUnsigned != 0
+}
+
+func isString(typ types.Type) bool {
+	b, ok := typ.Underlying().(*types.Basic)
+	return ok && b.Info()&types.IsString != 0
+}
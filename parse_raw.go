@@ -1,47 +1,178 @@
 package lunar
 
 import (
+	"fmt"
 	"go/ast"
-	"go/types"
+	"go/constant"
+	"strconv"
+	"strings"
 )
 
 const LuaPkgPath = "github.com/eandre/lunar/lua"
 
-func (p *Parser) parseRaw(w *Writer, e *ast.CallExpr) bool {
-	sel, ok := e.Fun.(*ast.SelectorExpr)
-	if !ok {
-		return false
+// SetCheckRaw makes the parser check the syntax of the Lua code of
+// lua.Raw, lua.Expr and lua.Stmt calls, reporting invalid code as errors.
+func (p *Parser) SetCheckRaw(on bool) {
+	p.checkRaw = on
+}
+
+// parseRaw returns the Lua code of a call to lua.Raw or lua.Expr, or nil
+// if e is another call. Calls used as statements are handled by
+// parseRawStmt.
+func (p *Parser) parseRaw(e *ast.CallExpr) luaExpr {
+	switch name := p.luaFunc(e); name {
+	case "Raw", "Expr":
+		return p.parseRawCode(e, name, false)
+	case "Stmt":
+		p.errorf(e, CodeUnsupported, "lua.Stmt can only be called as a statement")
 	}
-	if sel.Sel.Name != "Raw" {
-		return false
+	return nil
+}
+
+// parseRawStmt returns the statement of a call to lua.Raw, lua.Expr or
+// lua.Stmt used as a statement, or nil if e is another call.
+func (p *Parser) parseRawStmt(e *ast.CallExpr) luaStmt {
+	switch name := p.luaFunc(e); name {
+	case "Raw", "Stmt":
+		return &luaExprStmt{x: p.parseRawCode(e, name, true)}
+	case "Expr":
+		// Lua does not allow expressions as statements
+		return &luaLocalStmt{names: []string{"_"}, values: []luaExpr{p.parseRawCode(e, name, false)}}
+	}
+	return nil
+}
+
+// parseRawCode returns the Lua code of the call e to the function name of
+// the lua package, which is statements if stmt is set and an expression
+// otherwise.
+func (p *Parser) parseRawCode(e *ast.CallExpr, name string, stmt bool) luaExpr {
+	tav := p.exprTypeAndValue(e.Args[0])
+	if tav.Value == nil || tav.Value.Kind() != constant.String {
+		if name == "Raw" {
+			// The code is not known, so the expression itself is written
+			// for compatibility
+			p.warnf(e.Args[0], WarnRawExpr, "lua.Raw code is not a constant string and is written as the expression itself")
+			return &luaRawExpr{parts: []luaExpr{p.parseExpr(e.Args[0])}}
+		}
+		p.errorf(e.Args[0], CodeUnsupported, "lua.%s needs a constant string", name)
 	}
+	src := constant.StringVal(tav.Value)
 
-	ident, ok := sel.X.(*ast.Ident)
-	if !ok {
-		return false
+	raw := &luaRawExpr{}
+	if p.minify {
+		raw.parts = append(raw.parts, &luaCode{text: rawMarker})
+	}
+	check := src
+	if name == "Raw" {
+		raw.parts = append(raw.parts, &luaCode{text: src, raw: true})
+	} else {
+		if e.Ellipsis.IsValid() {
+			p.errorf(e, CodeUnsupported, "lua.%s cannot bind the elements of a slice to placeholders", name)
+		}
+		args := e.Args[1:]
+		code, refs, err := rawTemplate(src, len(args))
+		if err != nil {
+			p.errorf(e.Args[0], CodeInvalid, "Invalid lua.%s template: %v", name, err)
+		}
+		values := make([]luaExpr, len(args))
+		for i, arg := range args {
+			values[i] = p.parseExpr(arg)
+		}
+		p.checkRawArgs(e, name, values, refs)
+		check = code[0]
+		raw.parts = append(raw.parts, &luaCode{text: code[0], raw: true})
+		for i, ref := range refs {
+			// Placeholders are checked as names of the same width
+			check += "_" + strconv.Itoa(ref+1) + code[i+1]
+			raw.parts = append(raw.parts, rawArg(values[ref], code[i+1]), &luaCode{text: code[i+1], raw: true})
+		}
 	}
 
-	pkg, ok := p.identObject(ident).(*types.PkgName)
-	if !ok {
-		return false
+	if p.checkRaw {
+		if err := checkLua(check, !stmt, p.target); err != nil {
+			p.errorf(e.Args[0], CodeInvalid, "Invalid Lua code in lua.%s: %v", name, err)
+		}
 	}
+	return raw
+}
 
-	if pkg.Imported().Path() != LuaPkgPath {
-		return false
+// checkRawArgs reports an error if the placeholders refs of the call e to
+// lua.Expr or lua.Stmt do not evaluate its arguments values as a call
+// would: once each, from left to right. Placeholders are replaced by the
+// code of their argument, so arguments calling functions must be used once
+// and in order.
+func (p *Parser) checkRawArgs(e *ast.CallExpr, name string, values []luaExpr, refs []int) {
+	seen := make([]bool, len(values))
+	last := -1 // the last argument with calls used
+	for _, ref := range refs {
+		if !hasCalls(values[ref]) {
+			continue
+		}
+		if seen[ref] {
+			p.errorf(e.Args[ref+1], CodeUnsupported, "lua.%s uses argument %d, which calls a function, more than once; assign it to a variable first", name, ref+1)
+		}
+		if ref < last {
+			p.errorf(e.Args[ref+1], CodeUnsupported, "lua.%s uses argument %d before argument %d, and both call functions; assign them to variables first", name, ref+1, last+1)
+		}
+		seen[ref] = true
+		last = ref
 	}
+}
 
-	for _, arg := range e.Args {
-		switch arg := arg.(type) {
-		case *ast.BasicLit:
-			if arg.Value[0] == '"' || arg.Value[0] == '`' {
-				// String literal; skip quotes
-				w.WriteString(arg.Value[1 : len(arg.Value)-1])
-			} else {
-				w.WriteString(arg.Value)
-			}
-		default:
-			p.parseExpr(w, arg)
+// rawTemplate splits the template src of lua.Expr or lua.Stmt at its
+// placeholders, returning the code around them and the indexes of the
+// arguments they stand for. All nargs arguments must be used.
+func rawTemplate(src string, nargs int) (code []string, refs []int, err error) {
+	used := make([]bool, nargs)
+	var b strings.Builder
+	for i := 0; i < len(src); i++ {
+		if src[i] != '$' {
+			b.WriteByte(src[i])
+			continue
+		}
+		j := i + 1
+		for j < len(src) && isDigit(src[j]) {
+			j++
+		}
+		switch {
+		case j < len(src) && j == i+1 && src[j] == '$':
+			b.WriteByte('$')
+			i = j
+			continue
+		case j == i+1:
+			return nil, nil, fmt.Errorf("$ at offset %d is neither $$ nor followed by an argument number", i)
 		}
+		n, _ := strconv.Atoi(src[i+1 : j])
+		if n < 1 || n > nargs {
+			return nil, nil, fmt.Errorf("$%s refers to a missing argument", src[i+1:j])
+		}
+		used[n-1] = true
+		code = append(code, b.String())
+		refs = append(refs, n-1)
+		b.Reset()
+		i = j - 1
+	}
+	for i, ok := range used {
+		if !ok {
+			return nil, nil, fmt.Errorf("argument %d is not used", i+1)
+		}
+	}
+	return append(code, b.String()), refs, nil
+}
+
+// rawArg returns the argument x of a template, followed by the code next,
+// parenthesized unless it is clearly an operand of the code around it:
+// operators are always parenthesized, and literals, tables and functions
+// when next indexes or calls them.
+func rawArg(x luaExpr, next string) luaExpr {
+	prec := luaExprPrec(x)
+	if prec < luaSimplePrec {
+		return &luaParenExpr{x: x}
+	}
+	next = strings.TrimLeft(next, " \t")
+	suffixed := next != "" && strings.ContainsAny(next[:1], ".:[(\"'{") && !strings.HasPrefix(next, "..")
+	if prec < luaPrefixPrec && suffixed {
+		return &luaParenExpr{x: x}
 	}
-	return true
+	return x
 }
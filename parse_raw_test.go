@@ -0,0 +1,103 @@
+package lunar
+
+import (
+	"go/ast"
+	"strings"
+	"testing"
+)
+
+func TestRaw(t *testing.T) {
+	const decls = `import "github.com/eandre/lunar/lua"
+
+const greeting = "print(\"hello\")"
+
+var x, y int
+`
+	RunDeclFuncTests(t, decls, []StringTest{
+		{`lua.Raw("print(\"a\\tb\")")`, `print("a\tb")`},
+		{"lua.Raw(`print(\"a\\tb\")`)", `print("a\tb")`},
+		{`lua.Raw("a()\nb()")`, "a()\nb()"},
+		{`lua.Raw(greeting)`, `print("hello")`},
+		{`_ = lua.Raw("{" + "1}")`, `_ = {1}`},
+		{`_ = lua.Expr("#$1 + $2", "abc", x)`, `_ = #"abc" + _dummy.x`},
+		{`_ = lua.Expr("$1 * $1", x + y)`, `_ = (_dummy.x + _dummy.y) * (_dummy.x + _dummy.y)`},
+		{`_ = lua.Expr("$1:upper() .. '$$'", "abc")`, `_ = ("abc"):upper() .. '$'`},
+		{`_ = lua.Expr("$1 .. $2", "a", 1)`, `_ = "a" .. 1`},
+		{`lua.Stmt("$2 = $1", 1, lua.Raw("t"))`, `t = 1`},
+		{`lua.Expr("f()")`, `local _ = f()`},
+		// Statements starting with a parenthesis are separated
+		{`lua.Stmt("print()"); lua.Stmt("$1:upper()", "a")`, "print()\n;(\"a\"):upper()"},
+	})
+}
+
+func TestRawErrors(t *testing.T) {
+	const decls = `import "github.com/eandre/lunar/lua"
+
+var src = "print()"
+
+func f() int { return 1 }
+`
+	tests := []struct {
+		Go, Err string
+	}{
+		{`_ = lua.Expr(src)`, "lua.Expr needs a constant string"},
+		{`lua.Stmt("$2", 1)`, "Invalid lua.Stmt template: $2 refers to a missing argument"},
+		{`lua.Stmt("f()", 1)`, "Invalid lua.Stmt template: argument 1 is not used"},
+		{`lua.Stmt("a$b")`, "Invalid lua.Stmt template: $ at offset 1 is neither $$ nor followed by an argument number"},
+		{`args := []interface{}{1}; lua.Stmt("f($1)", args...)`, "lua.Stmt cannot bind the elements of a slice to placeholders"},
+		{`_ = lua.Expr("1 +")`, `Invalid Lua code in lua.Expr: 1:4: unexpected token near "<eof>"`},
+		{`lua.Stmt("if $1 then", true)`, `Invalid Lua code in lua.Stmt: 1:11: expected "end" near "<eof>"`},
+		{`lua.Raw("x =")`, `Invalid Lua code in lua.Raw`},
+		{`_ = lua.Expr("$1 + $1", f())`, "lua.Expr uses argument 1, which calls a function, more than once"},
+		{`_ = lua.Expr("$2 .. $1", f(), f())`, "lua.Expr uses argument 1 before argument 2, and both call functions"},
+		{`lua.Stmt("goto done; ::done::")`, `Invalid Lua code in lua.Stmt: 1:1: "goto" is not supported by lua5.1`},
+		{`_ = lua.Expr("$1 // 2", 7)`, `Invalid Lua code in lua.Expr: 1:4: "//" is not supported by lua5.1`},
+		{`_ = lua.Expr("$1 & 1", 7)`, `"&" is not supported by lua5.1`},
+	}
+	get := func(f *ast.File) ast.Node {
+		return f.Decls[len(f.Decls)-1].(*ast.FuncDecl).Body
+	}
+	for i, test := range tests {
+		_, _, err := parseStrWith(func(p *Parser) { p.SetCheckRaw(true) }, decls+"\nfunc testFunc() {"+test.Go+"}", get)
+		if err == nil {
+			t.Errorf("%d. Go %q resulted in no error; want %q", i, test.Go, test.Err)
+		} else if !strings.Contains(err.Error(), test.Err) {
+			t.Errorf("%d. Go %q resulted in error %v; want %q", i, test.Go, err, test.Err)
+		}
+	}
+
+	// Code is checked for the target
+	src := decls + "\nfunc testFunc() {lua.Stmt(\"goto done; ::done::\"); _ = lua.Expr(\"$1 // 2 & 1\", 7)}"
+	if _, _, err := parseStrWith(func(p *Parser) { p.SetCheckRaw(true); p.SetTarget(Lua53) }, src, get); err != nil {
+		t.Errorf("Got error for lua5.3 code: %v", err)
+	}
+}
+
+func TestRawNonConstant(t *testing.T) {
+	const src = `import "github.com/eandre/lunar/lua"
+
+var src = "print()"
+
+func f() {
+	_ = lua.Raw(src)
+}`
+	var got []string
+	setup := func(p *Parser) {
+		p.SetWarningHandler(WarningFunc(func(d Diagnostic) {
+			got = append(got, d.Code)
+		}))
+	}
+	get := func(f *ast.File) ast.Node {
+		return f.Decls[len(f.Decls)-1].(*ast.FuncDecl).Body
+	}
+	lua, _, err := parseStrWith(setup, src, get)
+	if err != nil {
+		t.Fatalf("Got error: %v", err)
+	}
+	if want := "_ = _dummy.src"; !strings.Contains(lua, want) {
+		t.Errorf("Got:\n%s\nwant %q", lua, want)
+	}
+	if len(got) != 1 || got[0] != WarnRawExpr {
+		t.Errorf("Got warnings %v, want %s", got, WarnRawExpr)
+	}
+}
@@ -0,0 +1,106 @@
+package lunar
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStdlibImports(t *testing.T) {
+	lua, _, err := ParsePackage(`
+import (
+	"sort"
+	str "strings"
+	"unicode/utf8"
+)
+
+var _ = sort.Ints
+var _ = str.Split
+var _ = utf8.RuneLen
+`)
+	if err != nil {
+		t.Fatalf("Got error: %v", err)
+	}
+	for _, want := range []string{
+		`local _sort = builtins.pkgs["sort"]`,
+		`local _str = builtins.pkgs["strings"]`,
+		`local _utf8 = builtins.pkgs["unicode/utf8"]`,
+	} {
+		if !strings.Contains(lua, want) {
+			t.Errorf("Expected %q in output:\n%s", want, lua)
+		}
+	}
+}
+
+func TestStdlibShims(t *testing.T) {
+	for path, shim := range stdlibShims {
+		register := `builtins.pkgs["` + path + `"] = `
+		i := strings.Index(shim.src, register)
+		if i < 0 {
+			t.Errorf("Shim for %q does not register itself", path)
+			continue
+		}
+		tbl := strings.Fields(shim.src[i+len(register):])[0]
+		for name := range shim.names {
+			member := tbl + "." + name
+			if !strings.Contains(shim.src, "\nfunction "+member+"(") && !strings.Contains(shim.src, "\n"+member+" = ") {
+				t.Errorf("Shim for %q does not define %s", path, name)
+			}
+		}
+	}
+}
+
+func TestStdlibUnsupported(t *testing.T) {
+	tests := []struct {
+		Go, Err string
+	}{
+		{`import "strings"` + "\n\nvar x = strings.Title(\"a\")", "strings.Title is not supported"},
+		{`import "strings"` + "\n\nfunc f() {\n\t_ = strings.TrimFunc(\"a\", nil)\n}", "strings.TrimFunc is not supported"},
+		{`import "math"` + "\n\nvar f = math.Float64bits", "math.Float64bits is not supported"},
+		{`import . "math"` + "\n\nvar x = Float64bits(1)", "math.Float64bits is not supported"},
+	}
+	for i, test := range tests {
+		_, _, err := ParsePackage(test.Go)
+		if err == nil {
+			t.Errorf("%d. Go %q resulted in no error; want %q", i, test.Go, test.Err)
+		} else if !strings.Contains(err.Error(), test.Err) {
+			t.Errorf("%d. Go %q resulted in error %v; want %q", i, test.Go, err, test.Err)
+		}
+	}
+
+	// Interfaces have no Lua value
+	if _, _, err := ParsePackage(`import "fmt"` + "\n\nvar s fmt.Stringer"); err != nil {
+		t.Errorf("Got error for fmt.Stringer: %v", err)
+	}
+}
+
+func TestStdlibCalls(t *testing.T) {
+	const decls = `
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var _ = sort.Ints
+var _ = strconv.Itoa
+var _ = strings.Split
+`
+	RunDeclFuncTests(t, decls, []StringTest{
+		{
+			`_ = strings.Split("a,b", ",")`,
+			`_ = _strings.Split("a,b", ",")`,
+		},
+		{
+			`n, err := strconv.Atoi("5"); _, _ = n, err`,
+			"local n, err = _strconv.Atoi(\"5\")\n_, _ = n, err",
+		},
+		{
+			`x := []int{2, 1}; sort.Slice(x, func(i, j int) bool { return x[i] < x[j] })`,
+			"local x = { 2, 1 }\n_sort.Slice(x, function(i, j)\n\treturn (x[i + 1] or 0) < (x[j + 1] or 0)\nend)",
+		},
+		{
+			`var b strings.Builder; b.WriteString("x")`,
+			"local b = setmetatable({}, {__index=_strings.Builder})\n\nb:WriteString(\"x\")",
+		},
+	})
+}
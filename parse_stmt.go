@@ -6,40 +6,59 @@ import (
 	"go/types"
 )
 
-func (p *Parser) parseBlockStmt(w *Writer, b *ast.BlockStmt) {
+func (p *Parser) parseBlockStmt(b *ast.BlockStmt) []luaStmt {
+	var stmts []luaStmt
 	for _, stmt := range b.List {
-		p.parseStmt(w, stmt)
+		stmts = append(stmts, p.parseStmt(stmt)...)
 	}
+	return stmts
 }
 
-func (p *Parser) parseStmt(w *Writer, s ast.Stmt) {
+func (p *Parser) parseStmt(s ast.Stmt) (stmts []luaStmt) {
+	defer p.recoverError()
+	defer func() { setLuaPos(stmts, s.Pos()) }()
 	switch t := s.(type) {
 	case *ast.AssignStmt:
-		p.parseAssignStmt(w, t)
+		return p.parseAssignStmt(t)
 	case *ast.BlockStmt:
-		p.parseBlockStmt(w, t)
+		return p.parseBlockStmt(t)
 	case *ast.DeclStmt:
-		p.parseDeclStmt(w, t)
+		return p.parseDeclStmt(t)
 	case *ast.ExprStmt:
-		// ExprStmt is an expression that ends in a newline
-		p.parseExpr(w, t.X)
-		w.WriteBytes(newline)
+		if call, ok := ast.Unparen(t.X).(*ast.CallExpr); ok {
+			if s := p.parseLuaStmt(call); s != nil {
+				return []luaStmt{s}
+			}
+		}
+		x := p.parseExpr(t.X)
+		switch x.(type) {
+		case *luaCallExpr, *luaRawExpr, *luaCode:
+		default:
+			// An inlined call, which Lua does not allow as a statement
+			return []luaStmt{&luaLocalStmt{names: []string{"_"}, values: []luaExpr{x}}}
+		}
+		return []luaStmt{&luaExprStmt{x: x}}
 	case *ast.ReturnStmt:
-		p.parseReturnStmt(w, t)
+		return []luaStmt{p.parseReturnStmt(t)}
 	case *ast.IfStmt:
-		p.parseIfStmt(w, t)
+		return []luaStmt{p.parseIfStmt(t)}
 	case *ast.RangeStmt:
-		p.parseRangeStmt(w, t)
+		return []luaStmt{p.parseRangeStmt(t)}
 	case *ast.ForStmt:
-		p.parseForStmt(w, t)
+		return []luaStmt{p.parseForStmt(t)}
 	case *ast.IncDecStmt:
-		p.parseIncDecStmt(w, t)
+		return []luaStmt{p.parseIncDecStmt(t)}
+	case *ast.TypeSwitchStmt:
+		return []luaStmt{p.parseTypeSwitchStmt(t)}
+	case *ast.BranchStmt:
+		return []luaStmt{p.parseBranchStmt(t)}
 	default:
-		p.errorf(s, "Unhandled statement type %T", t)
+		p.errorf(s, CodeUnsupported, "Unhandled statement type %T", t)
 	}
+	return nil
 }
 
-func (p *Parser) parseAssignStmt(w *Writer, s *ast.AssignStmt) {
+func (p *Parser) parseAssignStmt(s *ast.AssignStmt) []luaStmt {
 	nl := len(s.Lhs)
 	nr := len(s.Rhs)
 
@@ -48,120 +67,150 @@ func (p *Parser) parseAssignStmt(w *Writer, s *ast.AssignStmt) {
 		_, index := lhs.(*ast.IndexExpr)
 		_, sel := lhs.(*ast.SelectorExpr)
 		if !ident && !index && !sel {
-			p.errorf(s, "Got assignment to non-identifier/index/selector %T", lhs)
+			p.errorf(s, CodeUnsupported, "Got assignment to non-identifier/index/selector %T", lhs)
 		}
 	}
 
-	switch s.Tok {
-	case token.ADD_ASSIGN, token.SUB_ASSIGN, token.MUL_ASSIGN, token.QUO_ASSIGN, token.REM_ASSIGN:
+	if op, ok := assignOps[s.Tok]; ok {
 		// combined assignment and binary expression; handle separately
 		if nl != 1 || nr != 1 {
-			p.errorf(s, "Got assignment with token %q and != 1 expr per side (%d vs %d)", s.Tok.String(), nl, nr)
+			p.errorf(s, CodeUnsupported, "Got assignment with token %q and != 1 expr per side (%d vs %d)", s.Tok.String(), nl, nr)
 		}
 
-		// Left hand side appears twice
-		p.parseExpr(w, s.Lhs[0])
-		w.WriteString(" = ")
-		p.parseExpr(w, s.Lhs[0])
+		// Left hand side appears twice. The right hand side becomes an
+		// operand of the operator, so binary expressions need parentheses.
+		rhs := s.Rhs[0]
+		if _, ok := rhs.(*ast.BinaryExpr); ok {
+			rhs = &ast.ParenExpr{Lparen: rhs.Pos(), X: rhs, Rparen: rhs.End()}
+		}
+		return []luaStmt{&luaAssignStmt{
+			targets: []luaExpr{p.parseLhs(s.Lhs[0])},
+			values:  []luaExpr{p.parseBinaryOp(s.Lhs[0], op, rhs)},
+		}}
+	}
 
-		// Add first part of operator
-		w.WriteByte(' ')
-		w.WriteByte(s.Tok.String()[0])
-		w.WriteByte(' ')
+	var values []luaExpr
+	if ta, ok := s.Rhs[0].(*ast.TypeAssertExpr); ok && nl == 2 && nr == 1 {
+		// Comma-ok type assertion
+		values = []luaExpr{p.parseTypeAssertExpr(ta, true)}
+	} else {
+		for i, rhs := range s.Rhs {
+			// TODO(eandre) Need to map this to the zero value for each type instead of "nil"
+			if s.Tok == token.ASSIGN && nl == nr {
+				values = append(values, p.parseExprTo(rhs, p.lhsType(s.Lhs[i])))
+			} else {
+				values = append(values, p.parseExpr(rhs))
+			}
+		}
+	}
 
-		// Add right hand side
-		p.parseExpr(w, s.Rhs[0])
-		w.WriteBytes(newline)
-		return
+	if s.Tok == token.DEFINE {
+		// combined assignment and declaration
+		names := make([]string, nl)
+		for i, lhs := range s.Lhs {
+			names[i] = lhs.(*ast.Ident).Name
+		}
+		return []luaStmt{&luaLocalStmt{names: names, values: values}}
+	}
+	targets := make([]luaExpr, nl)
+	for i, lhs := range s.Lhs {
+		targets[i] = p.parseLhs(lhs)
+	}
+	return []luaStmt{&luaAssignStmt{targets: targets, values: values}}
+}
 
-	case token.DEFINE:
-		// combined assignment and declaration, prepend "local"
-		w.WriteString("local ")
+// parseLhs returns the assignment target x.
+func (p *Parser) parseLhs(x ast.Expr) luaExpr {
+	if index, ok := x.(*ast.IndexExpr); ok {
+		return p.parseIndexExpr(index, true)
 	}
+	return p.parseExpr(x)
+}
 
-	for i, lhs := range s.Lhs {
-		switch lhs := lhs.(type) {
-		case *ast.IndexExpr:
-			p.parseIndexExpr(w, lhs, true)
-		default:
-			p.parseExpr(w, lhs)
+// lhsType returns the type of the assignment target x, or nil if x is the
+// blank identifier or an element or field of a value of a Lua type.
+func (p *Parser) lhsType(x ast.Expr) types.Type {
+	switch x := x.(type) {
+	case *ast.Ident:
+		if x.Name == "_" {
+			return nil
 		}
-
-		// Add a comma if we have more expressions coming
-		if (i + 1) != nl {
-			w.WriteString(", ")
+	case *ast.IndexExpr:
+		// Values stored in Lua types are used as they are
+		if p.isLuaType(p.exprTypeRaw(x.X)) {
+			return nil
 		}
-	}
-	w.WriteString(" = ")
-	for i, rhs := range s.Rhs {
-		// TODO(eandre) Need to map this to the zero value for each type instead of "nil"
-		p.parseExpr(w, rhs)
-		// Add a comma if we have more expressions coming
-		if (i + 1) != nr {
-			w.WriteString(", ")
+	case *ast.SelectorExpr:
+		if s := p.nodePkg(x).Selections[x]; s != nil && p.isLuaType(s.Recv()) {
+			return nil
 		}
 	}
-	w.WriteBytes(newline)
+	return p.exprTypeRaw(x)
 }
 
-func (p *Parser) parseDeclStmt(w *Writer, s *ast.DeclStmt) {
-	p.parseGenDecl(w, s.Decl.(*ast.GenDecl), false)
+func (p *Parser) parseDeclStmt(s *ast.DeclStmt) []luaStmt {
+	return p.parseGenDecl(s.Decl.(*ast.GenDecl), false)
 }
 
-func (p *Parser) parseReturnStmt(w *Writer, r *ast.ReturnStmt) {
+func (p *Parser) parseReturnStmt(r *ast.ReturnStmt) luaStmt {
 	// Naked return
 	if r.Results == nil {
-		w.WriteLine("return")
-		return
+		return &luaReturnStmt{}
+	}
+
+	var results *types.Tuple
+	if n := len(p.funcSigs); n > 0 {
+		results = p.funcSigs[n-1].Results()
 	}
 
-	w.WriteString("return ")
+	ret := &luaReturnStmt{}
 	nr := len(r.Results)
+	if results != nil && results.Len() == 1 && nr == 1 && isMulti(results.At(0).Type()) {
+		ret.values = p.parseMultiResult(r.Results[0])
+		return ret
+	}
 	for i, res := range r.Results {
-		p.parseExpr(w, res)
-		if (i + 1) != nr {
-			w.WriteString(", ")
+		if results != nil && results.Len() == nr {
+			ret.values = append(ret.values, p.parseExprTo(res, results.At(i).Type()))
+		} else {
+			ret.values = append(ret.values, p.parseExpr(res))
 		}
 	}
-	w.WriteNewline()
+	return ret
 }
 
-func (p *Parser) parseIfStmt(w *Writer, s *ast.IfStmt) {
+// parseIfStmt returns an if statement, wrapped in a block declaring the
+// variables of the init statement if there is one. Else-if statements
+// become elseif clauses unless they have an init statement of their own.
+func (p *Parser) parseIfStmt(s *ast.IfStmt) luaStmt {
+	var init []luaStmt
 	if s.Init != nil {
-		w.WriteLine("do")
-		w.Indent()
-		p.parseStmt(w, s.Init)
-		defer func() {
-			w.Dedent()
-			w.WriteLine("end")
-		}()
-	}
-
-	w.WriteString("if ")
-	p.parseExpr(w, s.Cond)
-	w.WriteString(" then")
-	w.WriteNewline()
-	w.Indent()
-	p.parseBlockStmt(w, s.Body)
-	w.Dedent()
-	if s.Else != nil {
-		if elif, ok := s.Else.(*ast.IfStmt); ok {
-			// We have an else-if statement
-			w.WriteString("else")
-			p.parseIfStmt(w, elif)
-			return
+		init = p.parseStmt(s.Init)
+	}
+
+	stmt := &luaIfStmt{}
+	for {
+		stmt.clauses = append(stmt.clauses, luaClause{
+			cond: p.parseExpr(s.Cond),
+			body: p.parseBlockStmt(s.Body),
+		})
+		elif, ok := s.Else.(*ast.IfStmt)
+		if !ok || elif.Init != nil {
+			break
 		}
+		s = elif
+	}
+	if s.Else != nil {
+		stmt.elseBlock = p.parseStmt(s.Else)
+	}
 
-		// Regular else statement
-		w.WriteLine("else")
-		w.Indent()
-		p.parseStmt(w, s.Else)
-		w.Dedent()
+	if init != nil {
+		return &luaDoStmt{body: append(init, stmt)}
 	}
-	w.WriteLine("end")
+	return stmt
 }
 
-func (p *Parser) parseRangeStmt(w *Writer, s *ast.RangeStmt) {
+func (p *Parser) parseRangeStmt(s *ast.RangeStmt) luaStmt {
 	// TODO(eandre) We can only handle ":=" range statements for now, since
 	// Lua uses a local scope in for loops. To get around this to allow for
 	// outer-declared variables we'd have to allocate a temporary variable
@@ -169,79 +218,145 @@ func (p *Parser) parseRangeStmt(w *Writer, s *ast.RangeStmt) {
 	// ILLEGAL is supported also, which is the case where no variables at all
 	// are assigned to.
 	if s.Tok != token.DEFINE && s.Tok != token.ILLEGAL {
-		p.errorf(s, "Unhandled range token %s", s.Tok.String())
+		p.errorf(s, CodeUnsupported, "Unhandled range token %s", s.Tok.String())
 	}
 
-	w.WriteString("for ")
-
 	// Lua requires at least one local variable; if we don't have one
 	// use "_"
-	if s.Key == nil {
-		w.WriteString("_")
-	} else {
-		w.WriteString(s.Key.(*ast.Ident).Name)
+	stmt := &luaForInStmt{names: []string{"_"}}
+	if s.Key != nil {
+		stmt.names[0] = s.Key.(*ast.Ident).Name
 	}
-
 	if s.Value != nil {
-		w.WriteStringf(", %s", s.Value.(*ast.Ident).Name)
+		stmt.names = append(stmt.names, s.Value.(*ast.Ident).Name)
 	}
 
-	w.WriteString(" in ")
+	if iter := p.parseLuaRange(s.X); iter != nil {
+		stmt.x = iter
+		stmt.body = p.parseLoopBody(s.Body)
+		return stmt
+	}
 
+	// Add "or {}" to match Go's behavior of iteration over nil slices
+	// and maps
+	x := &luaBinaryExpr{op: "or", x: p.parseExpr(s.X), y: &luaTableLit{}}
 	switch t := p.exprType(s.X).(type) {
 	case *types.Slice:
-		w.WriteString("builtins.slice_iter(")
-		p.parseExpr(w, s.X)
-		// Add "or {}" to match Go's behavior of iteration over nil slices
-		w.WriteString(" or {})")
+		stmt.x = luaBuiltin("slice_iter", x)
 	case *types.Map:
-		w.WriteString("pairs(")
-		p.parseExpr(w, s.X)
-		// Add "or {}" to match Go's behavior of iteration over nil maps
-		w.WriteString(" or {})")
+		stmt.x = luaCallOf(luaIdentOf("pairs"), x)
 	default:
-		p.errorf(s, "Unhandled RangeStmt expression type %T", t)
+		p.errorf(s, CodeUnsupported, "Unhandled RangeStmt expression type %T", t)
 	}
 
-	w.WriteString(" do")
-	w.WriteNewline()
-	w.Indent()
-	p.parseBlockStmt(w, s.Body)
-	w.Dedent()
-	w.WriteLine("end")
+	stmt.body = p.parseLoopBody(s.Body)
+	return stmt
 }
 
-func (p *Parser) parseForStmt(w *Writer, s *ast.ForStmt) {
-	w.WriteLine("do")
-	w.Indent()
+func (p *Parser) parseForStmt(s *ast.ForStmt) luaStmt {
+	var stmts []luaStmt
 	if s.Init != nil {
-		p.parseStmt(w, s.Init)
+		stmts = p.parseStmt(s.Init)
 	}
-	w.WriteString("while ")
+	loop := &luaWhileStmt{cond: luaLitOf("true")}
 	if s.Cond != nil {
-		p.parseExpr(w, s.Cond)
-	} else {
-		w.WriteString("true")
+		loop.cond = p.parseExpr(s.Cond)
 	}
-	w.WriteLine(" do")
-	w.Indent()
-	p.parseBlockStmt(w, s.Body)
+	loop.body = p.parseLoopBody(s.Body)
 	if s.Post != nil {
-		p.parseStmt(w, s.Post)
+		loop.post = p.parseStmt(s.Post)
 	}
-	w.Dedent()
-	w.WriteLine("end")
-	w.Dedent()
-	w.WriteLine("end")
+	return &luaDoStmt{body: append(stmts, loop)}
 }
 
-func (p *Parser) parseIncDecStmt(w *Writer, s *ast.IncDecStmt) {
-	p.parseExpr(w, s.X)
-	w.WriteString(" = ")
-	p.parseExpr(w, s.X)
-	if s.Tok == token.INC {
-		w.WriteLine(" + 1")
-	} else {
-		w.WriteLine(" - 1")
+func (p *Parser) parseIncDecStmt(s *ast.IncDecStmt) luaStmt {
+	op := "+"
+	if s.Tok == token.DEC {
+		op = "-"
+	}
+	return &luaAssignStmt{
+		targets: []luaExpr{p.parseLhs(s.X)},
+		values:  []luaExpr{&luaBinaryExpr{op: op, x: p.parseExpr(s.X), y: luaLitOf("1")}},
+	}
+}
+
+// loopInfo describes how to write break statements for an enclosing loop
+// or switch statement.
+type loopInfo struct {
+	isSwitch   bool   // a switch, which can only be broken out of
+	breakLabel string // label to jump to on break, if any
+}
+
+// parseLoopBody returns the body of a loop. Its continue statements are
+// lowered by lowerLoops.
+func (p *Parser) parseLoopBody(body *ast.BlockStmt) []luaStmt {
+	p.loops = append(p.loops, &loopInfo{})
+	defer func() { p.loops = p.loops[:len(p.loops)-1] }()
+	return p.parseBlockStmt(body)
+}
+
+// bodyBranches reports whether the body of a loop or switch statement
+// contains continue and break statements. Break statements are only
+// reported if they belong to the statement itself.
+func bodyBranches(body *ast.BlockStmt) (hasContinue, hasBreak bool) {
+	var visit func(n ast.Node, inSwitch bool)
+	visit = func(n ast.Node, inSwitch bool) {
+		ast.Inspect(n, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.FuncLit, *ast.ForStmt, *ast.RangeStmt:
+				return false
+			case *ast.SwitchStmt, *ast.TypeSwitchStmt, *ast.SelectStmt:
+				// Breaks inside switches break out of the switch
+				if !inSwitch {
+					visit(n, true)
+					return false
+				}
+			case *ast.BranchStmt:
+				if n.Label != nil {
+					break
+				}
+				if n.Tok == token.CONTINUE {
+					hasContinue = true
+				} else if n.Tok == token.BREAK && !inSwitch {
+					hasBreak = true
+				}
+			}
+			return true
+		})
+	}
+	visit(body, false)
+	return hasContinue, hasBreak
+}
+
+func (p *Parser) parseBranchStmt(s *ast.BranchStmt) luaStmt {
+	if s.Label != nil {
+		p.errorf(s, CodeUnsupported, "Unhandled labeled %s statement", s.Tok)
+	}
+
+	switch s.Tok {
+	case token.BREAK:
+		if len(p.loops) == 0 {
+			p.errorf(s, CodeInvalid, "Got break outside of loop")
+		}
+		info := p.loops[len(p.loops)-1]
+		switch {
+		case info.breakLabel != "":
+			return &luaGotoStmt{label: info.breakLabel}
+		case info.isSwitch:
+			p.errorf(s, CodeTarget, "Unhandled break out of switch statement for target %s", p.target)
+		}
+		return &luaBreakStmt{}
+
+	case token.CONTINUE:
+		for i := len(p.loops) - 1; i >= 0; i-- {
+			if !p.loops[i].isSwitch {
+				return &luaContinueStmt{}
+			}
+		}
+		p.errorf(s, CodeInvalid, "Got continue outside of loop")
+
+	default:
+		p.errorf(s, CodeUnsupported, "Unhandled branch statement %s", s.Tok)
 	}
+	return nil
 }
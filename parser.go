@@ -1,77 +1,153 @@
 package lunar
 
 import (
+	"bytes"
 	"fmt"
 	"go/ast"
 	"go/types"
 	"io"
-	"log"
 
 	"golang.org/x/tools/go/loader"
 )
 
 type Parser struct {
-	prog        *loader.Program
-	transient   map[string]bool
-	testPkgName string // for testing purposes
+	prog      *Program
+	transient map[string]bool
+	target    Target
+	modules   func(path string) string // module names, in module mode
+	live      *deadCode                // reachable declarations, if eliminating dead code
+	minify    bool                     // whether output is minified; see SetMinify
+	checkRaw  bool                     // whether lua.Raw code is checked; see SetCheckRaw
+	optimize  bool                     // whether output is optimized; see SetOptimize
+	style     Style                    // layout of the output
+
+	funcSigs    []*types.Signature // signatures of the enclosing functions
+	loops       []*loopInfo        // enclosing loops and switches
+	sourceMap   *SourceMap         // of the output of the last ParseNode call
+	diags       Diagnostics        // found by the last ParseNode call
+	warnings    WarningHandler     // receives warnings, if set
+	promoted    map[string]bool    // warning categories promoted to errors
+	testPkgName string             // for testing purposes
+
+	// Inlining; see inlineCall
+	inlining     map[*types.Func]bool          // functions whose bodies are being inlined
+	inlineParams map[types.Object]*inlineParam // parameters of the body being inlined
+	funcDecls    map[*types.Package]map[*types.Func]*ast.FuncDecl
+
+	// Directives of package-level declarations; see objDirectives
+	directives map[*types.Package]map[types.Object]*declDirectives
+}
+
+// NewParser returns a parser for a program loaded with go/loader.
+func NewParser(prog *loader.Program) *Parser {
+	return NewProgramParser(FromLoader(prog))
 }
 
-func NewParser(prog *loader.Program) *Parser {
+// NewProgramParser returns a parser for the given program, which can be
+// loaded with Load or created from go/packages results with FromPackages.
+func NewProgramParser(prog *Program) *Parser {
 	return &Parser{
 		prog:      prog,
 		transient: make(map[string]bool),
+		style:     DefaultStyle,
 	}
 }
 
-func (p *Parser) ParseNode(w io.Writer, n ast.Node) (err error) {
+// SetStyle sets the layout of the Lua code written. The default is
+// DefaultStyle.
+func (p *Parser) SetStyle(s Style) {
+	p.style = s
+}
+
+// ParseNode writes the Lua code for n to w. Parsing continues past
+// untranslatable declarations and statements, so that all of them are
+// reported. The returned error is of type Diagnostics if any errors were
+// found, or a WriteError if writing failed.
+func (p *Parser) ParseNode(w io.Writer, n ast.Node) error {
+	return p.parse(w, func(w *Writer) {
+		p.printChunk(w, p.parseNode(n, true))
+	})
+}
+
+// parse calls fn with a writer writing to out, recording the diagnostics
+// and source map of the output like ParseNode.
+func (p *Parser) parse(out io.Writer, fn func(w *Writer)) (err error) {
+	p.diags = nil
 	// Handle panics
 	defer func() {
 		e := recover()
 		if e != nil {
-			switch e.(type) {
-			case ParseError, WriteError:
-				err = e.(error)
+			switch e := e.(type) {
+			case ParseError:
+				p.addError(e)
+			case WriteError:
+				err = e
 				return
+			default:
+				// Panic again if it wasn't a parse error
+				panic(e)
 			}
-
-			// Panic again if it wasn't a parse error
-			panic(e)
+		}
+		if errs := p.diags.Errors(); len(errs) > 0 {
+			err = errs
 		}
 	}()
 
-	writer := NewWriter(w)
-	p.parseNode(writer, n, true)
+	// Minified output is written once it is complete
+	dst := out
+	var buf bytes.Buffer
+	if p.minify {
+		out = &buf
+	}
+	writer := NewWriter(out)
+	writer.SetStyle(p.style)
+	p.sourceMap = &SourceMap{builtins: p.builtinsRef()}
+	if p.prog != nil {
+		p.sourceMap.Fset = p.prog.Fset
+	}
+	defer func() { p.sourceMap.Mappings = writer.Mappings() }()
+	fn(writer)
+	if p.minify {
+		lua := buf.Bytes()
+		if len(p.diags.Errors()) == 0 {
+			if lua, err = p.minifyOutput(writer, lua); err != nil {
+				return err
+			}
+		}
+		if _, err := dst.Write(lua); err != nil {
+			return WriteError{err}
+		}
+	}
 	return nil
 }
 
-func (p *Parser) parseNode(w *Writer, n ast.Node, topLevel bool) {
+func (p *Parser) parseNode(n ast.Node, topLevel bool) (stmts []luaStmt) {
+	defer p.recoverError()
+	defer func() { setLuaPos(stmts, n.Pos()) }()
 	switch t := n.(type) {
 	case *ast.GenDecl:
-		p.parseGenDecl(w, t, topLevel)
+		return p.parseGenDecl(t, topLevel)
 	case *ast.BlockStmt:
-		p.parseBlockStmt(w, t)
+		return p.parseBlockStmt(t)
 	case *ast.FuncDecl:
-		p.parseFuncDecl(w, t)
+		return p.parseFuncDecl(t)
 	case *ast.File:
-		p.parseFile(w, t)
+		return p.parseFile(t)
 	case *ast.Package:
-		p.parsePackage(w, t)
+		return p.parsePackage(t)
 	default:
-		p.log("Unhandled node type %T", t)
+		p.warnf(n, WarnUnhandledNode, "Unhandled node type %T", t)
 	}
+	return nil
 }
 
-func (p *Parser) log(format string, args ...interface{}) {
-	log.Printf(format, args...)
-}
-
-func (p *Parser) error(node ast.Node, err string) {
-	panic(ParseError{node: node, err: err})
+func (p *Parser) error(node ast.Node, code, err string) {
+	panic(ParseError{node: node, code: code, err: err})
 }
 
-func (p *Parser) errorf(node ast.Node, format string, args ...interface{}) {
+func (p *Parser) errorf(node ast.Node, code, format string, args ...interface{}) {
 	err := fmt.Sprintf(format, args...)
-	p.error(node, err)
+	p.error(node, code, err)
 }
 
 func (p *Parser) exprType(x ast.Expr) types.Type {
@@ -79,7 +155,7 @@ func (p *Parser) exprType(x ast.Expr) types.Type {
 	if typ := pkg.Info.TypeOf(x); typ != nil {
 		return typ.Underlying()
 	}
-	p.error(x, "Could not determine type of expr")
+	p.error(x, CodeInternal, "Could not determine type of expr")
 	return nil // unreachable
 }
 
@@ -88,7 +164,7 @@ func (p *Parser) exprTypeRaw(x ast.Expr) types.Type {
 	if typ := pkg.Info.TypeOf(x); typ != nil {
 		return typ
 	}
-	p.error(x, "Could not determine type of expr")
+	p.error(x, CodeInternal, "Could not determine type of expr")
 	return nil // unreachable
 }
 
@@ -97,7 +173,7 @@ func (p *Parser) identObject(i *ast.Ident) types.Object {
 	if obj := pkg.Info.ObjectOf(i); obj != nil {
 		return obj
 	}
-	p.error(i, "Could not determine ident object")
+	p.error(i, CodeInternal, "Could not determine ident object")
 	return nil // unreachable
 }
 
@@ -106,7 +182,13 @@ func (p *Parser) importObject(i *ast.ImportSpec) types.Object {
 	if obj := pkg.Info.Implicits[i]; obj != nil {
 		return obj
 	}
-	p.error(i, "Could not determine import object")
+	// Renamed imports define their local name instead
+	if i.Name != nil {
+		if obj := pkg.Info.Defs[i.Name]; obj != nil {
+			return obj
+		}
+	}
+	p.error(i, CodeInternal, "Could not determine import object")
 	return nil // unreachable
 }
 
@@ -120,7 +202,7 @@ func (p *Parser) exprTypeAndValue(x ast.Expr) types.TypeAndValue {
 	if tav, ok := pkg.Info.Types[x]; ok {
 		return tav
 	}
-	p.error(x, "Could not determine type and value of expr")
+	p.error(x, CodeInternal, "Could not determine type and value of expr")
 	return types.TypeAndValue{} // unreachable
 }
 
@@ -134,15 +216,13 @@ func (p *Parser) pkgName(n ast.Node) string {
 	return pkg.Pkg.Name()
 }
 
-func (p *Parser) nodePkg(n ast.Node) *loader.PackageInfo {
-	pkg, _, _ := p.prog.PathEnclosingInterval(n.Pos(), n.End())
+func (p *Parser) nodePkg(n ast.Node) *Package {
+	if p.prog == nil {
+		p.errorf(n, CodeInternal, "No program to look up package of node %T", n)
+	}
+	pkg := p.prog.PackageOf(n.Pos())
 	if pkg == nil {
-		if ident, ok := n.(*ast.Ident); ok {
-			f := p.prog.Fset.File(n.Pos())
-			fmt.Println("ident", ident.Name, f, n.Pos())
-		}
-		panic("Could not get package for node")
-		p.errorf(n, "Could not get package for node %T", n)
+		p.errorf(n, CodeInternal, "Could not get package for node %T", n)
 	}
 	return pkg
 }
@@ -158,8 +238,11 @@ func (p *Parser) IsTransientPkg(pkg *types.Package) bool {
 	return p.transient[pkg.Path()]
 }
 
+// ParseError is raised by the parser when it cannot translate a node. It is
+// recovered and reported as a Diagnostic.
 type ParseError struct {
 	node ast.Node
+	code string
 	err  string
 }
 
@@ -40,6 +40,16 @@ func ParseFunc(src string) (string, string, error) {
 	return parseStr(src, get)
 }
 
+// ParseFuncWithDecls parses src as the body of a function declared after
+// the package-level declarations in decls.
+func ParseFuncWithDecls(decls, src string) (string, string, error) {
+	src = fmt.Sprintf("%s\nfunc testFunc() {%s}", decls, src)
+	get := func(f *ast.File) ast.Node {
+		return f.Decls[len(f.Decls)-1].(*ast.FuncDecl).Body
+	}
+	return parseStr(src, get)
+}
+
 func ParsePackage(src string) (string, string, error) {
 	get := func(f *ast.File) ast.Node {
 		return f
@@ -48,6 +58,12 @@ func ParsePackage(src string) (string, string, error) {
 }
 
 func parseStr(src string, get func(*ast.File) ast.Node) (string, string, error) {
+	return parseStrWith(nil, src, get)
+}
+
+// parseStrWith is like parseStr, calling setup to configure the parser
+// unless it is nil.
+func parseStrWith(setup func(p *Parser), src string, get func(*ast.File) ast.Node) (string, string, error) {
 	src = "package dummy\n" + src
 	fset := token.NewFileSet()
 	f, err := parser.ParseFile(fset, "dummy.go", src, parser.ParseComments)
@@ -62,12 +78,17 @@ func parseStr(src string, get func(*ast.File) ast.Node) (string, string, error)
 	var conf loader.Config
 	conf.Fset = fset
 	conf.CreateFromFiles("dummy", f)
+	// Only the package under test needs its function bodies type-checked
+	conf.TypeCheckFuncBodies = func(path string) bool { return path == "dummy" }
 	prog, err := conf.Load()
 	if err != nil {
 		return "", tree.String(), err
 	}
 
 	p := NewParser(prog)
+	if setup != nil {
+		setup(p)
+	}
 	buf := &bytes.Buffer{}
 	err = p.ParseNode(buf, node)
 	if err != nil {
@@ -111,6 +132,21 @@ func RunFuncTests(t *testing.T, tests []StringTest) {
 	}
 }
 
+func RunDeclFuncTests(t *testing.T, decls string, tests []StringTest) {
+	for i, test := range tests {
+		lua, tree, err := ParseFuncWithDecls(decls, test.Go)
+		if err != nil {
+			t.Logf("Got tree: %s", tree)
+			t.Errorf("%d. Go %q resulted in error: %#v", i, test.Go, err)
+			continue
+		} else if lua != test.Lua {
+			t.Logf("Got tree: %s", tree)
+			t.Errorf("%d. Go %q resulted in Lua %q; want %q", i, test.Go, lua, test.Lua)
+			continue
+		}
+	}
+}
+
 func RunPackageTests(t *testing.T, tests []StringTest) {
 	const prelude = `-- Package declaration
 local dummy = _G.dummy or {}
@@ -0,0 +1,288 @@
+package lunar
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/go/loader"
+	"golang.org/x/tools/go/packages"
+)
+
+// Program is a set of type-checked packages to translate, independent of
+// how they were loaded.
+type Program struct {
+	Fset     *token.FileSet
+	Initial  []*Package // the packages that were requested
+	Packages []*Package // all packages with syntax, ordered by path
+
+	byFile map[*token.File]*Package
+	byPath map[string]*Package
+	sizes  types.Sizes // used to type-check packages again, if known
+}
+
+// Package is a type-checked package with its syntax.
+type Package struct {
+	Pkg   *types.Package
+	Files []*ast.File
+	*types.Info
+
+	// Module is the module containing the package, if it was loaded with
+	// go/packages in module mode.
+	Module *packages.Module
+}
+
+// LoadMode is the go/packages load mode required by the parser.
+const LoadMode = packages.NeedName | packages.NeedFiles | packages.NeedImports | packages.NeedDeps |
+	packages.NeedTypes | packages.NeedSyntax | packages.NeedTypesInfo | packages.NeedModule
+
+// Load loads the packages matching the patterns using go/packages, which
+// understands modules, build tags and workspaces. The mode of cfg is
+// extended with LoadMode; cfg may be nil.
+func Load(cfg *packages.Config, patterns ...string) (*Program, error) {
+	var c packages.Config
+	if cfg != nil {
+		c = *cfg
+	}
+	c.Mode |= LoadMode
+	if c.Fset == nil {
+		c.Fset = token.NewFileSet()
+	}
+	pkgs, err := packages.Load(&c, patterns...)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []string
+	packages.Visit(pkgs, nil, func(pkg *packages.Package) {
+		for _, e := range pkg.Errors {
+			errs = append(errs, e.Error())
+		}
+	})
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("lunar: could not load packages:\n%s", strings.Join(errs, "\n"))
+	}
+	return FromPackages(c.Fset, pkgs), nil
+}
+
+// FromPackages creates a program from packages loaded with go/packages
+// using at least LoadMode. Dependencies are included as well.
+func FromPackages(fset *token.FileSet, initial []*packages.Package) *Program {
+	prog := newProgram(fset)
+	seen := make(map[*packages.Package]*Package)
+	packages.Visit(initial, nil, func(pkg *packages.Package) {
+		if pkg.Types == nil || pkg.TypesInfo == nil {
+			return
+		}
+		if prog.sizes == nil {
+			prog.sizes = pkg.TypesSizes
+		}
+		seen[pkg] = prog.add(&Package{
+			Pkg:    pkg.Types,
+			Files:  pkg.Syntax,
+			Info:   pkg.TypesInfo,
+			Module: pkg.Module,
+		})
+	})
+	for _, pkg := range initial {
+		if p := seen[pkg]; p != nil {
+			prog.Initial = append(prog.Initial, p)
+		}
+	}
+	prog.sort()
+	return prog
+}
+
+// FromLoader creates a program from a program loaded with go/loader.
+func FromLoader(lprog *loader.Program) *Program {
+	prog := newProgram(lprog.Fset)
+	initial := make(map[*loader.PackageInfo]bool)
+	for _, info := range lprog.InitialPackages() {
+		initial[info] = true
+	}
+	for _, info := range lprog.AllPackages {
+		pkg := prog.add(&Package{
+			Pkg:   info.Pkg,
+			Files: info.Files,
+			Info:  &info.Info,
+		})
+		if initial[info] {
+			prog.Initial = append(prog.Initial, pkg)
+		}
+	}
+	prog.sort()
+	return prog
+}
+
+func newProgram(fset *token.FileSet) *Program {
+	return &Program{
+		Fset:   fset,
+		byFile: make(map[*token.File]*Package),
+		byPath: make(map[string]*Package),
+	}
+}
+
+func (prog *Program) add(pkg *Package) *Package {
+	prog.Packages = append(prog.Packages, pkg)
+	prog.byPath[pkg.Pkg.Path()] = pkg
+	for _, f := range pkg.Files {
+		if tf := prog.Fset.File(f.Pos()); tf != nil {
+			prog.byFile[tf] = pkg
+		}
+	}
+	return pkg
+}
+
+func (prog *Program) sort() {
+	for _, pkgs := range [][]*Package{prog.Initial, prog.Packages} {
+		sort.Slice(pkgs, func(i, j int) bool {
+			return pkgs[i].Pkg.Path() < pkgs[j].Pkg.Path()
+		})
+	}
+}
+
+// Package returns the package with the given import path, or nil.
+func (prog *Program) Package(path string) *Package {
+	return prog.byPath[path]
+}
+
+// PackageOf returns the package containing the source position pos, or
+// nil.
+func (prog *Program) PackageOf(pos token.Pos) *Package {
+	return prog.byFile[prog.Fset.File(pos)]
+}
+
+// Update returns a program in which the packages with the import paths in
+// files are parsed again from the given files, and type-checked again
+// along with all packages importing them. The other packages, including
+// their type-checking results, are shared with prog, which is unchanged.
+// The packages that were type-checked again are returned in dependency
+// order.
+//
+// The files parsed again are added to the file set of prog, which is
+// shared by the programs Update returns, since the other packages keep
+// their positions. The file set therefore grows with each update, and
+// long-running callers should load the program again from time to time;
+// the watch mode of lunar build does so once the file set exceeds
+// a size limit.
+//
+// Update fails if a package imports a package that is not part of prog;
+// the program has to be loaded again in that case.
+func (prog *Program) Update(files map[string][]string) (*Program, []*Package, error) {
+	importers := make(map[string][]string)
+	for _, pkg := range prog.Packages {
+		for _, imp := range pkg.Pkg.Imports() {
+			importers[imp.Path()] = append(importers[imp.Path()], pkg.Pkg.Path())
+		}
+	}
+	dirty := make(map[string]bool)
+	var markDirty func(path string)
+	markDirty = func(path string) {
+		if dirty[path] {
+			return
+		}
+		dirty[path] = true
+		for _, imp := range importers[path] {
+			markDirty(imp)
+		}
+	}
+	for path := range files {
+		if prog.byPath[path] == nil {
+			return nil, nil, fmt.Errorf("lunar: package %s is not part of the program", path)
+		}
+		markDirty(path)
+	}
+
+	next := newProgram(prog.Fset)
+	next.sizes = prog.sizes
+	var checked []*Package
+	var errs []string
+	var check func(path string) (*Package, error)
+	importer := importerFunc(func(path string) (*types.Package, error) {
+		if path == "unsafe" {
+			return types.Unsafe, nil
+		}
+		pkg, err := check(path)
+		if err != nil {
+			return nil, err
+		}
+		return pkg.Pkg, nil
+	})
+	check = func(path string) (*Package, error) {
+		if pkg := next.byPath[path]; pkg != nil {
+			return pkg, nil
+		}
+		old := prog.byPath[path]
+		if old == nil {
+			return nil, fmt.Errorf("package %s is not part of the program", path)
+		}
+		if !dirty[path] {
+			return next.add(old), nil
+		}
+
+		syntax := old.Files
+		if names, ok := files[path]; ok {
+			syntax = nil
+			for _, name := range names {
+				f, err := parser.ParseFile(prog.Fset, name, nil, parser.ParseComments)
+				if err != nil {
+					errs = append(errs, err.Error())
+					continue
+				}
+				syntax = append(syntax, f)
+			}
+		}
+		info := &types.Info{
+			Types:      make(map[ast.Expr]types.TypeAndValue),
+			Defs:       make(map[*ast.Ident]types.Object),
+			Uses:       make(map[*ast.Ident]types.Object),
+			Implicits:  make(map[ast.Node]types.Object),
+			Selections: make(map[*ast.SelectorExpr]*types.Selection),
+			Scopes:     make(map[ast.Node]*types.Scope),
+		}
+		conf := types.Config{
+			Importer: importer,
+			Sizes:    prog.sizes,
+			Error: func(err error) {
+				errs = append(errs, err.Error())
+			},
+		}
+		if old.Module != nil && old.Module.GoVersion != "" {
+			conf.GoVersion = "go" + old.Module.GoVersion
+		}
+		tpkg, _ := conf.Check(path, prog.Fset, syntax, info)
+		pkg := next.add(&Package{
+			Pkg:    tpkg,
+			Files:  syntax,
+			Info:   info,
+			Module: old.Module,
+		})
+		checked = append(checked, pkg)
+		return pkg, nil
+	}
+
+	for _, pkg := range prog.Packages {
+		if _, err := check(pkg.Pkg.Path()); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return nil, nil, fmt.Errorf("lunar: could not load packages:\n%s", strings.Join(errs, "\n"))
+	}
+	for _, pkg := range prog.Initial {
+		next.Initial = append(next.Initial, next.byPath[pkg.Pkg.Path()])
+	}
+	next.sort()
+	return next, checked, nil
+}
+
+// importerFunc adapts a function to the types.Importer interface.
+type importerFunc func(path string) (*types.Package, error)
+
+func (f importerFunc) Import(path string) (*types.Package, error) {
+	return f(path)
+}
@@ -0,0 +1,144 @@
+package lunar
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/tools/go/loader"
+	"golang.org/x/tools/go/packages"
+)
+
+func TestFromLoader(t *testing.T) {
+	fset := token.NewFileSet()
+	var files []*ast.File
+	for _, src := range []string{
+		"package dummy\nimport \"strings\"\nvar A = strings.ToUpper(\"a\")",
+		"package dummy\nvar B = 2",
+	} {
+		f, err := parser.ParseFile(fset, "dummy.go", src, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, f)
+	}
+
+	var conf loader.Config
+	conf.Fset = fset
+	conf.CreateFromFiles("dummy", files...)
+	conf.TypeCheckFuncBodies = func(path string) bool { return path == "dummy" }
+	lprog, err := conf.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prog := FromLoader(lprog)
+	if len(prog.Initial) != 1 || prog.Initial[0].Pkg.Path() != "dummy" {
+		t.Fatalf("Got initial packages %v; want [dummy]", prog.Initial)
+	}
+	dummy := prog.Package("dummy")
+	if dummy == nil || prog.Package("strings") == nil {
+		t.Fatalf("Package lookup failed")
+	}
+	for _, f := range files {
+		if pkg := prog.PackageOf(f.Decls[len(f.Decls)-1].Pos()); pkg != dummy {
+			t.Errorf("Got package %v for %s; want dummy", pkg, fset.Position(f.Pos()))
+		}
+	}
+	if pkg := prog.PackageOf(token.NoPos); pkg != nil {
+		t.Errorf("Got package %v for no position; want nil", pkg)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, src string) {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("go.mod", "module example.com/m\n\ngo 1.18\n")
+	write("a/a.go", "package a\n\nimport \"example.com/m/b\"\n\nfunc A() int { return b.B }\n")
+	write("b/b.go", "package b\n\nvar B = 1\n")
+
+	prog, err := Load(&packages.Config{Dir: dir, Env: append(os.Environ(), "GOFLAGS=-mod=mod", "GOPROXY=off")}, "./a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prog.Initial) != 1 || prog.Initial[0].Pkg.Path() != "example.com/m/a" {
+		t.Fatalf("Got initial packages %v; want [example.com/m/a]", prog.Initial)
+	}
+	a := prog.Initial[0]
+	if a.Module == nil || a.Module.Path != "example.com/m" {
+		t.Errorf("Got module %v; want example.com/m", a.Module)
+	}
+	if prog.Package("example.com/m/b") == nil {
+		t.Errorf("Dependency example.com/m/b was not loaded")
+	}
+	if pkg := prog.PackageOf(a.Files[0].Pos()); pkg != a {
+		t.Errorf("Got package %v for a.go; want example.com/m/a", pkg)
+	}
+
+	if _, err := Load(&packages.Config{Dir: dir}, "./missing"); err == nil {
+		t.Errorf("Loading a missing package succeeded")
+	}
+}
+
+func TestProgramUpdate(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, src string) string {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	write("go.mod", "module example.com/m\n\ngo 1.18\n")
+	write("a/a.go", "package a\n\nimport \"example.com/m/b\"\n\nvar A = b.B\n")
+	bFile := write("b/b.go", "package b\n\nvar B = 1\n")
+	write("c/c.go", "package c\n\nvar C = 1\n")
+
+	prog, err := Load(&packages.Config{Dir: dir}, "./a", "./c")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write("b/b.go", "package b\n\nvar B = \"b\"\n")
+	next, checked, err := prog.Update(map[string][]string{"example.com/m/b": {bFile}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, pkg := range checked {
+		paths = append(paths, pkg.Pkg.Path())
+	}
+	if got, want := fmt.Sprint(paths), "[example.com/m/b example.com/m/a]"; got != want {
+		t.Errorf("Got checked packages %s; want %s", got, want)
+	}
+	if next.Package("example.com/m/c") != prog.Package("example.com/m/c") {
+		t.Errorf("Unchanged package example.com/m/c was not reused")
+	}
+	a := next.Package("example.com/m/a")
+	if typ := a.Pkg.Scope().Lookup("A").Type().String(); typ != "string" {
+		t.Errorf("Got type %s for A; want string", typ)
+	}
+	if next.PackageOf(a.Files[0].Pos()) != a || len(next.Initial) != 2 {
+		t.Errorf("Updated program is not indexed")
+	}
+
+	write("b/b.go", "package b\n\nimport \"example.com/m/c\"\n\nvar B = c.D\n")
+	if _, _, err := prog.Update(map[string][]string{"example.com/m/b": {bFile}}); err == nil {
+		t.Errorf("Update with type errors succeeded")
+	}
+}
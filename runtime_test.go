@@ -0,0 +1,48 @@
+package lunar
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// luaInterpreters are the names of the Lua interpreters RunLua looks for.
+var luaInterpreters = []string{"lua", "lua5.1", "luajit"}
+
+// RunLua compiles the package src, runs it after the builtins with the
+// first Lua interpreter found in PATH and returns what it printed. The
+// package should print from its init functions. The test is skipped if no
+// interpreter is installed.
+func RunLua(t *testing.T, src string) string {
+	t.Helper()
+	var interp string
+	for _, name := range luaInterpreters {
+		if path, err := exec.LookPath(name); err == nil {
+			interp = path
+			break
+		}
+	}
+	if interp == "" {
+		t.Skip("No Lua interpreter found")
+	}
+
+	lua, _, err := ParsePackage(src)
+	if err != nil {
+		t.Fatalf("Go %q resulted in error: %v", src, err)
+	}
+	var buf bytes.Buffer
+	WriteBuiltins(&buf)
+	buf.WriteString("\n" + lua + "\nbuiltins.run_inits()\n")
+	file := filepath.Join(t.TempDir(), "main.lua")
+	if err := os.WriteFile(file, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command(interp, file).CombinedOutput()
+	if err != nil {
+		t.Fatalf("Running Lua of %q failed: %v\n%s", src, err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
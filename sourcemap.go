@@ -0,0 +1,135 @@
+package lunar
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/token"
+	"io"
+	"sort"
+	"strings"
+)
+
+// SourceMap maps the lines of generated Lua code back to the Go code they
+// were generated from.
+type SourceMap struct {
+	Fset     *token.FileSet
+	Mappings []Mapping // ordered by output position
+
+	builtins string // expression evaluating to the builtins, if not global
+}
+
+// Position returns the position of the Go code that generated the given
+// one-based line of Lua code. The position is invalid if the line precedes
+// all mappings.
+func (m *SourceMap) Position(line int) token.Position {
+	i := sort.Search(len(m.Mappings), func(i int) bool {
+		return m.Mappings[i].Line >= line
+	})
+	if i == 0 {
+		return token.Position{}
+	}
+	return m.Fset.Position(m.Mappings[i-1].Pos)
+}
+
+// WriteLineTable writes Lua code registering a table from the lines of the
+// Lua chunk with the given name to Go positions. The builtins use the
+// registered tables to rewrite error messages and tracebacks; see
+// builtins.traceback. The chunk name is the name of the Lua file as it
+// appears in error messages.
+func (m *SourceMap) WriteLineTable(w io.Writer, chunk string) error {
+	var buf strings.Builder
+	builtins := m.builtins
+	if builtins == "" {
+		builtins = "_G.lunar_go_builtins"
+	}
+	fmt.Fprintf(&buf, "local builtins = %s\n", builtins)
+	fmt.Fprintf(&buf, "builtins.source_maps[%s] = {\n", luaQuote(chunk))
+	prev := ""
+	for i, mapping := range m.Mappings {
+		// Only the first mapping of a line is used
+		if i > 0 && m.Mappings[i-1].Line == mapping.Line {
+			continue
+		}
+		pos := m.Fset.Position(mapping.Pos)
+		loc := fmt.Sprintf("%s:%d", pos.Filename, pos.Line)
+		if loc != prev {
+			fmt.Fprintf(&buf, "\t[%d] = %s,\n", mapping.Line+1, luaQuote(loc))
+			prev = loc
+		}
+	}
+	buf.WriteString("}\n")
+	_, err := io.WriteString(w, buf.String())
+	return err
+}
+
+// WriteJSON writes the source map in the source map v3 format, for the Lua
+// file with the given name.
+func (m *SourceMap) WriteJSON(w io.Writer, file string) error {
+	sources := []string{}
+	sourceIdx := make(map[string]int)
+
+	var mappings strings.Builder
+	var line, prevSource, prevLine, prevCol int
+	for i, mapping := range m.Mappings {
+		pos := m.Fset.Position(mapping.Pos)
+		idx, ok := sourceIdx[pos.Filename]
+		if !ok {
+			idx = len(sources)
+			sources = append(sources, pos.Filename)
+			sourceIdx[pos.Filename] = idx
+		}
+
+		// Columns in the output are relative to the previous segment on
+		// the same line; everything else to the previous segment.
+		prevGenCol := 0
+		if i > 0 && m.Mappings[i-1].Line == mapping.Line {
+			prevGenCol = m.Mappings[i-1].Column
+			mappings.WriteByte(',')
+		}
+		for ; line < mapping.Line; line++ {
+			mappings.WriteByte(';')
+		}
+		writeVLQ(&mappings, mapping.Column-prevGenCol)
+		writeVLQ(&mappings, idx-prevSource)
+		writeVLQ(&mappings, pos.Line-1-prevLine)
+		writeVLQ(&mappings, pos.Column-1-prevCol)
+		prevSource, prevLine, prevCol = idx, pos.Line-1, pos.Column-1
+	}
+
+	return json.NewEncoder(w).Encode(struct {
+		Version  int      `json:"version"`
+		File     string   `json:"file"`
+		Sources  []string `json:"sources"`
+		Names    []string `json:"names"`
+		Mappings string   `json:"mappings"`
+	}{3, file, sources, []string{}, mappings.String()})
+}
+
+const base64Digits = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+
+// writeVLQ writes n as a base64 variable-length quantity, as used by the
+// mappings of source maps.
+func writeVLQ(buf *strings.Builder, n int) {
+	// The sign is stored in the least significant bit
+	v := n << 1
+	if n < 0 {
+		v = (-n << 1) | 1
+	}
+	for {
+		digit := v & 0x1f
+		v >>= 5
+		if v > 0 {
+			digit |= 0x20
+		}
+		buf.WriteByte(base64Digits[digit])
+		if v == 0 {
+			return
+		}
+	}
+}
+
+// SourceMap returns the source map of the code written by the last call
+// to ParseNode.
+func (p *Parser) SourceMap() *SourceMap {
+	return p.sourceMap
+}
@@ -0,0 +1,135 @@
+package lunar
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"strings"
+	"testing"
+
+	"golang.org/x/tools/go/loader"
+)
+
+const sourceMapSrc = `package dummy
+
+func fail(n int) int {
+	if n > 2 {
+		panic("boom")
+	}
+	return n
+}
+`
+
+func parseSourceMap(t *testing.T) (string, *SourceMap) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "dummy.go", sourceMapSrc, parser.ParseComments)
+	if err != nil {
+		t.Fatalf("Could not parse source: %v", err)
+	}
+	var conf loader.Config
+	conf.Fset = fset
+	conf.CreateFromFiles("dummy", f)
+	prog, err := conf.Load()
+	if err != nil {
+		t.Fatalf("Could not load program: %v", err)
+	}
+
+	p := NewParser(prog)
+	buf := &bytes.Buffer{}
+	if err := p.ParseNode(buf, f); err != nil {
+		t.Fatalf("Got error: %v", err)
+	}
+	return buf.String(), p.SourceMap()
+}
+
+func TestSourceMapPosition(t *testing.T) {
+	lua, sm := parseSourceMap(t)
+	want := map[string]int{
+		`_dummy.fail = function(n)`: 3,
+		`if n > 2 then`:             4,
+		`error("boom")`:             5,
+		`return n`:                  7,
+	}
+	for i, line := range strings.Split(lua, "\n") {
+		goLine, ok := want[strings.TrimSpace(line)]
+		if !ok {
+			continue
+		}
+		if pos := sm.Position(i + 1); pos.Filename != "dummy.go" || pos.Line != goLine {
+			t.Errorf("Lua line %d (%q) maps to %s; want dummy.go:%d", i+1, line, pos, goLine)
+		}
+	}
+	if pos := sm.Position(0); pos.IsValid() {
+		t.Errorf("Line 0 maps to %s; want invalid position", pos)
+	}
+}
+
+func TestSourceMapLineTable(t *testing.T) {
+	lua, sm := parseSourceMap(t)
+	buf := &bytes.Buffer{}
+	if err := sm.WriteLineTable(buf, "out.lua"); err != nil {
+		t.Fatalf("Got error: %v", err)
+	}
+	errLine := 0
+	for i, line := range strings.Split(lua, "\n") {
+		if strings.Contains(line, `error("boom")`) {
+			errLine = i + 1
+		}
+	}
+	table := buf.String()
+	if !strings.Contains(table, `builtins.source_maps["out.lua"] = {`) {
+		t.Errorf("Line table does not register itself:\n%s", table)
+	}
+	if want := fmt.Sprintf(`[%d] = "dummy.go:5",`, errLine); !strings.Contains(table, want) {
+		t.Errorf("Expected %q in line table:\n%s", want, table)
+	}
+}
+
+func TestSourceMapJSON(t *testing.T) {
+	_, sm := parseSourceMap(t)
+	buf := &bytes.Buffer{}
+	if err := sm.WriteJSON(buf, "out.lua"); err != nil {
+		t.Fatalf("Got error: %v", err)
+	}
+	var got struct {
+		Version  int
+		File     string
+		Sources  []string
+		Mappings string
+	}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("Invalid JSON %q: %v", buf.String(), err)
+	}
+	if got.Version != 3 || got.File != "out.lua" || len(got.Sources) != 1 || got.Sources[0] != "dummy.go" {
+		t.Errorf("Got source map %+v", got)
+	}
+	// The first line maps to the package clause, and the function
+	// declaration to line 3 of the source, two lines further.
+	if !strings.HasPrefix(got.Mappings, "AAAA;;;;;;AAEA;") {
+		t.Errorf("Got mappings %q", got.Mappings)
+	}
+}
+
+func TestWriteVLQ(t *testing.T) {
+	tests := []struct {
+		N   int
+		VLQ string
+	}{
+		{0, "A"},
+		{1, "C"},
+		{-1, "D"},
+		{15, "e"},
+		{16, "gB"},
+		{-16, "hB"},
+		{1000, "w+B"},
+	}
+	for _, test := range tests {
+		buf := &strings.Builder{}
+		writeVLQ(buf, test.N)
+		if buf.String() != test.VLQ {
+			t.Errorf("writeVLQ(%d) = %q; want %q", test.N, buf.String(), test.VLQ)
+		}
+	}
+}
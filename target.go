@@ -0,0 +1,97 @@
+package lunar
+
+import (
+	"fmt"
+)
+
+// Target identifies the Lua dialect the generated code runs on. It
+// determines which language features and libraries the generated code
+// and the builtins may rely on.
+type Target int
+
+const (
+	Lua51 Target = iota
+	Lua52
+	Lua53
+	Lua54
+	LuaJIT
+	WoW // the Lua 5.1 dialect embedded in World of Warcraft
+)
+
+var targetNames = [...]string{
+	Lua51:  "lua5.1",
+	Lua52:  "lua5.2",
+	Lua53:  "lua5.3",
+	Lua54:  "lua5.4",
+	LuaJIT: "luajit",
+	WoW:    "wow",
+}
+
+func (t Target) String() string {
+	if t < 0 || int(t) >= len(targetNames) {
+		return fmt.Sprintf("Target(%d)", int(t))
+	}
+	return targetNames[t]
+}
+
+// ParseTarget returns the target with the given name, as returned by
+// Target.String.
+func ParseTarget(name string) (Target, error) {
+	for t, n := range targetNames {
+		if n == name {
+			return Target(t), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown target %q", name)
+}
+
+// hasGoto reports whether the target supports goto statements and labels.
+func (t Target) hasGoto() bool {
+	return t == Lua52 || t == Lua53 || t == Lua54 || t == LuaJIT
+}
+
+// hasIntegers reports whether the target has an integer number subtype
+// with native integer division and bitwise operators.
+func (t Target) hasIntegers() bool {
+	return t == Lua53 || t == Lua54
+}
+
+// bitLib returns the library providing bitwise operations on targets
+// without native bitwise operators. Lua 5.1 has no such library, so the
+// builtins provide one.
+func (t Target) bitLib() string {
+	switch t {
+	case Lua52:
+		return "bit32"
+	case LuaJIT, WoW:
+		return "bit"
+	}
+	return "builtins"
+}
+
+// unpack returns the function that unpacks a table into multiple values.
+func (t Target) unpack() string {
+	switch t {
+	case Lua52, Lua53, Lua54:
+		return "table.unpack"
+	}
+	return "unpack"
+}
+
+// hasSetfenv reports whether the target has the getfenv and setfenv
+// functions. From Lua 5.2, the environment of a function is its _ENV
+// upvalue instead, which the builtins get and set.
+func (t Target) hasSetfenv() bool {
+	return t == Lua51 || t == LuaJIT || t == WoW
+}
+
+// SetTarget sets the Lua dialect to generate code for. The default is
+// Lua51.
+func (p *Parser) SetTarget(t Target) {
+	p.target = t
+}
+
+// Target returns the Lua dialect the parser generates code for.
+func (p *Parser) Target() Target {
+	return p.target
+}
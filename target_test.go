@@ -0,0 +1,226 @@
+package lunar
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"strings"
+	"testing"
+)
+
+// ParseFuncFor is like ParseFuncWithDecls, generating code for the given
+// target.
+func ParseFuncFor(target Target, decls, src string) (string, string, error) {
+	src = fmt.Sprintf("%s\nfunc testFunc() {%s}", decls, src)
+	get := func(f *ast.File) ast.Node {
+		return f.Decls[len(f.Decls)-1].(*ast.FuncDecl).Body
+	}
+	return parseStrWith(func(p *Parser) { p.SetTarget(target) }, src, get)
+}
+
+var allTargets = []Target{Lua51, Lua52, Lua53, Lua54, LuaJIT, WoW}
+
+type TargetTest struct {
+	Go  string
+	Lua map[Target]string // expected output; an empty string expects an error
+}
+
+func RunTargetTests(t *testing.T, tests []TargetTest) {
+	for i, test := range tests {
+		for _, target := range allTargets {
+			want, ok := test.Lua[target]
+			if !ok {
+				t.Fatalf("%d. Missing expected output for %s", i, target)
+			}
+			lua, tree, err := ParseFuncFor(target, "", test.Go)
+			if err != nil && want != "" {
+				t.Logf("Got tree: %s", tree)
+				t.Errorf("%d. Go %q resulted in error for %s: %#v", i, test.Go, target, err)
+			} else if err == nil && lua != want {
+				t.Logf("Got tree: %s", tree)
+				t.Errorf("%d. Go %q resulted in Lua %q for %s; want %q", i, test.Go, lua, target, want)
+			}
+		}
+	}
+}
+
+func TestParseTarget(t *testing.T) {
+	for _, target := range allTargets {
+		got, err := ParseTarget(target.String())
+		if err != nil || got != target {
+			t.Errorf("ParseTarget(%q) = %v, %v; want %v", target.String(), got, err, target)
+		}
+	}
+	if _, err := ParseTarget("lua6"); err == nil {
+		t.Errorf("Expected error for unknown target")
+	}
+}
+
+func TestTargetUnpack(t *testing.T) {
+	const src = `f := func(a ...int) {}; x := []int{1}; f(x...)`
+	const prefix = "local f = function(...)\n\tlocal a = {...}\nend\nlocal x = { 1 }\n"
+	RunTargetTests(t, []TargetTest{
+		{src, map[Target]string{
+			Lua51:  prefix + "f(unpack(x))",
+			Lua52:  prefix + "f(table.unpack(x))",
+			Lua53:  prefix + "f(table.unpack(x))",
+			Lua54:  prefix + "f(table.unpack(x))",
+			LuaJIT: prefix + "f(unpack(x))",
+			WoW:    prefix + "f(unpack(x))",
+		}},
+	})
+}
+
+func TestTargetIntegerOps(t *testing.T) {
+	const signed = "local a, b = 7, 2\n"
+	const unsigned = "local a = 7\nlocal b = 2\n\n"
+	const uint32 = "local a = 1\n\n"
+	const signedBit32 = "_, _ = ((bit32.band(a, b) + 0x80000000) % 0x100000000 - 0x80000000), " +
+		"((bit32.arshift(a, b) + 0x80000000) % 0x100000000 - 0x80000000)"
+	RunTargetTests(t, []TargetTest{
+		{`a, b := 7, 2; _, _ = a / b, a % b`, map[Target]string{
+			Lua51:  signed + "_, _ = builtins.idiv(a, b), math.fmod(a, b)",
+			Lua52:  signed + "_, _ = builtins.idiv(a, b), math.fmod(a, b)",
+			Lua53:  signed + "_, _ = builtins.idiv(a, b), math.fmod(a, b)",
+			Lua54:  signed + "_, _ = builtins.idiv(a, b), math.fmod(a, b)",
+			LuaJIT: signed + "_, _ = builtins.idiv(a, b), math.fmod(a, b)",
+			WoW:    signed + "_, _ = builtins.idiv(a, b), math.fmod(a, b)",
+		}},
+		{`var a, b uint = 7, 2; _, _ = a / b, a % b`, map[Target]string{
+			Lua51:  unsigned + "_, _ = math.floor(a / b), a % b",
+			Lua52:  unsigned + "_, _ = math.floor(a / b), a % b",
+			Lua53:  unsigned + "_, _ = a // b, a % b",
+			Lua54:  unsigned + "_, _ = a // b, a % b",
+			LuaJIT: unsigned + "_, _ = math.floor(a / b), a % b",
+			WoW:    unsigned + "_, _ = math.floor(a / b), a % b",
+		}},
+		{`a, b := 7, 2; _, _ = a & b, a >> b`, map[Target]string{
+			Lua51:  signed + "_, _ = builtins.band(a, b), builtins.arshift(a, b)",
+			Lua52:  signed + signedBit32,
+			Lua53:  signed + "_, _ = (a & b), builtins.arshift(a, b)",
+			Lua54:  signed + "_, _ = (a & b), builtins.arshift(a, b)",
+			LuaJIT: signed + "_, _ = bit.band(a, b), bit.arshift(a, b)",
+			WoW:    signed + "_, _ = bit.band(a, b), bit.arshift(a, b)",
+		}},
+		{`var a uint32 = 1; a <<= 31; _ = a &^ 1`, map[Target]string{
+			Lua51:  uint32 + "a = (builtins.lshift(a, 31) % 0x100000000)\n_ = (builtins.band(a, builtins.bnot(1)) % 0x100000000)",
+			Lua52:  uint32 + "a = (bit32.lshift(a, 31) % 0x100000000)\n_ = (bit32.band(a, bit32.bnot(1)) % 0x100000000)",
+			Lua53:  uint32 + "a = ((a << 31) % 0x100000000)\n_ = (a & ~1)",
+			Lua54:  uint32 + "a = ((a << 31) % 0x100000000)\n_ = (a & ~1)",
+			LuaJIT: uint32 + "a = (bit.lshift(a, 31) % 0x100000000)\n_ = (bit.band(a, bit.bnot(1)) % 0x100000000)",
+			WoW:    uint32 + "a = (bit.lshift(a, 31) % 0x100000000)\n_ = (bit.band(a, bit.bnot(1)) % 0x100000000)",
+		}},
+		{`_, _ = 7 / 2, ^7`, map[Target]string{
+			Lua51:  "_, _ = 3, (-8)",
+			Lua52:  "_, _ = 3, (-8)",
+			Lua53:  "_, _ = 3, (-8)",
+			Lua54:  "_, _ = 3, (-8)",
+			LuaJIT: "_, _ = 3, (-8)",
+			WoW:    "_, _ = 3, (-8)",
+		}},
+	})
+}
+
+func TestTargetContinue(t *testing.T) {
+	const src = `for i := 0; i < 3; i++ { if i == 1 { continue }; if i == 2 { break } }`
+	const withGoto = "do\n\tlocal i = 0\n\twhile i < 3 do\n\t\tdo\n" +
+		"\t\t\tif i == 1 then\n\t\t\t\tgoto continue\n\t\t\tend\n" +
+		"\t\t\tif i == 2 then\n\t\t\t\tbreak\n\t\t\tend\n" +
+		"\t\tend\n\t\t::continue::\n\t\ti = i + 1\n\tend\nend"
+	const withRepeat = "do\n\tlocal i = 0\n\twhile i < 3 do\n" +
+		"\t\tlocal __break = false\n\t\trepeat\n" +
+		"\t\t\tif i == 1 then\n\t\t\t\tbreak\n\t\t\tend\n" +
+		"\t\t\tif i == 2 then\n\t\t\t\t__break = true\n\t\t\t\tbreak\n\t\t\tend\n" +
+		"\t\tuntil true\n\t\tif __break then break end\n\t\ti = i + 1\n\tend\nend"
+	const nested = `for { for { continue }; continue }`
+	const nestedGoto = "do\n\twhile true do\n\t\tdo\n" +
+		"\t\t\tdo\n\t\t\t\twhile true do\n\t\t\t\t\tdo\n\t\t\t\t\t\tgoto continue2\n\t\t\t\t\tend\n" +
+		"\t\t\t\t\t::continue2::\n\t\t\t\tend\n\t\t\tend\n" +
+		"\t\t\tgoto continue\n\t\tend\n\t\t::continue::\n\tend\nend"
+	const nestedRepeat = "do\n\twhile true do\n\t\trepeat\n" +
+		"\t\t\tdo\n\t\t\t\twhile true do\n\t\t\t\t\trepeat\n\t\t\t\t\t\tbreak\n" +
+		"\t\t\t\t\tuntil true\n\t\t\t\tend\n\t\t\tend\n" +
+		"\t\t\tbreak\n\t\tuntil true\n\tend\nend"
+	RunTargetTests(t, []TargetTest{
+		{src, map[Target]string{
+			Lua51:  withRepeat,
+			Lua52:  withGoto,
+			Lua53:  withGoto,
+			Lua54:  withGoto,
+			LuaJIT: withGoto,
+			WoW:    withRepeat,
+		}},
+		{nested, map[Target]string{
+			Lua51:  nestedRepeat,
+			Lua52:  nestedGoto,
+			Lua53:  nestedGoto,
+			Lua54:  nestedGoto,
+			LuaJIT: nestedGoto,
+			WoW:    nestedRepeat,
+		}},
+	})
+}
+
+func TestTargetSwitchBreak(t *testing.T) {
+	const src = `var x interface{}; switch x.(type) { case int: break }`
+	const withGoto = "local x = nil\n\ndo\n\tlocal __x = x\n" +
+		"\tif builtins.is_type(__x, \"int\") then\n\t\tgoto switch_end\n\tend\n" +
+		"\t::switch_end::\nend"
+	RunTargetTests(t, []TargetTest{
+		{src, map[Target]string{
+			Lua51:  "",
+			Lua52:  withGoto,
+			Lua53:  withGoto,
+			Lua54:  withGoto,
+			LuaJIT: withGoto,
+			WoW:    "",
+		}},
+	})
+}
+
+func TestTargetEnv(t *testing.T) {
+	const decls = `import "github.com/eandre/lunar/lua"`
+	const src = `f := lua.Global("g"); lua.SetEnv(f, lua.Table{}); _ = lua.Env(f)`
+	native := "local f = g\nsetfenv(f, {})\n_ = getfenv(f)"
+	upvalue := "local f = g\nbuiltins.setfenv(f, {})\n_ = builtins.getfenv(f)"
+	want := map[Target]string{
+		Lua51:  native,
+		Lua52:  upvalue,
+		Lua53:  upvalue,
+		Lua54:  upvalue,
+		LuaJIT: native,
+		WoW:    native,
+	}
+	for _, target := range allTargets {
+		lua, _, err := ParseFuncFor(target, decls, src)
+		if err != nil {
+			t.Errorf("Go %q resulted in error for %s: %v", src, target, err)
+		} else if lua != want[target] {
+			t.Errorf("Go %q resulted in Lua %q for %s; want %q", src, lua, target, want[target])
+		}
+	}
+}
+
+func TestTargetBuiltins(t *testing.T) {
+	for _, target := range allTargets {
+		buf := &bytes.Buffer{}
+		if _, err := WriteBuiltinsFor(buf, target); err != nil {
+			t.Fatalf("WriteBuiltinsFor(%s) failed: %v", target, err)
+		}
+		lua := buf.String()
+		for _, want := range []string{"function builtins.idiv(", "function builtins.write("} {
+			if !strings.Contains(lua, want) {
+				t.Errorf("Builtins for %s lack %q", target, want)
+			}
+		}
+		if hasBand := strings.Contains(lua, "function builtins.band("); hasBand != (target == Lua51) {
+			t.Errorf("Builtins for %s define builtins.band: %v", target, hasBand)
+		}
+		if hasInt := strings.Contains(lua, "a // b"); hasInt != target.hasIntegers() {
+			t.Errorf("Builtins for %s use integer division: %v", target, hasInt)
+		}
+		if hasEnv := strings.Contains(lua, "function builtins.setfenv("); hasEnv == target.hasSetfenv() {
+			t.Errorf("Builtins for %s define builtins.setfenv: %v", target, hasEnv)
+		}
+	}
+}
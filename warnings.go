@@ -0,0 +1,63 @@
+package lunar
+
+import (
+	"fmt"
+	"go/ast"
+)
+
+// Warning categories classify the constructs that are translated with
+// different semantics than in Go, or skipped. They are used as the code of
+// warning diagnostics.
+const (
+	WarnUnhandledNode  = "unhandled-node"  // declaration skipped entirely
+	WarnInterfaceField = "interface-field" // field not initialized from tables
+	WarnRuneLiteral    = "rune-literal"    // rune represented as a string
+	WarnIntOverflow    = "int-overflow"    // sized integer arithmetic does not wrap
+	WarnBitwise32      = "bitwise-32"      // bitwise operation limited to 32 bits
+	WarnNotInlined     = "not-inlined"     // function marked //lunar:inline called instead
+	WarnRawExpr        = "raw-expr"        // non-constant lua.Raw code written as its expression
+)
+
+// A WarningHandler receives the warnings found while parsing, as they are
+// found.
+type WarningHandler interface {
+	Warn(d Diagnostic)
+}
+
+// WarningFunc adapts a function to the WarningHandler interface.
+type WarningFunc func(d Diagnostic)
+
+func (f WarningFunc) Warn(d Diagnostic) {
+	f(d)
+}
+
+// SetWarningHandler sets the handler receiving warnings. Warnings are
+// also included in Diagnostics, with or without a handler.
+func (p *Parser) SetWarningHandler(h WarningHandler) {
+	p.warnings = h
+}
+
+// PromoteWarnings makes the warnings of the given categories errors, so
+// that ParseNode fails instead of producing subtly wrong Lua.
+func (p *Parser) PromoteWarnings(categories ...string) {
+	if p.promoted == nil {
+		p.promoted = make(map[string]bool)
+	}
+	for _, c := range categories {
+		p.promoted[c] = true
+	}
+}
+
+// warnf reports a lossy translation of node. Unlike errors, warnings do
+// not stop the translation of node, even when promoted to errors.
+func (p *Parser) warnf(node ast.Node, category, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if p.promoted[category] {
+		p.addDiagnostic(node, SeverityError, category, msg)
+		return
+	}
+	d := p.addDiagnostic(node, SeverityWarning, category, msg)
+	if p.warnings != nil {
+		p.warnings.Warn(d)
+	}
+}
@@ -0,0 +1,92 @@
+package lunar
+
+import (
+	"go/ast"
+	"testing"
+)
+
+const warningsSrc = `
+type T struct {
+	Err error
+}
+
+func f() {
+	var x int8 = 1
+	_ = x + 1
+	_ = 'a'
+}
+
+//lunar:inline
+func g() int {
+	x := 1
+	return x
+}
+`
+
+func TestWarnings(t *testing.T) {
+	var got []Diagnostic
+	setup := func(p *Parser) {
+		p.SetWarningHandler(WarningFunc(func(d Diagnostic) {
+			got = append(got, d)
+		}))
+	}
+	get := func(f *ast.File) ast.Node { return f }
+	if _, _, err := parseStrWith(setup, warningsSrc, get); err != nil {
+		t.Fatalf("Got error: %v", err)
+	}
+
+	want := []struct {
+		Category string
+		Line     int
+	}{
+		{WarnInterfaceField, 3},
+		{WarnIntOverflow, 9},
+		{WarnRuneLiteral, 10},
+		{WarnNotInlined, 14},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Got %d warnings, want %d: %v", len(got), len(want), got)
+	}
+	for i, d := range got {
+		if d.Code != want[i].Category || d.Pos.Line != want[i].Line || d.Severity != SeverityWarning {
+			t.Errorf("%d. Got %s warning %q at line %d, want %s at line %d",
+				i, d.Severity, d.Code, d.Pos.Line, want[i].Category, want[i].Line)
+		}
+	}
+}
+
+func TestPromoteWarnings(t *testing.T) {
+	setup := func(p *Parser) {
+		p.PromoteWarnings(WarnIntOverflow)
+	}
+	get := func(f *ast.File) ast.Node { return f }
+	_, _, err := parseStrWith(setup, warningsSrc, get)
+	diags, ok := err.(Diagnostics)
+	if !ok || len(diags) != 1 {
+		t.Fatalf("Got error %#v, want one diagnostic", err)
+	}
+	if d := diags[0]; d.Code != WarnIntOverflow || d.Severity != SeverityError {
+		t.Errorf("Got %s %q, want promoted %s", d.Severity, d.Code, WarnIntOverflow)
+	}
+}
+
+func TestBitwise32Warning(t *testing.T) {
+	for _, target := range allTargets {
+		var got []string
+		setup := func(p *Parser) {
+			p.SetTarget(target)
+			p.SetWarningHandler(WarningFunc(func(d Diagnostic) {
+				got = append(got, d.Code)
+			}))
+		}
+		get := func(f *ast.File) ast.Node {
+			return f.Decls[len(f.Decls)-1].(*ast.FuncDecl).Body
+		}
+		if _, _, err := parseStrWith(setup, "func testFunc() { a, b := 1, 2; _ = a | b }", get); err != nil {
+			t.Fatalf("Got error for %s: %v", target, err)
+		}
+		if warned := len(got) == 1 && got[0] == WarnBitwise32; warned == target.hasIntegers() {
+			t.Errorf("Got warnings %v for %s", got, target)
+		}
+	}
+}
@@ -1,19 +1,166 @@
 package lunar
 
 import (
+	"go/ast"
+	"go/types"
 	"io"
+	"sort"
+	"strings"
 )
 
+// WriteBuiltins writes the builtins for the Lua51 target.
 func WriteBuiltins(w io.Writer) (n int, err error) {
-	return w.Write([]byte(`
+	return WriteBuiltinsFor(w, Lua51)
+}
+
+// WriteBuiltinsFor writes the builtins for the given target, which must
+// match the target the code using them was generated for.
+func WriteBuiltinsFor(w io.Writer, t Target) (n int, err error) {
+	return io.WriteString(w, globalBuiltinsHeader+builtinsFor(t))
+}
+
+// WriteBuiltinsModule writes the builtins for the given target as a Lua
+// module returning the builtins table, for code generated in module mode.
+// See Parser.SetModules.
+func WriteBuiltinsModule(w io.Writer, t Target) (n int, err error) {
+	return io.WriteString(w, moduleBuiltinsHeader+builtinsFor(t)+"\nreturn builtins\n")
+}
+
+// builtinsFor returns the builtins for the given target, which expect a
+// builtins table to be defined.
+func builtinsFor(t Target) string {
+	var buf strings.Builder
+	buf.WriteString(coreBuiltins)
+	buf.WriteString(sourceMapBuiltins)
+	buf.WriteString(targetBuiltins(t))
+
+	// Each shim is written in its own block to keep its locals private
+	paths := make([]string, 0, len(stdlibShims))
+	for path := range stdlibShims {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		buf.WriteString("\ndo\n")
+		buf.WriteString(stdlibShims[path].src)
+		buf.WriteString("end\n")
+	}
+	return buf.String()
+}
+
+// stdlibShim is a standard library package implemented by the builtins.
+// Its Lua source registers the package table in builtins.pkgs, which is
+// where imports of the package are resolved to.
+type stdlibShim struct {
+	src   string
+	names map[string]bool // members of the package the source defines
+}
+
+// shimNames returns the set of the space-separated names.
+func shimNames(names string) map[string]bool {
+	set := make(map[string]bool)
+	for _, name := range strings.Fields(names) {
+		set[name] = true
+	}
+	return set
+}
+
+// stdlibShims maps the import paths of the standard library packages
+// implemented by the builtins to their shims. Only the listed members of
+// the packages can be used.
+var stdlibShims = map[string]*stdlibShim{
+	"errors": {errorsBuiltins, shimNames(`Is Join New Unwrap`)},
+	"fmt":    {fmtBuiltins, shimNames(`Errorf Print Printf Println Sprint Sprintf Sprintln`)},
+	"math": {mathBuiltins, shimNames(`
+		Abs Acos Asin Atan Atan2 Cbrt Ceil Copysign Cos Cosh Dim Exp Exp2
+		Expm1 Floor Hypot Inf IsInf IsNaN Log Log10 Log1p Log2 Max Min Mod
+		Modf NaN Pow Pow10 Round RoundToEven Signbit Sin Sinh Sqrt Tan Tanh
+		Trunc
+		E Ln10 Ln2 Log10E Log2E Phi Pi Sqrt2 SqrtE SqrtPhi SqrtPi
+		MaxFloat32 MaxFloat64 SmallestNonzeroFloat32 SmallestNonzeroFloat64
+		MaxInt MaxInt8 MaxInt16 MaxInt32 MaxInt64 MinInt MinInt8 MinInt16
+		MinInt32 MinInt64 MaxUint8 MaxUint16 MaxUint32
+	`)},
+	"sort": {sortBuiltins, shimNames(`
+		Float64Slice Float64s Float64sAreSorted IntSlice Ints IntsAreSorted
+		IsSorted Reverse Search SearchFloat64s SearchInts SearchStrings Slice
+		SliceIsSorted SliceStable Sort Stable StringSlice Strings
+		StringsAreSorted
+	`)},
+	"strconv": {strconvBuiltins, shimNames(`
+		Atoi FormatBool FormatFloat FormatInt FormatUint Itoa ParseBool
+		ParseFloat ParseInt ParseUint Quote QuoteRune Unquote
+		ErrRange ErrSyntax IntSize NumError
+	`)},
+	"strings": {stringsBuiltins, shimNames(`
+		Compare Contains ContainsAny ContainsRune Count Cut CutPrefix
+		CutSuffix EqualFold Fields HasPrefix HasSuffix Index IndexAny
+		IndexByte IndexRune Join LastIndex LastIndexByte NewReplacer Repeat
+		Replace ReplaceAll Split SplitAfter SplitAfterN SplitN ToLower
+		ToUpper Trim TrimLeft TrimPrefix TrimRight TrimSpace TrimSuffix
+		Builder Replacer
+	`)},
+	"unicode/utf8": {utf8Builtins, shimNames(`
+		DecodeLastRuneInString DecodeRuneInString RuneCountInString RuneLen
+		ValidRune ValidString
+		MaxRune RuneError RuneSelf UTFMax
+	`)},
+}
+
+// isStdlibShim reports whether the package with the given import path is
+// implemented by the builtins.
+func isStdlibShim(path string) bool {
+	_, ok := stdlibShims[path]
+	return ok
+}
+
+// checkStdlibObject reports an error at node if it refers to a member of a
+// package implemented by the builtins that its shim does not define, which
+// would otherwise be nil at runtime. Interfaces have no Lua value and are
+// always allowed.
+func (p *Parser) checkStdlibObject(node ast.Node, obj types.Object) {
+	if obj == nil || obj.Pkg() == nil {
+		return
+	}
+	shim := stdlibShims[obj.Pkg().Path()]
+	if shim == nil || shim.names[obj.Name()] {
+		return
+	}
+	if _, ok := obj.(*types.TypeName); ok && types.IsInterface(obj.Type()) {
+		return
+	}
+	p.errorf(node, CodeUnsupported, "%s.%s is not supported", obj.Pkg().Path(), obj.Name())
+}
+
+// globalBuiltinsHeader defines the builtins as a global table, shared by
+// all files using them.
+const globalBuiltinsHeader = `
 local builtins = _G.lunar_go_builtins or {}
 _G.lunar_go_builtins = builtins
+`
+
+// moduleBuiltinsHeader defines the builtins as the table of a module.
+const moduleBuiltinsHeader = `
+local builtins = {}
+`
+
+const coreBuiltins = `
+builtins.pkgs = builtins.pkgs or {}
 
-local err_meta = {__index={
-	Error = function(self)
-		return self.msg
+-- Converts a float to an integer, truncating towards zero like Go
+function builtins.toint(x)
+	if x < 0 then
+		return math.ceil(x)
 	end
-}}
+	return math.floor(x)
+end
+
+-- errorString is the type of errors created by errors.New
+local errorString = {__name="*errors.errorString"}
+function errorString.Error(self)
+	return self.msg
+end
+local err_meta = {__index=errorString}
 
 function builtins.create_error(msg)
 	return setmetatable({msg=msg}, err_meta)
@@ -60,17 +207,107 @@ function builtins.makeSlice(f, n)
 	return s
 end
 
+-- Converts the struct x to the struct type typ, or to an unnamed struct
+-- type if typ is nil, by copying its fields. renames maps the Lua names of
+-- fields that are named differently in typ to their new names.
+function builtins.convert_struct(x, typ, renames)
+	local v = {}
+	for k, f in pairs(x) do
+		if renames ~= nil and renames[k] ~= nil then
+			k = renames[k]
+		end
+		v[k] = f
+	end
+	if typ ~= nil then
+		setmetatable(v, {__index=typ})
+	end
+	return v
+end
+
+-- Runes are numbers, but character literals are compiled to strings, so
+-- both representations are accepted where a rune is expected.
+function builtins.rune_string(r)
+	if type(r) == "string" then
+		return r
+	end
+	if r < 0 or r > 0x10FFFF or (r >= 0xD800 and r <= 0xDFFF) then
+		r = 0xFFFD
+	end
+	if r < 0x80 then
+		return string.char(r)
+	elseif r < 0x800 then
+		return string.char(0xC0 + math.floor(r / 0x40), 0x80 + r % 0x40)
+	elseif r < 0x10000 then
+		return string.char(0xE0 + math.floor(r / 0x1000), 0x80 + math.floor(r / 0x40) % 0x40, 0x80 + r % 0x40)
+	end
+	return string.char(0xF0 + math.floor(r / 0x40000), 0x80 + math.floor(r / 0x1000) % 0x40,
+		0x80 + math.floor(r / 0x40) % 0x40, 0x80 + r % 0x40)
+end
+
+-- Decodes the UTF-8 encoded rune starting at byte i of s, returning the
+-- rune and its size in bytes. Invalid encodings yield (0xFFFD, 1), and the
+-- end of the string yields (0xFFFD, 0).
+function builtins.decode_rune(s, i)
+	local c = s:byte(i)
+	if c == nil then
+		return 0xFFFD, 0
+	elseif c < 0x80 then
+		return c, 1
+	end
+
+	local n, r, min
+	if c >= 0xC2 and c <= 0xDF then
+		n, r, min = 1, c - 0xC0, 0x80
+	elseif c >= 0xE0 and c <= 0xEF then
+		n, r, min = 2, c - 0xE0, 0x800
+	elseif c >= 0xF0 and c <= 0xF4 then
+		n, r, min = 3, c - 0xF0, 0x10000
+	else
+		return 0xFFFD, 1
+	end
+	for j = 1, n do
+		local cc = s:byte(i + j)
+		if cc == nil or cc < 0x80 or cc > 0xBF then
+			return 0xFFFD, 1
+		end
+		r = r * 0x40 + (cc - 0x80)
+	end
+	if r < min or r > 0x10FFFF or (r >= 0xD800 and r <= 0xDFFF) then
+		return 0xFFFD, 1
+	end
+	return r, n + 1
+end
+
 local inits = {}
 function builtins.add_init(f)
 	table.insert(inits, f)
 end
 
-function builtins.run_inits()
-	for _, f in ipairs(inits) do
+-- Packages of bundles, in initialization order
+local packages = {}
+function builtins.add_package(f)
+	table.insert(packages, f)
+end
+
+local function run_added_inits()
+	while #inits > 0 do
+		local f = table.remove(inits, 1)
 		f()
 	end
 end
 
+-- Runs the init functions added so far, then initializes the packages
+-- added with add_package, each followed by its init functions like in Go.
+-- Every init function and package is only run once.
+function builtins.run_inits()
+	run_added_inits()
+	while #packages > 0 do
+		local pkg = table.remove(packages, 1)
+		pkg()
+		run_added_inits()
+	end
+end
+
 
 local function _slice_iter(tbl, i)
 	i = i + 1 -- zero-based
@@ -84,6 +321,452 @@ function builtins.slice_iter(tbl)
 	return _slice_iter, tbl, -1
 end
 
+-- Interface values. Values that do not carry their dynamic type (basic
+-- types other than int, string and bool, named types, struct values and
+-- nil pointers) are boxed when converted to an interface. Method calls on
+-- a box are forwarded to the methods of its type, passing the boxed value
+-- as the receiver. Types are either type tables, descriptors or the names
+-- of basic types, which have no methods.
+local boxMetas = setmetatable({}, {__mode="k"}) -- weak keys
+local function box_meta(typ)
+	local meta = boxMetas[typ]
+	if meta ~= nil then
+		return meta
+	end
+
+	local methods = {}
+	meta = {
+		__lunar_box = true,
+		__index = function(box, name)
+			local f = methods[name]
+			if f == nil then
+				if type(typ) ~= "table" then
+					return nil
+				end
+				local hidden = rawget(typ, "__hidden")
+				if hidden ~= nil and hidden[name] then
+					-- Methods of pointers to struct values
+					return nil
+				end
+				local m = typ[name]
+				if type(m) ~= "function" then
+					return nil
+				end
+				f = function(self, ...)
+					return m(self.__value, ...)
+				end
+				methods[name] = f
+			end
+			return f
+		end,
+	}
+	boxMetas[typ] = meta
+	return meta
+end
+
+local function is_box(x)
+	if type(x) ~= "table" then
+		return false
+	end
+	local meta = getmetatable(x)
+	return meta ~= nil and meta.__lunar_box == true
+end
+
+-- Boxes of values other than tables are created once per type and value,
+-- so that equal interface values are equal Lua values, as map keys too.
+local boxes = setmetatable({}, {__mode="k"}) -- weak keys
+
+-- len is only given for slices passed to the fmt package whose trailing
+-- elements are nil, which the length of Lua tables does not count.
+function builtins.box(v, typ, len)
+	if v == nil or v ~= v or len ~= nil or type(v) == "table" then
+		return setmetatable({__value=v, __type=typ, __len=len}, box_meta(typ))
+	end
+	local byValue = boxes[typ]
+	if byValue == nil then
+		byValue = setmetatable({}, {__mode="v"}) -- weak values
+		boxes[typ] = byValue
+	end
+	local box = byValue[v]
+	if box == nil then
+		box = setmetatable({__value=v, __type=typ}, box_meta(typ))
+		byValue[v] = box
+	end
+	return box
+end
+
+function builtins.box_nil(v, typ)
+	if v == nil then
+		return builtins.box(nil, typ)
+	end
+	return v
+end
+
+function builtins.unbox(x)
+	if is_box(x) then
+		return x.__value
+	end
+	return x
+end
+
+-- Type descriptors describe the static types of values passed to the fmt
+-- package that have no type table, with their name and kind: ptr, slice,
+-- array, map or struct. Descriptors are created once per type name.
+local typeDescs = {}
+local function type_desc(name, desc)
+	desc.__name = name
+	typeDescs[name] = desc
+	return desc
+end
+
+function builtins.ptr_type(name, elem)
+	local desc = typeDescs[name]
+	if desc == nil then
+		desc = type_desc(name, {__kind="ptr", __elem=elem})
+		if type(elem) == "table" then
+			-- Pointers have the methods of their element type
+			setmetatable(desc, {__index=elem})
+		end
+	end
+	return desc
+end
+
+function builtins.slice_type(name, elem)
+	return typeDescs[name] or type_desc(name, {__kind="slice", __elem=elem})
+end
+
+function builtins.array_type(name, elem, len)
+	return typeDescs[name] or type_desc(name, {__kind="array", __elem=elem, __len=len})
+end
+
+function builtins.map_type(name, key, elem)
+	return typeDescs[name] or type_desc(name, {__kind="map", __key=key, __elem=elem})
+end
+
+function builtins.struct_type(name, fields, types)
+	return typeDescs[name] or type_desc(name, {__kind="struct", __fields=fields, __types=types})
+end
+
+-- Describes a named type whose underlying type has a descriptor, keeping
+-- the methods of its type table.
+local namedDescs = setmetatable({}, {__mode="k"}) -- weak keys
+function builtins.named_type(typ, under)
+	local desc = namedDescs[typ]
+	if desc == nil then
+		desc = setmetatable({
+			__name = typ.__name, __type = typ, __kind = under.__kind,
+			__key = under.__key, __elem = under.__elem, __len = under.__len,
+		}, {__index=typ})
+		namedDescs[typ] = desc
+	end
+	return desc
+end
+
+-- Describes values of the named struct type typ, rather than pointers to
+-- them, whose Error and String methods are only used if they are not in
+-- the list hidden of methods with pointer receivers.
+local valueDescs = setmetatable({}, {__mode="k"}) -- weak keys
+function builtins.value_type(typ, hidden)
+	local desc = valueDescs[typ]
+	if desc == nil then
+		local set = {}
+		for _, name in ipairs(hidden) do
+			set[name] = true
+		end
+		desc = setmetatable({__name = typ.__name, __type = typ, __kind = "value", __hidden = set}, {__index=typ})
+		valueDescs[typ] = desc
+	end
+	return desc
+end
+
+-- Returns the value of x as converted to an interface outside the fmt
+-- package, unboxing values boxed with a type descriptor.
+function builtins.fmt_unbox(x)
+	if not is_box(x) or type(x.__type) ~= "table" or rawget(x.__type, "__kind") == nil then
+		return x
+	end
+	local typ, v = x.__type, x.__value
+	if typ.__kind == "value" then
+		-- Struct values are boxed with the same descriptor
+		return x
+	elseif rawget(typ, "__type") ~= nil then
+		return builtins.box(v, typ.__type)
+	elseif v == nil and typ.__kind == "ptr" and type(typ.__elem) == "table" then
+		-- Nil pointers to named types are boxed with the same descriptor
+		return x
+	end
+	return v
+end
+
+-- Returns the dynamic type of an interface value: the type of boxed
+-- values, a pointer descriptor for tables with a type table, which are
+-- pointers to structs, and the name of the Go type of other Lua values.
+-- Numbers that are not converted from Go values are ints if they are
+-- integral, and float64 otherwise.
+function builtins.type_of(x)
+	local t = type(x)
+	if t == "table" then
+		if is_box(x) then
+			return x.__type
+		end
+		local meta = getmetatable(x)
+		local typ = meta ~= nil and meta.__index
+		if type(typ) == "table" then
+			local name = typ.__name
+			if type(name) ~= "string" then
+				return typ
+			end
+			if name:sub(1, 1) ~= "*" then
+				-- Type tables of builtins may describe the pointer type
+				name = "*" .. name
+			end
+			return builtins.ptr_type(name, typ)
+		end
+	elseif t == "number" then
+		if math.floor(x) == x then
+			return "int"
+		end
+		return "float64"
+	elseif t == "boolean" then
+		return "bool"
+	end
+	return t
+end
+
+function builtins.is_type(x, typ)
+	return builtins.type_of(x) == typ
+end
+
+function builtins.implements(x, methods)
+	if x == nil then
+		return false
+	elseif type(x) ~= "table" then
+		return #methods == 0
+	end
+	for _, name in ipairs(methods) do
+		if type(x[name]) ~= "function" then
+			return false
+		end
+	end
+	return true
+end
+
+function builtins.type_assert(x, typ)
+	if builtins.is_type(x, typ) then
+		return builtins.unbox(x)
+	end
+	error("interface conversion: interface holds the wrong type")
+end
+
+function builtins.type_assert_ok(x, typ, zero)
+	if builtins.is_type(x, typ) then
+		return builtins.unbox(x), true
+	end
+	return zero, false
+end
+
+function builtins.iface_assert(x, methods)
+	if builtins.implements(x, methods) then
+		return x
+	end
+	error("interface conversion: interface is missing methods")
+end
+
+function builtins.iface_assert_ok(x, methods)
+	if builtins.implements(x, methods) then
+		return x, true
+	end
+	return nil, false
+end
+
+function builtins.iface_eq(a, b)
+	if a == b then
+		return true
+	end
+	if is_box(a) and is_box(b) then
+		return a.__type == b.__type and a.__value == b.__value
+	end
+	return false
+end
+
+-- Errors, mirroring the errors package and fmt.Errorf
+
+-- wrapError is the type of errors created by fmt.Errorf with a single %w
+local wrapError = {__name="*fmt.wrapError"}
+function wrapError.Error(self)
+	return self.msg
+end
+function wrapError.Unwrap(self)
+	return self.err
+end
+local wrap_meta = {__index=wrapError}
+
+-- wrapErrors is the type of errors created by fmt.Errorf with several %w
+local wrapErrors = {__name="*fmt.wrapErrors"}
+function wrapErrors.Error(self)
+	return self.msg
+end
+function wrapErrors.Unwrap(self)
+	return self.errs
+end
+local wraps_meta = {__index=wrapErrors}
+
+-- joinError is the type of errors created by errors.Join
+local joinError = {__name="*errors.joinError"}
+function joinError.Error(self)
+	local msgs = {}
+	for i, err in ipairs(self.errs) do
+		msgs[i] = err:Error()
+	end
+	return table.concat(msgs, "\n")
+end
+function joinError.Unwrap(self)
+	return self.errs
+end
+local join_meta = {__index=joinError}
+
+builtins.errors_new = builtins.create_error
+
+-- Returns the list of errors directly wrapped by err, if any. Unwrap
+-- methods may return either a single error or a slice of errors.
+local function unwrap_all(err)
+	if type(err) ~= "table" or type(err.Unwrap) ~= "function" then
+		return nil
+	end
+	local u = err:Unwrap()
+	if u == nil then
+		return nil
+	elseif type(u) == "table" and getmetatable(u) == nil then
+		return u
+	end
+	return {u}
+end
+
+function builtins.errors_unwrap(err)
+	if type(err) ~= "table" or type(err.Unwrap) ~= "function" then
+		return nil
+	end
+	local u = err:Unwrap()
+	if type(u) == "table" and getmetatable(u) == nil then
+		-- Unwrap() []error does not count
+		return nil
+	end
+	return u
+end
+
+function builtins.errors_is(err, target)
+	if err == nil or target == nil then
+		return err == target
+	end
+	if builtins.iface_eq(err, target) then
+		return true
+	end
+	if type(err) == "table" and type(err.Is) == "function" and err:Is(target) then
+		return true
+	end
+	local errs = unwrap_all(err)
+	if errs ~= nil then
+		for _, e in ipairs(errs) do
+			if builtins.errors_is(e, target) then
+				return true
+			end
+		end
+	end
+	return false
+end
+
+local function errors_as(err, match, set)
+	if err == nil then
+		return false
+	end
+	if match(err) then
+		set(err)
+		return true
+	end
+	local errs = unwrap_all(err)
+	if errs ~= nil then
+		for _, e in ipairs(errs) do
+			if errors_as(e, match, set) then
+				return true
+			end
+		end
+	end
+	return false
+end
+
+function builtins.errors_as(err, typ, set)
+	local match = function(e)
+		return builtins.is_type(e, typ)
+	end
+	return errors_as(err, match, function(e)
+		set(builtins.unbox(e))
+	end)
+end
+
+function builtins.errors_as_iface(err, methods, set)
+	local match = function(e)
+		return builtins.implements(e, methods)
+	end
+	return errors_as(err, match, set)
+end
+
+function builtins.errors_join(...)
+	local errs = {}
+	for i = 1, select("#", ...) do
+		local err = select(i, ...)
+		if err ~= nil then
+			table.insert(errs, err)
+		end
+	end
+	if #errs == 0 then
+		return nil
+	end
+	return setmetatable({errs=errs}, join_meta)
+end
+
+-- Calls f(verb, flags, argIndex) for each verb in a format string, and
+-- f(nil, text) for the literal text between them.
+local function scan_format(format, f)
+	local argi = 0
+	local i = 1
+	while true do
+		local s, e, flags, verb = format:find("%%([-+# 0]*%d*%.?%d*)(.)", i)
+		if s == nil then
+			f(nil, format:sub(i))
+			return
+		end
+		f(nil, format:sub(i, s - 1))
+		if verb == "%" then
+			f(nil, "%")
+		else
+			argi = argi + 1
+			f(verb, flags, argi)
+		end
+		i = e + 1
+	end
+end
+
+function builtins.errorf(format, ...)
+	local msg = builtins.pkgs["fmt"].Sprintf(format, ...)
+	local args = {...}
+	local wrapped, nwrap = {}, 0
+	scan_format(format, function(verb, flags, argi)
+		if verb == "w" then
+			nwrap = nwrap + 1
+			if args[argi] ~= nil then
+				table.insert(wrapped, builtins.fmt_unbox(args[argi]))
+			end
+		end
+	end)
+
+	if nwrap == 0 then
+		return builtins.create_error(msg)
+	elseif nwrap == 1 then
+		return setmetatable({msg=msg, err=wrapped[1]}, wrap_meta)
+	end
+	return setmetatable({msg=msg, errs=wrapped}, wraps_meta)
+end
+
 local closureCache = setmetatable({}, {__mode="k"}) -- weak keys
 function builtins.create_closure(obj, funcName)
 	-- See if we have a closure cache for this object already
@@ -109,5 +792,16 @@ function builtins.create_closure(obj, funcName)
 	objClosures[funcName] = f
 	return f
 end
-`))
-}
+`
+
+// errorsBuiltins exposes the errors functions as a package, for when they
+// are used as values rather than called directly.
+const errorsBuiltins = `
+local errors = {}
+builtins.pkgs["errors"] = errors
+
+errors.New = builtins.errors_new
+errors.Is = builtins.errors_is
+errors.Unwrap = builtins.errors_unwrap
+errors.Join = builtins.errors_join
+`
@@ -0,0 +1,694 @@
+package lunar
+
+// fmtBuiltins implements the formatting functions of the fmt package.
+//
+// Since Lua does not distinguish between integers and floats in all
+// versions, integral numbers are formatted as integers and other numbers
+// as float64. Struct values are formatted using the __name and __fields
+// metadata generated for their type tables. Arguments whose Lua values do
+// not tell their Go type are boxed with a type descriptor by the compiler,
+// see Parser.parseFmtArg; other values are formatted by their Lua type.
+const fmtBuiltins = `
+local fmt = {}
+builtins.pkgs["fmt"] = fmt
+
+-- Returns the kind of a type descriptor, or nil for type tables, the names
+-- of basic types and unknown types.
+local function kind_of(desc)
+	if type(desc) == "table" then
+		return rawget(desc, "__kind")
+	end
+	return nil
+end
+
+-- Reports whether desc describes an integer type.
+local function is_integer_type(desc)
+	return type(desc) == "string" and desc:match("^u?int") ~= nil
+end
+
+-- Returns the value of an argument and its type descriptor if it was boxed
+-- with one, along with the length of slices with trailing nil elements.
+local function unpack_arg(v, desc)
+	local raw = builtins.unbox(v)
+	if raw ~= v then
+		return raw, builtins.type_of(v), rawget(v, "__len")
+	end
+	return v, desc
+end
+
+-- Returns the length of a slice, including nil elements before the last
+-- element, which the length operator may not count.
+local function seq_len(t)
+	local n = #t
+	for k in pairs(t) do
+		if type(k) == "number" and k > n and math.floor(k) == k then
+			n = k
+		end
+	end
+	return n
+end
+
+-- Reports whether t is a plain table holding a slice.
+local function is_slice(t)
+	if getmetatable(t) ~= nil then
+		return false
+	end
+	local n = #t
+	for k in pairs(t) do
+		if type(k) ~= "number" or k < 1 or k > n or math.floor(k) ~= k then
+			return false
+		end
+	end
+	return true
+end
+
+-- Returns the Go type name of a value, as printed by %T.
+local function type_name(v)
+	if v == nil then
+		return "<nil>"
+	end
+	local typ = builtins.type_of(v)
+	if type(typ) == "table" then
+		return typ.__name or "?"
+	elseif typ == "function" then
+		return "func()"
+	elseif typ == "table" then
+		if next(v) ~= nil and is_slice(v) then
+			return "[]interface {}"
+		end
+		return "map[interface {}]interface {}"
+	end
+	return typ
+end
+
+local function pad(s, f)
+	local width = f.width
+	if width == nil or #s >= width then
+		return s
+	elseif f.minus then
+		return s .. string.rep(" ", width - #s)
+	end
+	return string.rep(" ", width - #s) .. s
+end
+
+-- Pads a number with leading zeroes if requested, keeping the sign first.
+local function pad_number(s, f)
+	local width = f.width
+	if not f.zero or f.minus or width == nil or #s >= width then
+		return pad(s, f)
+	end
+	local sign = s:match("^[-+ ]") or ""
+	return sign .. string.rep("0", width - #s) .. s:sub(#sign + 1)
+end
+
+local function sign_of(neg, f)
+	if neg then
+		return "-"
+	elseif f.plus then
+		return "+"
+	elseif f.space then
+		return " "
+	end
+	return ""
+end
+
+local utf8_char = builtins.rune_string
+
+local escapes = {
+	["\a"] = "\\a", ["\b"] = "\\b", ["\f"] = "\\f", ["\n"] = "\\n",
+	["\r"] = "\\r", ["\t"] = "\\t", ["\v"] = "\\v", ["\\"] = "\\\\",
+}
+
+local function quote(s, q)
+	return q .. s:gsub("[%c\\\"'\127]", function(c)
+		if escapes[c] ~= nil then
+			return escapes[c]
+		elseif c == '"' or c == "'" then
+			if c == q then
+				return "\\" .. c
+			end
+			return c
+		end
+		return string.format("\\x%02x", c:byte())
+	end) .. q
+end
+
+local digits = "0123456789abcdef"
+
+local function integer_digits(v, base)
+	if v == 0 then
+		return "0"
+	end
+	local out = {}
+	while v > 0 do
+		local d = v % base
+		table.insert(out, 1, digits:sub(d + 1, d + 1))
+		v = (v - d) / base
+	end
+	return table.concat(out)
+end
+
+local function fmt_integer(v, base, verb, f)
+	local neg = v < 0
+	local s = integer_digits(math.abs(v), base)
+	if f.prec ~= nil and #s < f.prec then
+		s = string.rep("0", f.prec - #s) .. s
+	end
+	if f.sharp then
+		if base == 16 then
+			s = "0x" .. s
+		elseif base == 8 and s:sub(1, 1) ~= "0" then
+			s = "0" .. s
+		elseif base == 2 then
+			s = "0b" .. s
+		end
+	end
+	if verb == "X" then
+		s = s:upper()
+	end
+	s = sign_of(neg, f) .. s
+	if f.prec ~= nil then
+		return pad(s, f)
+	end
+	return pad_number(s, f)
+end
+
+-- Returns the shortest representation of v that reads back to the same
+-- number, in the style of strconv.FormatFloat(v, 'g', -1, 64).
+local function shortest_float(v)
+	local mant, exp
+	for prec = 0, 16 do
+		local s = string.format("%." .. prec .. "e", v)
+		if tonumber(s) == v or prec == 16 then
+			mant, exp = s:match("^(.-)e(.*)$")
+			exp = tonumber(exp)
+			if mant:find(".", 1, true) then
+				mant = mant:gsub("0+$", ""):gsub("%.$", "")
+			end
+			break
+		end
+	end
+	local ndigits = #mant:gsub("[-.]", "")
+	if exp < -4 or exp >= 6 then
+		local sign = "+"
+		if exp < 0 then
+			sign = "-"
+		end
+		return string.format("%se%s%02d", mant, sign, math.abs(exp))
+	end
+	return string.format("%." .. math.max(ndigits - 1 - exp, 0) .. "f", v)
+end
+
+local function fmt_float(v, verb, f)
+	local s
+	if v ~= v then
+		s = "NaN"
+	elseif v == math.huge then
+		s = sign_of(false, f) .. "Inf"
+		if s == "Inf" then
+			s = "+Inf"
+		end
+	elseif v == -math.huge then
+		s = "-Inf"
+	elseif (verb == "g" or verb == "G" or verb == "v") and f.prec == nil then
+		s = shortest_float(v)
+		if verb == "G" then
+			s = s:upper()
+		end
+		if v >= 0 then
+			s = sign_of(false, f) .. s
+		end
+	else
+		local spec = "%"
+		if f.plus then
+			spec = spec .. "+"
+		elseif f.space then
+			spec = spec .. " "
+		end
+		if f.sharp then
+			spec = spec .. "#"
+		end
+		if f.prec ~= nil then
+			spec = spec .. "." .. f.prec
+		end
+		if verb == "v" then
+			verb = "g"
+		elseif verb == "F" then
+			verb = "f"
+		end
+		s = string.format(spec .. verb, v)
+	end
+	if v ~= v or v == math.huge or v == -math.huge then
+		return pad(s, f)
+	end
+	return pad_number(s, f)
+end
+
+local format_value
+
+local function bad_verb(v, verb)
+	if v == nil then
+		return "%!" .. verb .. "(<nil>)"
+	end
+	return "%!" .. verb .. "(" .. type_name(v) .. "=" .. format_value(v, "v", {}, 0) .. ")"
+end
+
+local function fmt_number(v, verb, f)
+	local integral = math.floor(v) == v and math.abs(v) < 2^53
+	if verb == "v" then
+		if integral then
+			return fmt_integer(v, 10, verb, f)
+		end
+		return fmt_float(v, verb, f)
+	elseif verb == "e" or verb == "E" or verb == "f" or verb == "F" or verb == "g" or verb == "G" then
+		return fmt_float(v, verb, f)
+	elseif not integral then
+		return bad_verb(v, verb)
+	elseif verb == "d" then
+		return fmt_integer(v, 10, verb, f)
+	elseif verb == "x" or verb == "X" then
+		return fmt_integer(v, 16, verb, f)
+	elseif verb == "o" then
+		return fmt_integer(v, 8, verb, f)
+	elseif verb == "b" then
+		return fmt_integer(v, 2, verb, f)
+	elseif verb == "c" then
+		return pad(utf8_char(v), f)
+	elseif verb == "q" then
+		return pad(quote(utf8_char(v), "'"), f)
+	elseif verb == "U" then
+		local s = string.format("U+%04X", v)
+		if f.sharp then
+			s = s .. " '" .. utf8_char(v) .. "'"
+		end
+		return pad(s, f)
+	end
+	return bad_verb(v, verb)
+end
+
+local function fmt_string(s, verb, f)
+	if (verb == "c" or verb == "U") and s ~= "" then
+		-- Rune literals are written as strings
+		local r, size = builtins.decode_rune(s, 1)
+		if size == #s then
+			return fmt_number(r, verb, f)
+		end
+	end
+	if verb == "v" or verb == "s" then
+		if f.sharpV then
+			return pad(quote(s, '"'), f)
+		end
+		if f.prec ~= nil then
+			s = s:sub(1, f.prec)
+		end
+		return pad(s, f)
+	elseif verb == "q" then
+		if f.sharp and not s:find("[%c\96]") then
+			return pad("\96" .. s .. "\96", f)
+		end
+		return pad(quote(s, '"'), f)
+	elseif verb == "x" or verb == "X" then
+		if f.prec ~= nil then
+			s = s:sub(1, f.prec)
+		end
+		local out = {}
+		for i = 1, #s do
+			local b = string.format("%02x", s:byte(i))
+			if f.sharp and (i == 1 or f.space) then
+				b = "0x" .. b
+			end
+			out[i] = b
+		end
+		local sep = ""
+		if f.space then
+			sep = " "
+		end
+		s = table.concat(out, sep)
+		if verb == "X" then
+			s = s:upper()
+		end
+		return pad(s, f)
+	end
+	return bad_verb(s, verb)
+end
+
+-- Calls the Error or String method of v, if any, for the verbs that
+-- accept them.
+local function handle_methods(v, verb, f, desc)
+	if f.sharpV or type(v) ~= "table" or getmetatable(v) == nil then
+		return nil
+	end
+	if verb ~= "v" and verb ~= "s" and verb ~= "q" and verb ~= "x" and verb ~= "X" then
+		return nil
+	end
+	-- Values of struct types do not have the methods of pointers to them
+	local hidden = {}
+	if kind_of(desc) == "value" then
+		hidden = rawget(desc, "__hidden")
+	end
+	local m
+	if not hidden.Error then
+		m = v.Error
+	end
+	if type(m) ~= "function" and not hidden.String then
+		m = v.String
+	end
+	if type(m) ~= "function" then
+		return nil
+	end
+	local ok, s = pcall(m, v)
+	if not ok then
+		if builtins.unbox(v) == nil then
+			return "<nil>"
+		end
+		return "%!" .. verb .. "(PANIC=" .. tostring(s) .. ")"
+	end
+	return fmt_string(s, verb, f)
+end
+
+-- Formats the struct v, given its field names, the descriptors of their
+-- types if known and its type name.
+local function fmt_struct(v, verb, f, depth, fields, types, name)
+	local out = {}
+	for i, field in ipairs(fields) do
+		local s = format_value(v[field], verb, f, depth + 1, types and types[i] or nil)
+		if f.plusV or f.sharpV then
+			s = field .. ":" .. s
+		end
+		out[i] = s
+	end
+	local sep = " "
+	if f.sharpV then
+		sep = ", "
+	end
+	local s = "{" .. table.concat(out, sep) .. "}"
+	if f.sharpV then
+		s = (name or "") .. s
+	end
+	return s
+end
+
+-- Formats the first n elements of the slice or array v.
+local function fmt_seq(v, verb, f, depth, n, elem, name)
+	local out = {}
+	for i = 1, n do
+		out[i] = format_value(v[i], verb, f, depth + 1, elem)
+	end
+	if f.sharpV then
+		return name .. "{" .. table.concat(out, ", ") .. "}"
+	end
+	return "[" .. table.concat(out, " ") .. "]"
+end
+
+-- Formats the map v. Maps are printed sorted by key, like Go does.
+local function fmt_map(v, verb, f, depth, key, elem, name)
+	local keys = {}
+	for k in pairs(v) do
+		table.insert(keys, k)
+	end
+	table.sort(keys, function(a, b)
+		if type(a) ~= type(b) then
+			return type(a) < type(b)
+		elseif type(a) == "number" or type(a) == "string" then
+			return a < b
+		end
+		return tostring(a) < tostring(b)
+	end)
+	local out = {}
+	for i, k in ipairs(keys) do
+		out[i] = format_value(k, verb, f, depth + 1, key) .. ":" .. format_value(v[k], verb, f, depth + 1, elem)
+	end
+	if f.sharpV then
+		return name .. "{" .. table.concat(out, ", ") .. "}"
+	end
+	return "map[" .. table.concat(out, " ") .. "]"
+end
+
+local function address(v)
+	return tostring(v):match("0x%x+") or tostring(v)
+end
+
+-- Formats the table v of the type described by desc, if known.
+local function fmt_table(v, verb, f, depth, desc, len)
+	if depth > 10 then
+		return "..."
+	end
+
+	local kind = kind_of(desc)
+	if kind == "value" then
+		desc, kind = rawget(desc, "__type"), nil
+	end
+	if kind == "ptr" then
+		-- Pointers to composite values are only followed at the top level
+		local elem = rawget(desc, "__elem")
+		local ek = kind_of(elem)
+		local composite = ek ~= nil and ek ~= "ptr" or ek == nil and type(elem) == "table" and elem.__fields ~= nil
+		if depth == 0 and composite then
+			return "&" .. fmt_table(v, verb, f, depth + 1, elem)
+		end
+		return address(v)
+	elseif kind == "slice" or kind == "array" then
+		local n = len or rawget(desc, "__len") or seq_len(v)
+		return fmt_seq(v, verb, f, depth, n, rawget(desc, "__elem"), desc.__name)
+	elseif kind == "map" then
+		return fmt_map(v, verb, f, depth, rawget(desc, "__key"), rawget(desc, "__elem"), desc.__name)
+	elseif kind == "struct" then
+		return fmt_struct(v, verb, f, depth, desc.__fields, desc.__types, desc.__name)
+	end
+
+	local meta = getmetatable(v)
+	local typ = meta ~= nil and meta.__index
+	if type(typ) == "table" and typ.__fields ~= nil then
+		return fmt_struct(v, verb, f, depth, typ.__fields, nil, typ.__name)
+	end
+
+	-- Without a descriptor, tables are slices if they look like one
+	if is_slice(v) then
+		return fmt_seq(v, verb, f, depth, #v, nil, "[]interface {}")
+	end
+	return fmt_map(v, verb, f, depth, nil, nil, "map[interface {}]interface {}")
+end
+
+function format_value(v, verb, f, depth, desc)
+	local raw, d, len = unpack_arg(v, desc)
+	local s = handle_methods(v, verb, f, d)
+	if s ~= nil then
+		return s
+	end
+	v, desc = raw, d
+	local t = type(v)
+	if v == nil then
+		if verb ~= "v" then
+			return bad_verb(v, verb)
+		end
+		-- Nil maps and slices are printed empty
+		local kind = kind_of(desc)
+		if kind == "map" then
+			return pad("map[]", f)
+		elseif kind == "slice" then
+			return pad("[]", f)
+		end
+		return pad("<nil>", f)
+	elseif t == "string" and is_integer_type(desc) then
+		-- Rune literals are written as strings
+		v, t = builtins.decode_rune(v, 1), "number"
+	end
+
+	if t == "boolean" then
+		if verb == "v" or verb == "t" then
+			return pad(tostring(v), f)
+		end
+		return bad_verb(v, verb)
+	elseif t == "number" then
+		return fmt_number(v, verb, f)
+	elseif t == "string" then
+		return fmt_string(v, verb, f)
+	elseif t == "table" then
+		if verb == "p" then
+			return pad(address(v), f)
+		end
+		return fmt_table(v, verb, f, depth, desc, len)
+	elseif verb == "v" or verb == "p" then
+		return pad(address(v), f)
+	end
+	return bad_verb(v, verb)
+end
+
+-- Parses a decimal number or a * at position i, returning the number and
+-- the position following it.
+local function parse_num(format, i, args, argi)
+	if format:sub(i, i) == "*" then
+		local v = args[argi]
+		if type(v) ~= "number" then
+			return nil, i + 1, argi + 1, true
+		end
+		return v, i + 1, argi + 1
+	end
+	local s, e = format:find("^%d+", i)
+	if s == nil then
+		return nil, i, argi
+	end
+	return tonumber(format:sub(s, e)), e + 1, argi
+end
+
+function fmt.Sprintf(format, ...)
+	local args = {...}
+	local nargs = select("#", ...)
+	local out = {}
+	local argi = 1
+	local reordered = false
+	local i, n = 1, #format
+
+	-- Parses an explicit argument index such as [2]
+	local function arg_index()
+		local idx, e = format:match("^%[(%d+)%]()", i)
+		if idx ~= nil then
+			argi = tonumber(idx)
+			i = e
+			reordered = true
+		end
+	end
+
+	while i <= n do
+		local s = format:find("%", i, true)
+		if s == nil then
+			table.insert(out, format:sub(i))
+			break
+		end
+		table.insert(out, format:sub(i, s - 1))
+		i = s + 1
+
+		local f = {}
+		while true do
+			local c = format:sub(i, i)
+			if c == "-" then
+				f.minus = true
+				f.zero = false
+			elseif c == "+" then
+				f.plus = true
+			elseif c == "#" then
+				f.sharp = true
+			elseif c == " " then
+				f.space = true
+			elseif c == "0" then
+				f.zero = not f.minus
+			else
+				break
+			end
+			i = i + 1
+		end
+
+		local bad_width, bad_prec
+		arg_index()
+		f.width, i, argi, bad_width = parse_num(format, i, args, argi)
+		if f.width ~= nil and f.width < 0 then
+			f.minus = true
+			f.zero = false
+			f.width = -f.width
+		end
+		if format:sub(i, i) == "." then
+			i = i + 1
+			arg_index()
+			f.prec, i, argi, bad_prec = parse_num(format, i, args, argi)
+			if f.prec == nil or f.prec < 0 then
+				f.prec = 0
+			end
+		end
+		arg_index()
+
+		local verb = format:sub(i, i)
+		i = i + 1
+		if bad_width then
+			table.insert(out, "%!(BADWIDTH)")
+		end
+		if bad_prec then
+			table.insert(out, "%!(BADPREC)")
+		end
+
+		if verb == "" then
+			table.insert(out, "%!(NOVERB)")
+		elseif verb == "%" then
+			table.insert(out, "%")
+		elseif argi > nargs then
+			table.insert(out, "%!" .. verb .. "(MISSING)")
+		else
+			local v = args[argi]
+			argi = argi + 1
+			if verb == "w" then
+				verb = "v"
+			end
+			if verb == "v" then
+				f.plusV = f.plus
+				f.sharpV = f.sharp
+				f.plus, f.sharp = false, false
+			end
+			if verb == "T" then
+				table.insert(out, fmt_string(type_name(v), "s", f))
+			else
+				table.insert(out, format_value(v, verb, f, 0))
+			end
+		end
+	end
+
+	if not reordered and argi <= nargs then
+		local extra = {}
+		for j = argi, nargs do
+			local v = args[j]
+			if v == nil then
+				table.insert(extra, "<nil>")
+			else
+				table.insert(extra, type_name(v) .. "=" .. format_value(v, "v", {}, 0))
+			end
+		end
+		table.insert(out, "%!(EXTRA " .. table.concat(extra, ", ") .. ")")
+	end
+	return table.concat(out)
+end
+
+function fmt.Sprint(...)
+	local out = {}
+	local prev_string = false
+	for i = 1, select("#", ...) do
+		local v = select(i, ...)
+		local raw, desc = unpack_arg(v)
+		local is_string = type(raw) == "string" and not is_integer_type(desc)
+		-- Spaces are added between operands when neither is a string
+		if i > 1 and not is_string and not prev_string then
+			table.insert(out, " ")
+		end
+		table.insert(out, format_value(v, "v", {}, 0))
+		prev_string = is_string
+	end
+	return table.concat(out)
+end
+
+function fmt.Sprintln(...)
+	local out = {}
+	for i = 1, select("#", ...) do
+		out[i] = format_value((select(i, ...)), "v", {}, 0)
+	end
+	return table.concat(out, " ") .. "\n"
+end
+
+function fmt.Printf(format, ...)
+	local s = fmt.Sprintf(format, ...)
+	builtins.write(s)
+	return #s, nil
+end
+
+function fmt.Print(...)
+	local s = fmt.Sprint(...)
+	builtins.write(s)
+	return #s, nil
+end
+
+function fmt.Println(...)
+	local s = fmt.Sprintln(...)
+	builtins.write(s)
+	return #s, nil
+end
+
+function fmt.Errorf(format, ...)
+	return builtins.errorf(format, ...)
+end
+`
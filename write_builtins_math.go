@@ -0,0 +1,285 @@
+package lunar
+
+// mathBuiltins implements the math package on top of the Lua math
+// library, avoiding the functions that were removed in later Lua versions.
+const mathBuiltins = `
+local math_ = {}
+builtins.pkgs["math"] = math_
+
+local huge = math.huge
+local floor, ceil = math.floor, math.ceil
+
+math_.E = 2.71828182845904523536028747135266249775724709369995957496696763
+math_.Pi = 3.14159265358979323846264338327950288419716939937510582097494459
+math_.Phi = 1.61803398874989484820458683436563811772030917980576286213544862
+math_.Sqrt2 = 1.41421356237309504880168872420969807856967187537694807317667974
+math_.SqrtE = 1.64872127070012814684865078831848338924043442446643862713148440
+math_.SqrtPi = 1.77245385090551602729816748334114518279754945612238712821380779
+math_.SqrtPhi = 1.27201964951406896425242246173749149171560804184009624861664038
+math_.Ln2 = 0.693147180559945309417232121458176568075500134360255254120680009
+math_.Log2E = 1.44269504088896340735992468100189213742664595415298593413544940
+math_.Ln10 = 2.30258509299404568401799145468436420760110148862877297603332790
+math_.Log10E = 0.43429448190325182765112891891660508229439700580366656611445378
+math_.MaxFloat32 = 3.40282346638528859811704183484516925440e+38
+math_.SmallestNonzeroFloat32 = 1.401298464324817070923729583289916131280e-45
+math_.MaxFloat64 = 1.79769313486231570814527423731704356798070e+308
+math_.SmallestNonzeroFloat64 = 4.9406564584124654417656879286822137236505980e-324
+math_.MaxInt8 = 127
+math_.MinInt8 = -128
+math_.MaxInt16 = 32767
+math_.MinInt16 = -32768
+math_.MaxInt32 = 2147483647
+math_.MinInt32 = -2147483648
+math_.MaxInt64 = 9223372036854775807
+math_.MinInt64 = -9223372036854775807 - 1
+math_.MaxInt = math_.MaxInt64
+math_.MinInt = math_.MinInt64
+math_.MaxUint8 = 255
+math_.MaxUint16 = 65535
+math_.MaxUint32 = 4294967295
+
+local function is_nan(x)
+	return x ~= x
+end
+
+local function trunc(x)
+	if x ~= x or x == huge or x == -huge then
+		return x
+	elseif x < 0 then
+		return ceil(x)
+	end
+	return floor(x)
+end
+
+function math_.Abs(x)
+	return math.abs(x)
+end
+
+function math_.Ceil(x)
+	return ceil(x)
+end
+
+function math_.Floor(x)
+	return floor(x)
+end
+
+math_.Trunc = trunc
+
+-- Round rounds half away from zero.
+function math_.Round(x)
+	local t = trunc(x)
+	if math.abs(x - t) >= 0.5 then
+		if x < 0 then
+			return t - 1
+		end
+		return t + 1
+	end
+	return t
+end
+
+function math_.RoundToEven(x)
+	local t = trunc(x)
+	local d = math.abs(x - t)
+	if d > 0.5 or (d == 0.5 and t % 2 ~= 0) then
+		if x < 0 then
+			return t - 1
+		end
+		return t + 1
+	end
+	return t
+end
+
+function math_.Modf(x)
+	local i = trunc(x)
+	return i, x - i
+end
+
+function math_.Max(x, y)
+	if x == huge or y == huge then
+		return huge
+	elseif is_nan(x) or is_nan(y) then
+		return 0 / 0
+	elseif x > y then
+		return x
+	end
+	return y
+end
+
+function math_.Min(x, y)
+	if x == -huge or y == -huge then
+		return -huge
+	elseif is_nan(x) or is_nan(y) then
+		return 0 / 0
+	elseif x < y then
+		return x
+	end
+	return y
+end
+
+function math_.Dim(x, y)
+	local v = x - y
+	if v <= 0 then
+		return 0
+	end
+	return v
+end
+
+function math_.Mod(x, y)
+	if y == 0 or x == huge or x == -huge or is_nan(x) or is_nan(y) then
+		return 0 / 0
+	end
+	return math.fmod(x, y)
+end
+
+function math_.Sqrt(x)
+	return math.sqrt(x)
+end
+
+function math_.Cbrt(x)
+	if x < 0 then
+		return -((-x) ^ (1 / 3))
+	end
+	return x ^ (1 / 3)
+end
+
+function math_.Pow(x, y)
+	return x ^ y
+end
+
+function math_.Pow10(n)
+	return 10 ^ n
+end
+
+function math_.Hypot(p, q)
+	if p == huge or p == -huge or q == huge or q == -huge then
+		return huge
+	end
+	return math.sqrt(p * p + q * q)
+end
+
+function math_.Exp(x)
+	return math.exp(x)
+end
+
+function math_.Exp2(x)
+	return 2 ^ x
+end
+
+function math_.Expm1(x)
+	return math.exp(x) - 1
+end
+
+function math_.Log(x)
+	return math.log(x)
+end
+
+-- Splits x into a fraction in [0.5, 1) and a power of two.
+local function frexp(x)
+	if x == 0 or x ~= x or x == huge or x == -huge then
+		return x, 0
+	end
+	local exp = floor(math.log(math.abs(x)) * math_.Log2E) + 1
+	local frac = x / 2 ^ exp
+	-- Correct for rounding errors in the logarithm
+	if math.abs(frac) >= 1 then
+		frac, exp = frac / 2, exp + 1
+	elseif math.abs(frac) < 0.5 then
+		frac, exp = frac * 2, exp - 1
+	end
+	return frac, exp
+end
+
+function math_.Log2(x)
+	local frac, exp = frexp(x)
+	-- Make sure exact powers of two give exact answers
+	if frac == 0.5 then
+		return exp - 1
+	end
+	return math.log(frac) * math_.Log2E + exp
+end
+
+function math_.Log10(x)
+	-- Ln2/Ln10, computed exactly
+	return math_.Log2(x) * 0.30102999566398119521373889472449302676818988146210854131
+end
+
+function math_.Log1p(x)
+	return math.log(1 + x)
+end
+
+function math_.Sin(x)
+	return math.sin(x)
+end
+
+function math_.Cos(x)
+	return math.cos(x)
+end
+
+function math_.Tan(x)
+	return math.tan(x)
+end
+
+function math_.Asin(x)
+	return math.asin(x)
+end
+
+function math_.Acos(x)
+	return math.acos(x)
+end
+
+function math_.Atan(x)
+	return math.atan(x)
+end
+
+-- math.atan2 was removed in Lua 5.3 in favor of a two-argument math.atan
+local atan2 = math.atan2 or math.atan
+function math_.Atan2(y, x)
+	return atan2(y, x)
+end
+
+function math_.Sinh(x)
+	return (math.exp(x) - math.exp(-x)) / 2
+end
+
+function math_.Cosh(x)
+	return (math.exp(x) + math.exp(-x)) / 2
+end
+
+function math_.Tanh(x)
+	if x > 20 then
+		return 1
+	elseif x < -20 then
+		return -1
+	end
+	local a, b = math.exp(x), math.exp(-x)
+	return (a - b) / (a + b)
+end
+
+function math_.Inf(sign)
+	if sign >= 0 then
+		return huge
+	end
+	return -huge
+end
+
+function math_.IsInf(x, sign)
+	return (sign >= 0 and x == huge) or (sign <= 0 and x == -huge)
+end
+
+math_.IsNaN = is_nan
+
+function math_.NaN()
+	return 0 / 0
+end
+
+function math_.Signbit(x)
+	return x < 0 or (x == 0 and 1 / x < 0)
+end
+
+function math_.Copysign(f, sign)
+	if math_.Signbit(f) ~= math_.Signbit(sign) then
+		return -f
+	end
+	return f
+end
+`
@@ -0,0 +1,304 @@
+package lunar
+
+// sortBuiltins implements the sort package. The sorting algorithms are
+// expressed in terms of less and swap functions taking zero-based indexes,
+// like sort.Interface, so they can operate on slices as well as on values
+// implementing the interface.
+const sortBuiltins = `
+local sort = {}
+builtins.pkgs["sort"] = sort
+
+local function insertion_sort(less, swap, a, b)
+	for i = a + 1, b - 1 do
+		local j = i
+		while j > a and less(j, j - 1) do
+			swap(j, j - 1)
+			j = j - 1
+		end
+	end
+end
+
+local function sift_down(less, swap, lo, hi, first)
+	local root = lo
+	while true do
+		local child = 2 * root + 1
+		if child >= hi then
+			return
+		end
+		if child + 1 < hi and less(first + child, first + child + 1) then
+			child = child + 1
+		end
+		if not less(first + root, first + child) then
+			return
+		end
+		swap(first + root, first + child)
+		root = child
+	end
+end
+
+local function unstable_sort(less, swap, n)
+	if n < 12 then
+		insertion_sort(less, swap, 0, n)
+		return
+	end
+	for i = math.floor((n - 1) / 2), 0, -1 do
+		sift_down(less, swap, i, n, 0)
+	end
+	for i = n - 1, 0, -1 do
+		swap(0, i)
+		sift_down(less, swap, 0, i, 0)
+	end
+end
+
+local function swap_range(swap, a, b, n)
+	for i = 0, n - 1 do
+		swap(a + i, b + i)
+	end
+end
+
+local function rotate(swap, a, m, b)
+	local i = m - a
+	local j = b - m
+	while i ~= j do
+		if i > j then
+			swap_range(swap, m - i, m, j)
+			i = i - j
+		else
+			swap_range(swap, m - i, m + j - i, i)
+			j = j - i
+		end
+	end
+	swap_range(swap, m - i, m, i)
+end
+
+-- Merges the sorted ranges [a, m) and [m, b) in place, using the SymMerge
+-- algorithm from the Go sort package.
+local function sym_merge(less, swap, a, m, b)
+	if m - a == 1 then
+		local i, j = m, b
+		while i < j do
+			local h = math.floor((i + j) / 2)
+			if less(h, a) then
+				i = h + 1
+			else
+				j = h
+			end
+		end
+		for k = a, i - 2 do
+			swap(k, k + 1)
+		end
+		return
+	end
+	if b - m == 1 then
+		local i, j = a, m
+		while i < j do
+			local h = math.floor((i + j) / 2)
+			if not less(m, h) then
+				i = h + 1
+			else
+				j = h
+			end
+		end
+		for k = m, i + 1, -1 do
+			swap(k, k - 1)
+		end
+		return
+	end
+
+	local mid = math.floor((a + b) / 2)
+	local n = mid + m
+	local start, r
+	if m > mid then
+		start, r = n - b, mid
+	else
+		start, r = a, m
+	end
+	local p = n - 1
+	while start < r do
+		local c = math.floor((start + r) / 2)
+		if not less(p - c, c) then
+			start = c + 1
+		else
+			r = c
+		end
+	end
+	local stop = n - start
+	if start < m and m < stop then
+		rotate(swap, start, m, stop)
+	end
+	if a < start and start < mid then
+		sym_merge(less, swap, a, start, mid)
+	end
+	if mid < stop and stop < b then
+		sym_merge(less, swap, mid, stop, b)
+	end
+end
+
+local function stable_sort(less, swap, n)
+	local block = 20
+	local a, b = 0, block
+	while b <= n do
+		insertion_sort(less, swap, a, b)
+		a = b
+		b = b + block
+	end
+	insertion_sort(less, swap, a, n)
+
+	while block < n do
+		a, b = 0, 2 * block
+		while b <= n do
+			sym_merge(less, swap, a, a + block, b)
+			a = b
+			b = b + 2 * block
+		end
+		if a + block < n then
+			sym_merge(less, swap, a, a + block, n)
+		end
+		block = block * 2
+	end
+end
+
+local function is_sorted(less, n)
+	for i = n - 1, 1, -1 do
+		if less(i, i - 1) then
+			return false
+		end
+	end
+	return true
+end
+
+local function iface_funcs(data)
+	local less = function(i, j)
+		return data:Less(i, j)
+	end
+	local swap = function(i, j)
+		data:Swap(i, j)
+	end
+	return less, swap, data:Len()
+end
+
+local function slice_funcs(x, less)
+	x = builtins.unbox(x) or {}
+	local swap = function(i, j)
+		x[i + 1], x[j + 1] = x[j + 1], x[i + 1]
+	end
+	return less, swap, #x
+end
+
+function sort.Sort(data)
+	unstable_sort(iface_funcs(data))
+end
+
+function sort.Stable(data)
+	stable_sort(iface_funcs(data))
+end
+
+function sort.IsSorted(data)
+	local less, _, n = iface_funcs(data)
+	return is_sorted(less, n)
+end
+
+function sort.Slice(x, less)
+	unstable_sort(slice_funcs(x, less))
+end
+
+function sort.SliceStable(x, less)
+	stable_sort(slice_funcs(x, less))
+end
+
+function sort.SliceIsSorted(x, less)
+	local _, _, n = slice_funcs(x, less)
+	return is_sorted(less, n)
+end
+
+function sort.Search(n, f)
+	local i, j = 0, n
+	while i < j do
+		local h = math.floor((i + j) / 2)
+		if not f(h) then
+			i = h + 1
+		else
+			j = h
+		end
+	end
+	return i
+end
+
+local function search_values(a, x)
+	a = a or {}
+	return sort.Search(#a, function(i)
+		return a[i + 1] >= x
+	end)
+end
+
+-- Slices of basic types can be sorted directly by value.
+local function sort_values(x)
+	if x ~= nil then
+		table.sort(x)
+	end
+end
+
+local function values_sorted(x)
+	x = x or {}
+	for i = 2, #x do
+		if x[i] < x[i - 1] then
+			return false
+		end
+	end
+	return true
+end
+
+sort.Ints = sort_values
+sort.Strings = sort_values
+sort.Float64s = sort_values
+sort.IntsAreSorted = values_sorted
+sort.StringsAreSorted = values_sorted
+sort.Float64sAreSorted = values_sorted
+sort.SearchInts = search_values
+sort.SearchStrings = search_values
+sort.SearchFloat64s = search_values
+
+-- IntSlice, StringSlice and Float64Slice attach the methods of Interface
+-- to slices of basic types.
+local function slice_type(name)
+	local t = {__name = name}
+	function t.Len(x)
+		return #x
+	end
+	function t.Less(x, i, j)
+		return x[i + 1] < x[j + 1]
+	end
+	function t.Swap(x, i, j)
+		x[i + 1], x[j + 1] = x[j + 1], x[i + 1]
+	end
+	function t.Sort(x)
+		sort_values(x)
+	end
+	function t.Search(x, v)
+		return search_values(x, v)
+	end
+	return t
+end
+
+sort.IntSlice = slice_type("sort.IntSlice")
+sort.StringSlice = slice_type("sort.StringSlice")
+sort.Float64Slice = slice_type("sort.Float64Slice")
+
+local reverse = {__name = "*sort.reverse", __fields = {"Interface"}}
+
+function reverse.Len(r)
+	return r.Interface:Len()
+end
+
+function reverse.Less(r, i, j)
+	return r.Interface:Less(j, i)
+end
+
+function reverse.Swap(r, i, j)
+	r.Interface:Swap(i, j)
+end
+
+function sort.Reverse(data)
+	return setmetatable({Interface = data}, {__index = reverse})
+end
+`
@@ -0,0 +1,64 @@
+package lunar
+
+// sourceMapBuiltins rewrites positions in Lua error messages and
+// tracebacks into the Go positions they were generated from, using the
+// line tables written by SourceMap.WriteLineTable.
+const sourceMapBuiltins = `
+-- Line tables by chunk name, mapping Lua lines to Go positions
+builtins.source_maps = builtins.source_maps or {}
+
+local function go_position(chunk, line)
+	local lines = builtins.source_maps[chunk]
+	if lines == nil then
+		return nil
+	end
+	-- Lines without an entry belong to the closest entry before them
+	for l = line, 1, -1 do
+		if lines[l] ~= nil then
+			return lines[l]
+		end
+	end
+	return nil
+end
+
+-- Rewrites the chunk:line positions in msg into Go positions, leaving
+-- positions in chunks without a line table as they are.
+function builtins.rewrite_positions(msg)
+	if type(msg) ~= "string" then
+		return msg
+	end
+	return (msg:gsub("([^%s:]+):(%d+):", function(chunk, line)
+		local pos = go_position(chunk, tonumber(line))
+		if pos == nil then
+			return nil
+		end
+		return pos .. ":"
+	end))
+end
+
+-- Message handler for xpcall, returning a traceback in terms of Go
+-- positions:
+--
+--	local ok, err = xpcall(f, builtins.traceback)
+function builtins.traceback(msg)
+	if type(msg) ~= "string" then
+		return msg
+	end
+	if debug ~= nil and debug.traceback ~= nil then
+		msg = debug.traceback(msg, 2)
+	end
+	return builtins.rewrite_positions(msg)
+end
+
+local function rewrite_result(ok, ...)
+	if not ok then
+		return false, builtins.rewrite_positions((...))
+	end
+	return true, ...
+end
+
+-- Like pcall, but error messages refer to Go positions
+function builtins.pcall(f, ...)
+	return rewrite_result(pcall(f, ...))
+end
+`
@@ -0,0 +1,321 @@
+package lunar
+
+// strconvBuiltins implements the strconv package. Numbers are Lua
+// numbers, so integers beyond 2^53 lose precision when using Lua versions
+// without an integer subtype.
+const strconvBuiltins = `
+local strconv = {}
+builtins.pkgs["strconv"] = strconv
+
+strconv.IntSize = 64
+strconv.ErrRange = builtins.errors_new("value out of range")
+strconv.ErrSyntax = builtins.errors_new("invalid syntax")
+
+-- NumError records a failed conversion.
+local NumError = {__name = "*strconv.NumError", __fields = {"Func", "Num", "Err"}}
+strconv.NumError = NumError
+
+function NumError.Error(e)
+	return "strconv." .. e.Func .. ": parsing " .. strconv.Quote(e.Num) .. ": " .. e.Err:Error()
+end
+
+function NumError.Unwrap(e)
+	return e.Err
+end
+
+local function num_error(fn, s, err)
+	return setmetatable({Func = fn, Num = s, Err = err}, {__index = NumError})
+end
+
+-- Parses the digits of s in the given base, returning nil if s contains
+-- anything else.
+local function parse_digits(s, base)
+	if s == "" then
+		return nil
+	end
+	local v = 0
+	for i = 1, #s do
+		local c = s:byte(i)
+		local d
+		if c >= 48 and c <= 57 then
+			d = c - 48
+		elseif c >= 97 and c <= 122 then
+			d = c - 87
+		elseif c >= 65 and c <= 90 then
+			d = c - 55
+		else
+			return nil
+		end
+		if d >= base then
+			return nil
+		end
+		v = v * base + d
+	end
+	return v
+end
+
+-- Parses an unsigned integer, returning the value and the error cause if
+-- the conversion failed.
+local function parse_uint(s, base, bitSize)
+	if s == "" then
+		return 0, strconv.ErrSyntax
+	end
+	if base == 0 then
+		base = 10
+		local prefix = s:sub(1, 2):lower()
+		if prefix == "0x" then
+			base, s = 16, s:sub(3)
+		elseif prefix == "0b" then
+			base, s = 2, s:sub(3)
+		elseif prefix == "0o" then
+			base, s = 8, s:sub(3)
+		elseif s:sub(1, 1) == "0" and #s > 1 then
+			base, s = 8, s:sub(2)
+		end
+		-- Underscores are only permitted with base prefixes
+		s = s:gsub("_", "")
+	elseif base < 2 or base > 36 then
+		return 0, builtins.errors_new("invalid base " .. base)
+	end
+	if bitSize == 0 then
+		bitSize = 64
+	elseif bitSize < 0 or bitSize > 64 then
+		return 0, builtins.errors_new("invalid bit size " .. bitSize)
+	end
+
+	local v = parse_digits(s, base)
+	if v == nil then
+		return 0, strconv.ErrSyntax
+	end
+	local max = 2 ^ bitSize - 1
+	if v > max then
+		return max, strconv.ErrRange
+	end
+	return v, nil
+end
+
+local function parse_int(s, base, bitSize)
+	if s == "" then
+		return 0, strconv.ErrSyntax
+	end
+	local neg = false
+	local sign = s:sub(1, 1)
+	if sign == "+" or sign == "-" then
+		neg = sign == "-"
+		s = s:sub(2)
+	end
+	if bitSize == 0 then
+		bitSize = 64
+	end
+
+	local un, err = parse_uint(s, base, bitSize)
+	if err ~= nil and err ~= strconv.ErrRange then
+		return 0, err
+	end
+	local cutoff = 2 ^ (bitSize - 1)
+	if not neg and un >= cutoff then
+		return cutoff - 1, strconv.ErrRange
+	elseif neg and un > cutoff then
+		return -cutoff, strconv.ErrRange
+	end
+	if neg then
+		return -un, nil
+	end
+	return un, nil
+end
+
+function strconv.ParseUint(s, base, bitSize)
+	local v, err = parse_uint(s, base, bitSize)
+	if err ~= nil then
+		return v, num_error("ParseUint", s, err)
+	end
+	return v, nil
+end
+
+function strconv.ParseInt(s, base, bitSize)
+	local v, err = parse_int(s, base, bitSize)
+	if err ~= nil then
+		return v, num_error("ParseInt", s, err)
+	end
+	return v, nil
+end
+
+function strconv.Atoi(s)
+	local v, err = parse_int(s, 10, 0)
+	if err ~= nil then
+		return v, num_error("Atoi", s, err)
+	end
+	return v, nil
+end
+
+function strconv.ParseFloat(s, bitSize)
+	local sign, rest = s:lower():match("^([+-]?)(.*)$")
+	if rest == "inf" or rest == "infinity" then
+		if sign == "-" then
+			return -math.huge, nil
+		end
+		return math.huge, nil
+	elseif rest == "nan" and sign == "" then
+		return 0 / 0, nil
+	end
+
+	local v = nil
+	if not s:find("[%s_]") then
+		v = tonumber(s)
+	end
+	if v == nil then
+		return 0, num_error("ParseFloat", s, strconv.ErrSyntax)
+	elseif v == math.huge or v == -math.huge then
+		return v, num_error("ParseFloat", s, strconv.ErrRange)
+	end
+	return v, nil
+end
+
+function strconv.ParseBool(s)
+	if s == "1" or s == "t" or s == "T" or s == "true" or s == "TRUE" or s == "True" then
+		return true, nil
+	elseif s == "0" or s == "f" or s == "F" or s == "false" or s == "FALSE" or s == "False" then
+		return false, nil
+	end
+	return false, num_error("ParseBool", s, strconv.ErrSyntax)
+end
+
+function strconv.Itoa(i)
+	return string.format("%d", i)
+end
+
+function strconv.FormatInt(i, base)
+	if base < 2 or base > 36 then
+		error("strconv: illegal AppendInt/FormatInt base")
+	end
+	if base == 10 then
+		return string.format("%d", i)
+	end
+	local neg = i < 0
+	if neg then
+		i = -i
+	end
+	local digits = "0123456789abcdefghijklmnopqrstuvwxyz"
+	local out = {}
+	repeat
+		local d = i % base
+		table.insert(out, 1, digits:sub(d + 1, d + 1))
+		i = (i - d) / base
+	until i == 0
+	if neg then
+		table.insert(out, 1, "-")
+	end
+	return table.concat(out)
+end
+
+strconv.FormatUint = strconv.FormatInt
+
+function strconv.FormatBool(b)
+	if b then
+		return "true"
+	end
+	return "false"
+end
+
+function strconv.FormatFloat(f, fmt, prec, bitSize)
+	if type(fmt) == "number" then
+		fmt = string.char(fmt)
+	end
+	local Sprintf = builtins.pkgs["fmt"].Sprintf
+	if prec >= 0 then
+		return Sprintf("%." .. prec .. fmt, f)
+	elseif fmt == "g" or fmt == "G" or f ~= f or f == math.huge or f == -math.huge then
+		return Sprintf("%" .. fmt, f)
+	end
+	-- Use the smallest precision that represents f exactly
+	for p = 0, 17 do
+		local s = string.format("%." .. p .. fmt, f)
+		if tonumber(s) == f then
+			return s
+		end
+	end
+	return Sprintf("%" .. fmt, f)
+end
+
+function strconv.Quote(s)
+	return builtins.pkgs["fmt"].Sprintf("%q", s)
+end
+
+function strconv.QuoteRune(r)
+	if type(r) == "string" then
+		r = builtins.decode_rune(r, 1)
+	end
+	return builtins.pkgs["fmt"].Sprintf("%q", r)
+end
+
+local unescapes = {
+	a = "\a", b = "\b", f = "\f", n = "\n", r = "\r", t = "\t", v = "\v",
+	["\\"] = "\\", ["'"] = "'", ['"'] = '"',
+}
+
+-- Unquote interprets s as a single-quoted, double-quoted or backquoted Go
+-- string literal, returning the string value that s quotes.
+function strconv.Unquote(s)
+	local q = s:sub(1, 1)
+	if #s < 2 or s:sub(-1) ~= q then
+		return "", strconv.ErrSyntax
+	end
+	local inner = s:sub(2, -2)
+	if q == "\96" then
+		if inner:find("\96", 1, true) then
+			return "", strconv.ErrSyntax
+		end
+		return (inner:gsub("\r", "")), nil
+	elseif q ~= '"' and q ~= "'" then
+		return "", strconv.ErrSyntax
+	end
+
+	local out = {}
+	local i = 1
+	while i <= #inner do
+		local c = inner:sub(i, i)
+		if c == q or c == "\n" then
+			return "", strconv.ErrSyntax
+		elseif c ~= "\\" then
+			table.insert(out, c)
+			i = i + 1
+		else
+			local e = inner:sub(i + 1, i + 1)
+			if unescapes[e] ~= nil and (e ~= "'" or q == "'") and (e ~= '"' or q == '"') then
+				table.insert(out, unescapes[e])
+				i = i + 2
+			elseif e == "x" or e == "u" or e == "U" then
+				local n = ({x = 2, u = 4, U = 8})[e]
+				local v = parse_digits(inner:sub(i + 2, i + 1 + n), 16)
+				if v == nil or #inner < i + 1 + n then
+					return "", strconv.ErrSyntax
+				end
+				if e == "x" then
+					table.insert(out, string.char(v))
+				else
+					table.insert(out, builtins.rune_string(v))
+				end
+				i = i + 2 + n
+			elseif e:find("^[0-7]$") then
+				local v = parse_digits(inner:sub(i + 1, i + 3), 8)
+				if v == nil or v > 255 then
+					return "", strconv.ErrSyntax
+				end
+				table.insert(out, string.char(v))
+				i = i + 4
+			else
+				return "", strconv.ErrSyntax
+			end
+		end
+	end
+
+	local res = table.concat(out)
+	if q == "'" then
+		local _, size = builtins.decode_rune(res, 1)
+		if res == "" or size ~= #res then
+			return "", strconv.ErrSyntax
+		end
+	end
+	return res, nil
+end
+`
@@ -0,0 +1,406 @@
+package lunar
+
+// stringsBuiltins implements the strings package. Strings are Lua strings,
+// so indexes are byte offsets just like in Go. Case conversions only apply
+// to ASCII letters.
+const stringsBuiltins = `
+local strings = {}
+builtins.pkgs["strings"] = strings
+
+-- Splits s into its UTF-8 encoded characters.
+local function split_chars(s)
+	local out = {}
+	for c in s:gmatch("[^\128-\191][\128-\191]*") do
+		table.insert(out, c)
+	end
+	return out
+end
+
+local function char_set(s)
+	local set = {}
+	for _, c in ipairs(split_chars(s)) do
+		set[c] = true
+	end
+	return set
+end
+
+function strings.Compare(a, b)
+	if a == b then
+		return 0
+	elseif a < b then
+		return -1
+	end
+	return 1
+end
+
+function strings.Contains(s, substr)
+	return s:find(substr, 1, true) ~= nil
+end
+
+function strings.ContainsAny(s, chars)
+	return strings.IndexAny(s, chars) >= 0
+end
+
+function strings.ContainsRune(s, r)
+	return strings.IndexRune(s, r) >= 0
+end
+
+function strings.Count(s, substr)
+	if substr == "" then
+		return #split_chars(s) + 1
+	end
+	local n, i = 0, 1
+	while true do
+		local s1, e1 = s:find(substr, i, true)
+		if s1 == nil then
+			return n
+		end
+		n = n + 1
+		i = e1 + 1
+	end
+end
+
+function strings.EqualFold(a, b)
+	return a:lower() == b:lower()
+end
+
+function strings.Fields(s)
+	local out = {}
+	for f in s:gmatch("%S+") do
+		table.insert(out, f)
+	end
+	return out
+end
+
+function strings.HasPrefix(s, prefix)
+	return s:sub(1, #prefix) == prefix
+end
+
+function strings.HasSuffix(s, suffix)
+	return suffix == "" or s:sub(-#suffix) == suffix
+end
+
+function strings.Index(s, substr)
+	local i = s:find(substr, 1, true)
+	if i == nil then
+		return -1
+	end
+	return i - 1
+end
+
+function strings.IndexByte(s, c)
+	if type(c) == "number" then
+		c = string.char(c)
+	end
+	return strings.Index(s, c)
+end
+
+function strings.IndexRune(s, r)
+	return strings.Index(s, builtins.rune_string(r))
+end
+
+function strings.IndexAny(s, chars)
+	local set = char_set(chars)
+	local i = 1
+	while i <= #s do
+		local _, size = builtins.decode_rune(s, i)
+		if set[s:sub(i, i + size - 1)] then
+			return i - 1
+		end
+		i = i + size
+	end
+	return -1
+end
+
+function strings.LastIndex(s, substr)
+	if substr == "" then
+		return #s
+	end
+	local last, i = -1, 1
+	while true do
+		local s1 = s:find(substr, i, true)
+		if s1 == nil then
+			return last
+		end
+		last = s1 - 1
+		i = s1 + 1
+	end
+end
+
+function strings.LastIndexByte(s, c)
+	if type(c) == "number" then
+		c = string.char(c)
+	end
+	return strings.LastIndex(s, c)
+end
+
+function strings.Join(elems, sep)
+	if elems == nil then
+		return ""
+	end
+	return table.concat(elems, sep)
+end
+
+function strings.Repeat(s, count)
+	if count < 0 then
+		error("strings: negative Repeat count")
+	end
+	return string.rep(s, count)
+end
+
+function strings.Replace(s, old, new, n)
+	if old == new or n == 0 then
+		return s
+	end
+	local out = {}
+	if old == "" then
+		-- Insert new before each character and at the end
+		local cs = split_chars(s)
+		for i = 1, #cs + 1 do
+			if n < 0 or i <= n then
+				table.insert(out, new)
+			end
+			table.insert(out, cs[i])
+		end
+		return table.concat(out)
+	end
+
+	local i, done = 1, 0
+	while n < 0 or done < n do
+		local s1, e1 = s:find(old, i, true)
+		if s1 == nil then
+			break
+		end
+		table.insert(out, s:sub(i, s1 - 1))
+		table.insert(out, new)
+		i = e1 + 1
+		done = done + 1
+	end
+	table.insert(out, s:sub(i))
+	return table.concat(out)
+end
+
+function strings.ReplaceAll(s, old, new)
+	return strings.Replace(s, old, new, -1)
+end
+
+-- Splits s around sep, keeping sepSave bytes of sep in each part and
+-- returning at most n parts if n is non-negative.
+local function gen_split(s, sep, sepSave, n)
+	if n == 0 then
+		return nil
+	end
+	if sep == "" then
+		local cs = split_chars(s)
+		if n > 0 and #cs > n then
+			local rest = table.concat(cs, "", n)
+			for i = #cs, n, -1 do
+				cs[i] = nil
+			end
+			cs[n] = rest
+		end
+		return cs
+	end
+
+	local out = {}
+	local i = 1
+	while n < 0 or #out < n - 1 do
+		local s1, e1 = s:find(sep, i, true)
+		if s1 == nil then
+			break
+		end
+		table.insert(out, s:sub(i, s1 - 1 + sepSave))
+		i = e1 + 1
+	end
+	table.insert(out, s:sub(i))
+	return out
+end
+
+function strings.Split(s, sep)
+	return gen_split(s, sep, 0, -1)
+end
+
+function strings.SplitN(s, sep, n)
+	return gen_split(s, sep, 0, n)
+end
+
+function strings.SplitAfter(s, sep)
+	return gen_split(s, sep, #sep, -1)
+end
+
+function strings.SplitAfterN(s, sep, n)
+	return gen_split(s, sep, #sep, n)
+end
+
+function strings.ToLower(s)
+	return s:lower()
+end
+
+function strings.ToUpper(s)
+	return s:upper()
+end
+
+function strings.TrimSpace(s)
+	return s:match("^%s*(.-)%s*$")
+end
+
+function strings.TrimLeft(s, cutset)
+	local set = char_set(cutset)
+	local i = 1
+	while i <= #s do
+		local _, size = builtins.decode_rune(s, i)
+		if not set[s:sub(i, i + size - 1)] then
+			break
+		end
+		i = i + size
+	end
+	return s:sub(i)
+end
+
+function strings.TrimRight(s, cutset)
+	local set = char_set(cutset)
+	local cs = split_chars(s)
+	local n = #cs
+	while n > 0 and set[cs[n]] do
+		n = n - 1
+	end
+	return table.concat(cs, "", 1, n)
+end
+
+function strings.Trim(s, cutset)
+	return strings.TrimRight(strings.TrimLeft(s, cutset), cutset)
+end
+
+function strings.TrimPrefix(s, prefix)
+	if strings.HasPrefix(s, prefix) then
+		return s:sub(#prefix + 1)
+	end
+	return s
+end
+
+function strings.TrimSuffix(s, suffix)
+	if suffix ~= "" and strings.HasSuffix(s, suffix) then
+		return s:sub(1, #s - #suffix)
+	end
+	return s
+end
+
+function strings.Cut(s, sep)
+	local i = strings.Index(s, sep)
+	if i >= 0 then
+		return s:sub(1, i), s:sub(i + #sep + 1), true
+	end
+	return s, "", false
+end
+
+function strings.CutPrefix(s, prefix)
+	if strings.HasPrefix(s, prefix) then
+		return s:sub(#prefix + 1), true
+	end
+	return s, false
+end
+
+function strings.CutSuffix(s, suffix)
+	if strings.HasSuffix(s, suffix) then
+		return s:sub(1, #s - #suffix), true
+	end
+	return s, false
+end
+
+-- Builder accumulates the written strings and concatenates them lazily.
+local Builder = {__name = "strings.Builder", __fields = {}}
+strings.Builder = Builder
+
+local function builder_parts(b)
+	local parts = rawget(b, "__parts")
+	if parts == nil then
+		parts = {}
+		b.__parts = parts
+		b.__len = 0
+	end
+	return parts
+end
+
+function Builder.WriteString(b, s)
+	table.insert(builder_parts(b), s)
+	b.__len = b.__len + #s
+	return #s, nil
+end
+
+function Builder.WriteByte(b, c)
+	if type(c) == "number" then
+		c = string.char(c)
+	end
+	Builder.WriteString(b, c)
+	return nil
+end
+
+function Builder.WriteRune(b, r)
+	return Builder.WriteString(b, builtins.rune_string(r))
+end
+
+function Builder.String(b)
+	local parts = builder_parts(b)
+	if #parts > 1 then
+		local s = table.concat(parts)
+		b.__parts = {s}
+	end
+	return b.__parts[1] or ""
+end
+
+function Builder.Len(b)
+	builder_parts(b)
+	return b.__len
+end
+
+function Builder.Reset(b)
+	b.__parts = nil
+end
+
+function Builder.Grow(b, n)
+	if n < 0 then
+		error("strings.Builder.Grow: negative count")
+	end
+end
+
+-- Replacer replaces the old strings in argument order, at each position
+-- of the input.
+local Replacer = {__name = "*strings.Replacer", __fields = {}}
+strings.Replacer = Replacer
+
+function strings.NewReplacer(...)
+	local oldnew = {...}
+	if #oldnew % 2 == 1 then
+		error("strings.NewReplacer: odd argument count")
+	end
+	return setmetatable({oldnew = oldnew}, {__index = Replacer})
+end
+
+function Replacer.Replace(r, s)
+	local oldnew = r.oldnew
+	local out = {}
+	local i = 1
+	while i <= #s + 1 do
+		local matched = false
+		for j = 1, #oldnew, 2 do
+			local old = oldnew[j]
+			if s:sub(i, i + #old - 1) == old then
+				table.insert(out, oldnew[j + 1])
+				if old == "" then
+					table.insert(out, s:sub(i, i))
+					i = i + 1
+				else
+					i = i + #old
+				end
+				matched = true
+				break
+			end
+		end
+		if not matched then
+			table.insert(out, s:sub(i, i))
+			i = i + 1
+		end
+	end
+	return table.concat(out)
+end
+`
@@ -0,0 +1,209 @@
+package lunar
+
+import (
+	"strings"
+)
+
+// targetBuiltins returns the part of the builtins that differs between
+// targets: integer division, the bitwise operations missing from the
+// target, function environments and writing to standard output.
+func targetBuiltins(t Target) string {
+	var buf strings.Builder
+	if t.hasIntegers() {
+		buf.WriteString(intBuiltins)
+	} else {
+		buf.WriteString(floatBuiltins)
+	}
+	if t == Lua51 {
+		buf.WriteString(bitBuiltins)
+	}
+	if !t.hasSetfenv() {
+		buf.WriteString(envBuiltins)
+	}
+	if t == WoW {
+		buf.WriteString(printWriteBuiltins)
+	} else {
+		buf.WriteString(ioWriteBuiltins)
+	}
+	return buf.String()
+}
+
+// intBuiltins implements integer operations for targets with an integer
+// number subtype.
+const intBuiltins = `
+-- Divides integers, truncating towards zero like Go
+function builtins.idiv(a, b)
+	if b == 0 then
+		error("runtime error: integer divide by zero")
+	end
+	local q = a // b
+	if q < 0 and q * b ~= a then
+		q = q + 1
+	end
+	return q
+end
+
+-- Shifts a signed integer right, preserving its sign
+function builtins.arshift(a, n)
+	if n >= 63 then
+		if a < 0 then
+			return -1
+		end
+		return 0
+	end
+	return a // (1 << n)
+end
+`
+
+// floatBuiltins implements integer operations for targets where all
+// numbers are floats.
+const floatBuiltins = `
+-- Divides integers, truncating towards zero like Go
+function builtins.idiv(a, b)
+	if b == 0 then
+		error("runtime error: integer divide by zero")
+	end
+	local q = a / b
+	if q < 0 then
+		return math.ceil(q)
+	end
+	return math.floor(q)
+end
+`
+
+// bitBuiltins implements the bitwise operations of LuaJIT's bit library
+// for Lua 5.1, which has none. Operands and results are 32-bit signed
+// integers.
+const bitBuiltins = `
+local function tobit(x)
+	x = x % 0x100000000
+	if x >= 0x80000000 then
+		return x - 0x100000000
+	end
+	return x
+end
+
+-- Combines the bits of a and b, keeping those where keep(x, y) is true
+local function bitop(a, b, keep)
+	a, b = a % 0x100000000, b % 0x100000000
+	local res, bit = 0, 1
+	for _ = 1, 32 do
+		local x, y = a % 2, b % 2
+		if keep(x, y) then
+			res = res + bit
+		end
+		a, b, bit = (a - x) / 2, (b - y) / 2, bit * 2
+	end
+	return tobit(res)
+end
+
+local function both(x, y)
+	return x + y == 2
+end
+
+local function either(x, y)
+	return x + y > 0
+end
+
+local function one(x, y)
+	return x + y == 1
+end
+
+function builtins.band(a, b)
+	return bitop(a, b, both)
+end
+
+function builtins.bor(a, b)
+	return bitop(a, b, either)
+end
+
+function builtins.bxor(a, b)
+	return bitop(a, b, one)
+end
+
+function builtins.bnot(a)
+	return tobit(-1 - a)
+end
+
+function builtins.lshift(a, n)
+	return tobit(a * 2 ^ (n % 32))
+end
+
+function builtins.rshift(a, n)
+	return tobit(math.floor(a % 0x100000000 / 2 ^ (n % 32)))
+end
+
+function builtins.arshift(a, n)
+	return math.floor(tobit(a) / 2 ^ (n % 32))
+end
+`
+
+// envBuiltins implements getfenv and setfenv for targets where the
+// environment of a function is its _ENV upvalue. Functions that use no
+// globals have no such upvalue; their environment is the global table and
+// cannot be changed.
+const envBuiltins = `
+local function env_upvalue(f)
+	local i = 1
+	while true do
+		local name = debug.getupvalue(f, i)
+		if name == "_ENV" then
+			return i
+		elseif name == nil then
+			return nil
+		end
+		i = i + 1
+	end
+end
+
+function builtins.getfenv(f)
+	local i = env_upvalue(f)
+	if i == nil then
+		return _G
+	end
+	local _, env = debug.getupvalue(f, i)
+	return env
+end
+
+-- Gives f an _ENV upvalue of its own, leaving other functions sharing it
+-- unchanged
+function builtins.setfenv(f, env)
+	local i = env_upvalue(f)
+	if i ~= nil then
+		debug.upvaluejoin(f, i, function()
+			return env
+		end, 1)
+	end
+	return f
+end
+`
+
+// ioWriteBuiltins writes to standard output using the io library.
+const ioWriteBuiltins = `
+function builtins.write(...)
+	for i = 1, select("#", ...) do
+		io.write(tostring((select(i, ...))))
+	end
+end
+`
+
+// printWriteBuiltins writes to standard output in environments without
+// the io library, where print is the only way to output anything. Output
+// is buffered until a full line is available.
+const printWriteBuiltins = `
+local stdout_buf = ""
+
+function builtins.write(...)
+	for i = 1, select("#", ...) do
+		stdout_buf = stdout_buf .. tostring((select(i, ...)))
+	end
+	while true do
+		local nl = stdout_buf:find("\n", 1, true)
+		if nl == nil then
+			return
+		end
+		print(stdout_buf:sub(1, nl - 1))
+		stdout_buf = stdout_buf:sub(nl + 1)
+	end
+end
+`
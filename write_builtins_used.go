@@ -0,0 +1,207 @@
+package lunar
+
+import (
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// WriteUsedBuiltins is like WriteBuiltinsFor, but leaves out the helpers
+// and standard library shims that are not used by the given generated
+// code, directly or through other builtins. The functions of the builtins
+// called by hosts, like run_inits and pcall, are always written.
+func WriteUsedBuiltins(w io.Writer, t Target, code ...string) (n int, err error) {
+	return io.WriteString(w, globalBuiltinsHeader+usedBuiltins(t, code))
+}
+
+// WriteUsedBuiltinsModule is like WriteBuiltinsModule, but leaves out the
+// builtins not used by the given generated code like WriteUsedBuiltins.
+func WriteUsedBuiltinsModule(w io.Writer, t Target, code ...string) (n int, err error) {
+	return io.WriteString(w, moduleBuiltinsHeader+usedBuiltins(t, code)+"\nreturn builtins\n")
+}
+
+// hostBuiltins are the builtins used by hosts rather than generated code.
+var hostBuiltins = []string{
+	"builtins.add_init",
+	"builtins.add_package",
+	"builtins.pcall",
+	"builtins.pkgs",
+	"builtins.rewrite_positions",
+	"builtins.run_inits",
+	"builtins.source_maps",
+	"builtins.traceback",
+}
+
+// A builtinStmt is a top-level statement of the builtins, along with the
+// comments preceding it.
+type builtinStmt struct {
+	src  string
+	defs []string // names of the builtins and locals it defines
+	refs []string // names of the builtins and locals it uses
+}
+
+var (
+	// builtinRefRe matches uses of builtins, including the packages of
+	// shims.
+	builtinRefRe = regexp.MustCompile(`builtins\.(\w+)(\["[^"]*"\])?`)
+	// assignRe matches assignments to a name or its fields.
+	assignRe  = regexp.MustCompile(`^[A-Za-z_]\w*\s*([.:\[]|=[^=])`)
+	luaNameRe = regexp.MustCompile(`[A-Za-z_]\w*`)
+)
+
+// usedBuiltins returns the builtins for the given target that are used
+// by code, in the form returned by builtinsFor.
+func usedBuiltins(t Target, code []string) string {
+	var stmts []*builtinStmt
+	for _, src := range []string{coreBuiltins, sourceMapBuiltins, targetBuiltins(t)} {
+		stmts = append(stmts, splitBuiltins(src)...)
+	}
+	locals := make(map[string]bool)
+	for _, stmt := range stmts {
+		for _, name := range stmt.defs {
+			if !strings.HasPrefix(name, "builtins.") {
+				locals[name] = true
+			}
+		}
+	}
+	for _, stmt := range stmts {
+		stmt.refs = builtinRefs(stmt.src, locals)
+	}
+
+	// Shims are kept or left out as a whole
+	paths := make([]string, 0, len(stdlibShims))
+	for path := range stdlibShims {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		stmts = append(stmts, &builtinStmt{
+			src:  "\ndo\n" + stdlibShims[path].src + "end\n",
+			defs: []string{`builtins.pkgs["` + path + `"]`},
+			refs: builtinRefs(stdlibShims[path].src, locals),
+		})
+	}
+
+	used := make(map[string]bool)
+	for _, name := range hostBuiltins {
+		used[name] = true
+	}
+	for _, src := range code {
+		for _, name := range builtinRefs(src, nil) {
+			used[name] = true
+		}
+	}
+
+	// Keep the statements defining used names until no more are used.
+	// Statements that define nothing are always kept.
+	kept := make([]bool, len(stmts))
+	for changed := true; changed; {
+		changed = false
+		for i, stmt := range stmts {
+			if kept[i] {
+				continue
+			}
+			keep := len(stmt.defs) == 0
+			for _, name := range stmt.defs {
+				keep = keep || used[name]
+			}
+			if !keep {
+				continue
+			}
+			kept[i] = true
+			changed = true
+			for _, name := range stmt.refs {
+				used[name] = true
+			}
+		}
+	}
+
+	var buf strings.Builder
+	for i, stmt := range stmts {
+		if kept[i] {
+			buf.WriteString(stmt.src)
+		}
+	}
+	return buf.String()
+}
+
+// splitBuiltins splits the builtins src into its top-level statements,
+// which start at the beginning of a line. Comments at the beginning of a
+// line belong to the statement after them, and empty lines to the one
+// before them.
+func splitBuiltins(src string) []*builtinStmt {
+	var stmts []*builtinStmt
+	cur := &builtinStmt{}
+	comments := ""
+	for _, line := range strings.SplitAfter(src, "\n") {
+		switch {
+		case strings.HasPrefix(line, "--"):
+			comments += line
+			continue
+		case isBuiltinStmtStart(line):
+			stmts = append(stmts, cur)
+			cur = &builtinStmt{src: comments}
+			cur.defs = builtinDefs(line)
+		default:
+			cur.src += comments
+		}
+		comments = ""
+		cur.src += line
+	}
+	cur.src += comments
+	return append(stmts, cur)
+}
+
+// isBuiltinStmtStart reports whether line starts a top-level statement.
+func isBuiltinStmtStart(line string) bool {
+	word := luaNameRe.FindString(line)
+	return word != "" && strings.HasPrefix(line, word) && !luaBlockEnds[word]
+}
+
+// luaBlockEnds are the keywords ending or continuing a block, which do
+// not start a statement.
+var luaBlockEnds = map[string]bool{
+	"else":   true,
+	"elseif": true,
+	"end":    true,
+	"until":  true,
+}
+
+// builtinDefs returns the names defined or extended by the top-level
+// statement starting with line: local variables and functions, builtins,
+// and the tables fields are assigned to.
+func builtinDefs(line string) []string {
+	if strings.HasPrefix(line, "local ") && !strings.HasPrefix(line, "local function ") {
+		lhs, _, _ := strings.Cut(strings.TrimPrefix(line, "local "), "=")
+		return luaNameRe.FindAllString(lhs, -1)
+	}
+	line = strings.TrimPrefix(line, "local ")
+	if rest := strings.TrimPrefix(line, "function "); rest != line {
+		line = rest
+	} else if !assignRe.MatchString(line) {
+		return nil
+	}
+	if strings.HasPrefix(line, "builtins.") {
+		return []string{builtinRefRe.FindString(line)}
+	}
+	return []string{luaNameRe.FindString(line)}
+}
+
+// builtinRefs returns the names of the builtins used by src, and the
+// names in locals it refers to.
+func builtinRefs(src string, locals map[string]bool) []string {
+	var refs []string
+	for _, m := range builtinRefRe.FindAllStringSubmatch(src, -1) {
+		refs = append(refs, "builtins."+m[1])
+		if m[2] != "" {
+			refs = append(refs, m[0])
+		}
+	}
+	for _, name := range luaNameRe.FindAllString(src, -1) {
+		if locals[name] {
+			refs = append(refs, name)
+		}
+	}
+	return refs
+}
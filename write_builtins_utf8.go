@@ -0,0 +1,81 @@
+package lunar
+
+// utf8Builtins implements the string functions of the unicode/utf8
+// package.
+const utf8Builtins = `
+local utf8 = {}
+builtins.pkgs["unicode/utf8"] = utf8
+
+utf8.RuneError = 0xFFFD
+utf8.RuneSelf = 0x80
+utf8.MaxRune = 0x10FFFF
+utf8.UTFMax = 4
+
+function utf8.DecodeRuneInString(s)
+	return builtins.decode_rune(s, 1)
+end
+
+function utf8.DecodeLastRuneInString(s)
+	if s == "" then
+		return 0xFFFD, 0
+	end
+	-- Find the start of the last rune, which is at most UTFMax bytes back
+	local start = #s
+	while start > 1 and start > #s - 3 do
+		local c = s:byte(start)
+		if c < 0x80 or c >= 0xC0 then
+			break
+		end
+		start = start - 1
+	end
+	local r, size = builtins.decode_rune(s, start)
+	if start + size - 1 ~= #s then
+		return 0xFFFD, 1
+	end
+	return r, size
+end
+
+function utf8.RuneCountInString(s)
+	local n, i = 0, 1
+	while i <= #s do
+		local _, size = builtins.decode_rune(s, i)
+		i = i + size
+		n = n + 1
+	end
+	return n
+end
+
+function utf8.RuneLen(r)
+	if type(r) == "string" then
+		return #r
+	elseif r < 0 or r > 0x10FFFF or (r >= 0xD800 and r <= 0xDFFF) then
+		return -1
+	elseif r < 0x80 then
+		return 1
+	elseif r < 0x800 then
+		return 2
+	elseif r < 0x10000 then
+		return 3
+	end
+	return 4
+end
+
+function utf8.ValidRune(r)
+	if type(r) == "string" then
+		return true
+	end
+	return r >= 0 and r <= 0x10FFFF and not (r >= 0xD800 and r <= 0xDFFF)
+end
+
+function utf8.ValidString(s)
+	local i = 1
+	while i <= #s do
+		local r, size = builtins.decode_rune(s, i)
+		if r == 0xFFFD and size == 1 then
+			return false
+		end
+		i = i + size
+	end
+	return true
+end
+`
@@ -3,11 +3,16 @@ package lunar
 import (
 	"bytes"
 	"fmt"
+	"go/token"
 	"io"
 	"strings"
 )
 
-const indent = "\t"
+const tab = "\t"
+
+// tabWidth is the number of columns a tab counts as when measuring the
+// width of lines.
+const tabWidth = 4
 
 var newline = []byte{'\n'}
 var strNewline = string(newline)
@@ -20,25 +25,278 @@ func (e WriteError) Error() string {
 	return e.Err.Error()
 }
 
+// A Style describes the layout of the Lua code written by a Writer.
+type Style struct {
+	Indent        string // indentation of each level, such as "\t" or "  "
+	MaxWidth      int    // width to wrap argument lists and table constructors at, or 0 not to wrap
+	TrailingComma bool   // whether wrapped table constructors end in a comma
+	PadTables     bool   // whether table constructors are written as { 1, 2 } rather than {1, 2}
+	BlankLines    int    // number of blank lines after declarations
+}
+
+// DefaultStyle is the style used unless another one is set.
+var DefaultStyle = Style{Indent: tab, PadTables: true, BlankLines: 1}
+
 type Writer struct {
 	w         io.Writer
+	style     Style
 	level     int
 	prefix    []byte
 	isNewline bool
+	margin    int   // if set, the width of the line before the first line of output
+	rawLines  []int // zero-based lines starting within raw writes, which are not re-indented
+
+	line, col int       // zero-based position of the next byte written
+	pos       token.Pos // position of the Go node being written
+	mapped    bool      // whether pos has been mapped at its current value
+	mappings  []Mapping
+}
+
+// A Mapping maps a position in the output to the position of the Go node
+// the output was generated from. The mapping applies to all output up to
+// the next mapping.
+type Mapping struct {
+	Line, Column int // zero-based position in the output
+	Pos          token.Pos
 }
 
+// Write writes p, indenting each line of it that is not empty to the
+// current indentation level. Tabs at the start of lines are taken as
+// levels of relative indentation. Content that must not be altered, such
+// as long strings, is written with WriteRaw instead.
 func (w *Writer) Write(p []byte) (int, error) {
-	// TODO(eandre) We should probably split on each newline to re-indent
-	// Write line prefix if we're on a new line
-	if w.isNewline {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n') + 1
+		if i == 0 {
+			i = len(p)
+		}
+		line := p[:i]
+		if w.isNewline && w.style.Indent != tab {
+			trimmed := bytes.TrimLeft(line, tab)
+			if levels := len(line) - len(trimmed); levels > 0 {
+				line = append([]byte(strings.Repeat(w.style.Indent, levels)), trimmed...)
+			}
+		}
+		w.write(line, false)
+		p = p[i:]
+	}
+	return n, nil
+}
+
+// WriteRaw writes p as is. Only the line p starts on is indented, if p
+// starts a line.
+func (w *Writer) WriteRaw(p []byte) {
+	w.write(p, true)
+}
+
+// WriteRawString is like WriteRaw for strings.
+func (w *Writer) WriteRawString(s string) {
+	w.write([]byte(s), true)
+}
+
+// write writes p, indenting it if it starts a line. If raw is set, the
+// lines p starts are recorded as raw.
+func (w *Writer) write(p []byte, raw bool) {
+	// Write line prefix if we're on a new line, unless it stays empty
+	if w.isNewline && (len(p) == 0 || p[0] != '\n') {
 		_, err := w.w.Write(w.prefix)
 		w.err(err)
+		w.col += len(w.prefix)
+	}
+
+	// Map the output to the current node once it writes something other
+	// than line breaks
+	if trimmed := bytes.TrimLeft(p, strNewline); !w.mapped && w.pos.IsValid() && len(bytes.TrimRight(trimmed, strNewline)) > 0 {
+		m := Mapping{Line: w.line, Column: w.col, Pos: w.pos}
+		if n := len(p) - len(trimmed); n > 0 {
+			m.Line, m.Column = m.Line+n, 0
+		}
+		w.mappings = append(w.mappings, m)
+		w.mapped = true
+	}
+
+	if raw {
+		for i, line := 0, w.line; i < len(p)-1; i++ {
+			if p[i] == '\n' {
+				line++
+				w.rawLines = append(w.rawLines, line)
+			}
+		}
 	}
 
 	_, err := w.w.Write(p)
 	w.err(err)
 	w.isNewline = bytes.HasSuffix(p, newline)
-	return len(p), nil
+	if n := bytes.Count(p, newline); n > 0 {
+		w.line += n
+		w.col = len(p) - bytes.LastIndexByte(p, '\n') - 1
+	} else {
+		w.col += len(p)
+	}
+}
+
+// SetPos sets the position of the Go node being written, returning the
+// previous position. Nodes restore the position of their parent when done:
+//
+//	defer w.SetPos(w.SetPos(n.Pos()))
+func (w *Writer) SetPos(pos token.Pos) (prev token.Pos) {
+	prev = w.pos
+	if pos != w.pos {
+		w.pos = pos
+		w.mapped = false
+	}
+	return prev
+}
+
+// Mappings returns the mappings from the output written so far to Go
+// positions, ordered by their output position.
+func (w *Writer) Mappings() []Mapping {
+	return w.mappings
+}
+
+// writeFrom writes buf, the output of from, keeping the mappings of from.
+// If w is at a deeper indentation level than from was, the lines of buf
+// after the first are indented further, unless they were written raw.
+func (w *Writer) writeFrom(from *Writer, buf []byte) {
+	extra := ""
+	if n := w.level - from.level; n > 0 {
+		extra = strings.Repeat(w.style.Indent, n)
+	}
+	raw := make(map[int]bool, len(from.rawLines))
+	for _, line := range from.rawLines {
+		raw[line] = true
+		w.rawLines = append(w.rawLines, w.line+line)
+	}
+
+	col := w.col
+	if w.isNewline && len(buf) > 0 && buf[0] != '\n' {
+		col += len(w.prefix)
+	}
+	for _, m := range from.mappings {
+		if m.Line == 0 {
+			m.Column += col
+		} else if !raw[m.Line] {
+			m.Column += len(extra)
+		}
+		m.Line += w.line
+		w.mappings = append(w.mappings, m)
+	}
+
+	if extra != "" {
+		lines := bytes.SplitAfter(buf, newline)
+		for i := 1; i < len(lines); i++ {
+			if !raw[i] && len(lines[i]) > 0 && lines[i][0] != '\n' {
+				lines[i] = append([]byte(extra), lines[i]...)
+			}
+		}
+		buf = bytes.Join(lines, nil)
+	}
+	defer w.SetPos(w.SetPos(token.NoPos))
+	w.write(buf, false)
+}
+
+// sub returns a writer writing to out with the style and indentation
+// level of w, for output that is written to w later with writeFrom.
+func (w *Writer) sub(out io.Writer) *Writer {
+	s := NewWriter(out)
+	s.style = w.style
+	s.setLevel(w.level)
+	s.pos = w.pos
+	return s
+}
+
+// width returns the width of the current line so far, counting tabs as
+// tabWidth columns.
+func (w *Writer) width() int {
+	if w.line == 0 && w.margin > 0 {
+		return w.margin + w.col
+	}
+	width := w.col + (tabWidth-1)*bytes.Count(w.prefix, []byte(tab))
+	if w.isNewline {
+		width += len(w.prefix)
+	}
+	return width
+}
+
+// writeList writes n items separated by commas between open and close,
+// calling item to write each one. Table constructors are padded and get
+// a trailing comma as the style says. If the style limits the width of
+// lines and the items do not fit on the current one, each item is
+// written on a line of its own, one level deeper. A last item spanning
+// several lines, such as a function, may start on the current line.
+func (w *Writer) writeList(open, close string, table bool, n int, item func(w *Writer, i int)) {
+	if n == 0 {
+		w.WriteString(open + close)
+		return
+	}
+	pad := ""
+	if table && w.style.PadTables {
+		pad = " "
+	}
+	if w.style.MaxWidth <= 0 {
+		w.WriteString(open + pad)
+		for i := 0; i < n; i++ {
+			if i > 0 {
+				w.WriteString(", ")
+			}
+			item(w, i)
+		}
+		w.WriteString(pad + close)
+		return
+	}
+
+	// Write the items separately to find out whether they fit
+	items := make([]*Writer, n)
+	bufs := make([]*bytes.Buffer, n)
+	width := w.width() + len(open) + len(pad)
+	fits, multiline := true, false
+	for i := range items {
+		bufs[i] = &bytes.Buffer{}
+		items[i] = w.sub(bufs[i])
+		items[i].isNewline = false
+		items[i].margin = width
+		item(items[i], i)
+
+		var line []byte
+		fits = fits && !multiline
+		line, _, multiline = bytes.Cut(bufs[i].Bytes(), newline)
+		width += len(line) + len(", ")
+	}
+	width -= len(", ")
+	if !multiline {
+		width += len(pad) + len(close)
+	}
+
+	if fits && width <= w.style.MaxWidth {
+		w.WriteString(open + pad)
+		for i, buf := range bufs {
+			if i > 0 {
+				w.WriteString(", ")
+			}
+			w.writeFrom(items[i], buf.Bytes())
+		}
+		w.WriteString(pad + close)
+		return
+	}
+	w.WriteLine(open)
+	w.Indent()
+	for i, buf := range bufs {
+		w.writeFrom(items[i], buf.Bytes())
+		if i < n-1 || table && w.style.TrailingComma {
+			w.WriteByte(',')
+		}
+		w.WriteNewline()
+	}
+	w.Dedent()
+	w.WriteString(close)
+}
+
+// writeBlankLines writes the blank lines separating declarations.
+func (w *Writer) writeBlankLines() {
+	for i := 0; i < w.style.BlankLines; i++ {
+		w.WriteNewline()
+	}
 }
 
 func (w *Writer) WriteByte(p byte) {
@@ -74,9 +332,15 @@ func (w *Writer) WriteLinef(format string, args ...interface{}) {
 	w.WriteLine(line)
 }
 
+// SetStyle sets the style of the output written from now on.
+func (w *Writer) SetStyle(s Style) {
+	w.style = s
+	w.setLevel(w.level)
+}
+
 func (w *Writer) Indent() {
 	w.level += 1
-	w.prefix = []byte(strings.Repeat(indent, w.level))
+	w.prefix = []byte(strings.Repeat(w.style.Indent, w.level))
 }
 
 func (w *Writer) Dedent() {
@@ -84,7 +348,13 @@ func (w *Writer) Dedent() {
 	if w.level < 0 {
 		panic("lunar: Writer.Dedent called when at indentation level 0")
 	}
-	w.prefix = []byte(strings.Repeat(indent, w.level))
+	w.prefix = []byte(strings.Repeat(w.style.Indent, w.level))
+}
+
+// setLevel sets the indentation level, for recovering from errors.
+func (w *Writer) setLevel(level int) {
+	w.level = level
+	w.prefix = []byte(strings.Repeat(w.style.Indent, w.level))
 }
 
 func (w *Writer) err(e error) {
@@ -96,6 +366,7 @@ func (w *Writer) err(e error) {
 func NewWriter(w io.Writer) *Writer {
 	return &Writer{
 		w:         w,
+		style:     DefaultStyle,
 		isNewline: true,
 	}
 }
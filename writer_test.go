@@ -3,6 +3,8 @@ package lunar
 import (
 	"bytes"
 	"fmt"
+	"go/ast"
+	"strings"
 	"testing"
 )
 
@@ -55,3 +57,110 @@ func TestWriteLinef(t *testing.T) {
 		t.Fatalf("Got output %q, want %q", s, want)
 	}
 }
+
+func TestWriterMappings(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+
+	w.SetPos(10)
+	w.WriteLine("foo")
+	w.Indent()
+	prev := w.SetPos(20)
+	w.WriteString("bar(")
+	w.SetPos(30)
+	w.WriteString("baz")
+	w.SetPos(prev)
+	w.WriteLine(")")
+	w.Dedent()
+
+	want := []Mapping{
+		{Line: 0, Column: 0, Pos: 10},
+		{Line: 1, Column: 1, Pos: 20},
+		{Line: 1, Column: 5, Pos: 30},
+		{Line: 1, Column: 8, Pos: 10},
+	}
+	got := w.Mappings()
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("Got mappings %v, want %v", got, want)
+	}
+}
+
+func TestWriteMultiline(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+
+	// Every non-empty line is indented
+	w.Indent()
+	w.WriteString("if x then\n\ty()\n\nend")
+	w.WriteNewline()
+	want := "\tif x then\n\t\ty()\n\n\tend\n"
+	if s := buf.String(); s != want {
+		t.Fatalf("Got output %q, want %q", s, want)
+	}
+
+	// Raw writes are left as they are after the first line
+	w.WriteRawString("[[a\n  b]]")
+	w.WriteNewline()
+	want += "\t[[a\n  b]]\n"
+	if s := buf.String(); s != want {
+		t.Fatalf("Got output %q, want %q", s, want)
+	}
+}
+
+func TestStyle(t *testing.T) {
+	src := `type Point struct{ X, Y int }
+
+func F(name string) {
+	ages := map[string]int{"alice": 31, "bob": 42, "carol": 27}
+	points := []Point{{1, 2}, {X: 3}}
+	println(ages, points, "a longer argument")
+	println(name, func() int {
+		return 1
+	})
+}
+
+func G() {}`
+	get := func(f *ast.File) ast.Node {
+		return f
+	}
+	style := Style{Indent: "  ", MaxWidth: 40, TrailingComma: true, BlankLines: 2}
+	lua, _, err := parseStrWith(func(p *Parser) { p.SetStyle(style) }, src, get)
+	if err != nil {
+		t.Fatalf("Got error: %v", err)
+	}
+	want := `_dummy.F = function(name)
+  local ages = {
+    ["alice"] = 31,
+    ["bob"] = 42,
+    ["carol"] = 27,
+  }
+  local points = {
+    setmetatable({
+      ["X"] = 1,
+      ["Y"] = 2,
+    }, {__index=_dummy.Point}),
+    setmetatable({
+      ["X"] = 3,
+      ["Y"] = 0,
+    }, {__index=_dummy.Point}),
+  }
+  print(
+    ages,
+    points,
+    "a longer argument"
+  )
+  print(name, function()
+    return 1
+  end)
+end
+
+
+_dummy.G = function()
+end`
+	if !strings.HasSuffix(lua, want) {
+		t.Errorf("Got:\n%s\nwant suffix:\n%s", lua, want)
+	}
+	if !strings.Contains(lua, "__fields = {\"X\", \"Y\"} }\n\n\n") {
+		t.Errorf("Got type table without style:\n%s", lua)
+	}
+}